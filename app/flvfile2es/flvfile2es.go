@@ -16,12 +16,13 @@ import (
 	"github.com/q191201771/lal/pkg/aac"
 	"github.com/q191201771/lal/pkg/avc"
 	"github.com/q191201771/lal/pkg/httpflv"
+	"github.com/q191201771/lal/pkg/opus"
 	log "github.com/q191201771/naza/pkg/nazalog"
 )
 
 func main() {
 	var err error
-	flvFileName, aacFileName, avcFileName := parseFlag()
+	flvFileName, audioFileName, avcFileName := parseFlag()
 
 	var ffr httpflv.FLVFileReader
 	err = ffr.Open(flvFileName)
@@ -29,16 +30,20 @@ func main() {
 	defer ffr.Dispose()
 	log.Infof("open flv file succ.")
 
-	afp, err := os.Create(aacFileName)
+	afp, err := os.Create(audioFileName)
 	log.FatalIfErrorNotNil(err)
 	defer afp.Close()
-	log.Infof("open es aac file succ.")
+	log.Infof("open es audio file succ.")
 
 	vfp, err := os.Create(avcFileName)
 	log.FatalIfErrorNotNil(err)
 	defer vfp.Close()
 	log.Infof("open es h264 file succ.")
 
+	var (
+		ow          *opus.OggWriter
+		audioLogged bool
+	)
 	for {
 		tag, err := ffr.ReadTag()
 		if err == io.EOF {
@@ -51,7 +56,29 @@ func main() {
 
 		switch tag.Header.Type {
 		case httpflv.TagTypeAudio:
-			aac.CaptureAAC(afp, payload)
+			if len(payload) == 0 {
+				break
+			}
+			if !audioLogged {
+				h := httpflv.ParseAudioTagHeader(payload[0])
+				log.Infof("audio. %+v, sampleRate=%d, channels=%d", h, h.SampleRate(), h.Channels())
+				audioLogged = true
+			}
+
+			switch tag.SoundFormat() {
+			case httpflv.SoundFormatAAC:
+				_ = aac.CaptureAAC(afp, payload)
+			case httpflv.SoundFormatMP3, httpflv.SoundFormatMP38k, httpflv.SoundFormatG711A, httpflv.SoundFormatG711U:
+				// 去掉1字节的音频 tag 头，剩下的就是可以直接播放的裸流
+				_, _ = afp.Write(payload[1:])
+			case httpflv.SoundFormatExHeader:
+				if tag.IsEnhancedAudio() && tag.AudioFourCC() == httpflv.FourCCOpus {
+					if ow == nil {
+						ow = opus.NewOggWriter(afp)
+					}
+					_ = ow.Capture(payload)
+				}
+			}
 		case httpflv.TagTypeVideo:
 			_ = avc.CaptureAVC(vfp, payload)
 		}
@@ -60,7 +87,7 @@ func main() {
 
 func parseFlag() (string, string, string) {
 	flv := flag.String("i", "", "specify flv file")
-	a := flag.String("a", "", "specify es aac file")
+	a := flag.String("a", "", "specify es audio file. aac(adts), mp3, g711(raw, 8000Hz mono) or opus(ogg)")
 	v := flag.String("v", "", "specify es h264 file")
 	flag.Parse()
 	if *flv == "" || *a == "" || *v == "" {
@@ -63,5 +63,9 @@ func LoadConf(confFile string) (*Config, error) {
 		config.Log.ShortFileFlag = true
 	}
 
+	// 数值配置项不存在或者为0时，logic 中使用默认值，见 logic.Config
+	if err = config.Validate(); err != nil {
+		return nil, err
+	}
 	return &config, nil
 }
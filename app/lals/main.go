@@ -88,7 +88,7 @@ func runWebPProf(addr string) {
 }
 
 func runSignalHandler() {
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGUSR1, syscall.SIGUSR2)
 	s := <-c
 	log.Infof("recv signal. s=%+v", s)
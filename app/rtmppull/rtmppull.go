@@ -19,6 +19,7 @@ import (
 	"github.com/q191201771/lal/pkg/httpflv"
 	"github.com/q191201771/lal/pkg/logic"
 	"github.com/q191201771/lal/pkg/rtmp"
+	"github.com/q191201771/lal/pkg/timestamp"
 	log "github.com/q191201771/naza/pkg/nazalog"
 )
 
@@ -60,6 +61,13 @@ func pull(url string, filename string) {
 		w   httpflv.FLVFileWriter
 		err error
 	)
+	// 存储的 flv 文件的时间戳从0开始，并且修复回退、跳变等问题
+	normalizer := timestamp.NewNormalizer(func(option *timestamp.Option) {
+		option.RebaseToZero = true
+		option.OnCorrection = func(c timestamp.Correction) {
+			log.Warnf("correct timestamp. kind=%s, type=%d, in=%d, out=%d", c.Kind, c.MsgTypeID, c.In, c.Out)
+		}
+	})
 
 	if filename != "" {
 		err = w.Open(filename)
@@ -78,6 +86,7 @@ func pull(url string, filename string) {
 	err = session.Pull(url, func(msg rtmp.AVMsg) {
 		//log.Infof("%+v, abs ts=%d", msg.Header, msg.Header.TimestampAbs)
 		if filename != "" {
+			msg.Header.TimestampAbs = normalizer.Normalize(msg.Header.MsgTypeID, msg.Header.TimestampAbs)
 			tag := logic.Trans.RTMPMsg2FLVTag(msg)
 			err := w.WriteTag(*tag)
 			log.FatalIfErrorNotNil(err)
@@ -15,12 +15,15 @@ GitCommitLog=${GitCommitLog//\'/\"}
 GitStatus=`git status -s`
 BuildTime=`date +'%Y.%m.%d.%H%M%S'`
 BuildGoVersion=`go version`
+# 版本号只在 CHANGELOG.md 中维护，取第一行的版本号，比如 `#### v0.7.0`
+LalVersion=`head -n 1 CHANGELOG.md | awk '{print $2}'`
 
 LDFlags=" \
     -X 'github.com/q191201771/naza/pkg/bininfo.GitCommitLog=${GitCommitLog}' \
     -X 'github.com/q191201771/naza/pkg/bininfo.GitStatus=${GitStatus}' \
     -X 'github.com/q191201771/naza/pkg/bininfo.BuildTime=${BuildTime}' \
     -X 'github.com/q191201771/naza/pkg/bininfo.BuildGoVersion=${BuildGoVersion}' \
+    -X 'github.com/q191201771/lal/pkg/logic.ServerVersion=${LalVersion}' \
 "
 
 cd ${ROOT_DIR}/app/lals && go build -ldflags "$LDFlags" -o ${ROOT_DIR}/bin/lals &&
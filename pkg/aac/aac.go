@@ -10,11 +10,14 @@ package aac
 
 import (
 	"encoding/hex"
+	"errors"
 	"io"
 
 	log "github.com/q191201771/naza/pkg/nazalog"
 )
 
+var ErrAAC = errors.New("lal.aac: fxxk")
+
 var adts ADTS
 
 type ADTS struct {
@@ -30,7 +33,10 @@ type ADTS struct {
 
 // 传入 AAC Sequence Header，一会生成 ADTS 头时需要使用
 // @param <payload> rtmp message payload，包含前面2个字节
-func (obj *ADTS) PutAACSequenceHeader(payload []byte) {
+func (obj *ADTS) PutAACSequenceHeader(payload []byte) error {
+	if len(payload) < 4 {
+		return ErrAAC
+	}
 	log.Debugf(hex.Dump(payload[:4]))
 	soundFormat := payload[0] >> 4        // 10=AAC
 	soundRate := (payload[0] >> 2) & 0x03 // 3=44kHz. For AAC: always 3
@@ -46,6 +52,7 @@ func (obj *ADTS) PutAACSequenceHeader(payload []byte) {
 	obj.dependOnCoreCoder = (payload[3] & 0x02) >> 1                            // 1bit
 	obj.extensionFlag = payload[3] & 0x01                                       // 1bit
 	log.Debugf("%+v", obj)
+	return nil
 }
 
 // 获取 ADTS 头，注意，每个包的长度不同，所以生成的每个包的 ADTS 头也不同
@@ -93,12 +100,15 @@ func (obj *ADTS) GetADTS(length uint16) []byte {
 
 // 将 rtmp AAC 传入，输出带 ADTS 头的 AAC ES流
 // @param <payload> rtmp message payload部分
-func CaptureAAC(w io.Writer, payload []byte) {
+func CaptureAAC(w io.Writer, payload []byte) error {
+	if len(payload) < 2 {
+		return ErrAAC
+	}
 	if payload[1] == 0 {
-		adts.PutAACSequenceHeader(payload)
-		return
+		return adts.PutAACSequenceHeader(payload)
 	}
 
 	_, _ = w.Write(adts.GetADTS(uint16(len(payload))))
 	_, _ = w.Write(payload[2:])
+	return nil
 }
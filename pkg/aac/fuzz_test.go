@@ -0,0 +1,34 @@
+// Copyright 2019, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+//go:build go1.18
+// +build go1.18
+
+package aac
+
+// go test -run=^$ -fuzz=FuzzPutAACSequenceHeader -fuzztime=1h ./pkg/aac/
+
+import (
+	"testing"
+)
+
+func FuzzPutAACSequenceHeader(f *testing.F) {
+	f.Add([]byte{0xaf, 0x0, 0x11, 0x90})
+	f.Add([]byte{0xaf, 0x0, 0x12, 0x10, 0x56, 0xe5, 0x0})
+	f.Add([]byte{0xaf, 0x1, 0x21, 0x2b})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		var obj ADTS
+		if err := obj.PutAACSequenceHeader(b); err != nil {
+			return
+		}
+		if h := obj.GetADTS(uint16(len(b))); len(h) != 7 {
+			t.Fatalf("invalid adts header. len=%d", len(h))
+		}
+	})
+}
@@ -31,8 +31,10 @@ var NaluUintTypeMapping = map[uint8]string{
 // 从 rtmp avc sequence header 中解析 sps 和 pps
 // @param <payload> rtmp message的payload部分 或者 flv tag的payload部分
 func ParseAVCSeqHeader(payload []byte) (sps, pps []byte, err error) {
-	// TODO chef: check if read out of <payload> range
-
+	if len(payload) < 11 {
+		err = ErrAVC
+		return
+	}
 	if payload[0] != 0x17 || payload[1] != 0x00 || payload[2] != 0 || payload[3] != 0 || payload[4] != 0 {
 		err = ErrAVC
 		return
@@ -54,17 +56,32 @@ func ParseAVCSeqHeader(payload []byte) (sps, pps []byte, err error) {
 	// TODO chef: if the situation of multi sps exist?
 	// only take the last one.
 	for i := 0; i < numOfSPS; i++ {
+		if len(payload) < index+2 {
+			return nil, nil, ErrAVC
+		}
 		lenOfSPS := int(bele.BEUint16(payload[index:]))
 		index += 2
+		if len(payload) < index+lenOfSPS {
+			return nil, nil, ErrAVC
+		}
 		sps = append(sps, payload[index:index+lenOfSPS]...)
 		index += lenOfSPS
 	}
 
+	if len(payload) < index+1 {
+		return nil, nil, ErrAVC
+	}
 	numOfPPS := int(payload[index] & 0x1F)
 	index++
 	for i := 0; i < numOfPPS; i++ {
+		if len(payload) < index+2 {
+			return nil, nil, ErrAVC
+		}
 		lenOfPPS := int(bele.BEUint16(payload[index:]))
 		index += 2
+		if len(payload) < index+lenOfPPS {
+			return nil, nil, ErrAVC
+		}
 		pps = append(pps, payload[index:index+lenOfPPS]...)
 		index += lenOfPPS
 	}
@@ -75,6 +92,10 @@ func ParseAVCSeqHeader(payload []byte) (sps, pps []byte, err error) {
 // 将rtmp avc数据转换成avc裸流
 // @param <payload> rtmp message的payload部分 或者 flv tag的payload部分
 func CaptureAVC(w io.Writer, payload []byte) error {
+	if len(payload) < 5 {
+		return ErrAVC
+	}
+
 	// sps pps
 	if payload[0] == 0x17 && payload[1] == 0x00 {
 		sps, pps, err := ParseAVCSeqHeader(payload)
@@ -92,8 +113,14 @@ func CaptureAVC(w io.Writer, payload []byte) error {
 	// payload中可能存在多个nalu
 	// 先跳过前面type的2字节，以及composition time的3字节
 	for i := 5; i != len(payload); {
+		if len(payload)-i < 4 {
+			return ErrAVC
+		}
 		naluLen := int(bele.BEUint32(payload[i:]))
 		i += 4
+		if naluLen < 0 || naluLen > len(payload)-i {
+			return ErrAVC
+		}
 		//naluUintType := payload[i] & 0x1f
 		//log.Debugf("naluLen:%d t:%d %s\n", naluLen, naluUintType, avc.NaluUintTypeMapping[naluUintType])
 		_, _ = w.Write(NaluStartCode)
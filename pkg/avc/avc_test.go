@@ -29,8 +29,50 @@ func TestCorner(t *testing.T) {
 	assert.Equal(t, nil, pps)
 	assert.Equal(t, err, ErrAVC)
 
+	// sps 长度超出 payload 范围
+	_, _, err = ParseAVCSeqHeader([]byte{0x17, 0x0, 0x0, 0x0, 0x0, 0x1, 0x64, 0x0, 0x1f, 0xff, 0xe1, 0x0, 0xa, 0x27, 0x64})
+	assert.Equal(t, err, ErrAVC)
+
 	b := &bytes.Buffer{}
 	err = CaptureAVC(b, []byte{0x17, 0x0, 0x1})
 	assert.Equal(t, nil, b.Bytes())
 	assert.Equal(t, err, ErrAVC)
+
+	// 1字节的 payload，以及 nalu 长度超出 payload 范围
+	err = CaptureAVC(b, []byte{0x17})
+	assert.Equal(t, err, ErrAVC)
+	err = CaptureAVC(b, []byte{0x27, 0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x8, 0x65})
+	assert.Equal(t, err, ErrAVC)
+	err = CaptureAVC(b, []byte{0x27, 0x1, 0x0, 0x0, 0x0, 0x0, 0x0})
+	assert.Equal(t, err, ErrAVC)
+	assert.Equal(t, nil, b.Bytes())
+}
+
+func TestParseSPS(t *testing.T) {
+	golden := []struct {
+		sps    []byte
+		expect SPS
+	}{
+		{
+			// 1280x720, high profile
+			[]byte{0x67, 0x64, 0x00, 0x1f, 0xac, 0xd9, 0x40, 0x50, 0x05, 0xbb, 0x01, 0x10, 0x00, 0x00, 0x03, 0x00, 0x10, 0x00, 0x00, 0x03, 0x03, 0xc0, 0xf1, 0x83, 0x19, 0x60},
+			SPS{ProfileIdc: 100, LevelIdc: 31, Width: 1280, Height: 720},
+		},
+		{
+			// 1920x1080，高度需要 cropping
+			[]byte{0x67, 0x64, 0x00, 0x28, 0xac, 0xd9, 0x40, 0x78, 0x02, 0x27, 0xe5, 0x84, 0x00, 0x00, 0x03, 0x00, 0x04, 0x00, 0x00, 0x03, 0x00, 0xc8, 0x3c, 0x60, 0xc6, 0x58},
+			SPS{ProfileIdc: 100, LevelIdc: 40, Width: 1920, Height: 1080},
+		},
+	}
+	for _, item := range golden {
+		sps, err := ParseSPS(item.sps)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, item.expect, sps)
+	}
+
+	// 截断的数据返回错误
+	for i := 0; i < 8; i++ {
+		_, err := ParseSPS(golden[0].sps[:i])
+		assert.Equal(t, ErrAVC, err)
+	}
 }
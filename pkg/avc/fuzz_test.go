@@ -0,0 +1,36 @@
+// Copyright 2019, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+//go:build go1.18
+// +build go1.18
+
+package avc
+
+// go test -run=^$ -fuzz=FuzzParseAVCSeqHeader -fuzztime=1h ./pkg/avc/
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+func FuzzParseAVCSeqHeader(f *testing.F) {
+	f.Add([]byte{0x17, 0x0, 0x0, 0x0, 0x0, 0x1, 0x64, 0x0, 0x1f, 0xff, 0xe1, 0x0, 0xa, 0x27, 0x64, 0x0, 0x1f, 0xac, 0x56, 0x80, 0xb4, 0xa, 0x19, 0x1, 0x0, 0x4, 0x28, 0xee, 0x3c, 0xb0})
+	f.Add([]byte{0x17, 0x0, 0x0, 0x0, 0x0, 0x1, 0x64, 0x0, 0x1f, 0xff, 0xe1, 0x0, 0x1a, 0x67, 0x64, 0x00, 0x1f, 0xac, 0xd9, 0x40, 0x50, 0x05, 0xbb, 0x01, 0x10, 0x00, 0x00, 0x03, 0x00, 0x10, 0x00, 0x00, 0x03, 0x03, 0xc0, 0xf1, 0x83, 0x19, 0x60, 0x1, 0x0, 0x4, 0x68, 0xeb, 0xe3, 0xcb})
+	f.Add([]byte{0x27, 0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x2, 0x65, 0x88})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		if sps, pps, err := ParseAVCSeqHeader(b); err == nil {
+			if len(sps)+len(pps) > len(b) {
+				t.Fatalf("invalid sps pps. len(sps)=%d, len(pps)=%d, len=%d", len(sps), len(pps), len(b))
+			}
+			_, _ = ParseSPS(sps)
+		}
+		_, _ = ParseSPS(b)
+		_ = CaptureAVC(ioutil.Discard, b)
+	})
+}
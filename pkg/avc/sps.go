@@ -0,0 +1,196 @@
+// Copyright 2019, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package avc
+
+// H.264-AVC-ISO_IEC_14496-10.pdf
+// 7.3.2.1.1 Sequence parameter set data syntax
+//
+// 只解析到 frame cropping 为止，不解析 vui
+
+type SPS struct {
+	ProfileIdc uint8
+	LevelIdc   uint8
+	Width      int
+	Height     int
+}
+
+// @param <sps> 包含1字节 nalu header，不包含 start code
+func ParseSPS(sps []byte) (ret SPS, err error) {
+	if len(sps) < 4 || sps[0]&0x1f != 7 {
+		return ret, ErrAVC
+	}
+	br := bitReader{b: removeEmulationPrevention(sps[1:])}
+
+	ret.ProfileIdc = uint8(br.readBits(8))
+	br.readBits(8) // constraint_set_flags
+	ret.LevelIdc = uint8(br.readBits(8))
+	br.readUE() // seq_parameter_set_id
+
+	chromaFormatIdc := uint32(1)
+	separateColourPlane := uint32(0)
+	switch ret.ProfileIdc {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormatIdc = br.readUE()
+		if chromaFormatIdc == 3 {
+			separateColourPlane = br.readBits(1)
+		}
+		br.readUE()    // bit_depth_luma_minus8
+		br.readUE()    // bit_depth_chroma_minus8
+		br.readBits(1) // qpprime_y_zero_transform_bypass_flag
+		// seq_scaling_matrix_present_flag
+		if br.readBits(1) == 1 {
+			n := 8
+			if chromaFormatIdc == 3 {
+				n = 12
+			}
+			for i := 0; i < n; i++ {
+				if br.readBits(1) == 0 {
+					continue
+				}
+				if i < 6 {
+					br.skipScalingList(16)
+				} else {
+					br.skipScalingList(64)
+				}
+			}
+		}
+	}
+
+	br.readUE() // log2_max_frame_num_minus4
+	// pic_order_cnt_type
+	switch br.readUE() {
+	case 0:
+		br.readUE() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		br.readBits(1) // delta_pic_order_always_zero_flag
+		br.readSE()    // offset_for_non_ref_pic
+		br.readSE()    // offset_for_top_to_bottom_field
+		n := br.readUE()
+		for i := uint32(0); i < n && br.err == nil; i++ {
+			br.readSE() // offset_for_ref_frame
+		}
+	}
+	br.readUE()    // max_num_ref_frames
+	br.readBits(1) // gaps_in_frame_num_value_allowed_flag
+	widthInMbs := br.readUE() + 1
+	heightInMapUnits := br.readUE() + 1
+	frameMbsOnly := br.readBits(1)
+	if frameMbsOnly == 0 {
+		br.readBits(1) // mb_adaptive_frame_field_flag
+	}
+	br.readBits(1) // direct_8x8_inference_flag
+
+	var cropLeft, cropRight, cropTop, cropBottom uint32
+	if br.readBits(1) == 1 {
+		cropLeft = br.readUE()
+		cropRight = br.readUE()
+		cropTop = br.readUE()
+		cropBottom = br.readUE()
+	}
+	if br.err != nil {
+		return ret, br.err
+	}
+
+	// 7.4.2.1.1 frame_crop_*_offset 的单位
+	cropUnitX := uint32(1)
+	cropUnitY := 2 - frameMbsOnly
+	if separateColourPlane == 0 && chromaFormatIdc != 0 {
+		if chromaFormatIdc != 3 {
+			cropUnitX = 2
+		}
+		if chromaFormatIdc == 1 {
+			cropUnitY *= 2
+		}
+	}
+
+	width := int(widthInMbs*16) - int(cropUnitX*(cropLeft+cropRight))
+	height := int((2-frameMbsOnly)*heightInMapUnits*16) - int(cropUnitY*(cropTop+cropBottom))
+	if width <= 0 || height <= 0 {
+		return ret, ErrAVC
+	}
+	ret.Width = width
+	ret.Height = height
+	return ret, nil
+}
+
+// 去除 nalu 中的防竞争字节，即 0x000003 中的 0x03
+func removeEmulationPrevention(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	zeros := 0
+	for _, v := range b {
+		if zeros >= 2 && v == 0x03 {
+			zeros = 0
+			continue
+		}
+		if v == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, v)
+	}
+	return out
+}
+
+// 读取越界后所有读取操作返回0，并设置 err，调用方在最后统一检查
+type bitReader struct {
+	b   []byte
+	pos uint
+	err error
+}
+
+func (br *bitReader) readBits(n uint) uint32 {
+	var v uint32
+	for i := uint(0); i < n; i++ {
+		if br.pos >= uint(len(br.b))*8 {
+			br.err = ErrAVC
+			return 0
+		}
+		bit := (br.b[br.pos/8] >> (7 - br.pos%8)) & 1
+		v = v<<1 | uint32(bit)
+		br.pos++
+	}
+	return v
+}
+
+// ue(v)，指数哥伦布编码
+func (br *bitReader) readUE() uint32 {
+	leadingZeros := uint(0)
+	for br.readBits(1) == 0 {
+		if br.err != nil || leadingZeros >= 31 {
+			br.err = ErrAVC
+			return 0
+		}
+		leadingZeros++
+	}
+	return (uint32(1)<<leadingZeros - 1) + br.readBits(leadingZeros)
+}
+
+// se(v)
+func (br *bitReader) readSE() int32 {
+	v := br.readUE()
+	if v&1 == 1 {
+		return int32((v + 1) / 2)
+	}
+	return -int32(v / 2)
+}
+
+// 7.3.2.1.1.1 Scaling list syntax
+func (br *bitReader) skipScalingList(size int) {
+	lastScale := int32(8)
+	nextScale := int32(8)
+	for j := 0; j < size && br.err == nil; j++ {
+		if nextScale != 0 {
+			nextScale = (lastScale + br.readSE() + 256) % 256
+		}
+		if nextScale != 0 {
+			lastScale = nextScale
+		}
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2019, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package bufpool
+
+// bufpool.go
+// @pure
+// 转发路径上使用的内存池，以及带引用计数的内存块
+// 比如 Group 中切割一次的 chunk，被所有拉流 session 共享，最后一个 session 发送完后归还到内存池
+
+import (
+	"github.com/q191201771/naza/pkg/slicebytepool"
+)
+
+// 底层使用 sync.Pool，空闲的内存块可以被 GC 回收，不会因为某段时间的高峰而一直占用内存
+var Pool slicebytepool.SliceBytePool = &pool{
+	core: slicebytepool.NewSliceBytePool(slicebytepool.StrategyMultiStdPoolBucket),
+}
+
+// 和 slicebytepool 中最小的桶大小保持一致
+const minPooledSize = 1024
+
+type pool struct {
+	core slicebytepool.SliceBytePool
+}
+
+func (p *pool) Get(size int) []byte {
+	return p.core.Get(size)
+}
+
+// slicebytepool 会把容量小于最小桶大小的内存块放入最小的桶，之后 Get 时越界，所以这种内存块直接丢弃
+func (p *pool) Put(b []byte) {
+	if cap(b) < minPooledSize {
+		return
+	}
+	p.core.Put(b)
+}
+
+func (p *pool) RetrieveStatus() slicebytepool.Status {
+	return p.core.RetrieveStatus()
+}
+
+// 从内存池中获取大小为 <size> 的内存块，引用计数为1
+func NewShared(size int) *slicebytepool.SharedSliceByte {
+	return slicebytepool.NewSharedSliceByte(size, slicebytepool.WithPool(Pool))
+}
+
+// 将不是从内存池中获取的内存块包装成带引用计数的内存块，引用计数为1，最后一次释放后放入内存池
+// 注意，之后调用方不应该再使用 <b>
+func WrapShared(b []byte) *slicebytepool.SharedSliceByte {
+	return slicebytepool.WrapSharedSliceByte(b, slicebytepool.WithPool(Pool))
+}
+
+// 功能类似于 make([]byte, <size>)，不再使用时调用 Put 归还
+func Get(size int) []byte {
+	return Pool.Get(size)
+}
+
+func Put(b []byte) {
+	Pool.Put(b)
+}
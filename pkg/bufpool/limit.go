@@ -0,0 +1,110 @@
+// Copyright 2019, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package bufpool
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/q191201771/naza/pkg/nazaatomic"
+)
+
+// 进程级别的内存限制，防止恶意的对端（或者接收太慢的对端）让服务端申请大量内存
+// 超过限制的 session 会被断开，并计入 Offences
+
+var (
+	ErrSessionBufferFull = errors.New("lal.bufpool: session buffered bytes exceed limit")
+	ErrTotalBufferFull   = errors.New("lal.bufpool: total buffered bytes exceed limit")
+)
+
+type Limit struct {
+	// 单个 rtmp message 或者 flv tag 的最大长度，为0时不限制
+	MaxMsgSize uint32
+
+	// 单个 session 缓存的数据的最大字节数，为0时不限制
+	// 包括接收时组装 message 使用的内存，以及还没有发送出去的数据
+	MaxSessionBufferedBytes int64
+
+	// 所有 session 还没有发送出去的数据的总字节数，为0时不限制
+	// 超过后，新写入数据的 session 如果还有没发送出去的数据，则被断开，而发送及时的 session 不受影响
+	MaxTotalBufferedBytes int64
+}
+
+var DefaultLimit = Limit{
+	MaxMsgSize:              8 * 1024 * 1024,
+	MaxSessionBufferedBytes: 64 * 1024 * 1024,
+	MaxTotalBufferedBytes:   0,
+}
+
+type OffenceKind int
+
+const (
+	OffenceMsgTooLarge       OffenceKind = iota + 1 // message 或者 tag 超过 MaxMsgSize
+	OffenceSessionBufferFull                        // 超过 MaxSessionBufferedBytes，或者待发送的内存块个数过多
+	OffenceTotalBufferFull                          // 超过 MaxTotalBufferedBytes
+)
+
+// 因为超过限制而被断开的 session 的数量
+type Offences struct {
+	MsgTooLarge       uint64
+	SessionBufferFull uint64
+	TotalBufferFull   uint64
+}
+
+var (
+	limit              atomic.Value
+	totalBufferedBytes nazaatomic.Int64
+	offences           struct {
+		msgTooLarge       nazaatomic.Uint64
+		sessionBufferFull nazaatomic.Uint64
+		totalBufferFull   nazaatomic.Uint64
+	}
+)
+
+func init() {
+	limit.Store(DefaultLimit)
+}
+
+// 协程安全，修改后对新接收以及新写入的数据生效
+func SetLimit(l Limit) {
+	limit.Store(l)
+}
+
+func GetLimit() Limit {
+	return limit.Load().(Limit)
+}
+
+// 所有 Writer 中还没有发送出去的数据的总字节数
+func TotalBufferedBytes() int64 {
+	return totalBufferedBytes.Load()
+}
+
+func ReportOffence(kind OffenceKind) {
+	switch kind {
+	case OffenceMsgTooLarge:
+		offences.msgTooLarge.Increment()
+	case OffenceSessionBufferFull:
+		offences.sessionBufferFull.Increment()
+	case OffenceTotalBufferFull:
+		offences.totalBufferFull.Increment()
+	}
+}
+
+func GetOffences() Offences {
+	return Offences{
+		MsgTooLarge:       offences.msgTooLarge.Load(),
+		SessionBufferFull: offences.sessionBufferFull.Load(),
+		TotalBufferFull:   offences.totalBufferFull.Load(),
+	}
+}
+
+// 是否是因为超过限制而产生的错误
+func IsLimitError(err error) bool {
+	return err == ErrWriterFull || err == ErrSessionBufferFull || err == ErrTotalBufferFull
+}
@@ -0,0 +1,272 @@
+// Copyright 2019, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package bufpool
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/q191201771/naza/pkg/nazaatomic"
+	"github.com/q191201771/naza/pkg/slicebytepool"
+)
+
+// 异步发送数据，代替 naza connection 的 channel 异步发送
+// 1. 后台协程每次将所有待发送的内存块合并，使用 writev 一次发送，减少系统调用
+// 2. 带引用计数的内存块发送完成后释放，内存块可以被多个 Writer 共享
+// 3. 待发送的内存块过多（对端接收太慢），或者超过 Limit 时，不阻塞调用方，而是关闭连接
+
+var (
+	ErrWriterClosed = errors.New("lal.bufpool: writer closed")
+	ErrWriterFull   = errors.New("lal.bufpool: too many pending buffers")
+)
+
+type WriterOption struct {
+	MaxPendingNum  int // 最多缓存多少个待发送的内存块
+	WriteTimeoutMS int // 每次发送的超时，为0时不设置超时
+}
+
+var defaultWriterOption = WriterOption{
+	MaxPendingNum:  1024,
+	WriteTimeoutMS: 0,
+}
+
+type ModWriterOption func(option *WriterOption)
+
+type Writer struct {
+	conn           net.Conn
+	maxPendingNum  int
+	writeTimeoutMS nazaatomic.Int32
+
+	mutex        sync.Mutex
+	pending      []pendingItem
+	pendingBytes int64 // 还没有发送完成的字节数，包括正在发送的
+	closed       bool
+	err          error
+	notifyChan   chan struct{}
+	exitChan     chan struct{}
+}
+
+type pendingItem struct {
+	b         []byte
+	ssb       *slicebytepool.SharedSliceByte // 不为 nil 时，发送完成后释放
+	flushDone chan struct{}                  // 不为 nil 时，表示 Flush 请求
+}
+
+func NewWriter(conn net.Conn, modOptions ...ModWriterOption) *Writer {
+	option := defaultWriterOption
+	for _, fn := range modOptions {
+		fn(&option)
+	}
+	w := &Writer{
+		conn:          conn,
+		maxPendingNum: option.MaxPendingNum,
+		notifyChan:    make(chan struct{}, 1),
+		exitChan:      make(chan struct{}),
+	}
+	w.writeTimeoutMS.Store(int32(option.WriteTimeoutMS))
+	go w.runLoop()
+	return w
+}
+
+// 实现 io.Writer 接口
+// 注意，<b> 在发送完成之前不会被拷贝，调用方不应该再修改
+func (w *Writer) Write(b []byte) (int, error) {
+	if err := w.push(pendingItem{b: b}); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// 内部增加 <ssb> 的引用计数，发送完成后释放，调用方依然需要释放自己持有的引用
+func (w *Writer) WriteShared(ssb *slicebytepool.SharedSliceByte) error {
+	ssb.Ref()
+	if err := w.push(pendingItem{b: ssb.Core, ssb: ssb}); err != nil {
+		ssb.ReleaseIfNeeded()
+		return err
+	}
+	return nil
+}
+
+// 阻塞直到之前的数据全部发送完毕
+func (w *Writer) Flush() error {
+	done := make(chan struct{})
+	if err := w.push(pendingItem{flushDone: done}); err != nil {
+		return err
+	}
+	<-done
+	return w.Err()
+}
+
+func (w *Writer) ModWriteTimeoutMS(n int) {
+	w.writeTimeoutMS.Store(int32(n))
+}
+
+// 发生错误的原因，Writer 还可以使用时返回 nil
+func (w *Writer) Err() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.err
+}
+
+// 丢弃还没有发送的数据，不会关闭连接
+func (w *Writer) Close() {
+	w.close(ErrWriterClosed)
+}
+
+// 还没有发送完成的字节数
+func (w *Writer) PendingBytes() int64 {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.pendingBytes
+}
+
+func (w *Writer) push(item pendingItem) error {
+	n := int64(len(item.b))
+	w.mutex.Lock()
+	if w.closed {
+		err := w.err
+		w.mutex.Unlock()
+		return err
+	}
+	if err := w.checkLimit(n); err != nil {
+		w.mutex.Unlock()
+		w.close(err)
+		_ = w.conn.Close()
+		return err
+	}
+	w.pending = append(w.pending, item)
+	w.pendingBytes += n
+	totalBufferedBytes.Add(n)
+	w.mutex.Unlock()
+
+	select {
+	case w.notifyChan <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// 调用方持有锁
+func (w *Writer) checkLimit(n int64) error {
+	if len(w.pending) >= w.maxPendingNum {
+		ReportOffence(OffenceSessionBufferFull)
+		return ErrWriterFull
+	}
+	l := GetLimit()
+	if l.MaxSessionBufferedBytes != 0 && w.pendingBytes+n > l.MaxSessionBufferedBytes {
+		ReportOffence(OffenceSessionBufferFull)
+		return ErrSessionBufferFull
+	}
+	if l.MaxTotalBufferedBytes != 0 && w.pendingBytes != 0 && totalBufferedBytes.Load()+n > l.MaxTotalBufferedBytes {
+		ReportOffence(OffenceTotalBufferFull)
+		return ErrTotalBufferFull
+	}
+	return nil
+}
+
+func (w *Writer) close(err error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.closed {
+		return
+	}
+	w.closed = true
+	w.err = err
+	w.sent(sizeOf(w.pending))
+	done(w.pending)
+	w.pending = nil
+	close(w.exitChan)
+}
+
+func (w *Writer) runLoop() {
+	var (
+		items []pendingItem
+		vec   net.Buffers
+	)
+	for {
+		select {
+		case <-w.exitChan:
+			return
+		case <-w.notifyChan:
+		}
+
+		// 交换两个切片，发送期间调用方可以继续写入
+		w.mutex.Lock()
+		if w.closed {
+			w.mutex.Unlock()
+			return
+		}
+		items, w.pending = w.pending, items[:0]
+		w.mutex.Unlock()
+
+		vec = vec[:0]
+		for _, item := range items {
+			if len(item.b) != 0 {
+				vec = append(vec, item.b)
+			}
+		}
+		err := w.write(vec)
+		// 不再持有已经释放的内存块，vec 底层的数组下次复用
+		for i := range vec {
+			vec[i] = nil
+		}
+		w.mutex.Lock()
+		w.sent(sizeOf(items))
+		w.mutex.Unlock()
+		done(items)
+		if err != nil {
+			w.close(err)
+			_ = w.conn.Close()
+			return
+		}
+	}
+}
+
+func (w *Writer) write(vec net.Buffers) error {
+	if len(vec) == 0 {
+		return nil
+	}
+	if timeout := w.writeTimeoutMS.Load(); timeout > 0 {
+		if err := w.conn.SetWriteDeadline(time.Now().Add(time.Duration(timeout) * time.Millisecond)); err != nil {
+			return err
+		}
+	}
+	// 底层是 *net.TCPConn 时使用 writev
+	// WriteTo 只修改参数 vec 本身，不影响调用方的切片
+	_, err := vec.WriteTo(w.conn)
+	return err
+}
+
+// 调用方持有锁
+func (w *Writer) sent(n int64) {
+	w.pendingBytes -= n
+	totalBufferedBytes.Add(-n)
+}
+
+func sizeOf(items []pendingItem) (n int64) {
+	for _, item := range items {
+		n += int64(len(item.b))
+	}
+	return
+}
+
+// 释放内存块，并唤醒等待的 Flush
+func done(items []pendingItem) {
+	for i := range items {
+		if items[i].ssb != nil {
+			items[i].ssb.ReleaseIfNeeded()
+		}
+		if items[i].flushDone != nil {
+			close(items[i].flushDone)
+		}
+		items[i] = pendingItem{}
+	}
+}
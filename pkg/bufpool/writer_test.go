@@ -0,0 +1,172 @@
+// Copyright 2019, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package bufpool_test
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/q191201771/lal/pkg/bufpool"
+	"github.com/q191201771/naza/pkg/assert"
+	"github.com/q191201771/naza/pkg/nazaatomic"
+	"github.com/q191201771/naza/pkg/slicebytepool"
+)
+
+// 记录内存块归还的次数
+type countPool struct {
+	putCount nazaatomic.Int32
+}
+
+func (p *countPool) Get(size int) []byte {
+	return make([]byte, size)
+}
+
+func (p *countPool) Put(b []byte) {
+	p.putCount.Increment()
+}
+
+func (p *countPool) RetrieveStatus() slicebytepool.Status {
+	return slicebytepool.Status{}
+}
+
+func TestWriter(t *testing.T) {
+	cc, sc := net.Pipe()
+	w := bufpool.NewWriter(sc)
+
+	var pool countPool
+	ssb := slicebytepool.NewSharedSliceByte(3, slicebytepool.WithPool(&pool))
+	copy(ssb.Core, "abc")
+
+	readDone := make(chan []byte)
+	go func() {
+		b := make([]byte, 7)
+		_, _ = io.ReadFull(cc, b)
+		readDone <- b
+	}()
+
+	_, err := w.Write([]byte("1"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, w.WriteShared(ssb))
+	assert.Equal(t, nil, w.WriteShared(ssb))
+	assert.Equal(t, []byte("1abcabc"), <-readDone)
+	assert.Equal(t, nil, w.Flush())
+
+	// 发送完成后只剩下调用方持有的引用
+	assert.Equal(t, int32(0), pool.putCount.Load())
+	ssb.ReleaseIfNeeded()
+	assert.Equal(t, int32(1), pool.putCount.Load())
+
+	w.Close()
+	_, err = w.Write([]byte("1"))
+	assert.Equal(t, bufpool.ErrWriterClosed, err)
+	assert.Equal(t, bufpool.ErrWriterClosed, w.Flush())
+	_ = cc.Close()
+	_ = sc.Close()
+}
+
+func TestWriter_Full(t *testing.T) {
+	cc, sc := net.Pipe()
+	w := bufpool.NewWriter(sc, func(option *bufpool.WriterOption) {
+		option.MaxPendingNum = 4
+	})
+
+	var pool countPool
+	ssb := slicebytepool.NewSharedSliceByte(1, slicebytepool.WithPool(&pool))
+
+	// 对端不读取，待发送的内存块越来越多
+	var err error
+	for i := 0; i < 16 && err == nil; i++ {
+		err = w.WriteShared(ssb)
+	}
+	assert.Equal(t, bufpool.ErrWriterFull, err)
+	assert.Equal(t, bufpool.ErrWriterFull, w.Err())
+
+	// 连接被关闭，正在发送的内存块在后台协程中释放
+	_, err = io.Copy(ioutil.Discard, cc)
+	assert.Equal(t, nil, err)
+	ssb.ReleaseIfNeeded()
+	for i := 0; i < 100 && pool.putCount.Load() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, int32(1), pool.putCount.Load())
+}
+
+func BenchmarkWriter(b *testing.B) {
+	cc, sc := net.Pipe()
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, cc)
+	}()
+	w := bufpool.NewWriter(sc, func(option *bufpool.WriterOption) {
+		option.MaxPendingNum = b.N + 1
+	})
+	ssb := bufpool.NewShared(4096)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = w.WriteShared(ssb)
+	}
+	_ = w.Flush()
+	ssb.ReleaseIfNeeded()
+	w.Close()
+	_ = sc.Close()
+}
+
+func TestWriter_Limit(t *testing.T) {
+	defer bufpool.SetLimit(bufpool.GetLimit())
+	bufpool.SetLimit(bufpool.Limit{
+		MaxSessionBufferedBytes: 8,
+		MaxTotalBufferedBytes:   12,
+	})
+
+	// 对端不读取
+	cc, sc := net.Pipe()
+	w := bufpool.NewWriter(sc)
+	before := bufpool.GetOffences()
+	_, err := w.Write(make([]byte, 4))
+	assert.Equal(t, nil, err)
+	_, err = w.Write(make([]byte, 4))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int64(8), w.PendingBytes())
+	_, err = w.Write(make([]byte, 1))
+	assert.Equal(t, bufpool.ErrSessionBufferFull, err)
+	assert.Equal(t, before.SessionBufferFull+1, bufpool.GetOffences().SessionBufferFull)
+	_ = cc.Close()
+	waitTotalBufferedBytes(0)
+	assert.Equal(t, int64(0), bufpool.TotalBufferedBytes())
+
+	// 总量超过限制时，有数据没发送出去的 session 被断开，没有缓存数据的 session 不受影响
+	cc1, sc1 := net.Pipe()
+	w1 := bufpool.NewWriter(sc1)
+	cc2, sc2 := net.Pipe()
+	w2 := bufpool.NewWriter(sc2)
+	_, err = w1.Write(make([]byte, 6))
+	assert.Equal(t, nil, err)
+	_, err = w2.Write(make([]byte, 6))
+	assert.Equal(t, nil, err)
+	_, err = w1.Write(make([]byte, 1))
+	assert.Equal(t, bufpool.ErrTotalBufferFull, err)
+	assert.Equal(t, before.TotalBufferFull+1, bufpool.GetOffences().TotalBufferFull)
+	assert.Equal(t, true, bufpool.IsLimitError(w1.Err()))
+
+	// 被断开的 session 缓存的数据不再计入总量
+	_ = cc1.Close()
+	waitTotalBufferedBytes(6)
+	assert.Equal(t, int64(6), bufpool.TotalBufferedBytes())
+	_ = cc2.Close()
+	w2.Close()
+}
+
+// 正在发送的数据在后台协程中释放
+func waitTotalBufferedBytes(n int64) {
+	for i := 0; i < 100 && bufpool.TotalBufferedBytes() != n; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -9,25 +9,37 @@
 package httpflv
 
 import (
+	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"net"
 	"net/url"
+	"runtime/debug"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/q191201771/lal/pkg/reconnect"
 	"github.com/q191201771/naza/pkg/connection"
 	log "github.com/q191201771/naza/pkg/nazalog"
 	"github.com/q191201771/naza/pkg/unique"
 )
 
+var ErrPullSessionDisposed = errors.New("lal.httpflv: pull session disposed")
+
 type PullSessionOption struct {
 	ConnectTimeoutMS int // TCP连接时超时，单位毫秒，如果为0，则不设置超时
 	ReadTimeoutMS    int // 接收数据超时，单位毫秒，如果为0，则不设置超时
+
+	// 默认不重连。开启后，Pull 会在连接失败或断开后自动重连，并且平移新连接上的时间戳，使得回调给上层的时间戳单调递增
+	Reconnect reconnect.Option
 }
 
 var defaultPullSessionOption = PullSessionOption{
 	ConnectTimeoutMS: 0,
 	ReadTimeoutMS:    0,
+	Reconnect:        reconnect.DefaultOption,
 }
 
 type PullSession struct {
@@ -40,6 +52,13 @@ type PullSession struct {
 	host string
 	uri  string
 	addr string
+
+	// 保护 Conn 的赋值，以及 disposed，使得在建立连接的过程中也可以调用 Dispose
+	mutex       sync.Mutex
+	disposed    bool
+	disposeChan chan struct{}
+
+	rebaser reconnect.TimestampRebaser
 }
 
 type ModPullSessionOption func(option *PullSessionOption)
@@ -53,14 +72,16 @@ func NewPullSession(modOptions ...ModPullSessionOption) *PullSession {
 	uk := unique.GenUniqueKey("FLVPULL")
 	log.Infof("lifecycle new PullSession. [%s]", uk)
 	return &PullSession{
-		option:    option,
-		UniqueKey: uk,
+		option:      option,
+		UniqueKey:   uk,
+		disposeChan: make(chan struct{}),
 	}
 }
 
 type OnReadFLVTag func(tag Tag)
 
 // 阻塞直到拉流失败
+// 开启重连后，阻塞直到重连次数用完，或者调用了 Dispose
 //
 // @param rawURL 支持如下两种格式。（当然，前提是对端支持）
 // http://{domain}/{app_name}/{stream_name}.flv
@@ -68,22 +89,63 @@ type OnReadFLVTag func(tag Tag)
 //
 // @param readFLVTagCB 读取到 flv tag 数据时回调。回调结束后，PullSession 不会再使用这块 <tag> 数据。
 func (session *PullSession) Pull(rawURL string, onReadFLVTag OnReadFLVTag) error {
-	if err := session.Connect(rawURL); err != nil {
-		return err
-	}
-	if err := session.WriteHTTPRequest(); err != nil {
-		return err
+	return session.PullContext(context.Background(), rawURL, onReadFLVTag)
+}
+
+// 和 Pull 相同，并且在建立连接、读取数据的过程中，<ctx> 被取消或超时时关闭连接，返回 ctx.Err()
+func (session *PullSession) PullContext(ctx context.Context, rawURL string, onReadFLVTag OnReadFLVTag) error {
+	onRead := onReadFLVTag
+	if session.option.Reconnect.Enabled() {
+		onRead = func(tag Tag) {
+			tag.ModTagTimestamp(session.rebaser.Rebase(tag.Header.Timestamp))
+			onReadFLVTag(tag)
+		}
 	}
 
-	return session.runReadLoop(onReadFLVTag)
+	// waitCtx 在 <ctx> 结束或者调用 Dispose 时结束，用于打断重连前的等待
+	waitCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-session.disposeChan:
+			cancel()
+		case <-waitCtx.Done():
+			if ctx.Err() != nil {
+				session.closeConn()
+			}
+		}
+	}()
+
+	retrier := reconnect.NewRetrier(session.option.Reconnect)
+	for {
+		err := session.pull(ctx, rawURL, onRead, retrier)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !retrier.Wait(err, waitCtx.Done()) {
+			return err
+		}
+		log.Warnf("reconnect PullSession. [%s] attempt=%d, err=%+v", session.UniqueKey, retrier.Attempt(), err)
+		session.rebaser.Reset()
+	}
 }
 
 func (session *PullSession) Dispose() {
 	log.Infof("lifecycle dispose PullSession. [%s]", session.UniqueKey)
-	_ = session.Conn.Close()
+	session.mutex.Lock()
+	if !session.disposed {
+		session.disposed = true
+		close(session.disposeChan)
+	}
+	session.mutex.Unlock()
+	session.closeConn()
 }
 
 func (session *PullSession) Connect(rawURL string) error {
+	return session.ConnectContext(context.Background(), rawURL)
+}
+
+func (session *PullSession) ConnectContext(ctx context.Context, rawURL string) error {
 	// # 从 url 中解析 host uri addr
 	url, err := url.Parse(rawURL)
 	if err != nil {
@@ -104,10 +166,21 @@ func (session *PullSession) Connect(rawURL string) error {
 	}
 
 	// # 建立连接
-	conn, err := net.DialTimeout("tcp", session.addr, time.Duration(session.option.ConnectTimeoutMS)*time.Millisecond)
+	dialer := net.Dialer{Timeout: time.Duration(session.option.ConnectTimeoutMS) * time.Millisecond}
+	conn, err := dialer.DialContext(ctx, "tcp", session.addr)
 	if err != nil {
 		return err
 	}
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	if session.disposed {
+		_ = conn.Close()
+		return ErrPullSessionDisposed
+	}
+	// 重连时，释放上一个连接
+	if session.Conn != nil {
+		_ = session.Conn.Close()
+	}
 	session.Conn = connection.New(conn, func(option *connection.Option) {
 		option.ReadBufSize = readBufSize
 		option.WriteTimeoutMS = session.option.ReadTimeoutMS // TODO chef: 为什么是 Read 赋值给 Write
@@ -153,7 +226,23 @@ func (session *PullSession) ReadTag() (Tag, error) {
 	return readTag(session.Conn)
 }
 
-func (session *PullSession) runReadLoop(onReadFLVTag OnReadFLVTag) error {
+func (session *PullSession) closeConn() {
+	session.mutex.Lock()
+	conn := session.Conn
+	session.mutex.Unlock()
+	if conn != nil {
+		_ = conn.Close()
+	}
+}
+
+func (session *PullSession) pull(ctx context.Context, rawURL string, onReadFLVTag OnReadFLVTag, retrier *reconnect.Retrier) error {
+	if err := session.ConnectContext(ctx, rawURL); err != nil {
+		return err
+	}
+	if err := session.WriteHTTPRequest(); err != nil {
+		return err
+	}
+
 	if _, _, err := session.ReadHTTPRespHeader(); err != nil {
 		return err
 	}
@@ -161,12 +250,32 @@ func (session *PullSession) runReadLoop(onReadFLVTag OnReadFLVTag) error {
 	if _, err := session.ReadFLVHeader(); err != nil {
 		return err
 	}
+	retrier.Succeed()
 
 	for {
 		tag, err := session.ReadTag()
 		if err != nil {
 			return err
 		}
-		onReadFLVTag(tag)
+		if err := session.onTag(tag, onReadFLVTag); err != nil {
+			return err
+		}
 	}
 }
+
+// 回调中发生 panic 时（比如对端发送了异常的数据），打印 tag 内容后返回 ErrPanic，只断开当前 session
+func (session *PullSession) onTag(tag Tag, onReadFLVTag OnReadFLVTag) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			raw := tag.Raw
+			if len(raw) > maxDebugDumpSize {
+				raw = raw[:maxDebugDumpSize]
+			}
+			log.Errorf("recover from panic. [%s] err=%v, header=%+v, len=%d, hex=%s\n%s",
+				session.UniqueKey, r, tag.Header, len(tag.Raw), hex.Dump(raw), debug.Stack())
+			err = ErrPanic
+		}
+	}()
+	onReadFLVTag(tag)
+	return nil
+}
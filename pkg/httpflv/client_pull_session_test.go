@@ -0,0 +1,42 @@
+// Copyright 2019, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package httpflv_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/q191201771/lal/pkg/httpflv"
+	"github.com/q191201771/naza/pkg/assert"
+)
+
+func TestPullSession_Context(t *testing.T) {
+	// 只建立 tcp 连接，不做任何回复的服务端
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	session := httpflv.NewPullSession()
+	err = session.PullContext(ctx, "http://"+ln.Addr().String()+"/live/ctx.flv", func(tag httpflv.Tag) {})
+	assert.Equal(t, context.DeadlineExceeded, err)
+	session.Dispose()
+}
@@ -0,0 +1,78 @@
+// Copyright 2019, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+//go:build go1.18
+// +build go1.18
+
+package httpflv
+
+// 对端可以控制的输入的 fuzz 测试，比如:
+// go test -run=^$ -fuzz=FuzzReadTag -fuzztime=1h ./pkg/httpflv/
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	"github.com/q191201771/lal/pkg/bufpool"
+)
+
+func FuzzParseHTTPHeader(f *testing.F) {
+	f.Add([]byte("GET /live/test.flv?token=1 HTTP/1.1\r\nHost: 127.0.0.1:8080\r\nUser-Agent: lal\r\n\r\n"))
+	f.Add([]byte(flvHTTPResponseHeaderStr))
+	f.Add([]byte("GET / HTTP/1.1\r\nbad header\r\n\r\n"))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		firstLine, headers, err := parseHTTPHeader(bufio.NewReader(bytes.NewReader(b)))
+		if err != nil {
+			return
+		}
+		if len(headers) >= maxHTTPHeaderLineNum {
+			t.Fatalf("too many headers. num=%d", len(headers))
+		}
+		_, _, _, _ = parseRequestLine(firstLine)
+		_, _, _, _ = parseStatusLine(firstLine)
+	})
+}
+
+func FuzzReadTag(f *testing.F) {
+	f.Add(PackHTTPFLVTag(TagTypeVideo, 0, []byte{0x17, 0x0, 0x0, 0x0, 0x0, 0x1, 0x64, 0x0, 0x1f, 0xff, 0xe1, 0x0, 0x4, 0x67, 0x64, 0x0, 0x1f, 0x1, 0x0, 0x1, 0x68}))
+	f.Add(append(PackHTTPFLVTag(TagTypeAudio, 40, []byte{0xaf, 0x0, 0x11, 0x90}), PackHTTPFLVTag(TagTypeAudio, 63, []byte{0xaf, 0x1, 0x21})...))
+	// Enhanced RTMP
+	f.Add(PackHTTPFLVTag(TagTypeVideo, 80, []byte{0x90, 'a', 'v', '0', '1', 0x81, 0x0, 0xc, 0x0}))
+	f.Add(PackHTTPFLVTag(TagTypeAudio, 80, []byte{0x90, 'O', 'p', 'u', 's', 'O', 'p', 'u', 's', 'H', 'e', 'a', 'd'}))
+	f.Add(PackHTTPFLVTag(TagTypeMetadata, 0, []byte{0x2, 0x0, 0xa, 'o', 'n', 'M', 'e', 't', 'a', 'D', 'a', 't', 'a'}))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		defer bufpool.SetLimit(bufpool.GetLimit())
+		bufpool.SetLimit(bufpool.Limit{MaxMsgSize: 64 * 1024})
+
+		r := bytes.NewReader(b)
+		for {
+			tag, err := readTag(r)
+			if err != nil {
+				return
+			}
+			if len(tag.Raw) != TagHeaderSize+int(tag.Header.DataSize)+prevTagSizeFieldSize {
+				t.Fatalf("invalid tag. header=%+v, len=%d", tag.Header, len(tag.Raw))
+			}
+			_ = tag.Payload()
+			_ = tag.IsVideoKeySeqHeader()
+			_ = tag.IsVideoKeyNalu()
+			if tag.Header.Type == TagTypeAudio {
+				_ = tag.IsAudioSeqHeader()
+			}
+			if tag.IsEnhancedVideo() {
+				_ = tag.VideoFourCC()
+			}
+			if tag.IsEnhancedAudio() {
+				_ = tag.AudioFourCC()
+			}
+		}
+	})
+}
@@ -15,11 +15,26 @@ import (
 
 var ErrHTTPFLV = errors.New("lal.httpflv: fxxk")
 
+// tag 的长度超过 bufpool.Limit 中的 MaxMsgSize
+var ErrTagTooLarge = errors.New("lal.httpflv: tag too large")
+
+// 处理 tag 时发生了 panic，一般是对端发送了异常的数据
+var ErrPanic = errors.New("lal.httpflv: recover from panic")
+
+// SubSession 建立连接后，没有在 ServerOption.ReadRequestTimeoutMS 内发送完 http 请求
+var ErrReadRequestTimeout = errors.New("lal.httpflv: read request timeout")
+
 const (
 	TagHeaderSize int = 11
 
 	flvHeaderSize            = 13
 	prevTagSizeFieldSize int = 4
+
+	// 打印日志时，二进制数据最多打印的字节数
+	maxDebugDumpSize = 256
+
+	// http 头中最多的行数，防止对端一直发送头导致内存增长
+	maxHTTPHeaderLineNum = 128
 )
 
 type LineReader interface {
@@ -43,7 +58,11 @@ func parseHTTPHeader(r LineReader) (firstLine string, headers map[string]string,
 	}
 	firstLine = string(line)
 
-	for {
+	for i := 0; ; i++ {
+		if i == maxHTTPHeaderLineNum {
+			err = ErrHTTPFLV
+			return
+		}
 		line, isPrefix, err = r.ReadLine()
 		if len(line) == 0 { // 读到一个空的 \r\n 表示http头全部读取完毕了
 			break
@@ -9,9 +9,12 @@
 package httpflv
 
 import (
+	"fmt"
 	"net"
+	"runtime/debug"
 	"sync"
 
+	"github.com/q191201771/naza/pkg/nazaatomic"
 	log "github.com/q191201771/naza/pkg/nazalog"
 )
 
@@ -23,22 +26,85 @@ type ServerObserver interface {
 	DelHTTPFLVSubSessionCB(session *SubSession)
 }
 
+// server 上所有 SubSession 使用的配置项
+type ServerOption struct {
+	ReadBufSize    int // SubSession 读取请求时，读缓冲的大小
+	WriteChanSize  int // SubSession 最多缓存多少个待发送的内存块
+	WriteTimeoutMS int // SubSession 发送数据的超时，为0时不设置超时
+
+	ReadRequestTimeoutMS int // SubSession 建立连接后，读取完 http 请求的超时，超时后关闭连接，为0时不设置超时
+}
+
+var DefaultServerOption = ServerOption{
+	ReadBufSize:    256,
+	WriteChanSize:  1024,
+	WriteTimeoutMS: 10000,
+
+	ReadRequestTimeoutMS: 10000,
+}
+
+type ModServerOption func(option *ServerOption)
+
+// 检查配置项是否合法，比如加载配置文件时调用
+func (option ServerOption) Validate() error {
+	switch {
+	case option.ReadBufSize <= 0:
+		return invalidServerOption("ReadBufSize", option.ReadBufSize)
+	case option.WriteChanSize <= 0:
+		return invalidServerOption("WriteChanSize", option.WriteChanSize)
+	case option.WriteTimeoutMS < 0:
+		return invalidServerOption("WriteTimeoutMS", option.WriteTimeoutMS)
+	case option.ReadRequestTimeoutMS < 0:
+		return invalidServerOption("ReadRequestTimeoutMS", option.ReadRequestTimeoutMS)
+	}
+	return nil
+}
+
+func invalidServerOption(name string, value int) error {
+	return fmt.Errorf("lal.httpflv: invalid server option. %s=%d", name, value)
+}
+
+// 因为超时而被关闭的连接的数量，和 rtmp.Timeouts 类似，httpflv 只有读取请求这一个阶段
+type Timeouts struct {
+	ReadRequest uint64
+}
+
+var timeouts struct {
+	readRequest nazaatomic.Uint64
+}
+
+func GetTimeouts() Timeouts {
+	return Timeouts{
+		ReadRequest: timeouts.readRequest.Load(),
+	}
+}
+
 type Server struct {
-	obs  ServerObserver
-	addr string
+	obs    ServerObserver
+	addr   string
+	option ServerOption
 
 	m  sync.Mutex
 	ln net.Listener
 }
 
-func NewServer(obs ServerObserver, addr string) *Server {
+func NewServer(obs ServerObserver, addr string, modOptions ...ModServerOption) *Server {
+	option := DefaultServerOption
+	for _, fn := range modOptions {
+		fn(&option)
+	}
 	return &Server{
-		obs:  obs,
-		addr: addr,
+		obs:    obs,
+		addr:   addr,
+		option: option,
 	}
 }
 
+// 配置项不合法时直接返回错误，不会开始监听
 func (server *Server) RunLoop() error {
+	if err := server.option.Validate(); err != nil {
+		return err
+	}
 	var err error
 
 	server.m.Lock()
@@ -72,9 +138,19 @@ func (server *Server) Dispose() {
 
 func (server *Server) handleConnect(conn net.Conn) {
 	log.Infof("accept a httpflv connection. remoteAddr=%v", conn.RemoteAddr())
-	session := NewSubSession(conn)
+	session := NewSubSession(conn, func(option *ServerOption) {
+		*option = server.option
+	})
+	defer func() {
+		// 只断开发生异常的 session，不影响整个进程
+		if r := recover(); r != nil {
+			log.Errorf("recover from panic. [%s] err=%v\n%s", session.UniqueKey, r, debug.Stack())
+			session.Dispose()
+			server.obs.DelHTTPFLVSubSessionCB(session)
+		}
+	}()
 	if err := session.ReadRequest(); err != nil {
-		log.Errorf("read httpflv SubSession request error. [%s]", session.UniqueKey)
+		log.Errorf("read httpflv SubSession request error. [%s] err=%v", session.UniqueKey, err)
 		return
 	}
 	log.Infof("-----> http request. [%s] uri=%s", session.UniqueKey, session.URI)
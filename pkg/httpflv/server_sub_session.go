@@ -14,7 +14,10 @@ import (
 	"strings"
 	"time"
 
+	"github.com/q191201771/lal/pkg/bufpool"
 	"github.com/q191201771/naza/pkg/connection"
+	"github.com/q191201771/naza/pkg/nazaatomic"
+	"github.com/q191201771/naza/pkg/slicebytepool"
 
 	log "github.com/q191201771/naza/pkg/nazalog"
 	"github.com/q191201771/naza/pkg/unique"
@@ -37,34 +40,63 @@ type SubSession struct {
 	StreamName string
 	AppName    string
 	URI        string
+	RawQuery   string // url 中 `?` 后面的部分，不包含 `?`
 	Headers    map[string]string
 
 	IsFresh     bool
 	WaitKeyNalu bool
 
-	conn connection.Connection
+	option ServerOption
+	conn   connection.Connection
+	aw     *bufpool.Writer
 }
 
-func NewSubSession(conn net.Conn) *SubSession {
+func NewSubSession(conn net.Conn, modOptions ...ModServerOption) *SubSession {
 	uk := unique.GenUniqueKey("FLVSUB")
 	log.Infof("lifecycle new SubSession. [%s] remoteAddr=%s", uk, conn.RemoteAddr().String())
+	option := DefaultServerOption
+	for _, fn := range modOptions {
+		fn(&option)
+	}
 	return &SubSession{
 		UniqueKey:   uk,
 		IsFresh:     true,
 		WaitKeyNalu: true,
-		conn: connection.New(conn, func(option *connection.Option) {
-			option.ReadBufSize = readBufSize
-			option.WriteChanSize = wChanSize
-			option.WriteTimeoutMS = subSessionWriteTimeoutMS
+		option:      option,
+		conn: connection.New(conn, func(connOption *connection.Option) {
+			connOption.ReadBufSize = option.ReadBufSize
+		}),
+		aw: bufpool.NewWriter(conn, func(writerOption *bufpool.WriterOption) {
+			writerOption.MaxPendingNum = option.WriteChanSize
+			writerOption.WriteTimeoutMS = option.WriteTimeoutMS
 		}),
 	}
 }
 
-// TODO chef: read request timeout
 func (session *SubSession) ReadRequest() (err error) {
 	session.StartTick = time.Now().Unix()
 
+	// 0 读取中，1 读取结束，2 超时
+	var state nazaatomic.Int32
+	var t *time.Timer
+	if timeoutMS := session.option.ReadRequestTimeoutMS; timeoutMS != 0 {
+		t = time.AfterFunc(time.Duration(timeoutMS)*time.Millisecond, func() {
+			if state.CompareAndSwap(0, 2) {
+				timeouts.readRequest.Increment()
+				log.Warnf("read request timeout, dispose session. [%s] timeout=%dms", session.UniqueKey, timeoutMS)
+				_ = session.conn.Close()
+			}
+		})
+	}
+
 	defer func() {
+		if t != nil {
+			t.Stop()
+		}
+		// 超时后连接已经被关闭，即使请求读取完整也不能再使用
+		if !state.CompareAndSwap(0, 1) {
+			err = ErrReadRequestTimeout
+		}
 		if err != nil {
 			session.Dispose()
 		}
@@ -89,6 +121,7 @@ func (session *SubSession) ReadRequest() (err error) {
 	if urlObj, err = url2.Parse(session.URI); err != nil {
 		return
 	}
+	session.RawQuery = urlObj.RawQuery
 	if !strings.HasSuffix(urlObj.Path, ".flv") {
 		err = ErrHTTPFLV
 		return
@@ -111,8 +144,14 @@ func (session *SubSession) ReadRequest() (err error) {
 }
 
 func (session *SubSession) RunLoop() error {
+	defer session.aw.Close()
 	buf := make([]byte, 128)
 	_, err := session.conn.Read(buf)
+	// 因为发送的数据超过限制而被关闭连接时，返回真正的原因，而不是读取失败
+	if werr := session.aw.Err(); bufpool.IsLimitError(werr) {
+		log.Warnf("disconnect since exceed limit. [%s] err=%v", session.UniqueKey, werr)
+		return werr
+	}
 	return err
 }
 
@@ -130,10 +169,17 @@ func (session *SubSession) WriteTag(tag *Tag) {
 	session.WriteRawPacket(tag.Raw)
 }
 
+// 注意，<pkt> 在发送完成之前不会被拷贝，调用方不应该再修改
 func (session *SubSession) WriteRawPacket(pkt []byte) {
-	_, _ = session.conn.Write(pkt)
+	_, _ = session.aw.Write(pkt)
+}
+
+// <ssb> 被引用直到发送完成，调用方依然需要释放自己持有的引用
+func (session *SubSession) WriteShared(ssb *slicebytepool.SharedSliceByte) {
+	_ = session.aw.WriteShared(ssb)
 }
 
 func (session *SubSession) Dispose() {
+	session.aw.Close()
 	_ = session.conn.Close()
 }
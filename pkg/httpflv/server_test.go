@@ -0,0 +1,65 @@
+// Copyright 2019, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package httpflv_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/q191201771/lal/pkg/httpflv"
+	"github.com/q191201771/naza/pkg/assert"
+)
+
+func TestServerOption_Validate(t *testing.T) {
+	assert.Equal(t, nil, httpflv.DefaultServerOption.Validate())
+
+	option := httpflv.DefaultServerOption
+	option.WriteTimeoutMS = 0
+	assert.Equal(t, nil, option.Validate())
+	option.ReadBufSize = 0
+	assert.IsNotNil(t, option.Validate())
+
+	// 配置项不合法时不会开始监听
+	s := httpflv.NewServer(nil, ":8083", func(option *httpflv.ServerOption) {
+		option.WriteChanSize = -1
+	})
+	assert.IsNotNil(t, s.RunLoop())
+}
+
+func TestSubSession_ReadRequestTimeout(t *testing.T) {
+	newSession := func() (net.Conn, *httpflv.SubSession) {
+		cc, sc := net.Pipe()
+		return cc, httpflv.NewSubSession(sc, func(option *httpflv.ServerOption) {
+			option.ReadRequestTimeoutMS = 100
+		})
+	}
+
+	// 只发送了一部分请求
+	before := httpflv.GetTimeouts()
+	cc, session := newSession()
+	go func() {
+		_, _ = cc.Write([]byte("GET /live/test.flv HTTP/1.1\r\n"))
+	}()
+	assert.Equal(t, httpflv.ErrReadRequestTimeout, session.ReadRequest())
+	assert.Equal(t, before.ReadRequest+1, httpflv.GetTimeouts().ReadRequest)
+	_ = cc.Close()
+
+	// 在超时之前读取完请求，之后不再计时
+	cc, session = newSession()
+	go func() {
+		_, _ = cc.Write([]byte("GET /live/test.flv HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n"))
+	}()
+	assert.Equal(t, nil, session.ReadRequest())
+	assert.Equal(t, "test", session.StreamName)
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, before.ReadRequest+1, httpflv.GetTimeouts().ReadRequest)
+	session.Dispose()
+	_ = cc.Close()
+}
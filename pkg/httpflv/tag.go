@@ -11,7 +11,9 @@ package httpflv
 import (
 	"io"
 
+	"github.com/q191201771/lal/pkg/bufpool"
 	"github.com/q191201771/naza/pkg/bele"
+	"github.com/q191201771/naza/pkg/slicebytepool"
 )
 
 const (
@@ -39,10 +41,86 @@ const (
 	AVCPacketTypeNalu uint8 = 1
 )
 
+// Enhanced RTMP 中的视频扩展头，rtmp 包中也使用这里的定义
+// 视频 tag 第一个字节的最高位为1时，表示使用扩展头，结构为:
+// IsExHeader 1bit | FrameType 3bit | PacketType 4bit | FourCC 4字节
 const (
-	SoundFormatAAC uint8 = 10
+	ExVideoPacketTypeSequenceStart        uint8 = 0
+	ExVideoPacketTypeCodedFrames          uint8 = 1
+	ExVideoPacketTypeSequenceEnd          uint8 = 2
+	ExVideoPacketTypeCodedFramesX         uint8 = 3 // 没有 composition time 字段
+	ExVideoPacketTypeMetadata             uint8 = 4
+	ExVideoPacketTypeMPEG2TSSequenceStart uint8 = 5
+	ExVideoPacketTypeMultitrack           uint8 = 6
 )
 
+const (
+	FourCCAV1  uint32 = 0x61763031 // av01
+	FourCCVP9  uint32 = 0x76703039 // vp09
+	FourCCHEVC uint32 = 0x68766331 // hvc1
+)
+
+const exVideoHeaderSize = 5
+
+const (
+	SoundFormatMP3      uint8 = 2
+	SoundFormatG711A    uint8 = 7
+	SoundFormatG711U    uint8 = 8
+	SoundFormatExHeader uint8 = 9 // Enhanced RTMP 的音频扩展头，实际的编码格式由 FourCC 决定
+	SoundFormatAAC      uint8 = 10
+	SoundFormatMP38k    uint8 = 14
+)
+
+// Enhanced RTMP 中的音频扩展头，SoundFormat 为 SoundFormatExHeader 时，结构为:
+// SoundFormat 4bit | PacketType 4bit | FourCC 4字节
+const (
+	ExAudioPacketTypeSequenceStart      uint8 = 0
+	ExAudioPacketTypeCodedFrames        uint8 = 1
+	ExAudioPacketTypeSequenceEnd        uint8 = 2
+	ExAudioPacketTypeMultichannelConfig uint8 = 4
+	ExAudioPacketTypeMultitrack         uint8 = 5
+)
+
+const (
+	FourCCOpus uint32 = 0x4f707573 // Opus
+	FourCCMP3  uint32 = 0x2e6d7033 // .mp3
+)
+
+const exAudioHeaderSize = 5
+
+// 音频 tag body 的第一个字节
+type AudioTagHeader struct {
+	SoundFormat uint8 // 2=MP3 7=G711A 8=G711U 9=ExHeader 10=AAC 14=MP3 8kHz
+	SoundRate   uint8 // 0=5.5kHz 1=11kHz 2=22kHz 3=44kHz
+	SoundSize   uint8 // 0=snd8Bit 1=snd16Bit
+	SoundType   uint8 // 0=sndMono 1=sndStereo
+}
+
+func ParseAudioTagHeader(b uint8) AudioTagHeader {
+	return AudioTagHeader{
+		SoundFormat: b >> 4,
+		SoundRate:   (b >> 2) & 0x03,
+		SoundSize:   (b >> 1) & 0x01,
+		SoundType:   b & 0x01,
+	}
+}
+
+// 采样率，单位Hz
+// 注意，AAC 和 Enhanced RTMP 的真实采样率需要从 seq header 中获取，这里返回的只是 tag 头中的值
+func (h AudioTagHeader) SampleRate() int {
+	switch h.SoundFormat {
+	case SoundFormatG711A, SoundFormatG711U, SoundFormatMP38k:
+		return 8000
+	case SoundFormatExHeader:
+		return 48000
+	}
+	return []int{5512, 11025, 22050, 44100}[h.SoundRate]
+}
+
+func (h AudioTagHeader) Channels() int {
+	return int(h.SoundType) + 1
+}
+
 const (
 	AACPacketTypeSeqHeader uint8 = 0
 	AACPacketTypeRaw       uint8 = 1
@@ -69,15 +147,77 @@ func (tag *Tag) IsMetadata() bool {
 }
 
 func (tag *Tag) IsAVCKeySeqHeader() bool {
-	return tag.Header.Type == TagTypeVideo && tag.Raw[TagHeaderSize] == AVCKey && tag.Raw[TagHeaderSize+1] == isAVCKeySeqHeader
+	return tag.Header.Type == TagTypeVideo && tag.Header.DataSize >= 2 && tag.Raw[TagHeaderSize] == AVCKey && tag.Raw[TagHeaderSize+1] == isAVCKeySeqHeader
 }
 
 func (tag *Tag) IsAVCKeyNalu() bool {
-	return tag.Header.Type == TagTypeVideo && tag.Raw[TagHeaderSize] == AVCKey && tag.Raw[TagHeaderSize+1] == AVCPacketTypeNalu
+	return tag.Header.Type == TagTypeVideo && tag.Header.DataSize >= 2 && tag.Raw[TagHeaderSize] == AVCKey && tag.Raw[TagHeaderSize+1] == AVCPacketTypeNalu
+}
+
+// 是否是 Enhanced RTMP 格式的视频 tag，比如 av1, vp9, hevc
+func (tag *Tag) IsEnhancedVideo() bool {
+	return tag.Header.Type == TagTypeVideo && tag.Header.DataSize >= exVideoHeaderSize && tag.Raw[TagHeaderSize]&0x80 != 0
+}
+
+// 注意，调用方需保证 IsEnhancedVideo 为 true
+func (tag *Tag) VideoFourCC() uint32 {
+	return bele.BEUint32(tag.Raw[TagHeaderSize+1:])
+}
+
+// 注意，调用方需保证 IsEnhancedVideo 为 true
+func (tag *Tag) ExVideoPacketType() uint8 {
+	return tag.Raw[TagHeaderSize] & 0x0f
+}
+
+// 视频的 seq header，包含 avc seq header 以及 Enhanced RTMP 的 SequenceStart
+func (tag *Tag) IsVideoKeySeqHeader() bool {
+	if tag.IsEnhancedVideo() {
+		return tag.ExVideoPacketType() == ExVideoPacketTypeSequenceStart
+	}
+	return tag.IsAVCKeySeqHeader()
+}
+
+// 视频的关键帧，包含 avc 的关键帧以及 Enhanced RTMP 的关键帧
+func (tag *Tag) IsVideoKeyNalu() bool {
+	if tag.IsEnhancedVideo() {
+		pt := tag.ExVideoPacketType()
+		return (tag.Raw[TagHeaderSize]>>4)&0x07 == frameTypeKey &&
+			(pt == ExVideoPacketTypeCodedFrames || pt == ExVideoPacketTypeCodedFramesX)
+	}
+	return tag.IsAVCKeyNalu()
+}
+
+// 注意，调用方需保证是音频 tag
+func (tag *Tag) SoundFormat() uint8 {
+	return tag.Raw[TagHeaderSize] >> 4
+}
+
+// 是否是 Enhanced RTMP 格式的音频 tag，比如 opus
+func (tag *Tag) IsEnhancedAudio() bool {
+	return tag.Header.Type == TagTypeAudio && tag.Header.DataSize >= exAudioHeaderSize && tag.SoundFormat() == SoundFormatExHeader
+}
+
+// 注意，调用方需保证 IsEnhancedAudio 为 true
+func (tag *Tag) AudioFourCC() uint32 {
+	return bele.BEUint32(tag.Raw[TagHeaderSize+1:])
+}
+
+// 注意，调用方需保证 IsEnhancedAudio 为 true
+func (tag *Tag) ExAudioPacketType() uint8 {
+	return tag.Raw[TagHeaderSize] & 0x0f
+}
+
+// 音频的 seq header，包含 aac seq header 以及 Enhanced RTMP 的 SequenceStart
+// 注意，mp3 和 g711 没有 seq header
+func (tag *Tag) IsAudioSeqHeader() bool {
+	if tag.IsEnhancedAudio() {
+		return tag.ExAudioPacketType() == ExAudioPacketTypeSequenceStart
+	}
+	return tag.IsAACSeqHeader()
 }
 
 func (tag *Tag) IsAACSeqHeader() bool {
-	return tag.Header.Type == TagTypeAudio && tag.Raw[TagHeaderSize]>>4 == SoundFormatAAC && tag.Raw[TagHeaderSize+1] == AACPacketTypeSeqHeader
+	return tag.Header.Type == TagTypeAudio && tag.Header.DataSize >= 2 && tag.Raw[TagHeaderSize]>>4 == SoundFormatAAC && tag.Raw[TagHeaderSize+1] == AACPacketTypeSeqHeader
 }
 
 func (tag *Tag) clone() (out Tag) {
@@ -96,6 +236,18 @@ func (tag *Tag) ModTagTimestamp(timestamp uint32) {
 // 打包一个序列化后的 tag 二进制buffer，包含 tag header，body，prev tag size
 func PackHTTPFLVTag(t uint8, timestamp uint32, in []byte) []byte {
 	out := make([]byte, TagHeaderSize+len(in)+prevTagSizeFieldSize)
+	packHTTPFLVTagTo(out, t, timestamp, in)
+	return out
+}
+
+// 和 PackHTTPFLVTag 相同，但是内存块从内存池中获取，引用计数为1，不再使用时调用 ReleaseIfNeeded 释放
+func PackHTTPFLVTagShared(t uint8, timestamp uint32, in []byte) *slicebytepool.SharedSliceByte {
+	ssb := bufpool.NewShared(TagHeaderSize + len(in) + prevTagSizeFieldSize)
+	packHTTPFLVTagTo(ssb.Core, t, timestamp, in)
+	return ssb
+}
+
+func packHTTPFLVTagTo(out []byte, t uint8, timestamp uint32, in []byte) {
 	out[0] = t
 	bele.BEPutUint24(out[1:], uint32(len(in)))
 	bele.BEPutUint24(out[4:], timestamp&0xFFFFFF)
@@ -105,7 +257,6 @@ func PackHTTPFLVTag(t uint8, timestamp uint32, in []byte) []byte {
 	out[10] = 0
 	copy(out[11:], in)
 	bele.BEPutUint32(out[TagHeaderSize+len(in):], uint32(TagHeaderSize+len(in)))
-	return out
 }
 
 func parseTagHeader(rawHeader []byte) TagHeader {
@@ -122,6 +273,11 @@ func readTag(rd io.Reader) (tag Tag, err error) {
 		return
 	}
 	header := parseTagHeader(rawHeader)
+	if max := bufpool.GetLimit().MaxMsgSize; max != 0 && header.DataSize > max {
+		bufpool.ReportOffence(bufpool.OffenceMsgTooLarge)
+		err = ErrTagTooLarge
+		return
+	}
 
 	needed := int(header.DataSize) + prevTagSizeFieldSize
 	tag.Header = header
@@ -0,0 +1,57 @@
+// Copyright 2019, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package httpflv
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/q191201771/lal/pkg/bufpool"
+	"github.com/q191201771/naza/pkg/assert"
+)
+
+func TestReadTag_Limit(t *testing.T) {
+	defer bufpool.SetLimit(bufpool.GetLimit())
+	bufpool.SetLimit(bufpool.Limit{MaxMsgSize: 16})
+
+	raw := PackHTTPFLVTag(TagTypeAudio, 10, make([]byte, 16))
+	tag, err := readTag(bytes.NewReader(raw))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, raw, tag.Raw)
+
+	// 只读取了 tag header，不会按照 header 中的长度申请内存
+	before := bufpool.GetOffences().MsgTooLarge
+	raw = PackHTTPFLVTag(TagTypeAudio, 10, make([]byte, 17))
+	_, err = readTag(bytes.NewReader(raw[:TagHeaderSize]))
+	assert.Equal(t, ErrTagTooLarge, err)
+	assert.Equal(t, before+1, bufpool.GetOffences().MsgTooLarge)
+}
+
+func TestTag_ShortPayload(t *testing.T) {
+	for _, payload := range [][]byte{nil, {0x17}, {0xaf}} {
+		tag, err := readTag(bytes.NewReader(PackHTTPFLVTag(TagTypeVideo, 0, payload)))
+		assert.Equal(t, nil, err)
+		assert.Equal(t, false, tag.IsAVCKeySeqHeader())
+		assert.Equal(t, false, tag.IsVideoKeyNalu())
+		tag, err = readTag(bytes.NewReader(PackHTTPFLVTag(TagTypeAudio, 0, payload)))
+		assert.Equal(t, nil, err)
+		assert.Equal(t, false, tag.IsAudioSeqHeader())
+	}
+}
+
+func TestPullSession_OnTagPanic(t *testing.T) {
+	var session PullSession
+	tag, err := readTag(bytes.NewReader(PackHTTPFLVTag(TagTypeVideo, 0, []byte{0x17})))
+	assert.Equal(t, nil, err)
+	err = session.onTag(tag, func(tag Tag) {
+		_ = tag.Payload()[1]
+	})
+	assert.Equal(t, ErrPanic, err)
+	assert.Equal(t, nil, session.onTag(tag, func(tag Tag) {}))
+}
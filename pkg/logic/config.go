@@ -8,15 +8,200 @@
 
 package logic
 
+import (
+	"fmt"
+	"math"
+
+	"github.com/q191201771/lal/pkg/bufpool"
+	"github.com/q191201771/lal/pkg/httpflv"
+	"github.com/q191201771/lal/pkg/rtmp"
+	"github.com/q191201771/lal/pkg/timestamp"
+)
+
+// 所有的数值配置项统一规则：为0时使用默认值，为-1时表示不设置超时，不检查，或者不限制
+// 默认值见 rtmp.DefaultServerOption，httpflv.DefaultServerOption，timestamp.DefaultOption，
+// DefaultInterleaveMaxLatencyMS 以及 bufpool.DefaultLimit
+// 大小类的配置项，比如 ChunkSize，以及 interleave.max_latency_ms 不能为-1
 type Config struct {
-	RTMP    RTMP    `json:"rtmp"`
-	HTTPFLV HTTPFLV `json:"httpflv"`
+	RTMP       RTMP       `json:"rtmp"`
+	HTTPFLV    HTTPFLV    `json:"httpflv"`
+	Metadata   Metadata   `json:"metadata"`
+	Timestamp  Timestamp  `json:"timestamp"`
+	Interleave Interleave `json:"interleave"`
+	Limit      Limit      `json:"limit"`
 }
 
+// 见 rtmp.ServerOption
 type RTMP struct {
-	Addr string `json:"addr"`
+	Addr              string `json:"addr"`
+	ReadBufSize       int    `json:"read_buf_size"`
+	WriteChanSize     int    `json:"write_chan_size"`
+	ReadAVTimeoutMS   int    `json:"read_av_timeout_ms"`
+	WriteAVTimeoutMS  int    `json:"write_av_timeout_ms"`
+	ChunkSize         int    `json:"chunk_size"`
+	WindowAckSize     int    `json:"window_ack_size"`
+	PeerBandwidth     int    `json:"peer_bandwidth"`
+	PingIntervalMS    int    `json:"ping_interval_ms"` // 为-1时不发送 PingRequest
+	PingTimeoutMS     int    `json:"ping_timeout_ms"`
+	MaxStreamsPerConn int    `json:"max_streams_per_conn"`
+
+	// 各个阶段的超时
+	HandshakeTimeoutMS  int `json:"handshake_timeout_ms"`
+	CommandTimeoutMS    int `json:"command_timeout_ms"`
+	FirstMediaTimeoutMS int `json:"first_media_timeout_ms"`
+
+	// 定时检查的超时
+	IdleTimeoutMS          int `json:"idle_timeout_ms"`
+	MediaInactiveTimeoutMS int `json:"media_inactive_timeout_ms"`
 }
 
+// 见 httpflv.ServerOption
 type HTTPFLV struct {
-	SubListenAddr string `json:"sub_listen_addr"`
+	SubListenAddr  string `json:"sub_listen_addr"`
+	ReadBufSize    int    `json:"read_buf_size"`
+	WriteChanSize  int    `json:"write_chan_size"`
+	WriteTimeoutMS int    `json:"write_timeout_ms"`
+
+	ReadRequestTimeoutMS int `json:"read_request_timeout_ms"`
+}
+
+type Metadata struct {
+	// 是否改写推流端的 onMetaData 后再转发给拉流端：
+	// 去除 @setDataFrame，使用 sps 中的宽高，增加服务端的名称和版本
+	// sps 中的宽高和 onMetaData 不一致时，已经开始拉流的 session 会再收到一次改写后的 onMetaData
+	Rewrite bool `json:"rewrite"`
+}
+
+// 见 timestamp.Option
+type Timestamp struct {
+	// 是否修复推流端的时间戳，比如回退、跳变、回绕，见 timestamp.Normalizer
+	Normalize       bool `json:"normalize"`
+	JumpThresholdMS int  `json:"jump_threshold_ms"`
+	MaxAVDriftMS    int  `json:"max_av_drift_ms"`
+}
+
+// 内存限制，超过限制的 session 被断开，见 bufpool.Limit
+type Limit struct {
+	MaxMsgSize              int64 `json:"max_msg_size"`               // 单个 rtmp message 或者 flv tag 的最大长度
+	MaxSessionBufferedBytes int64 `json:"max_session_buffered_bytes"` // 单个 session 缓存的数据的最大字节数
+	MaxTotalBufferedBytes   int64 `json:"max_total_buffered_bytes"`   // 所有 session 还没有发送出去的数据的总字节数
+}
+
+// 检查配置项是否合法，比如加载配置文件时调用
+func (config *Config) Validate() error {
+	if err := config.RTMP.ServerOption().Validate(); err != nil {
+		return err
+	}
+	if err := config.HTTPFLV.ServerOption().Validate(); err != nil {
+		return err
+	}
+	vals := []struct {
+		name string
+		val  int64
+		min  int64
+		max  int64
+	}{
+		{"timestamp.jump_threshold_ms", int64(config.Timestamp.JumpThresholdMS), -1, math.MaxUint32},
+		{"timestamp.max_av_drift_ms", int64(config.Timestamp.MaxAVDriftMS), -1, math.MaxUint32},
+		{"interleave.max_latency_ms", int64(config.Interleave.MaxLatencyMS), 0, math.MaxUint32},
+		{"limit.max_msg_size", config.Limit.MaxMsgSize, -1, math.MaxUint32},
+		{"limit.max_session_buffered_bytes", config.Limit.MaxSessionBufferedBytes, -1, math.MaxInt64},
+		{"limit.max_total_buffered_bytes", config.Limit.MaxTotalBufferedBytes, -1, math.MaxInt64},
+	}
+	for _, v := range vals {
+		if v.val < v.min || v.val > v.max {
+			return fmt.Errorf("lal.logic: invalid config. %s=%d", v.name, v.val)
+		}
+	}
+	return nil
+}
+
+func (c RTMP) ServerOption() rtmp.ServerOption {
+	option := rtmp.DefaultServerOption
+	setIfNotZero(&option.ReadBufSize, c.ReadBufSize)
+	setIfNotZero(&option.WriteChanSize, c.WriteChanSize)
+	setOrDisable(&option.ReadAVTimeoutMS, c.ReadAVTimeoutMS)
+	setOrDisable(&option.WriteAVTimeoutMS, c.WriteAVTimeoutMS)
+	setIfNotZero(&option.ChunkSize, c.ChunkSize)
+	setIfNotZero(&option.WindowAckSize, c.WindowAckSize)
+	setIfNotZero(&option.PeerBandwidth, c.PeerBandwidth)
+	setOrDisable(&option.PingIntervalMS, c.PingIntervalMS)
+	setOrDisable(&option.PingTimeoutMS, c.PingTimeoutMS)
+	setIfNotZero(&option.MaxStreamsPerConn, c.MaxStreamsPerConn)
+	setOrDisable(&option.HandshakeTimeoutMS, c.HandshakeTimeoutMS)
+	setOrDisable(&option.CommandTimeoutMS, c.CommandTimeoutMS)
+	setOrDisable(&option.FirstMediaTimeoutMS, c.FirstMediaTimeoutMS)
+	setOrDisable(&option.IdleTimeoutMS, c.IdleTimeoutMS)
+	setOrDisable(&option.MediaInactiveTimeoutMS, c.MediaInactiveTimeoutMS)
+	return option
+}
+
+func (c HTTPFLV) ServerOption() httpflv.ServerOption {
+	option := httpflv.DefaultServerOption
+	setIfNotZero(&option.ReadBufSize, c.ReadBufSize)
+	setIfNotZero(&option.WriteChanSize, c.WriteChanSize)
+	setOrDisable(&option.WriteTimeoutMS, c.WriteTimeoutMS)
+	setOrDisable(&option.ReadRequestTimeoutMS, c.ReadRequestTimeoutMS)
+	return option
+}
+
+// 不包含 OnCorrection
+func (c Timestamp) NormalizerOption() timestamp.Option {
+	option := timestamp.DefaultOption
+	option.JumpThresholdMS = uint32OrDisable(option.JumpThresholdMS, int64(c.JumpThresholdMS))
+	option.MaxAVDriftMS = uint32OrDisable(option.MaxAVDriftMS, int64(c.MaxAVDriftMS))
+	return option
+}
+
+// MaxLatencyMS 不支持-1，由 Validate 检查
+func (c Interleave) MaxLatency() uint32 {
+	if c.MaxLatencyMS == 0 {
+		return DefaultInterleaveMaxLatencyMS
+	}
+	return uint32(c.MaxLatencyMS)
+}
+
+func (c Limit) BufLimit() bufpool.Limit {
+	l := bufpool.DefaultLimit
+	l.MaxMsgSize = uint32OrDisable(l.MaxMsgSize, c.MaxMsgSize)
+	l.MaxSessionBufferedBytes = int64OrDisable(l.MaxSessionBufferedBytes, c.MaxSessionBufferedBytes)
+	l.MaxTotalBufferedBytes = int64OrDisable(l.MaxTotalBufferedBytes, c.MaxTotalBufferedBytes)
+	return l
+}
+
+func setIfNotZero(dst *int, v int) {
+	if v != 0 {
+		*dst = v
+	}
+}
+
+// 为0时保留默认值，为-1时设置为0，即不设置超时或者不检查，其他值原样设置，由 Validate 检查
+func setOrDisable(dst *int, v int) {
+	switch v {
+	case 0:
+	case -1:
+		*dst = 0
+	default:
+		*dst = v
+	}
+}
+
+func uint32OrDisable(def uint32, v int64) uint32 {
+	return uint32(int64OrDisable(int64(def), v))
+}
+
+func int64OrDisable(def int64, v int64) int64 {
+	switch v {
+	case 0:
+		return def
+	case -1:
+		return 0
+	}
+	return v
+}
+
+type Interleave struct {
+	// 是否将音频和视频按时间戳交错后再转发，见 Interleaver
+	Enable       bool `json:"enable"`
+	MaxLatencyMS int  `json:"max_latency_ms"` // 为了等待另一个轨道，最多增加的延时。不能为-1，不需要交错时关闭 Enable 即可
 }
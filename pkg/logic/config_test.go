@@ -0,0 +1,98 @@
+// Copyright 2019, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package logic
+
+import (
+	"testing"
+
+	"github.com/q191201771/lal/pkg/bufpool"
+	"github.com/q191201771/lal/pkg/httpflv"
+	"github.com/q191201771/lal/pkg/rtmp"
+	"github.com/q191201771/lal/pkg/timestamp"
+	"github.com/q191201771/naza/pkg/assert"
+)
+
+func TestConfig_ServerOption(t *testing.T) {
+	// 为0时使用默认值，和库的默认行为保持一致
+	var config Config
+	ro := config.RTMP.ServerOption()
+	assert.Equal(t, rtmp.DefaultServerOption, ro)
+	ho := config.HTTPFLV.ServerOption()
+	assert.Equal(t, httpflv.DefaultServerOption, ho)
+	assert.Equal(t, nil, config.Validate())
+
+	config.RTMP.ChunkSize = 1024
+	config.RTMP.WriteAVTimeoutMS = 3000
+	config.HTTPFLV.WriteChanSize = 64
+	assert.Equal(t, 1024, config.RTMP.ServerOption().ChunkSize)
+	assert.Equal(t, 3000, config.RTMP.ServerOption().WriteAVTimeoutMS)
+	assert.Equal(t, 64, config.HTTPFLV.ServerOption().WriteChanSize)
+	assert.Equal(t, nil, config.Validate())
+
+	// 为-1时不设置超时
+	config.RTMP.ReadAVTimeoutMS = -1
+	config.RTMP.PingIntervalMS = -1
+	config.HTTPFLV.WriteTimeoutMS = -1
+	assert.Equal(t, 0, config.RTMP.ServerOption().ReadAVTimeoutMS)
+	assert.Equal(t, 0, config.RTMP.ServerOption().PingIntervalMS)
+	assert.Equal(t, 0, config.HTTPFLV.ServerOption().WriteTimeoutMS)
+	assert.Equal(t, nil, config.Validate())
+
+	config.RTMP.ChunkSize = 64
+	assert.IsNotNil(t, config.Validate())
+	config.RTMP.ChunkSize = -1
+	assert.IsNotNil(t, config.Validate())
+	config.RTMP.ChunkSize = 1024
+	config.HTTPFLV.WriteTimeoutMS = -2
+	assert.IsNotNil(t, config.Validate())
+	config.HTTPFLV.WriteTimeoutMS = 0
+
+	// 各个阶段的超时
+	config.RTMP.HandshakeTimeoutMS = 5000
+	config.HTTPFLV.ReadRequestTimeoutMS = 3000
+	assert.Equal(t, 5000, config.RTMP.ServerOption().HandshakeTimeoutMS)
+	assert.Equal(t, rtmp.DefaultServerOption.FirstMediaTimeoutMS, config.RTMP.ServerOption().FirstMediaTimeoutMS)
+	assert.Equal(t, 3000, config.HTTPFLV.ServerOption().ReadRequestTimeoutMS)
+	assert.Equal(t, nil, config.Validate())
+	config.RTMP.CommandTimeoutMS = -2
+	assert.IsNotNil(t, config.Validate())
+	config.RTMP.CommandTimeoutMS = 0
+	config.RTMP.IdleTimeoutMS = 60000
+	assert.Equal(t, 60000, config.RTMP.ServerOption().IdleTimeoutMS)
+	config.RTMP.MediaInactiveTimeoutMS = -2
+	assert.IsNotNil(t, config.Validate())
+}
+
+func TestConfig_Defaults(t *testing.T) {
+	var config Config
+	assert.Equal(t, timestamp.DefaultOption.JumpThresholdMS, config.Timestamp.NormalizerOption().JumpThresholdMS)
+	assert.Equal(t, uint32(DefaultInterleaveMaxLatencyMS), config.Interleave.MaxLatency())
+	assert.Equal(t, bufpool.DefaultLimit, config.Limit.BufLimit())
+
+	config.Timestamp.JumpThresholdMS = -1
+	config.Interleave.MaxLatencyMS = 100
+	config.Limit.MaxMsgSize = -1
+	config.Limit.MaxTotalBufferedBytes = 1 << 30
+	assert.Equal(t, uint32(0), config.Timestamp.NormalizerOption().JumpThresholdMS)
+	assert.Equal(t, uint32(100), config.Interleave.MaxLatency())
+	l := config.Limit.BufLimit()
+	assert.Equal(t, uint32(0), l.MaxMsgSize)
+	assert.Equal(t, bufpool.DefaultLimit.MaxSessionBufferedBytes, l.MaxSessionBufferedBytes)
+	assert.Equal(t, int64(1<<30), l.MaxTotalBufferedBytes)
+	assert.Equal(t, nil, config.Validate())
+
+	config.Limit.MaxSessionBufferedBytes = -2
+	assert.IsNotNil(t, config.Validate())
+	config.Limit.MaxSessionBufferedBytes = 0
+	config.Interleave.MaxLatencyMS = -2
+	assert.IsNotNil(t, config.Validate())
+	// 不限制延时没有意义
+	config.Interleave.MaxLatencyMS = -1
+	assert.IsNotNil(t, config.Validate())
+}
@@ -9,28 +9,80 @@
 package logic
 
 import (
+	"github.com/q191201771/lal/pkg/httpflv"
 	"github.com/q191201771/lal/pkg/rtmp"
+	"github.com/q191201771/naza/pkg/slicebytepool"
 )
 
+// 第一次使用时才切割，切割的结果放在内存池的内存块中
+// 注意，使用结束后需要调用 Release，之后 Get 以及 GetShared 返回的内存块不能再使用
 type LazyChunkDivider struct {
+	divider *rtmp.ChunkDivider
 	message []byte
 	header  *rtmp.Header
 
-	chunks []byte
+	chunks *slicebytepool.SharedSliceByte
 }
 
-func (lcd *LazyChunkDivider) Init(message []byte, header *rtmp.Header) {
+// @param divider 决定切割使用的 chunk size，需要和 rtmp server 的配置一致
+func (lcd *LazyChunkDivider) Init(divider *rtmp.ChunkDivider, message []byte, header *rtmp.Header) {
+	lcd.divider = divider
 	lcd.message = message
 	lcd.header = header
 }
 
 func (lcd *LazyChunkDivider) Get() []byte {
+	return lcd.GetShared().Core
+}
+
+// 调用方如果需要在 Release 之后继续持有，需要调用 Ref 增加引用计数
+func (lcd *LazyChunkDivider) GetShared() *slicebytepool.SharedSliceByte {
 	if lcd.chunks == nil {
-		lcd.chunks = rtmp.Message2Chunks(lcd.message, lcd.header)
+		lcd.chunks = lcd.divider.Message2ChunksShared(lcd.message, lcd.header)
 	}
 	return lcd.chunks
 }
 
+func (lcd *LazyChunkDivider) Release() {
+	if lcd.chunks != nil {
+		lcd.chunks.ReleaseIfNeeded()
+		lcd.chunks = nil
+	}
+}
+
+// 和 LazyChunkDivider 类似，第一次使用时才转换成 httpflv tag 格式
+type LazyRTMPMsg2FLVTag struct {
+	msg rtmp.AVMsg
+
+	tag *httpflv.Tag
+	raw *slicebytepool.SharedSliceByte
+}
+
+func (l *LazyRTMPMsg2FLVTag) Init(msg rtmp.AVMsg) {
+	l.msg = msg
+}
+
+func (l *LazyRTMPMsg2FLVTag) Get() *httpflv.Tag {
+	if l.tag == nil {
+		l.tag, l.raw = Trans.RTMPMsg2SharedFLVTag(l.msg)
+	}
+	return l.tag
+}
+
+// tag.Raw 所在的内存块
+func (l *LazyRTMPMsg2FLVTag) GetShared() *slicebytepool.SharedSliceByte {
+	l.Get()
+	return l.raw
+}
+
+func (l *LazyRTMPMsg2FLVTag) Release() {
+	if l.raw != nil {
+		l.raw.ReleaseIfNeeded()
+		l.tag = nil
+		l.raw = nil
+	}
+}
+
 type GOPCache struct {
 	num int
 
@@ -9,11 +9,15 @@
 package logic
 
 import (
+	"runtime/debug"
+	"sort"
 	"sync"
 
 	"github.com/q191201771/lal/pkg/httpflv"
 	"github.com/q191201771/lal/pkg/rtmp"
+	"github.com/q191201771/lal/pkg/timestamp"
 	log "github.com/q191201771/naza/pkg/nazalog"
+	"github.com/q191201771/naza/pkg/slicebytepool"
 	"github.com/q191201771/naza/pkg/unique"
 )
 
@@ -22,37 +26,86 @@ type Group struct {
 
 	appName    string
 	streamName string
+	config     *Config
 
 	exitChan chan struct{}
 
 	mutex                sync.Mutex
 	pubSession           *rtmp.ServerSession
 	pullSession          *rtmp.PullSession
-	rtmpSubSessionSet    map[*rtmp.ServerSession]struct{}
-	httpflvSubSessionSet map[*httpflv.SubSession]struct{}
-	// rtmp chunk格式
-	metadata        []byte
-	avcKeySeqHeader []byte
-	aacSeqHeader    []byte
-	// httpflv tag格式
+	rtmpSubSessionSet    map[*rtmp.ServerSession]*subscriber
+	httpflvSubSessionSet map[*httpflv.SubSession]*subscriber
 	// TODO chef: 如果没有开启httpflv监听，可以不做格式转换，节约CPU资源
-	metadataTag        *httpflv.Tag
-	avcKeySeqHeaderTag *httpflv.Tag
-	aacSeqHeaderTag    *httpflv.Tag
+	metadata *cachedMsg
+	// 结构化的 metadata，以及从 sps 中解析出的宽高
+	meta           *rtmp.Metadata
+	metadataHeader rtmp.Header
+	spsWidth       int
+	spsHeight      int
+	// 按轨道缓存的 seq header，key 为轨道 id，非 multitrack 的流只有轨道 0
+	videoSeqHeaders map[uint8]*cachedMsg // avc seq header 或者 Enhanced RTMP 的 SequenceStart
+	audioSeqHeaders map[uint8]*cachedMsg // aac seq header 或者 Enhanced RTMP 的 SequenceStart
+	// 没有开启时为 nil
+	// 推流端重新推流时不重置，使得还在拉流的 session 看到的时间戳是连续的
+	normalizer *timestamp.Normalizer
+	// 没有开启时为 nil
+	interleaver *Interleaver
+	// 切割一次发送给所有 rtmp 拉流 session，chunk size 和 rtmp server 的配置一致
+	chunkDivider *rtmp.ChunkDivider
+}
+
+// 缓存的 metadata 或者 seq header，内存块来自内存池，被替换或者清空时释放
+type cachedMsg struct {
+	chunks *slicebytepool.SharedSliceByte // rtmp chunk格式
+	tag    *httpflv.Tag                   // httpflv tag格式，Raw 指向 tagRaw
+	tagRaw *slicebytepool.SharedSliceByte
+}
+
+// 持有 <chunks> 以及 <tagRaw> 的一个引用
+func newCachedMsg(chunks *slicebytepool.SharedSliceByte, tag *httpflv.Tag, tagRaw *slicebytepool.SharedSliceByte) *cachedMsg {
+	return &cachedMsg{
+		chunks: chunks,
+		tag:    tag,
+		tagRaw: tagRaw,
+	}
+}
+
+func (c *cachedMsg) release() {
+	c.chunks.ReleaseIfNeeded()
+	c.tagRaw.ReleaseIfNeeded()
 }
 
 var _ rtmp.PubSessionObserver = &Group{}
 
-func NewGroup(appName string, streamName string) *Group {
+func NewGroup(appName string, streamName string, config *Config) *Group {
 	uk := unique.GenUniqueKey("GROUP")
 	log.Infof("lifecycle new group. [%s] appName=%s, streamName=%s", uk, appName, streamName)
+	var normalizer *timestamp.Normalizer
+	if config.Timestamp.Normalize {
+		normalizer = timestamp.NewNormalizer(func(option *timestamp.Option) {
+			*option = config.Timestamp.NormalizerOption()
+			option.OnCorrection = func(c timestamp.Correction) {
+				log.Warnf("correct timestamp. [%s] kind=%s, type=%d, in=%d, out=%d", uk, c.Kind, c.MsgTypeID, c.In, c.Out)
+			}
+		})
+	}
+	var interleaver *Interleaver
+	if config.Interleave.Enable {
+		interleaver = NewInterleaver(config.Interleave.MaxLatency())
+	}
 	return &Group{
 		UniqueKey:            uk,
 		appName:              appName,
 		streamName:           streamName,
+		config:               config,
 		exitChan:             make(chan struct{}, 1),
-		rtmpSubSessionSet:    make(map[*rtmp.ServerSession]struct{}),
-		httpflvSubSessionSet: make(map[*httpflv.SubSession]struct{}),
+		rtmpSubSessionSet:    make(map[*rtmp.ServerSession]*subscriber),
+		httpflvSubSessionSet: make(map[*httpflv.SubSession]*subscriber),
+		videoSeqHeaders:      make(map[uint8]*cachedMsg),
+		audioSeqHeaders:      make(map[uint8]*cachedMsg),
+		normalizer:           normalizer,
+		interleaver:          interleaver,
+		chunkDivider:         rtmp.NewChunkDivider(config.RTMP.ServerOption().ChunkSize),
 	}
 }
 
@@ -75,6 +128,7 @@ func (group *Group) Dispose() {
 	for session := range group.httpflvSubSessionSet {
 		session.Dispose()
 	}
+	group.clearCache()
 }
 
 func (group *Group) AddRTMPPubSession(session *rtmp.ServerSession) bool {
@@ -82,10 +136,16 @@ func (group *Group) AddRTMPPubSession(session *rtmp.ServerSession) bool {
 	group.mutex.Lock()
 	if group.pubSession != nil {
 		log.Errorf("PubSession already exist in group. [%s] old=%s, new=%s", group.UniqueKey, group.pubSession.UniqueKey, session.UniqueKey)
+		group.mutex.Unlock()
 		return false
 	}
 
 	group.pubSession = session
+	for sub := range group.rtmpSubSessionSet {
+		if sub.IsPlayStarted() {
+			_ = sub.WriteStreamBegin()
+		}
+	}
 	group.mutex.Unlock()
 	session.SetPubSessionObserver(group)
 	return true
@@ -95,20 +155,32 @@ func (group *Group) DelRTMPPubSession(session *rtmp.ServerSession) {
 	log.Debugf("del PubSession from group. [%s] [%s]", group.UniqueKey, session.UniqueKey)
 	group.mutex.Lock()
 	defer group.mutex.Unlock()
+	// 被拒绝的推流或者已经提前结束的推流
+	if group.pubSession != session {
+		return
+	}
 	group.pubSession = nil
-	group.metadata = nil
-	group.avcKeySeqHeader = nil
-	group.aacSeqHeader = nil
-	group.metadataTag = nil
-	group.avcKeySeqHeaderTag = nil
-	group.aacSeqHeaderTag = nil
+	// 缓存中还没有转发的数据
+	if group.interleaver != nil {
+		group.interleaver.Flush(group.onInterleavedMsg)
+		group.interleaver.Reset()
+	}
+	for sub := range group.rtmpSubSessionSet {
+		if sub.IsPlayStarted() {
+			_ = sub.WriteStreamEOF()
+		}
+	}
+	group.clearCache()
+	group.meta = nil
+	group.spsWidth = 0
+	group.spsHeight = 0
 }
 
 func (group *Group) AddRTMPSubSession(session *rtmp.ServerSession) {
 	log.Debugf("add SubSession into group. [%s] [%s]", group.UniqueKey, session.UniqueKey)
 	group.mutex.Lock()
 	defer group.mutex.Unlock()
-	group.rtmpSubSessionSet[session] = struct{}{}
+	group.rtmpSubSessionSet[session] = newSubscriber(session.RawQuery)
 
 	// TODO chef: 多长没有拉流session存在的功能
 	//group.turnToEmptyTick = 0
@@ -128,7 +200,7 @@ func (group *Group) AddHTTPFLVSubSession(session *httpflv.SubSession) {
 
 	group.mutex.Lock()
 	defer group.mutex.Unlock()
-	group.httpflvSubSessionSet[session] = struct{}{}
+	group.httpflvSubSessionSet[session] = newSubscriber(session.RawQuery)
 }
 
 func (group *Group) DelHTTPFLVSubSession(session *httpflv.SubSession) {
@@ -144,6 +216,16 @@ func (group *Group) IsTotalEmpty() bool {
 	return group.pubSession == nil && len(group.rtmpSubSessionSet) == 0 && len(group.httpflvSubSessionSet) == 0
 }
 
+// 时间戳修正的统计，没有开启 Timestamp.Normalize 时返回 false
+func (group *Group) TimestampStats() (timestamp.Stats, bool) {
+	group.mutex.Lock()
+	defer group.mutex.Unlock()
+	if group.normalizer == nil {
+		return timestamp.Stats{}, false
+	}
+	return group.normalizer.Stats(), true
+}
+
 func (group *Group) IsInExist() bool {
 	group.mutex.Lock()
 	defer group.mutex.Unlock()
@@ -154,136 +236,199 @@ func (group *Group) IsInExist() bool {
 func (group *Group) OnReadRTMPAVMsg(msg rtmp.AVMsg) {
 	group.mutex.Lock()
 	defer group.mutex.Unlock()
+	// 处理异常数据时发生 panic，只断开推流的 session，不影响其他 group
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("recover from panic. [%s] err=%v, %s\n%s", group.UniqueKey, r, msg.DebugString(), debug.Stack())
+			if group.pubSession != nil {
+				group.pubSession.Dispose()
+			}
+		}
+	}()
+
+	if group.normalizer != nil {
+		msg.Header.TimestampAbs = group.normalizer.Normalize(msg.Header.MsgTypeID, msg.Header.TimestampAbs)
+	}
+	if group.interleaver != nil {
+		group.interleaver.Push(msg, group.onInterleavedMsg)
+		return
+	}
+	group.onInterleavedMsg(msg)
+}
 
-	group.broadcastRTMP(msg)
+// 注意，调用方需要持有 group.mutex
+func (group *Group) onInterleavedMsg(msg rtmp.AVMsg) {
+	// 包含多个轨道的 multitrack 消息，拆分成单个轨道后再处理，便于按轨道缓存以及过滤
+	msgs, err := rtmp.SplitMultitrack(msg)
+	if err != nil {
+		log.Warnf("split multitrack msg failed. [%s] err=%+v", group.UniqueKey, err)
+		msgs = []rtmp.AVMsg{msg}
+	}
+	for _, m := range msgs {
+		group.broadcastRTMP(m)
+	}
 }
 
 func (group *Group) broadcastRTMP(msg rtmp.AVMsg) {
 	//log.Infof("%+v", header)
 
+	// 在广播之前处理，保证新的 sub session 拿到的是更新后的 metadata
+	switch msg.Header.MsgTypeID {
+	case rtmp.TypeidDataMessageAMF0:
+		msg = group.onMetadata(msg)
+	case rtmp.TypeidVideo:
+		if msg.IsAVCKeySeqHeader() {
+			group.onAVCSeqHeader(msg)
+		}
+	}
+
+	// 切割后的 chunk 以及转换后的 tag 被所有拉流 session 共享，各自发送完成后释放
 	var (
-		currTag *httpflv.Tag
-		lcd     LazyChunkDivider
+		lcd LazyChunkDivider
+		lft LazyRTMPMsg2FLVTag
 	)
+	defer lcd.Release()
+	defer lft.Release()
 
 	// # 1. 设置好用于发送的 rtmp 头部信息
 	currHeader := Trans.MakeDefaultRTMPHeader(msg.Header)
 	// TODO 这行代码是否放到 MakeDefaultRTMPHeader 中
 	currHeader.MsgLen = uint32(len(msg.Payload))
-	lcd.Init(msg.Payload, &currHeader)
+	lcd.Init(group.chunkDivider, msg.Payload, &currHeader)
+	lft.Init(msg)
 
 	// # 2. 广播。遍历所有 rtmp sub session，决定是否转发
-	for session := range group.rtmpSubSessionSet {
+	for session, sub := range group.rtmpSubSessionSet {
+		// 还没有回复 play 信令的结果
+		if !session.IsPlayStarted() {
+			continue
+		}
+
 		// ## 2.1. 如果是新的 sub session，发送已缓存的信息
 		if session.IsFresh {
 			// 发送缓存的头部信息
 			if group.metadata != nil {
-				_ = session.AsyncWrite(group.metadata)
+				_ = writeRTMPChunks(session, group.metadata.chunks)
 			}
-			if group.avcKeySeqHeader != nil {
-				_ = session.AsyncWrite(group.avcKeySeqHeader)
+			for _, trackID := range sortedTrackIDs(group.videoSeqHeaders) {
+				if sub.isTrackSelected(rtmp.TypeidVideo, trackID) {
+					_ = writeRTMPChunks(session, group.videoSeqHeaders[trackID].chunks)
+				}
 			}
-			if group.aacSeqHeader != nil {
-				_ = session.AsyncWrite(group.aacSeqHeader)
+			for _, trackID := range sortedTrackIDs(group.audioSeqHeaders) {
+				if sub.isTrackSelected(rtmp.TypeidAudio, trackID) {
+					_ = writeRTMPChunks(session, group.audioSeqHeaders[trackID].chunks)
+				}
 			}
 			session.IsFresh = false
 		}
 
-		// ## 2.2. 判断当前包的类型，以及sub session的状态，决定是否发送，并更新sub session的状态
-		switch msg.Header.MsgTypeID {
-		case rtmp.TypeidDataMessageAMF0:
-			_ = session.AsyncWrite(lcd.Get())
-		case rtmp.TypeidAudio:
-			_ = session.AsyncWrite(lcd.Get())
-		case rtmp.TypeidVideo:
-			if session.WaitKeyNalu {
-				if msg.Payload[0] == 0x17 && msg.Payload[1] == 0x0 {
-					_ = session.AsyncWrite(lcd.Get())
-				}
-				if msg.Payload[0] == 0x17 && msg.Payload[1] == 0x1 {
-					_ = session.AsyncWrite(lcd.Get())
-					session.WaitKeyNalu = false
-				}
-			} else {
-				_ = session.AsyncWrite(lcd.Get())
+		// ## 2.2. 判断当前包的类型、所属轨道，以及sub session的状态，决定是否发送，并更新sub session的状态
+		// 暂停或者关闭视频后再恢复时，需要重新等待关键帧
+		if !session.IsReceiving(msg.Header.MsgTypeID) {
+			if msg.Header.MsgTypeID == rtmp.TypeidVideo {
+				sub.resetKeyNalu()
 			}
-
+		} else if sub.shouldForward(msg) {
+			_ = writeRTMPChunks(session, lcd.GetShared())
 		}
+		session.WaitKeyNalu = sub.waitKeyNalu()
 	}
 
 	// # 3. 广播。遍历所有 httpflv sub session，决定是否转发
-	for session := range group.httpflvSubSessionSet {
-		// ## 3.1. 将当前 message 转换成 tag 格式
-		if currTag == nil {
-			currTag = Trans.RTMPMsg2FLVTag(msg)
-		}
-
-		// ## 3.2. 如果是新的sub session，发送已缓存的信息
+	for session, sub := range group.httpflvSubSessionSet {
+		// ## 3.1. 如果是新的sub session，发送已缓存的信息
 		if session.IsFresh {
 			// 发送缓存的头部信息
-			if group.metadataTag != nil {
+			if group.metadata != nil {
 				log.Debugf("send cache metadata. [%s]", session.UniqueKey)
-				session.WriteTag(group.metadataTag)
+				session.WriteShared(group.metadata.tagRaw)
 			}
-			if group.avcKeySeqHeaderTag != nil {
-				session.WriteTag(group.avcKeySeqHeaderTag)
+			for _, trackID := range sortedTrackIDs(group.videoSeqHeaders) {
+				if sub.isTrackSelected(rtmp.TypeidVideo, trackID) {
+					session.WriteShared(group.videoSeqHeaders[trackID].tagRaw)
+				}
 			}
-			if group.aacSeqHeaderTag != nil {
-				session.WriteTag(group.aacSeqHeaderTag)
+			for _, trackID := range sortedTrackIDs(group.audioSeqHeaders) {
+				if sub.isTrackSelected(rtmp.TypeidAudio, trackID) {
+					session.WriteShared(group.audioSeqHeaders[trackID].tagRaw)
+				}
 			}
 			session.IsFresh = false
 		}
 
-		// ## 3.3. 判断当前包的类型，以及sub session的状态，决定是否发送，并更新sub session的状态
-		switch msg.Header.MsgTypeID {
-		case rtmp.TypeidDataMessageAMF0:
-			session.WriteTag(currTag)
-		case rtmp.TypeidAudio:
-			session.WriteTag(currTag)
-		case rtmp.TypeidVideo:
-			if session.WaitKeyNalu {
-				if msg.Payload[0] == 0x17 && msg.Payload[1] == 0x0 {
-					session.WriteTag(currTag)
-				}
-				if msg.Payload[0] == 0x17 && msg.Payload[1] == 0x1 {
-					session.WriteTag(currTag)
-					session.WaitKeyNalu = false
-				}
-			} else {
-				session.WriteTag(currTag)
-			}
-
+		// ## 3.2. 判断当前包的类型、所属轨道，以及sub session的状态，决定是否发送，并更新sub session的状态
+		if sub.shouldForward(msg) {
+			session.WriteShared(lft.GetShared())
 		}
+		session.WaitKeyNalu = sub.waitKeyNalu()
 	}
 
-	// # 4. 缓存 rtmp 以及 httpflv 的 metadata 和 avc key seq header 和 aac seq header
+	// # 4. 缓存 rtmp 以及 httpflv 的 metadata 和各轨道的 video seq header 和 audio seq header
 	// 由于可能没有订阅者，所以可能需要重新打包
 	switch msg.Header.MsgTypeID {
 	case rtmp.TypeidDataMessageAMF0:
-		if currTag == nil {
-			currTag = Trans.RTMPMsg2FLVTag(msg)
-		}
-		group.metadata = lcd.Get()
-		group.metadataTag = currTag
-		log.Debugf("cache metadata. [%s] rtmp size:%d, flv size:%d", group.UniqueKey, len(group.metadata), group.metadataTag.Header.DataSize)
+		group.setMetadata(newCachedMsg(lcd.GetShared().Ref(), lft.Get(), lft.GetShared().Ref()))
+		log.Debugf("cache metadata. [%s] rtmp size:%d, flv size:%d", group.UniqueKey, len(lcd.Get()), lft.Get().Header.DataSize)
 	case rtmp.TypeidVideo:
-		// TODO chef: magic number
-		if msg.Payload[0] == 0x17 && msg.Payload[1] == 0x0 {
-			if currTag == nil {
-				currTag = Trans.RTMPMsg2FLVTag(msg)
-			}
-			group.avcKeySeqHeader = lcd.Get()
-			group.avcKeySeqHeaderTag = currTag
-			log.Debugf("cache avc key seq header. [%s] rtmp size:%d, flv size:%d", group.UniqueKey, len(group.avcKeySeqHeader), group.avcKeySeqHeaderTag.Header.DataSize)
+		if msg.IsVideoKeySeqHeader() {
+			setCachedMsg(group.videoSeqHeaders, msg.TrackID(), newCachedMsg(lcd.GetShared().Ref(), lft.Get(), lft.GetShared().Ref()))
+			log.Debugf("cache video seq header. [%s] track=%d, enhanced=%t, rtmp size:%d, flv size:%d",
+				group.UniqueKey, msg.TrackID(), msg.IsEnhancedVideo(), len(lcd.Get()), lft.Get().Header.DataSize)
 		}
 	case rtmp.TypeidAudio:
-		if (msg.Payload[0]>>4) == 0x0a && msg.Payload[1] == 0x0 {
-			if currTag == nil {
-				currTag = Trans.RTMPMsg2FLVTag(msg)
-			}
-			group.aacSeqHeader = lcd.Get()
-			group.aacSeqHeaderTag = currTag
-			log.Debugf("cache aac seq header. [%s] rtmp size:%d, flv size:%d", group.UniqueKey, len(group.aacSeqHeader), group.aacSeqHeaderTag.Header.DataSize)
+		if msg.IsAudioSeqHeader() {
+			setCachedMsg(group.audioSeqHeaders, msg.TrackID(), newCachedMsg(lcd.GetShared().Ref(), lft.Get(), lft.GetShared().Ref()))
+			log.Debugf("cache audio seq header. [%s] track=%d, enhanced=%t, rtmp size:%d, flv size:%d",
+				group.UniqueKey, msg.TrackID(), msg.IsEnhancedAudio(), len(lcd.Get()), lft.Get().Header.DataSize)
 		}
 	}
 }
+
+func (group *Group) setMetadata(c *cachedMsg) {
+	if group.metadata != nil {
+		group.metadata.release()
+	}
+	group.metadata = c
+}
+
+func setCachedMsg(m map[uint8]*cachedMsg, trackID uint8, c *cachedMsg) {
+	if old, ok := m[trackID]; ok {
+		old.release()
+	}
+	m[trackID] = c
+}
+
+// 释放缓存的 metadata 以及 seq header
+func (group *Group) clearCache() {
+	group.setMetadata(nil)
+	for _, c := range group.videoSeqHeaders {
+		c.release()
+	}
+	for _, c := range group.audioSeqHeaders {
+		c.release()
+	}
+	group.videoSeqHeaders = make(map[uint8]*cachedMsg)
+	group.audioSeqHeaders = make(map[uint8]*cachedMsg)
+}
+
+// <chunks> 中的 message stream id 为 MSID1
+// 同一个连接上有多个 NetStream 时，拉流 session 可能使用其他的 message stream id，此时需要修改后再发送
+func writeRTMPChunks(session *rtmp.ServerSession, chunks *slicebytepool.SharedSliceByte) error {
+	if session.StreamID() != rtmp.MSID1 {
+		return session.AsyncWrite(rtmp.ModChunksMsgStreamID(chunks.Core, session.StreamID()))
+	}
+	return session.AsyncWriteShared(chunks)
+}
+
+// 按轨道 id 从小到大排序，保证缓存的 seq header 的发送顺序是固定的
+func sortedTrackIDs(m map[uint8]*cachedMsg) []uint8 {
+	ids := make([]uint8, 0, len(m))
+	for id := range m {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	return ids
+}
@@ -0,0 +1,288 @@
+// Copyright 2019, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package logic
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/q191201771/lal/pkg/httpflv"
+	"github.com/q191201771/lal/pkg/rtmp"
+	"github.com/q191201771/naza/pkg/assert"
+	"github.com/q191201771/naza/pkg/bele"
+)
+
+func TestGroup_NormalizeTimestamp(t *testing.T) {
+	seqMsg := func(ts uint32) rtmp.AVMsg {
+		msg := rtmp.AVMsg{Payload: []byte{0xaf, 0x0, 0x12, 0x10}}
+		msg.Header.MsgTypeID = rtmp.TypeidAudio
+		msg.Header.MsgLen = uint32(len(msg.Payload))
+		msg.Header.TimestampAbs = ts
+		return msg
+	}
+
+	// 默认不开启
+	group := NewGroup("live", "test", &Config{})
+	group.OnReadRTMPAVMsg(seqMsg(1000))
+	group.OnReadRTMPAVMsg(seqMsg(500))
+	assert.Equal(t, uint32(500), group.audioSeqHeaders[0].tag.Header.Timestamp)
+	_, ok := group.TimestampStats()
+	assert.Equal(t, false, ok)
+
+	group = NewGroup("live", "test", &Config{Timestamp: Timestamp{Normalize: true, JumpThresholdMS: 5000}})
+	group.OnReadRTMPAVMsg(seqMsg(1000))
+	group.OnReadRTMPAVMsg(seqMsg(500))
+	assert.Equal(t, uint32(1000), group.audioSeqHeaders[0].tag.Header.Timestamp)
+	group.OnReadRTMPAVMsg(seqMsg(100000))
+	assert.Equal(t, uint32(1000), group.audioSeqHeaders[0].tag.Header.Timestamp)
+	stats, ok := group.TimestampStats()
+	assert.Equal(t, true, ok)
+	assert.Equal(t, uint64(3), stats.Total)
+	assert.Equal(t, uint64(1), stats.Backward)
+	assert.Equal(t, uint64(1), stats.Jump)
+}
+
+// 广播给 rtmp 拉流的 chunk 使用配置中的 chunk size 切割
+func TestGroup_ChunkSize(t *testing.T) {
+	msg := rtmp.AVMsg{Payload: make([]byte, 300)}
+	msg.Payload[0] = 0xaf
+	msg.Header.MsgTypeID = rtmp.TypeidAudio
+	msg.Header.MsgLen = uint32(len(msg.Payload))
+
+	// fmt0 的 chunk header 12 字节，之后每个 fmt3 的 chunk header 1 字节
+	group := NewGroup("live", "test", &Config{})
+	group.OnReadRTMPAVMsg(msg)
+	assert.Equal(t, 12+300, len(group.audioSeqHeaders[0].chunks.Core))
+
+	group = NewGroup("live", "test", &Config{RTMP: RTMP{ChunkSize: 128}})
+	group.OnReadRTMPAVMsg(msg)
+	assert.Equal(t, 12+300+2, len(group.audioSeqHeaders[0].chunks.Core))
+}
+
+// 一个推流，多个 httpflv 拉流，每个 message 只转换一次格式，内存块被所有拉流共享
+func BenchmarkGroup_Broadcast(b *testing.B) {
+	group := NewGroup("live", "test", &Config{})
+	for i := 0; i < 100; i++ {
+		cc, sc := net.Pipe()
+		go func() {
+			_, _ = io.Copy(ioutil.Discard, cc)
+		}()
+		session := httpflv.NewSubSession(sc)
+		group.AddHTTPFLVSubSession(session)
+		defer session.Dispose()
+	}
+
+	key := rtmp.AVMsg{Payload: make([]byte, 20000)}
+	key.Payload[0], key.Payload[1] = 0x17, 0x1
+	key.Header.MsgTypeID = rtmp.TypeidVideo
+	key.Header.MsgLen = uint32(len(key.Payload))
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		key.Header.TimestampAbs = uint32(i * 40)
+		group.OnReadRTMPAVMsg(key)
+	}
+}
+
+// 广播时发生 panic，只断开推流的 session，group 依然可以使用
+func TestGroup_RecoverBroadcast(t *testing.T) {
+	group := NewGroup("live", "test", &Config{})
+	cc, sc := net.Pipe()
+	pub := rtmp.NewServerSession(nil, sc)
+	assert.Equal(t, true, group.AddRTMPPubSession(pub))
+	// 没有初始化的 session，写入时 panic
+	group.httpflvSubSessionSet[&httpflv.SubSession{}] = newSubscriber("")
+
+	key := rtmp.AVMsg{Payload: []byte{0x17, 0x1, 0x0, 0x0, 0x0}}
+	key.Header.MsgTypeID = rtmp.TypeidVideo
+	key.Header.MsgLen = uint32(len(key.Payload))
+	group.OnReadRTMPAVMsg(key)
+
+	_, err := cc.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	group.DelRTMPPubSession(pub)
+	assert.Equal(t, false, group.IsInExist())
+}
+
+// httpflv 拉流端，记录收到的每个 tag 的数据
+type testFLVSub struct {
+	session *httpflv.SubSession
+
+	mutex    sync.Mutex
+	payloads [][]byte
+}
+
+func addTestFLVSub(group *Group, rawQuery string) *testFLVSub {
+	cc, sc := net.Pipe()
+	sub := &testFLVSub{session: httpflv.NewSubSession(sc)}
+	sub.session.RawQuery = rawQuery
+	go sub.readLoop(cc)
+	group.AddHTTPFLVSubSession(sub.session)
+	return sub
+}
+
+func (sub *testFLVSub) readLoop(conn net.Conn) {
+	br := bufio.NewReader(conn)
+	// http 响应头以空行结束
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return
+		}
+		if line == "\r\n" {
+			break
+		}
+	}
+	if _, err := io.ReadFull(br, make([]byte, len(httpflv.FLVHeader))); err != nil {
+		return
+	}
+	for {
+		header := make([]byte, httpflv.TagHeaderSize)
+		if _, err := io.ReadFull(br, header); err != nil {
+			return
+		}
+		// tag 数据以及 prev tag size
+		body := make([]byte, bele.BEUint24(header[1:])+4)
+		if _, err := io.ReadFull(br, body); err != nil {
+			return
+		}
+		sub.mutex.Lock()
+		sub.payloads = append(sub.payloads, body[:len(body)-4])
+		sub.mutex.Unlock()
+	}
+}
+
+// 等待收到 <n> 个 tag，之后再稍等一下，确认没有多收到
+func (sub *testFLVSub) waitPayloads(n int) [][]byte {
+	for i := 0; i < 100; i++ {
+		sub.mutex.Lock()
+		num := len(sub.payloads)
+		sub.mutex.Unlock()
+		if num >= n {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	sub.mutex.Lock()
+	defer sub.mutex.Unlock()
+	return append([][]byte(nil), sub.payloads...)
+}
+
+// 测试中用 tag 数据的最后一个字节标识不同的 message
+func (sub *testFLVSub) waitIDs(n int) []byte {
+	var ids []byte
+	for _, payload := range sub.waitPayloads(n) {
+		ids = append(ids, payload[len(payload)-1])
+	}
+	return ids
+}
+
+// Enhanced RTMP multitrack OneTrack 格式的视频，<id> 放在最后一个字节
+func multitrackVideoMsg(frameType uint8, packetType uint8, trackID uint8, id byte) rtmp.AVMsg {
+	msg := rtmp.AVMsg{Payload: []byte{0x80 | frameType<<4 | httpflv.ExVideoPacketTypeMultitrack,
+		rtmp.AVMultitrackTypeOneTrack<<4 | packetType, 'a', 'v', '0', '1', trackID, id}}
+	msg.Header.MsgTypeID = rtmp.TypeidVideo
+	msg.Header.MsgLen = uint32(len(msg.Payload))
+	return msg
+}
+
+func multitrackAudioMsg(packetType uint8, trackID uint8, id byte) rtmp.AVMsg {
+	msg := rtmp.AVMsg{Payload: []byte{httpflv.SoundFormatExHeader<<4 | httpflv.ExAudioPacketTypeMultitrack,
+		rtmp.AVMultitrackTypeOneTrack<<4 | packetType, 'O', 'p', 'u', 's', trackID, id}}
+	msg.Header.MsgTypeID = rtmp.TypeidAudio
+	msg.Header.MsgLen = uint32(len(msg.Payload))
+	return msg
+}
+
+// 按 url 参数选择轨道，新的拉流端收到缓存的各轨道的 seq header，每个视频轨道从关键帧开始转发
+func TestGroup_Multitrack(t *testing.T) {
+	const (
+		key   = uint8(1)
+		inter = uint8(2)
+	)
+	group := NewGroup("live", "test", &Config{})
+
+	// 还没有拉流端时，只缓存各轨道的 seq header
+	group.OnReadRTMPAVMsg(multitrackVideoMsg(key, httpflv.ExVideoPacketTypeSequenceStart, 0, 'v'))
+	group.OnReadRTMPAVMsg(multitrackVideoMsg(key, httpflv.ExVideoPacketTypeSequenceStart, 1, 'V'))
+	group.OnReadRTMPAVMsg(multitrackAudioMsg(httpflv.ExAudioPacketTypeSequenceStart, 0, 'a'))
+	group.OnReadRTMPAVMsg(multitrackAudioMsg(httpflv.ExAudioPacketTypeSequenceStart, 1, 'A'))
+
+	all := addTestFLVSub(group, "")
+	track1 := addTestFLVSub(group, "video_track=1&audio_track=0")
+	defer all.session.Dispose()
+	defer track1.session.Dispose()
+
+	group.OnReadRTMPAVMsg(multitrackVideoMsg(inter, httpflv.ExVideoPacketTypeCodedFrames, 1, '1'))
+	group.OnReadRTMPAVMsg(multitrackVideoMsg(key, httpflv.ExVideoPacketTypeCodedFrames, 0, '2'))
+	group.OnReadRTMPAVMsg(multitrackVideoMsg(key, httpflv.ExVideoPacketTypeCodedFrames, 1, '3'))
+	group.OnReadRTMPAVMsg(multitrackVideoMsg(inter, httpflv.ExVideoPacketTypeCodedFrames, 1, '4'))
+	group.OnReadRTMPAVMsg(multitrackAudioMsg(httpflv.ExAudioPacketTypeCodedFrames, 0, '5'))
+	group.OnReadRTMPAVMsg(multitrackAudioMsg(httpflv.ExAudioPacketTypeCodedFrames, 1, '6'))
+
+	// 轨道1在关键帧之前的数据被丢弃
+	assert.Equal(t, "vVaA23456", string(all.waitIDs(9)))
+	assert.Equal(t, "Va345", string(track1.waitIDs(5)))
+
+	// 后加入的拉流端，只选择了视频轨道0，等待轨道0的关键帧
+	late := addTestFLVSub(group, "video_track=0")
+	defer late.session.Dispose()
+	group.OnReadRTMPAVMsg(multitrackVideoMsg(inter, httpflv.ExVideoPacketTypeCodedFrames, 0, '7'))
+	group.OnReadRTMPAVMsg(multitrackVideoMsg(key, httpflv.ExVideoPacketTypeCodedFrames, 1, '8'))
+	group.OnReadRTMPAVMsg(multitrackVideoMsg(key, httpflv.ExVideoPacketTypeCodedFrames, 0, '9'))
+	assert.Equal(t, "vaA9", string(late.waitIDs(4)))
+}
+
+// Enhanced RTMP 格式的视频，<id> 放在最后一个字节
+func enhancedVideoMsg(frameType uint8, packetType uint8, fourCC uint32, id byte) rtmp.AVMsg {
+	msg := rtmp.AVMsg{Payload: make([]byte, 6)}
+	msg.Payload[0] = 0x80 | frameType<<4 | packetType
+	bele.BEPutUint32(msg.Payload[1:], fourCC)
+	msg.Payload[5] = id
+	msg.Header.MsgTypeID = rtmp.TypeidVideo
+	msg.Header.MsgLen = uint32(len(msg.Payload))
+	return msg
+}
+
+// AV1 以及 VP9 的 SequenceStart 被缓存，新的拉流端先收到缓存的 SequenceStart，之后从关键帧开始转发
+func TestGroup_EnhancedVideo(t *testing.T) {
+	const (
+		key   = uint8(1)
+		inter = uint8(2)
+	)
+	for _, fourCC := range []uint32{httpflv.FourCCAV1, httpflv.FourCCVP9} {
+		group := NewGroup("live", "test", &Config{})
+		group.OnReadRTMPAVMsg(enhancedVideoMsg(key, httpflv.ExVideoPacketTypeSequenceStart, fourCC, 's'))
+		tag := group.videoSeqHeaders[0].tag
+		assert.Equal(t, true, tag.IsVideoKeySeqHeader())
+		assert.Equal(t, fourCC, tag.VideoFourCC())
+
+		sub := addTestFLVSub(group, "")
+		group.OnReadRTMPAVMsg(enhancedVideoMsg(inter, httpflv.ExVideoPacketTypeCodedFrames, fourCC, '1'))
+		group.OnReadRTMPAVMsg(enhancedVideoMsg(key, httpflv.ExVideoPacketTypeCodedFramesX, fourCC, '2'))
+		group.OnReadRTMPAVMsg(enhancedVideoMsg(inter, httpflv.ExVideoPacketTypeCodedFrames, fourCC, '3'))
+		assert.Equal(t, "s23", string(sub.waitIDs(3)))
+
+		// 推流端更新 SequenceStart 后，新的拉流端收到的是更新后的
+		group.OnReadRTMPAVMsg(enhancedVideoMsg(key, httpflv.ExVideoPacketTypeSequenceStart, fourCC, 'S'))
+		late := addTestFLVSub(group, "")
+		group.OnReadRTMPAVMsg(enhancedVideoMsg(inter, httpflv.ExVideoPacketTypeCodedFrames, fourCC, '4'))
+		group.OnReadRTMPAVMsg(enhancedVideoMsg(key, httpflv.ExVideoPacketTypeCodedFrames, fourCC, '5'))
+		assert.Equal(t, "S5", string(late.waitIDs(2)))
+		assert.Equal(t, "s23S45", string(sub.waitIDs(6)))
+		sub.session.Dispose()
+		late.session.Dispose()
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2019, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package logic
+
+import (
+	"github.com/q191201771/lal/pkg/bufpool"
+	"github.com/q191201771/lal/pkg/rtmp"
+)
+
+// 有些推流端的音频会领先视频很多（或者相反），按接收顺序转发时，flv.js 等播放器以及录制会出现卡顿
+// Interleaver 缓存一小段数据，按照时间戳从小到大的顺序，交错输出音频和视频
+//
+// 某个轨道在缓存中等待另一个轨道的时长（按时间戳计算）超过 maxLatencyMS 时，不再等待，直接输出
+// 另一个轨道从未出现过时（比如纯音频的流），直接输出
+//
+// 注意，非协程安全，由调用方保证
+type Interleaver struct {
+	maxLatencyMS uint32
+
+	audio     []rtmp.AVMsg
+	video     []rtmp.AVMsg
+	audioSeen bool
+	videoSeen bool
+}
+
+type OnInterleavedMsg func(msg rtmp.AVMsg)
+
+// 没有配置 Interleave.MaxLatencyMS 时使用
+const DefaultInterleaveMaxLatencyMS = 500
+
+func NewInterleaver(maxLatencyMS uint32) *Interleaver {
+	return &Interleaver{
+		maxLatencyMS: maxLatencyMS,
+	}
+}
+
+// @param onMsg 按顺序回调可以输出的 message，可能回调0次或多次
+// 注意，回调结束后 <msg> 的内存块可能被复用，如果需要在回调之外使用，需要自行拷贝
+func (i *Interleaver) Push(msg rtmp.AVMsg, onMsg OnInterleavedMsg) {
+	switch msg.Header.MsgTypeID {
+	case rtmp.TypeidAudio:
+		i.audioSeen = true
+		if len(i.audio) == 0 && !i.videoSeen {
+			onMsg(msg)
+			return
+		}
+		i.audio = append(i.audio, clone(msg))
+	case rtmp.TypeidVideo:
+		i.videoSeen = true
+		if len(i.video) == 0 && !i.audioSeen {
+			onMsg(msg)
+			return
+		}
+		i.video = append(i.video, clone(msg))
+	default:
+		// metadata 等其他类型，先把缓存的音视频都输出，保证相对顺序不变
+		i.Flush(onMsg)
+		onMsg(msg)
+		return
+	}
+	i.drain(onMsg)
+}
+
+// 按顺序输出所有缓存的数据，比如推流结束时
+func (i *Interleaver) Flush(onMsg OnInterleavedMsg) {
+	i.drain(onMsg)
+	for len(i.audio) != 0 || len(i.video) != 0 {
+		i.popEarlier(onMsg)
+	}
+}
+
+// 重新开始，缓存的数据被丢弃，比如推流端重新推流
+func (i *Interleaver) Reset() {
+	for _, msg := range i.audio {
+		bufpool.Put(msg.Payload)
+	}
+	for _, msg := range i.video {
+		bufpool.Put(msg.Payload)
+	}
+	i.audio = nil
+	i.video = nil
+	i.audioSeen = false
+	i.videoSeen = false
+}
+
+func (i *Interleaver) drain(onMsg OnInterleavedMsg) {
+	for {
+		switch {
+		case len(i.audio) != 0 && len(i.video) != 0:
+			i.popEarlier(onMsg)
+		case len(i.audio) != 0 && i.shouldPop(i.audio, i.videoSeen):
+			i.audio = pop(i.audio, onMsg)
+		case len(i.video) != 0 && i.shouldPop(i.video, i.audioSeen):
+			i.video = pop(i.video, onMsg)
+		default:
+			return
+		}
+	}
+}
+
+// 另一个轨道没有缓存数据时，是否继续等待
+func (i *Interleaver) shouldPop(q []rtmp.AVMsg, otherSeen bool) bool {
+	if !otherSeen {
+		return true
+	}
+	waited := int32(q[len(q)-1].Header.TimestampAbs - q[0].Header.TimestampAbs)
+	return waited > int32(i.maxLatencyMS)
+}
+
+// 两个轨道中时间戳较小的先输出，相等时视频先输出
+func (i *Interleaver) popEarlier(onMsg OnInterleavedMsg) {
+	switch {
+	case len(i.audio) == 0:
+		i.video = pop(i.video, onMsg)
+	case len(i.video) == 0:
+		i.audio = pop(i.audio, onMsg)
+	case int32(i.audio[0].Header.TimestampAbs-i.video[0].Header.TimestampAbs) < 0:
+		i.audio = pop(i.audio, onMsg)
+	default:
+		i.video = pop(i.video, onMsg)
+	}
+}
+
+func pop(q []rtmp.AVMsg, onMsg OnInterleavedMsg) []rtmp.AVMsg {
+	onMsg(q[0])
+	bufpool.Put(q[0].Payload)
+	q[0] = rtmp.AVMsg{}
+	return q[1:]
+}
+
+// 缓存的 message 的内存块从内存池中获取，输出后归还
+func clone(msg rtmp.AVMsg) rtmp.AVMsg {
+	payload := bufpool.Get(len(msg.Payload))
+	copy(payload, msg.Payload)
+	msg.Payload = payload
+	return msg
+}
@@ -0,0 +1,97 @@
+// Copyright 2019, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package logic
+
+import (
+	"testing"
+
+	"github.com/q191201771/lal/pkg/rtmp"
+	"github.com/q191201771/naza/pkg/assert"
+)
+
+func newTestMsg(typeid uint8, ts uint32) rtmp.AVMsg {
+	msg := rtmp.AVMsg{Payload: []byte{byte(ts)}}
+	msg.Header.MsgTypeID = typeid
+	msg.Header.MsgLen = 1
+	msg.Header.TimestampAbs = ts
+	return msg
+}
+
+type interleaveResult struct {
+	out []rtmp.AVMsg
+}
+
+func (r *interleaveResult) onMsg(msg rtmp.AVMsg) {
+	// 回调结束后内存块会被复用
+	msg.Payload = append([]byte(nil), msg.Payload...)
+	r.out = append(r.out, msg)
+}
+
+func (r *interleaveResult) types() (ret []uint8) {
+	for _, msg := range r.out {
+		ret = append(ret, msg.Header.MsgTypeID)
+	}
+	return
+}
+
+func (r *interleaveResult) timestamps() (ret []uint32) {
+	for _, msg := range r.out {
+		ret = append(ret, msg.Header.TimestampAbs)
+	}
+	return
+}
+
+func TestInterleaver(t *testing.T) {
+	a, v := rtmp.TypeidAudio, rtmp.TypeidVideo
+	var r interleaveResult
+	i := NewInterleaver(500)
+
+	// 只有音频时直接输出
+	i.Push(newTestMsg(a, 0), r.onMsg)
+	assert.Equal(t, 1, len(r.out))
+
+	// 音频领先视频
+	i.Push(newTestMsg(v, 0), r.onMsg)
+	i.Push(newTestMsg(a, 23), r.onMsg)
+	i.Push(newTestMsg(a, 46), r.onMsg)
+	i.Push(newTestMsg(a, 69), r.onMsg)
+	i.Push(newTestMsg(v, 40), r.onMsg)
+	assert.Equal(t, []uint32{0, 0, 23, 40}, r.timestamps())
+	assert.Equal(t, []uint8{a, v, a, v}, r.types())
+
+	// 内存块被拷贝，调用方可以复用
+	msg := newTestMsg(a, 92)
+	i.Push(msg, r.onMsg)
+	msg.Payload[0] = 0
+	i.Push(newTestMsg(v, 80), r.onMsg)
+	i.Push(newTestMsg(v, 120), r.onMsg)
+	assert.Equal(t, []uint32{0, 0, 23, 40, 46, 69, 80, 92}, r.timestamps())
+	assert.Equal(t, []byte{92}, r.out[7].Payload)
+
+	// 视频断流，音频等待超过 500ms 后输出
+	for ts := uint32(115); ts <= 115+23*24; ts += 23 {
+		i.Push(newTestMsg(a, ts), r.onMsg)
+	}
+	assert.Equal(t, uint32(120), r.out[9].Header.TimestampAbs)
+	assert.Equal(t, 12, len(r.out))
+
+	// metadata 之前把缓存的都输出
+	r.out = nil
+	i.Push(newTestMsg(rtmp.TypeidDataMessageAMF0, 0), r.onMsg)
+	assert.Equal(t, 23, len(r.out))
+	assert.Equal(t, rtmp.TypeidDataMessageAMF0, r.out[22].Header.MsgTypeID)
+
+	// Flush
+	r.out = nil
+	i.Push(newTestMsg(v, 1000), r.onMsg)
+	i.Push(newTestMsg(v, 1040), r.onMsg)
+	assert.Equal(t, 0, len(r.out))
+	i.Flush(r.onMsg)
+	assert.Equal(t, []uint32{1000, 1040}, r.timestamps())
+}
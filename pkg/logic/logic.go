@@ -10,6 +10,7 @@ package logic
 
 import (
 	"errors"
+	"runtime/debug"
 
 	"github.com/q191201771/lal/pkg/httpflv"
 	"github.com/q191201771/lal/pkg/rtmp"
@@ -17,6 +18,38 @@ import (
 
 var ErrLogic = errors.New("lal.logic: fxxk")
 
+// 改写 onMetaData 时写入
+// ServerVersion 由 build.sh 通过 -ldflags 注入 CHANGELOG.md 中最新的版本号，
+// 没有注入时，使用 go module 的版本号，比如作为依赖被其他项目引用时
+var (
+	ServerName    = "lal"
+	ServerVersion string
+)
+
+const modulePath = "github.com/q191201771/lal"
+
+func init() {
+	if ServerVersion == "" {
+		ServerVersion = moduleVersion()
+	}
+}
+
+func moduleVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if info.Main.Path == modulePath && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == modulePath {
+			return dep.Version
+		}
+	}
+	return "unknown"
+}
+
 var _ rtmp.ServerObserver = &ServerManager{}
 var _ httpflv.ServerObserver = &ServerManager{}
 var _ rtmp.PubSessionObserver = &Group{}
@@ -0,0 +1,121 @@
+// Copyright 2019, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package logic
+
+import (
+	"github.com/q191201771/lal/pkg/avc"
+	"github.com/q191201771/lal/pkg/rtmp"
+	log "github.com/q191201771/naza/pkg/nazalog"
+)
+
+const (
+	metadataKeyServer        = "server"
+	metadataKeyServerVersion = "server_version"
+)
+
+// 获取当前推流的 metadata，没有收到或者解析失败时返回 nil
+// 如果收到了 avc seq header，宽高使用 sps 中的值
+func (group *Group) Metadata() *rtmp.Metadata {
+	group.mutex.Lock()
+	defer group.mutex.Unlock()
+	if group.meta == nil {
+		return nil
+	}
+	meta := *group.meta
+	meta.Raw = append(rtmp.EcmaArray(nil), group.meta.Raw...)
+	return &meta
+}
+
+// 解析 onMetaData，开启改写时返回改写后的 message
+func (group *Group) onMetadata(msg rtmp.AVMsg) rtmp.AVMsg {
+	meta, err := rtmp.ParseMetadata(msg.Payload)
+	if err != nil {
+		log.Warnf("parse metadata failed. [%s] err=%+v", group.UniqueKey, err)
+		group.meta = nil
+		return msg
+	}
+	log.Infof("<----- metadata. [%s] width=%d, height=%d, framerate=%.2f, videocodecid=%d, audiocodecid=%d, encoder=%s",
+		group.UniqueKey, meta.Width, meta.Height, meta.FrameRate, meta.VideoCodecID, meta.AudioCodecID, meta.Encoder)
+	group.meta = meta
+	group.metadataHeader = msg.Header
+	group.refreshMetadata()
+
+	if !group.config.Metadata.Rewrite {
+		return msg
+	}
+	payload, err := group.meta.Pack()
+	if err != nil {
+		log.Warnf("pack metadata failed. [%s] err=%+v", group.UniqueKey, err)
+		return msg
+	}
+	msg.Payload = payload
+	msg.Header.MsgLen = uint32(len(payload))
+	return msg
+}
+
+// 从 sps 中解析宽高，开启改写时，如果和已缓存的 metadata 不一致，重新生成缓存
+func (group *Group) onAVCSeqHeader(msg rtmp.AVMsg) {
+	sps, _, err := avc.ParseAVCSeqHeader(msg.Payload)
+	if err != nil {
+		log.Warnf("parse avc seq header failed. [%s] err=%+v", group.UniqueKey, err)
+		return
+	}
+	info, err := avc.ParseSPS(sps)
+	if err != nil {
+		log.Warnf("parse sps failed. [%s] err=%+v", group.UniqueKey, err)
+		return
+	}
+	group.spsWidth = info.Width
+	group.spsHeight = info.Height
+
+	if group.meta == nil || !group.refreshMetadata() || !group.config.Metadata.Rewrite {
+		return
+	}
+
+	payload, err := group.meta.Pack()
+	if err != nil {
+		log.Warnf("pack metadata failed. [%s] err=%+v", group.UniqueKey, err)
+		return
+	}
+	metaMsg := rtmp.AVMsg{Header: group.metadataHeader, Payload: payload}
+	metaMsg.Header.MsgLen = uint32(len(payload))
+	currHeader := Trans.MakeDefaultRTMPHeader(metaMsg.Header)
+	tag, tagRaw := Trans.RTMPMsg2SharedFLVTag(metaMsg)
+	group.setMetadata(newCachedMsg(group.chunkDivider.Message2ChunksShared(payload, &currHeader), tag, tagRaw))
+	log.Debugf("update cache metadata by sps. [%s] width=%d, height=%d", group.UniqueKey, info.Width, info.Height)
+
+	// 已经开始转发的 sub session 收到过旧的 metadata（或者还没有收到），重新发送一次
+	// 还没有开始转发的 sub session 之后会收到新的缓存
+	for session := range group.rtmpSubSessionSet {
+		if session.IsPlayStarted() && !session.IsFresh && session.IsReceiving(rtmp.TypeidDataMessageAMF0) {
+			_ = writeRTMPChunks(session, group.metadata.chunks)
+		}
+	}
+	for session := range group.httpflvSubSessionSet {
+		if !session.IsFresh {
+			session.WriteShared(group.metadata.tagRaw)
+		}
+	}
+}
+
+// 使用 sps 中的宽高，开启改写时同时写入服务端信息
+// @return 宽高是否发生了变化
+func (group *Group) refreshMetadata() bool {
+	changed := false
+	if group.spsWidth != 0 && (group.meta.Width != group.spsWidth || group.meta.Height != group.spsHeight) {
+		group.meta.Width = group.spsWidth
+		group.meta.Height = group.spsHeight
+		changed = true
+	}
+	if group.config.Metadata.Rewrite {
+		group.meta.Set(metadataKeyServer, ServerName)
+		group.meta.Set(metadataKeyServerVersion, ServerVersion)
+	}
+	return changed
+}
@@ -0,0 +1,87 @@
+// Copyright 2019, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package logic
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/q191201771/lal/pkg/rtmp"
+	"github.com/q191201771/naza/pkg/assert"
+)
+
+func TestGroup_Metadata(t *testing.T) {
+	out := &bytes.Buffer{}
+	_ = rtmp.AMF0.WriteString(out, "@setDataFrame")
+	_ = rtmp.AMF0.WriteString(out, "onMetaData")
+	_ = rtmp.AMF0.WriteEcmaArray(out, rtmp.EcmaArray{
+		{Key: "width", Value: float64(0)},
+		{Key: "height", Value: float64(0)},
+		{Key: "encoder", Value: "obs"},
+	})
+	metaMsg := rtmp.AVMsg{Payload: out.Bytes()}
+	metaMsg.Header.MsgTypeID = rtmp.TypeidDataMessageAMF0
+	metaMsg.Header.MsgLen = uint32(len(metaMsg.Payload))
+
+	// 1280x720
+	seqMsg := rtmp.AVMsg{Payload: []byte{0x17, 0x0, 0x0, 0x0, 0x0, 0x1, 0x64, 0x0, 0x1f, 0xff, 0xe1, 0x0, 0x1a,
+		0x67, 0x64, 0x00, 0x1f, 0xac, 0xd9, 0x40, 0x50, 0x05, 0xbb, 0x01, 0x10, 0x00, 0x00, 0x03, 0x00, 0x10, 0x00, 0x00, 0x03, 0x03, 0xc0, 0xf1, 0x83, 0x19, 0x60,
+		0x1, 0x0, 0x4, 0x68, 0xeb, 0xe3, 0xcb}}
+	seqMsg.Header.MsgTypeID = rtmp.TypeidVideo
+	seqMsg.Header.MsgLen = uint32(len(seqMsg.Payload))
+
+	// 不改写时，原样缓存，但是结构化的 metadata 使用 sps 中的宽高
+	group := NewGroup("live", "test", &Config{})
+	group.OnReadRTMPAVMsg(metaMsg)
+	group.OnReadRTMPAVMsg(seqMsg)
+	meta := group.Metadata()
+	assert.Equal(t, 1280, meta.Width)
+	assert.Equal(t, 720, meta.Height)
+	assert.Equal(t, "obs", meta.Encoder)
+	assert.Equal(t, metaMsg.Payload, group.metadata.tag.Raw[11:11+len(metaMsg.Payload)])
+
+	// 改写
+	group = NewGroup("live", "test", &Config{Metadata: Metadata{Rewrite: true}})
+	group.OnReadRTMPAVMsg(metaMsg)
+	group.OnReadRTMPAVMsg(seqMsg)
+	tag := group.metadata.tag
+	m, err := rtmp.ParseMetadata(tag.Raw[11 : 11+tag.Header.DataSize])
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1280, m.Width)
+	assert.Equal(t, 720, m.Height)
+	assert.Equal(t, "obs", m.Encoder)
+	v, _ := m.Raw.Get(metadataKeyServer)
+	assert.Equal(t, ServerName, v)
+	v, _ = m.Raw.Get(metadataKeyServerVersion)
+	assert.Equal(t, ServerVersion, v)
+	assert.Equal(t, true, ServerVersion != "")
+	name, _, _ := rtmp.AMF0.ReadString(tag.Raw[11:])
+	assert.Equal(t, "onMetaData", name)
+
+	// 已经收到旧的 metadata 的拉流端，在 seq header 之前收到改写后的 metadata
+	group = NewGroup("live", "test", &Config{Metadata: Metadata{Rewrite: true}})
+	group.OnReadRTMPAVMsg(metaMsg)
+	sub := addTestFLVSub(group, "")
+	defer sub.session.Dispose()
+	audioMsg := rtmp.AVMsg{Payload: []byte{0xaf, 0x1, 0x21}}
+	audioMsg.Header.MsgTypeID = rtmp.TypeidAudio
+	audioMsg.Header.MsgLen = uint32(len(audioMsg.Payload))
+	group.OnReadRTMPAVMsg(audioMsg)
+	group.OnReadRTMPAVMsg(seqMsg)
+	payloads := sub.waitPayloads(4)
+	assert.Equal(t, 4, len(payloads))
+	m, err = rtmp.ParseMetadata(payloads[0])
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, m.Width)
+	assert.Equal(t, audioMsg.Payload, payloads[1])
+	m, err = rtmp.ParseMetadata(payloads[2])
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1280, m.Width)
+	assert.Equal(t, seqMsg.Payload, payloads[3])
+}
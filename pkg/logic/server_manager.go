@@ -12,6 +12,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/q191201771/lal/pkg/bufpool"
 	"github.com/q191201771/lal/pkg/httpflv"
 	"github.com/q191201771/lal/pkg/rtmp"
 	log "github.com/q191201771/naza/pkg/nazalog"
@@ -34,11 +35,16 @@ func NewServerManager(config *Config) *ServerManager {
 		groupMap: make(map[string]*Group),
 		exitChan: make(chan struct{}),
 	}
+	bufpool.SetLimit(config.Limit.BufLimit())
 	if len(config.HTTPFLV.SubListenAddr) != 0 {
-		m.httpflvServer = httpflv.NewServer(m, config.HTTPFLV.SubListenAddr)
+		m.httpflvServer = httpflv.NewServer(m, config.HTTPFLV.SubListenAddr, func(option *httpflv.ServerOption) {
+			*option = config.HTTPFLV.ServerOption()
+		})
 	}
 	if len(config.RTMP.Addr) != 0 {
-		m.rtmpServer = rtmp.NewServer(m, config.RTMP.Addr)
+		m.rtmpServer = rtmp.NewServer(m, config.RTMP.Addr, func(option *rtmp.ServerOption) {
+			*option = config.RTMP.ServerOption()
+		})
 	}
 	return m
 }
@@ -72,7 +78,8 @@ func (sm *ServerManager) RunLoop() {
 			count++
 			if (count % 10) == 0 {
 				sm.mutex.Lock()
-				log.Infof("group size:%d", len(sm.groupMap))
+				log.Infof("group size:%d, buffered bytes:%d, offences:%+v, rtmp timeouts:%+v, httpflv timeouts:%+v",
+					len(sm.groupMap), bufpool.TotalBufferedBytes(), bufpool.GetOffences(), rtmp.GetTimeouts(), httpflv.GetTimeouts())
 				sm.mutex.Unlock()
 			}
 		}
@@ -168,7 +175,7 @@ func (sm *ServerManager) check() {
 func (sm *ServerManager) getOrCreateGroup(appName string, streamName string) *Group {
 	group, exist := sm.groupMap[streamName]
 	if !exist {
-		group = NewGroup(appName, streamName)
+		group = NewGroup(appName, streamName, sm.config)
 		sm.groupMap[streamName] = group
 	}
 	go group.RunLoop()
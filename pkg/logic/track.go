@@ -0,0 +1,103 @@
+// Copyright 2019, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package logic
+
+import (
+	"net/url"
+	"strconv"
+
+	"github.com/q191201771/lal/pkg/rtmp"
+)
+
+// url 参数中用于选择轨道的 key，比如 `rtmp://127.0.0.1/live/test110?audio_track=1`
+const (
+	queryKeyAudioTrack = "audio_track"
+	queryKeyVideoTrack = "video_track"
+)
+
+const allTracks = -1
+
+// 订阅者的转发状态
+type subscriber struct {
+	audioTrack int // 选择的音频轨道，allTracks 表示转发所有轨道
+	videoTrack int // 选择的视频轨道，allTracks 表示转发所有轨道
+
+	keyNaluTracks map[uint8]struct{} // 已经转发过关键帧的视频轨道
+}
+
+func newSubscriber(rawQuery string) *subscriber {
+	sub := &subscriber{
+		audioTrack:    allTracks,
+		videoTrack:    allTracks,
+		keyNaluTracks: make(map[uint8]struct{}),
+	}
+	// 参数不合法时，忽略该参数，转发所有轨道
+	values, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return sub
+	}
+	sub.audioTrack = parseTrack(values.Get(queryKeyAudioTrack))
+	sub.videoTrack = parseTrack(values.Get(queryKeyVideoTrack))
+	return sub
+}
+
+// 判断订阅者是否选择了该轨道
+func (sub *subscriber) isTrackSelected(msgTypeID uint8, trackID uint8) bool {
+	switch msgTypeID {
+	case rtmp.TypeidAudio:
+		return sub.audioTrack == allTracks || sub.audioTrack == int(trackID)
+	case rtmp.TypeidVideo:
+		return sub.videoTrack == allTracks || sub.videoTrack == int(trackID)
+	}
+	return true
+}
+
+// 判断是否将 msg 转发给订阅者，并更新订阅者的状态
+// 每个视频轨道都需要从关键帧开始转发
+func (sub *subscriber) shouldForward(msg rtmp.AVMsg) bool {
+	trackID := msg.TrackID()
+	if !sub.isTrackSelected(msg.Header.MsgTypeID, trackID) {
+		return false
+	}
+	if msg.Header.MsgTypeID != rtmp.TypeidVideo {
+		return true
+	}
+	if _, ok := sub.keyNaluTracks[trackID]; ok {
+		return true
+	}
+	if msg.IsVideoKeySeqHeader() {
+		return true
+	}
+	if msg.IsVideoKeyNalu() {
+		sub.keyNaluTracks[trackID] = struct{}{}
+		return true
+	}
+	return false
+}
+
+func (sub *subscriber) waitKeyNalu() bool {
+	return len(sub.keyNaluTracks) == 0
+}
+
+func (sub *subscriber) resetKeyNalu() {
+	if len(sub.keyNaluTracks) != 0 {
+		sub.keyNaluTracks = make(map[uint8]struct{})
+	}
+}
+
+func parseTrack(s string) int {
+	if s == "" {
+		return allTracks
+	}
+	track, err := strconv.Atoi(s)
+	if err != nil || track < 0 || track > 0xff {
+		return allTracks
+	}
+	return track
+}
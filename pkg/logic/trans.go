@@ -11,6 +11,7 @@ package logic
 import (
 	"github.com/q191201771/lal/pkg/httpflv"
 	"github.com/q191201771/lal/pkg/rtmp"
+	"github.com/q191201771/naza/pkg/slicebytepool"
 )
 
 var Trans trans
@@ -68,3 +69,13 @@ func (t trans) RTMPMsg2FLVTag(msg rtmp.AVMsg) *httpflv.Tag {
 	tag.Raw = httpflv.PackHTTPFLVTag(msg.Header.MsgTypeID, msg.Header.TimestampAbs, msg.Payload)
 	return &tag
 }
+
+// 和 RTMPMsg2FLVTag 相同，但是 tag.Raw 的内存块从内存池中获取，<tag> 不再使用时调用 ssb.ReleaseIfNeeded 释放
+func (t trans) RTMPMsg2SharedFLVTag(msg rtmp.AVMsg) (tag *httpflv.Tag, ssb *slicebytepool.SharedSliceByte) {
+	ssb = httpflv.PackHTTPFLVTagShared(msg.Header.MsgTypeID, msg.Header.TimestampAbs, msg.Payload)
+	tag = &httpflv.Tag{Raw: ssb.Core}
+	tag.Header.Type = msg.Header.MsgTypeID
+	tag.Header.DataSize = msg.Header.MsgLen
+	tag.Header.Timestamp = msg.Header.TimestampAbs
+	return
+}
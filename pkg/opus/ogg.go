@@ -0,0 +1,151 @@
+// Copyright 2019, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package opus
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// 将 opus packet 封装成 Ogg Opus 文件（RFC 7845），每个 opus packet 单独使用一个 page
+//
+// TODO chef: 最后一个 page 没有设置 EOS 标志，目前常见的播放器都可以正常播放
+
+const (
+	pageFlagBOS = uint8(0x02)
+
+	pageHeaderSize  = 27
+	maxSegmentCount = 255
+)
+
+const vendor = "lal"
+
+var crcTable [256]uint32
+
+func init() {
+	// 多项式 0x04c11db7，不反转，初始值为 0
+	for i := 0; i < 256; i++ {
+		r := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if r&0x80000000 != 0 {
+				r = (r << 1) ^ 0x04c11db7
+			} else {
+				r <<= 1
+			}
+		}
+		crcTable[i] = r
+	}
+}
+
+type OggWriter struct {
+	w          io.Writer
+	serial     uint32
+	pageSeq    uint32
+	granule    uint64
+	headerDone bool
+}
+
+func NewOggWriter(w io.Writer) *OggWriter {
+	return &OggWriter{
+		w:      w,
+		serial: 0x6c616c21, // lal!
+	}
+}
+
+// 写入 OpusHead 和 OpusTags，必须在 WritePacket 之前调用，并且只能调用一次
+func (ow *OggWriter) WriteHeader(head OpusHead) error {
+	if ow.headerDone {
+		return ErrOpus
+	}
+	ow.headerDone = true
+	if err := ow.writePage(head.Pack(), pageFlagBOS); err != nil {
+		return err
+	}
+
+	tags := make([]byte, 8+4+len(vendor)+4)
+	copy(tags, "OpusTags")
+	binary.LittleEndian.PutUint32(tags[8:], uint32(len(vendor)))
+	copy(tags[12:], vendor)
+	binary.LittleEndian.PutUint32(tags[12+len(vendor):], 0) // comment list length
+	return ow.writePage(tags, 0)
+}
+
+func (ow *OggWriter) WritePacket(packet []byte) error {
+	if !ow.headerDone {
+		if err := ow.WriteHeader(DefaultOpusHead); err != nil {
+			return err
+		}
+	}
+	samples, err := PacketSamples(packet)
+	if err != nil {
+		return err
+	}
+	ow.granule += uint64(samples)
+	return ow.writePage(packet, 0)
+}
+
+// 将 Enhanced RTMP 的 opus 音频数据传入，输出 Ogg Opus 文件
+// @param <payload> rtmp message payload部分，包含前面5个字节的扩展头
+func (ow *OggWriter) Capture(payload []byte) error {
+	if len(payload) < 5 {
+		return ErrOpus
+	}
+	switch payload[0] & 0x0f {
+	case 0: // SequenceStart
+		if ow.headerDone {
+			return nil
+		}
+		head, err := ParseOpusHead(payload[5:])
+		if err != nil {
+			head = DefaultOpusHead
+		}
+		return ow.WriteHeader(head)
+	case 1: // CodedFrames
+		return ow.WritePacket(payload[5:])
+	}
+	return nil
+}
+
+func (ow *OggWriter) writePage(packet []byte, flag uint8) error {
+	// lacing values: 若干个255，最后一个小于255（可以为0）
+	segmentCount := len(packet)/255 + 1
+	if segmentCount > maxSegmentCount {
+		return ErrOpus
+	}
+
+	page := make([]byte, pageHeaderSize+segmentCount+len(packet))
+	copy(page, "OggS")
+	page[4] = 0 // version
+	page[5] = flag
+	// header page 写入时还没有 opus packet，granule position 为0
+	binary.LittleEndian.PutUint64(page[6:], ow.granule)
+	binary.LittleEndian.PutUint32(page[14:], ow.serial)
+	binary.LittleEndian.PutUint32(page[18:], ow.pageSeq)
+	// page[22:26] crc，最后计算
+	page[26] = uint8(segmentCount)
+	for i := 0; i < segmentCount-1; i++ {
+		page[pageHeaderSize+i] = 255
+	}
+	page[pageHeaderSize+segmentCount-1] = uint8(len(packet) % 255)
+	copy(page[pageHeaderSize+segmentCount:], packet)
+
+	binary.LittleEndian.PutUint32(page[22:], crc(page))
+	ow.pageSeq++
+
+	_, err := ow.w.Write(page)
+	return err
+}
+
+func crc(b []byte) uint32 {
+	var r uint32
+	for _, v := range b {
+		r = (r << 8) ^ crcTable[uint8(r>>24)^v]
+	}
+	return r
+}
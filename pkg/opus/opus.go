@@ -0,0 +1,104 @@
+// Copyright 2019, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package opus
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Enhanced RTMP 中 Opus 的处理
+// SequenceStart 的 body 为 OpusHead（RFC 7845 5.1 ID Header），CodedFrames 的 body 为一个 opus packet
+
+var ErrOpus = errors.New("lal.opus: fxxk")
+
+var opusHeadMagic = []byte("OpusHead")
+
+const opusHeadMinSize = 19
+
+// opus 内部固定使用 48kHz 的时钟
+const SampleRate = 48000
+
+type OpusHead struct {
+	Version         uint8
+	ChannelCount    uint8
+	PreSkip         uint16
+	InputSampleRate uint32
+	OutputGain      uint16
+	MappingFamily   uint8
+}
+
+// 在没有收到 SequenceStart 时使用
+var DefaultOpusHead = OpusHead{
+	Version:         1,
+	ChannelCount:    2,
+	PreSkip:         3840,
+	InputSampleRate: SampleRate,
+}
+
+func ParseOpusHead(b []byte) (head OpusHead, err error) {
+	if len(b) < opusHeadMinSize || string(b[:8]) != string(opusHeadMagic) {
+		return head, ErrOpus
+	}
+	// 注意，OpusHead 中的整数是小端
+	head.Version = b[8]
+	head.ChannelCount = b[9]
+	head.PreSkip = binary.LittleEndian.Uint16(b[10:])
+	head.InputSampleRate = binary.LittleEndian.Uint32(b[12:])
+	head.OutputGain = binary.LittleEndian.Uint16(b[16:])
+	head.MappingFamily = b[18]
+	return head, nil
+}
+
+// 只支持 MappingFamily 为 0 的情况，也即单声道或者双声道
+func (head OpusHead) Pack() []byte {
+	out := make([]byte, opusHeadMinSize)
+	copy(out, opusHeadMagic)
+	out[8] = head.Version
+	out[9] = head.ChannelCount
+	binary.LittleEndian.PutUint16(out[10:], head.PreSkip)
+	binary.LittleEndian.PutUint32(out[12:], head.InputSampleRate)
+	binary.LittleEndian.PutUint16(out[16:], head.OutputGain)
+	out[18] = head.MappingFamily
+	return out
+}
+
+// 通过 TOC 字节计算一个 opus packet 包含的采样点数（48kHz），参见 RFC 6716 3.1
+func PacketSamples(packet []byte) (int, error) {
+	if len(packet) == 0 {
+		return 0, ErrOpus
+	}
+	toc := packet[0]
+	config := toc >> 3
+
+	// 单位为 1/400 秒，也即 2.5 毫秒
+	var frameDuration int
+	switch {
+	case config < 12: // SILK 10, 20, 40, 60 ms
+		frameDuration = []int{4, 8, 16, 24}[config&0x03]
+	case config < 16: // Hybrid 10, 20 ms
+		frameDuration = []int{4, 8}[config&0x01]
+	default: // CELT 2.5, 5, 10, 20 ms
+		frameDuration = []int{1, 2, 4, 8}[config&0x03]
+	}
+
+	var frameCount int
+	switch toc & 0x03 {
+	case 0:
+		frameCount = 1
+	case 1, 2:
+		frameCount = 2
+	case 3:
+		if len(packet) < 2 {
+			return 0, ErrOpus
+		}
+		frameCount = int(packet[1] & 0x3f)
+	}
+	return frameCount * frameDuration * SampleRate / 400, nil
+}
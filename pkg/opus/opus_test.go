@@ -0,0 +1,85 @@
+// Copyright 2019, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package opus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/q191201771/naza/pkg/assert"
+)
+
+func TestPacketSamples(t *testing.T) {
+	golden := []struct {
+		packet  []byte
+		samples int
+	}{
+		{[]byte{0xfc}, 960},        // CELT 20ms
+		{[]byte{0xe0}, 120},        // CELT 2.5ms
+		{[]byte{0x09}, 1920},       // SILK 20ms, 2个 frame
+		{[]byte{0x18}, 2880},       // SILK 60ms
+		{[]byte{0x60}, 480},        // Hybrid 10ms
+		{[]byte{0xfb, 0x03}, 2880}, // CELT 20ms, 3个 frame
+	}
+	for _, item := range golden {
+		samples, err := PacketSamples(item.packet)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, item.samples, samples)
+	}
+	_, err := PacketSamples(nil)
+	assert.Equal(t, ErrOpus, err)
+	_, err = PacketSamples([]byte{0x03})
+	assert.Equal(t, ErrOpus, err)
+}
+
+func TestOpusHead(t *testing.T) {
+	b := DefaultOpusHead.Pack()
+	head, err := ParseOpusHead(b)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, DefaultOpusHead, head)
+	_, err = ParseOpusHead(b[:10])
+	assert.Equal(t, ErrOpus, err)
+}
+
+func TestOggWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	ow := NewOggWriter(buf)
+	// SequenceStart
+	assert.Equal(t, nil, ow.Capture(append([]byte{0x90, 'O', 'p', 'u', 's'}, DefaultOpusHead.Pack()...)))
+	// CodedFrames
+	assert.Equal(t, nil, ow.Capture([]byte{0x91, 'O', 'p', 'u', 's', 0xfc, 0x1, 0x2}))
+	assert.Equal(t, nil, ow.Capture(append([]byte{0x91, 'O', 'p', 'u', 's', 0xfc}, make([]byte, 300)...)))
+
+	// 解析 page，检查 crc、序号、granule
+	b := buf.Bytes()
+	var granules []uint64
+	for i := uint32(0); len(b) != 0; i++ {
+		assert.Equal(t, "OggS", string(b[:4]))
+		assert.Equal(t, i, binary.LittleEndian.Uint32(b[18:]))
+		granules = append(granules, binary.LittleEndian.Uint64(b[6:]))
+
+		segmentCount := int(b[26])
+		size := pageHeaderSize + segmentCount
+		for j := 0; j < segmentCount; j++ {
+			size += int(b[pageHeaderSize+j])
+		}
+		page := append([]byte{}, b[:size]...)
+		expected := binary.LittleEndian.Uint32(page[22:])
+		binary.LittleEndian.PutUint32(page[22:], 0)
+		assert.Equal(t, expected, crc(page))
+		b = b[size:]
+	}
+	assert.Equal(t, []uint64{0, 0, 960, 1920}, granules)
+}
+
+func TestCRC(t *testing.T) {
+	// CRC-32/MPEG-2 的变种，初始值为0，不做最终的异或
+	assert.Equal(t, uint32(0x89a1897f), crc([]byte("123456789")))
+}
@@ -0,0 +1,138 @@
+// Copyright 2019, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package reconnect
+
+import (
+	"math/rand"
+	"time"
+)
+
+// 客户端类型 session（rtmp 的 PullSession PushSession，httpflv 的 PullSession）断线重连的策略
+
+type Option struct {
+	MaxRetries   int     // 连续重连失败的最大次数。0 表示不重连，-1 表示无限重连
+	MinBackoffMS int     // 第一次重连前等待的时长，之后每次翻倍
+	MaxBackoffMS int     // 等待时长的上限
+	Jitter       float64 // 在等待时长上叠加的随机抖动比例，取值范围 [0, 1]，比如 0.2 表示在 [0.8, 1.2] 倍之间随机
+
+	// 断线（或者连接失败）后重新建立成功时回调
+	// @param attempt 本次成功之前连续尝试的次数，从1开始
+	// @param err     触发重连的错误
+	OnReconnect func(attempt int, err error)
+}
+
+var DefaultOption = Option{
+	MaxRetries:   0,
+	MinBackoffMS: 1000,
+	MaxBackoffMS: 30000,
+	Jitter:       0.2,
+}
+
+func (o *Option) Enabled() bool {
+	return o.MaxRetries != 0
+}
+
+// @param attempt 第几次重连，从1开始
+func (o *Option) canRetry(attempt int) bool {
+	return o.MaxRetries < 0 || attempt <= o.MaxRetries
+}
+
+// @param attempt 第几次重连，从1开始
+func (o *Option) Backoff(attempt int) time.Duration {
+	ms := float64(o.MinBackoffMS)
+	for i := 1; i < attempt && ms < float64(o.MaxBackoffMS); i++ {
+		ms *= 2
+	}
+	if ms > float64(o.MaxBackoffMS) {
+		ms = float64(o.MaxBackoffMS)
+	}
+	if o.Jitter > 0 {
+		ms *= 1 + o.Jitter*(2*rand.Float64()-1)
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// 记录连续失败的次数，并在每次重连前按照退避策略等待
+type Retrier struct {
+	option  Option
+	attempt int
+	lastErr error
+}
+
+func NewRetrier(option Option) *Retrier {
+	return &Retrier{
+		option: option,
+	}
+}
+
+// 当前已经连续失败的次数
+func (r *Retrier) Attempt() int {
+	return r.attempt
+}
+
+// 连接失败或者断开时调用，阻塞等待直到可以进行下一次重连
+//
+// @param err    本次失败的错误
+// @param cancel 被关闭时立即返回 false，一般是上层调用了 session 的 Dispose
+// @return       false 表示不再重连，比如没有开启重连，或者重连次数已经用完
+func (r *Retrier) Wait(err error, cancel <-chan struct{}) bool {
+	r.attempt++
+	r.lastErr = err
+	if !r.option.canRetry(r.attempt) {
+		return false
+	}
+	select {
+	case <-cancel:
+		return false
+	default:
+	}
+
+	t := time.NewTimer(r.option.Backoff(r.attempt))
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-cancel:
+		return false
+	}
+}
+
+// 连接建立成功时调用。如果之前有过失败，则回调 OnReconnect，并重置失败次数
+func (r *Retrier) Succeed() {
+	if r.attempt > 0 && r.option.OnReconnect != nil {
+		r.option.OnReconnect(r.attempt, r.lastErr)
+	}
+	r.attempt = 0
+	r.lastErr = nil
+}
+
+// 重连后，对端的时间戳一般会从头开始（或者发生跳变）
+// TimestampRebaser 将新连接上的时间戳平移到上一个连接最后的时间戳之后，使得上层看到的是单调递增的时间戳
+type TimestampRebaser struct {
+	offset  uint32
+	last    uint32
+	pending bool
+}
+
+// 新的连接建立前调用，之后收到的第一个时间戳会被平移到上一个连接的最后一个时间戳
+func (r *TimestampRebaser) Reset() {
+	r.pending = true
+}
+
+func (r *TimestampRebaser) Rebase(timestamp uint32) uint32 {
+	if r.pending {
+		r.offset = r.last - timestamp
+		r.pending = false
+	}
+	out := timestamp + r.offset
+	if out > r.last {
+		r.last = out
+	}
+	return out
+}
@@ -0,0 +1,102 @@
+// Copyright 2019, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package reconnect_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/q191201771/lal/pkg/reconnect"
+	"github.com/q191201771/naza/pkg/assert"
+)
+
+func TestOption_Backoff(t *testing.T) {
+	o := reconnect.Option{
+		MaxRetries:   -1,
+		MinBackoffMS: 100,
+		MaxBackoffMS: 1000,
+	}
+	assert.Equal(t, true, o.Enabled())
+	assert.Equal(t, 100*time.Millisecond, o.Backoff(1))
+	assert.Equal(t, 200*time.Millisecond, o.Backoff(2))
+	assert.Equal(t, 800*time.Millisecond, o.Backoff(4))
+	assert.Equal(t, 1000*time.Millisecond, o.Backoff(5))
+	assert.Equal(t, 1000*time.Millisecond, o.Backoff(100))
+
+	o.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		d := o.Backoff(1)
+		assert.Equal(t, true, d >= 50*time.Millisecond && d <= 150*time.Millisecond)
+	}
+
+	assert.Equal(t, false, reconnect.DefaultOption.Enabled())
+}
+
+func TestRetrier(t *testing.T) {
+	var (
+		cbAttempt int
+		cbErr     error
+	)
+	errTest := errors.New("test")
+	r := reconnect.NewRetrier(reconnect.Option{
+		MaxRetries:   2,
+		MinBackoffMS: 1,
+		MaxBackoffMS: 1,
+		OnReconnect: func(attempt int, err error) {
+			cbAttempt = attempt
+			cbErr = err
+		},
+	})
+	cancel := make(chan struct{})
+
+	// 首次即成功，不回调
+	r.Succeed()
+	assert.Equal(t, 0, cbAttempt)
+
+	assert.Equal(t, true, r.Wait(errTest, cancel))
+	assert.Equal(t, true, r.Wait(errTest, cancel))
+	assert.Equal(t, 2, r.Attempt())
+	r.Succeed()
+	assert.Equal(t, 2, cbAttempt)
+	assert.Equal(t, errTest, cbErr)
+	assert.Equal(t, 0, r.Attempt())
+
+	// 次数用完
+	assert.Equal(t, true, r.Wait(errTest, cancel))
+	assert.Equal(t, true, r.Wait(errTest, cancel))
+	assert.Equal(t, false, r.Wait(errTest, cancel))
+
+	// 被取消
+	r = reconnect.NewRetrier(reconnect.Option{MaxRetries: -1, MinBackoffMS: 10000, MaxBackoffMS: 10000})
+	close(cancel)
+	assert.Equal(t, false, r.Wait(errTest, cancel))
+
+	// 不重连
+	r = reconnect.NewRetrier(reconnect.DefaultOption)
+	assert.Equal(t, false, r.Wait(errTest, make(chan struct{})))
+}
+
+func TestTimestampRebaser(t *testing.T) {
+	var r reconnect.TimestampRebaser
+	// 第一个连接上不做修改
+	assert.Equal(t, uint32(1000), r.Rebase(1000))
+	assert.Equal(t, uint32(2000), r.Rebase(2000))
+	assert.Equal(t, uint32(1990), r.Rebase(1990))
+
+	// 重连后时间戳从头开始
+	r.Reset()
+	assert.Equal(t, uint32(2000), r.Rebase(0))
+	assert.Equal(t, uint32(2040), r.Rebase(40))
+
+	// 重连后时间戳变大
+	r.Reset()
+	assert.Equal(t, uint32(2040), r.Rebase(100000))
+	assert.Equal(t, uint32(2080), r.Rebase(100040))
+}
@@ -16,38 +16,45 @@ import (
 	"bytes"
 	"errors"
 	"io"
+	"math"
+	"sort"
+	"time"
 
 	"github.com/q191201771/naza/pkg/bele"
-	log "github.com/q191201771/naza/pkg/nazalog"
 )
 
 var (
 	ErrAMFInvalidType = errors.New("lal.rtmp: invalid amf0 type")
 	ErrAMFTooShort    = errors.New("lal.rtmp: too short to unmarshal amf0 data")
+	ErrAMFTooDeep     = errors.New("lal.rtmp: amf0 data nested too deep")
+	ErrAMFReference   = errors.New("lal.rtmp: invalid amf0 reference")
 )
 
 const (
-	AMF0TypeMarkerNumber     = uint8(0x00)
-	AMF0TypeMarkerBoolean    = uint8(0x01)
-	AMF0TypeMarkerString     = uint8(0x02)
-	AMF0TypeMarkerObject     = uint8(0x03)
-	AMF0TypeMarkerNull       = uint8(0x05)
-	AMF0TypeMarkerObjectEnd  = uint8(0x09)
-	AMF0TypeMarkerLongString = uint8(0x0c)
-
-	// 还没用到的类型
-	//AMF0TypeMarkerMovieclip   = uint8(0x04)
-	//AMF0TypeMarkerUndefined   = uint8(0x06)
-	//AMF0TypeMarkerReference   = uint8(0x07)
-	//AMF0TypeMarkerEcmaArray   = uint8(0x08)
-	//AMF0TypeMarkerStrictArray = uint8(0x0a)
-	//AMF0TypeMarkerData        = uint8(0x0b)
-	//AMF0TypeMarkerUnsupported = uint8(0x0d)
-	//AMF0TypeMarkerRecordset   = uint8(0x0e)
-	//AMF0TypeMarkerXmlDocument = uint8(0x0f)
-	//AMF0TypeMarkerTypedObject = uint8(0x10)
+	AMF0TypeMarkerNumber      = uint8(0x00)
+	AMF0TypeMarkerBoolean     = uint8(0x01)
+	AMF0TypeMarkerString      = uint8(0x02)
+	AMF0TypeMarkerObject      = uint8(0x03)
+	AMF0TypeMarkerMovieclip   = uint8(0x04) // reserved, not supported
+	AMF0TypeMarkerNull        = uint8(0x05)
+	AMF0TypeMarkerUndefined   = uint8(0x06)
+	AMF0TypeMarkerReference   = uint8(0x07)
+	AMF0TypeMarkerEcmaArray   = uint8(0x08)
+	AMF0TypeMarkerObjectEnd   = uint8(0x09)
+	AMF0TypeMarkerStrictArray = uint8(0x0a)
+	AMF0TypeMarkerDate        = uint8(0x0b)
+	AMF0TypeMarkerLongString  = uint8(0x0c)
+	AMF0TypeMarkerUnsupported = uint8(0x0d)
+	AMF0TypeMarkerRecordset   = uint8(0x0e) // reserved, not supported
+	AMF0TypeMarkerXMLDocument = uint8(0x0f)
+	AMF0TypeMarkerTypedObject = uint8(0x10)
+
+	AMF0TypeMarkerAvmplusObject = uint8(0x11) // 后面紧跟的一个值使用 amf3 编码
 )
 
+// 对象嵌套的最大层数，防止恶意数据导致栈溢出，amf0 和 amf3 共用
+const amfMaxDepth = 32
+
 var AMF0TypeMarkerObjectEndBytes = []byte{0, 0, AMF0TypeMarkerObjectEnd}
 
 type ObjectPair struct {
@@ -55,6 +62,51 @@ type ObjectPair struct {
 	Value interface{}
 }
 
+// 以下类型用于表示 amf0 中没有直接对应 Go 类型的值
+//
+// 读取时，各 amf0 类型对应的 Go 类型为:
+// Number      -> float64
+// Boolean     -> bool
+// String      -> string（LongString 也是）
+// Object      -> map[string]interface{}
+// Null        -> nil
+// Undefined   -> Undefined
+// Reference   -> 所引用的值
+// EcmaArray   -> EcmaArray
+// StrictArray -> []interface{}
+// Date        -> time.Time
+// Unsupported -> Unsupported
+// XMLDocument -> XMLDocument
+// TypedObject -> TypedObject
+//
+// 写入时，除以上类型外，还支持 []ObjectPair（按顺序写入的 Object），Reference，以及各种整型
+
+type Undefined struct{}
+
+type Unsupported struct{}
+
+type XMLDocument string
+
+// 写入时使用，写入对之前第 n 个复杂类型（Object, EcmaArray, StrictArray, TypedObject）的引用
+type Reference uint16
+
+// 常用于 onMetaData，保留了 key 的顺序
+type EcmaArray []ObjectPair
+
+func (arr EcmaArray) Get(key string) (interface{}, bool) {
+	for _, pair := range arr {
+		if pair.Key == key {
+			return pair.Value, true
+		}
+	}
+	return nil, false
+}
+
+type TypedObject struct {
+	ClassName string
+	Object    map[string]interface{}
+}
+
 type amf0 struct{}
 
 var AMF0 amf0
@@ -103,38 +155,180 @@ func (amf0) WriteBoolean(writer io.Writer, b bool) error {
 	return err
 }
 
+func (amf0) WriteUndefined(writer io.Writer) error {
+	_, err := writer.Write([]byte{AMF0TypeMarkerUndefined})
+	return err
+}
+
+func (amf0) WriteDate(writer io.Writer, t time.Time) error {
+	if _, err := writer.Write([]byte{AMF0TypeMarkerDate}); err != nil {
+		return err
+	}
+	if err := bele.WriteBE(writer, float64(t.UnixNano()/int64(time.Millisecond))); err != nil {
+		return err
+	}
+	// time-zone，规范要求为0
+	return bele.WriteBE(writer, int16(0))
+}
+
 func (amf0) WriteObject(writer io.Writer, objs []ObjectPair) error {
-	if _, err := writer.Write([]byte{AMF0TypeMarkerObject}); err != nil {
+	return writeObject(writer, AMF0TypeMarkerObject, objs, 0)
+}
+
+func (amf0) WriteEcmaArray(writer io.Writer, arr EcmaArray) error {
+	return writeObject(writer, AMF0TypeMarkerEcmaArray, arr, 0)
+}
+
+func (amf0) WriteStrictArray(writer io.Writer, arr []interface{}) error {
+	return writeStrictArray(writer, arr, 0)
+}
+
+// 根据 val 的类型写入对应的 amf0 数据，支持的类型见上文
+func (amf0) WriteValue(writer io.Writer, val interface{}) error {
+	return writeValue(writer, val, 0)
+}
+
+func writeValue(writer io.Writer, val interface{}, depth int) error {
+	if depth > amfMaxDepth {
+		return ErrAMFTooDeep
+	}
+	switch v := val.(type) {
+	case nil:
+		return AMF0.WriteNull(writer)
+	case Undefined:
+		return AMF0.WriteUndefined(writer)
+	case Unsupported:
+		_, err := writer.Write([]byte{AMF0TypeMarkerUnsupported})
 		return err
+	case bool:
+		return AMF0.WriteBoolean(writer, v)
+	case string:
+		return AMF0.WriteString(writer, v)
+	case XMLDocument:
+		if _, err := writer.Write([]byte{AMF0TypeMarkerXMLDocument}); err != nil {
+			return err
+		}
+		if err := bele.WriteBE(writer, uint32(len(v))); err != nil {
+			return err
+		}
+		_, err := writer.Write([]byte(v))
+		return err
+	case float64:
+		return AMF0.WriteNumber(writer, v)
+	case float32:
+		return AMF0.WriteNumber(writer, float64(v))
+	case int:
+		return AMF0.WriteNumber(writer, float64(v))
+	case int8:
+		return AMF0.WriteNumber(writer, float64(v))
+	case int16:
+		return AMF0.WriteNumber(writer, float64(v))
+	case int32:
+		return AMF0.WriteNumber(writer, float64(v))
+	case int64:
+		return AMF0.WriteNumber(writer, float64(v))
+	case uint:
+		return AMF0.WriteNumber(writer, float64(v))
+	case uint8:
+		return AMF0.WriteNumber(writer, float64(v))
+	case uint16:
+		return AMF0.WriteNumber(writer, float64(v))
+	case uint32:
+		return AMF0.WriteNumber(writer, float64(v))
+	case uint64:
+		return AMF0.WriteNumber(writer, float64(v))
+	case time.Time:
+		return AMF0.WriteDate(writer, v)
+	case Reference:
+		if _, err := writer.Write([]byte{AMF0TypeMarkerReference}); err != nil {
+			return err
+		}
+		return bele.WriteBE(writer, uint16(v))
+	case []ObjectPair:
+		return writeObject(writer, AMF0TypeMarkerObject, v, depth)
+	case map[string]interface{}:
+		return writeObject(writer, AMF0TypeMarkerObject, sortedPairs(v), depth)
+	case EcmaArray:
+		return writeObject(writer, AMF0TypeMarkerEcmaArray, v, depth)
+	case []interface{}:
+		return writeStrictArray(writer, v, depth)
+	case TypedObject:
+		if _, err := writer.Write([]byte{AMF0TypeMarkerTypedObject}); err != nil {
+			return err
+		}
+		if err := writeStringWithoutType(writer, v.ClassName); err != nil {
+			return err
+		}
+		return writeObjectProperties(writer, sortedPairs(v.Object), depth)
 	}
-	for i := 0; i < len(objs); i++ {
-		if err := bele.WriteBE(writer, uint16(len(objs[i].Key))); err != nil {
+	return ErrAMFInvalidType
+}
+
+// Object 以及 EcmaArray
+func writeObject(writer io.Writer, marker uint8, objs []ObjectPair, depth int) error {
+	if _, err := writer.Write([]byte{marker}); err != nil {
+		return err
+	}
+	if marker == AMF0TypeMarkerEcmaArray {
+		// associative-count，只是一个提示值，读取时不依赖它
+		if err := bele.WriteBE(writer, uint32(len(objs))); err != nil {
 			return err
 		}
-		if _, err := writer.Write([]byte(objs[i].Key)); err != nil {
+	}
+	return writeObjectProperties(writer, objs, depth)
+}
+
+func writeObjectProperties(writer io.Writer, objs []ObjectPair, depth int) error {
+	for i := 0; i < len(objs); i++ {
+		if err := writeStringWithoutType(writer, objs[i].Key); err != nil {
 			return err
 		}
-		switch objs[i].Value.(type) {
-		case string:
-			if err := AMF0.WriteString(writer, objs[i].Value.(string)); err != nil {
-				return err
-			}
-		case int:
-			if err := AMF0.WriteNumber(writer, float64(objs[i].Value.(int))); err != nil {
-				return err
-			}
-		case bool:
-			if err := AMF0.WriteBoolean(writer, objs[i].Value.(bool)); err != nil {
-				return err
-			}
-		default:
-			log.Panicf("unknown value type. i=%d, v=%v", i, objs[i].Value)
+		if err := writeValue(writer, objs[i].Value, depth+1); err != nil {
+			return err
 		}
 	}
 	_, err := writer.Write(AMF0TypeMarkerObjectEndBytes)
 	return err
 }
 
+func writeStrictArray(writer io.Writer, arr []interface{}, depth int) error {
+	if _, err := writer.Write([]byte{AMF0TypeMarkerStrictArray}); err != nil {
+		return err
+	}
+	if err := bele.WriteBE(writer, uint32(len(arr))); err != nil {
+		return err
+	}
+	for i := range arr {
+		if err := writeValue(writer, arr[i], depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeStringWithoutType(writer io.Writer, val string) error {
+	if len(val) > math.MaxUint16 {
+		return ErrAMFInvalidType
+	}
+	if err := bele.WriteBE(writer, uint16(len(val))); err != nil {
+		return err
+	}
+	_, err := writer.Write([]byte(val))
+	return err
+}
+
+// map 是无序的，按 key 排序后写入，保证输出是确定的
+func sortedPairs(m map[string]interface{}) []ObjectPair {
+	objs := make([]ObjectPair, 0, len(m))
+	for k, v := range m {
+		objs = append(objs, ObjectPair{Key: k, Value: v})
+	}
+	sort.Slice(objs, func(i, j int) bool {
+		return objs[i].Key < objs[j].Key
+	})
+	return objs
+}
+
 // read类型的方法集合
 //
 // 从输入参数<b>切片中读取函数名所指定的amf类型数据
@@ -221,50 +415,185 @@ func (amf0) ReadObject(b []byte) (map[string]interface{}, int, error) {
 	if b[0] != AMF0TypeMarkerObject {
 		return nil, 0, ErrAMFInvalidType
 	}
+	var r amf0Reader
+	v, l, err := r.readValue(b, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	return v.(map[string]interface{}), l, nil
+}
 
-	index := 1
-	obj := make(map[string]interface{})
-	for {
-		if len(b)-index >= 3 && bytes.Equal(b[index:index+3], AMF0TypeMarkerObjectEndBytes) {
-			return obj, index + 3, nil
-		}
+func (amf0) ReadEcmaArray(b []byte) (EcmaArray, int, error) {
+	if len(b) < 1 {
+		return nil, 0, ErrAMFTooShort
+	}
+	if b[0] != AMF0TypeMarkerEcmaArray {
+		return nil, 0, ErrAMFInvalidType
+	}
+	var r amf0Reader
+	v, l, err := r.readValue(b, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	return v.(EcmaArray), l, nil
+}
 
-		k, l, err := AMF0.ReadStringWithoutType(b[index:])
+// 读取任意类型的 amf0 数据，返回值的类型见上文
+func (amf0) ReadValue(b []byte) (interface{}, int, error) {
+	var r amf0Reader
+	return r.readValue(b, 0)
+}
+
+// 一次读取过程中的状态，用于解析 Reference
+type amf0Reader struct {
+	refs []interface{}
+}
+
+func (r *amf0Reader) readValue(b []byte, depth int) (interface{}, int, error) {
+	if depth > amfMaxDepth {
+		return nil, 0, ErrAMFTooDeep
+	}
+	if len(b) < 1 {
+		return nil, 0, ErrAMFTooShort
+	}
+
+	switch b[0] {
+	case AMF0TypeMarkerNumber:
+		return AMF0.ReadNumber(b)
+	case AMF0TypeMarkerBoolean:
+		return AMF0.ReadBoolean(b)
+	case AMF0TypeMarkerString, AMF0TypeMarkerLongString:
+		return AMF0.ReadString(b)
+	case AMF0TypeMarkerNull:
+		return nil, 1, nil
+	case AMF0TypeMarkerUndefined:
+		return Undefined{}, 1, nil
+	case AMF0TypeMarkerUnsupported:
+		return Unsupported{}, 1, nil
+	case AMF0TypeMarkerXMLDocument:
+		v, l, err := AMF0.ReadLongStringWithoutType(b[1:])
 		if err != nil {
 			return nil, 0, err
 		}
-		index += l
-		if len(b)-index < 1 {
+		return XMLDocument(v), l + 1, nil
+	case AMF0TypeMarkerDate:
+		// date-marker 1 | ms 8 | time-zone 2
+		if len(b) < 11 {
 			return nil, 0, ErrAMFTooShort
 		}
-		vt := b[index]
-		switch vt {
-		case AMF0TypeMarkerString:
-			v, l, err := AMF0.ReadString(b[index:])
-			if err != nil {
-				return nil, 0, err
-			}
+		ms := bele.BEFloat64(b[1:])
+		// ECMAScript 中 Date 的取值范围
+		if math.IsNaN(ms) || math.Abs(ms) > 8.64e15 {
+			return nil, 0, ErrAMFInvalidType
+		}
+		return time.Unix(int64(ms)/1000, int64(ms)%1000*int64(time.Millisecond)), 11, nil
+	case AMF0TypeMarkerReference:
+		if len(b) < 3 {
+			return nil, 0, ErrAMFTooShort
+		}
+		index := int(bele.BEUint16(b[1:]))
+		if index >= len(r.refs) || r.refs[index] == nil {
+			return nil, 0, ErrAMFReference
+		}
+		return r.refs[index], 3, nil
+	case AMF0TypeMarkerObject:
+		obj := make(map[string]interface{})
+		r.refs = append(r.refs, obj)
+		l, err := r.readObjectProperties(b[1:], depth, func(k string, v interface{}) {
 			obj[k] = v
-			index += l
-		case AMF0TypeMarkerBoolean:
-			v, l, err := AMF0.ReadBoolean(b[index:])
-			if err != nil {
-				return nil, 0, err
-			}
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+		return obj, l + 1, nil
+	case AMF0TypeMarkerTypedObject:
+		className, cl, err := AMF0.ReadStringWithoutType(b[1:])
+		if err != nil {
+			return nil, 0, err
+		}
+		obj := make(map[string]interface{})
+		r.refs = append(r.refs, obj)
+		l, err := r.readObjectProperties(b[1+cl:], depth, func(k string, v interface{}) {
 			obj[k] = v
-			index += l
-		case AMF0TypeMarkerNumber:
-			v, l, err := AMF0.ReadNumber(b[index:])
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+		return TypedObject{ClassName: className, Object: obj}, 1 + cl + l, nil
+	case AMF0TypeMarkerEcmaArray:
+		// associative-count 不可信，以 object end 为准
+		if len(b) < 5 {
+			return nil, 0, ErrAMFTooShort
+		}
+		// 数组在读取完成之前无法被引用，先占位
+		refIndex := len(r.refs)
+		r.refs = append(r.refs, nil)
+		var arr EcmaArray
+		l, err := r.readObjectProperties(b[5:], depth, func(k string, v interface{}) {
+			arr = append(arr, ObjectPair{Key: k, Value: v})
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+		r.refs[refIndex] = arr
+		return arr, l + 5, nil
+	case AMF0TypeMarkerStrictArray:
+		if len(b) < 5 {
+			return nil, 0, ErrAMFTooShort
+		}
+		count := int(bele.BEUint32(b[1:]))
+		// 每个元素至少1字节，防止恶意的 count 导致申请过大的内存
+		if count > len(b)-5 {
+			return nil, 0, ErrAMFTooShort
+		}
+		refIndex := len(r.refs)
+		r.refs = append(r.refs, nil)
+		arr := make([]interface{}, 0, count)
+		index := 5
+		for i := 0; i < count; i++ {
+			v, l, err := r.readValue(b[index:], depth+1)
 			if err != nil {
 				return nil, 0, err
 			}
-			obj[k] = v
+			arr = append(arr, v)
 			index += l
-		default:
-			log.Panicf("unknown type. vt=%d", vt)
 		}
+		r.refs[refIndex] = arr
+		return arr, index, nil
+	case AMF0TypeMarkerAvmplusObject:
+		// 每次切换都使用新的 amf3 引用表
+		var r3 amf3Reader
+		v, l, err := r3.readValue(b[1:], depth+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		return v, l + 1, nil
 	}
 
-	//panic("should not reach here.")
-	//return nil, 0, nil
+	// Movieclip, Recordset, ObjectEnd 以及未知类型
+	return nil, 0, ErrAMFInvalidType
+}
+
+// 读取 key-value 对，直到 object end
+// 返回值为消耗的字节大小，包含 object end
+func (r *amf0Reader) readObjectProperties(b []byte, depth int, onPair func(k string, v interface{})) (int, error) {
+	index := 0
+	for {
+		if len(b)-index >= 3 && bytes.Equal(b[index:index+3], AMF0TypeMarkerObjectEndBytes) {
+			return index + 3, nil
+		}
+
+		k, l, err := AMF0.ReadStringWithoutType(b[index:])
+		if err != nil {
+			return 0, err
+		}
+		index += l
+
+		v, l, err := r.readValue(b[index:], depth+1)
+		if err != nil {
+			return 0, err
+		}
+		onPair(k, v)
+		index += l
+	}
 }
@@ -12,6 +12,7 @@ import (
 	"bytes"
 	"strings"
 	"testing"
+	"time"
 
 	. "github.com/q191201771/lal/pkg/rtmp"
 	"github.com/q191201771/naza/pkg/assert"
@@ -240,13 +241,144 @@ func TestAMF0Corner(t *testing.T) {
 	assert.Equal(t, 0, l)
 	assert.Equal(t, ErrAMFInvalidType, err)
 
-	defer func() {
-		recover()
-	}()
 	objs = []ObjectPair{
 		{Key: "key", Value: []byte{1}},
 	}
-	_ = AMF0.WriteObject(mw, objs)
+	err = AMF0.WriteObject(fake.NewWriter(fake.WriterTypeDoNothing), objs)
+	assert.Equal(t, ErrAMFInvalidType, err)
+}
+
+func TestAmf0_WriteValue_ReadValue(t *testing.T) {
+	date := time.Unix(1577836800, 123*int64(time.Millisecond))
+	cases := []interface{}{
+		float64(1.5),
+		true,
+		"abc",
+		strings.Repeat("1", 65536),
+		nil,
+		Undefined{},
+		Unsupported{},
+		XMLDocument("<a></a>"),
+		date,
+		EcmaArray{
+			{Key: "duration", Value: float64(0)},
+			{Key: "width", Value: float64(1280)},
+			{Key: "encoder", Value: "obs"},
+		},
+		[]interface{}{float64(1), "2", false, nil},
+		map[string]interface{}{
+			"app":   "live",
+			"inner": map[string]interface{}{"a": float64(1), "b": []interface{}{"c"}},
+		},
+		TypedObject{ClassName: "com.lal.Foo", Object: map[string]interface{}{"x": float64(1)}},
+	}
+	for _, item := range cases {
+		out := &bytes.Buffer{}
+		err := AMF0.WriteValue(out, item)
+		assert.Equal(t, nil, err)
+		v, l, err := AMF0.ReadValue(out.Bytes())
+		assert.Equal(t, nil, err)
+		assert.Equal(t, out.Len(), l)
+		if tm, ok := v.(time.Time); ok {
+			assert.Equal(t, true, tm.Equal(date))
+			continue
+		}
+		assert.Equal(t, item, v)
+	}
+
+	// []ObjectPair 以及整型
+	out := &bytes.Buffer{}
+	err := AMF0.WriteValue(out, []ObjectPair{{Key: "a", Value: uint32(7)}, {Key: "b", Value: int64(-1)}})
+	assert.Equal(t, nil, err)
+	obj, _, err := AMF0.ReadObject(out.Bytes())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, map[string]interface{}{"a": float64(7), "b": float64(-1)}, obj)
+
+	// onMetaData 中常见的 ecma array
+	out = &bytes.Buffer{}
+	arr := EcmaArray{{Key: "framerate", Value: float64(25)}}
+	err = AMF0.WriteEcmaArray(out, arr)
+	assert.Equal(t, nil, err)
+	arr2, l, err := AMF0.ReadEcmaArray(out.Bytes())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, out.Len(), l)
+	v, ok := arr2.Get("framerate")
+	assert.Equal(t, true, ok)
+	assert.Equal(t, float64(25), v)
+	_, ok = arr2.Get("width")
+	assert.Equal(t, false, ok)
+}
+
+func TestAmf0_Reference(t *testing.T) {
+	// [ {a:1}, ref(1) ]，引用下标0是数组本身，下标1是对象
+	out := &bytes.Buffer{}
+	inner := []ObjectPair{{Key: "a", Value: float64(1)}}
+	err := AMF0.WriteStrictArray(out, []interface{}{inner, Reference(1)})
+	assert.Equal(t, nil, err)
+	v, _, err := AMF0.ReadValue(out.Bytes())
+	assert.Equal(t, nil, err)
+	arr := v.([]interface{})
+	assert.Equal(t, 2, len(arr))
+	assert.Equal(t, map[string]interface{}{"a": float64(1)}, arr[1])
+
+	// 引用未读取完的数组，以及不存在的下标
+	out.Reset()
+	err = AMF0.WriteStrictArray(out, []interface{}{Reference(0)})
+	assert.Equal(t, nil, err)
+	_, _, err = AMF0.ReadValue(out.Bytes())
+	assert.Equal(t, ErrAMFReference, err)
+	out.Reset()
+	err = AMF0.WriteValue(out, Reference(3))
+	assert.Equal(t, nil, err)
+	_, _, err = AMF0.ReadValue(out.Bytes())
+	assert.Equal(t, ErrAMFReference, err)
+}
+
+func TestAmf0_ReadValueCorner(t *testing.T) {
+	// 所有合法数据的截断都应该返回错误，而不是 panic
+	out := &bytes.Buffer{}
+	err := AMF0.WriteValue(out, map[string]interface{}{
+		"a": EcmaArray{{Key: "b", Value: []interface{}{"c", float64(1), time.Unix(1, 0)}}},
+		"d": TypedObject{ClassName: "e", Object: map[string]interface{}{"f": XMLDocument("g")}},
+	})
+	assert.Equal(t, nil, err)
+	b := out.Bytes()
+	for i := 0; i < len(b); i++ {
+		_, _, err = AMF0.ReadValue(b[:i])
+		assert.IsNotNil(t, err)
+	}
+
+	// 不支持的类型
+	for _, marker := range []uint8{AMF0TypeMarkerMovieclip, AMF0TypeMarkerObjectEnd, AMF0TypeMarkerRecordset, 0xff} {
+		_, _, err = AMF0.ReadValue([]byte{marker, 0, 0, 0, 0})
+		assert.Equal(t, ErrAMFInvalidType, err)
+	}
+
+	// 过长的 strict array count
+	_, _, err = AMF0.ReadValue([]byte{AMF0TypeMarkerStrictArray, 0xff, 0xff, 0xff, 0xff, 0})
+	assert.Equal(t, ErrAMFTooShort, err)
+
+	// 嵌套过深
+	b = nil
+	for i := 0; i < 100; i++ {
+		b = append(b, AMF0TypeMarkerStrictArray, 0, 0, 0, 1)
+	}
+	b = append(b, AMF0TypeMarkerNull)
+	_, _, err = AMF0.ReadValue(b)
+	assert.Equal(t, ErrAMFTooDeep, err)
+
+	var v interface{} = "x"
+	for i := 0; i < 100; i++ {
+		v = []interface{}{v}
+	}
+	err = AMF0.WriteValue(out, v)
+	assert.Equal(t, ErrAMFTooDeep, err)
+
+	// ReadObject 和 ReadEcmaArray 的类型检查
+	_, _, err = AMF0.ReadEcmaArray(nil)
+	assert.Equal(t, ErrAMFTooShort, err)
+	_, _, err = AMF0.ReadEcmaArray([]byte{AMF0TypeMarkerObject})
+	assert.Equal(t, ErrAMFInvalidType, err)
 }
 
 func BenchmarkAmf0_ReadObject(b *testing.B) {
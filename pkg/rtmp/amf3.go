@@ -0,0 +1,683 @@
+// Copyright 2019, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package rtmp
+
+// amf3.go
+// @pure
+// 提供amf3格式的编码与解码的操作
+//
+// 读取时，各 amf3 类型对应的 Go 类型为:
+// Undefined     -> Undefined
+// Null          -> nil
+// False, True   -> bool
+// Integer       -> float64（和 amf0 保持一致，便于上层统一处理）
+// Double        -> float64
+// String        -> string
+// XMLDocument   -> XMLDocument（XML 也是）
+// Date          -> time.Time
+// Array         -> []interface{}，如果包含关联部分，则为 EcmaArray，稠密部分的 key 为下标
+// Object        -> map[string]interface{}，如果有类名，则为 TypedObject
+// ByteArray     -> []byte
+// VectorInt     -> []int32
+// VectorUint    -> []uint32
+// VectorDouble  -> []float64
+// VectorObject  -> []interface{}
+//
+// 不支持 Externalizable 的 Object 以及 Dictionary
+//
+// 写入时不会产生引用
+
+import (
+	"io"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/q191201771/naza/pkg/bele"
+)
+
+const (
+	AMF3TypeMarkerUndefined    = uint8(0x00)
+	AMF3TypeMarkerNull         = uint8(0x01)
+	AMF3TypeMarkerFalse        = uint8(0x02)
+	AMF3TypeMarkerTrue         = uint8(0x03)
+	AMF3TypeMarkerInteger      = uint8(0x04)
+	AMF3TypeMarkerDouble       = uint8(0x05)
+	AMF3TypeMarkerString       = uint8(0x06)
+	AMF3TypeMarkerXMLDocument  = uint8(0x07)
+	AMF3TypeMarkerDate         = uint8(0x08)
+	AMF3TypeMarkerArray        = uint8(0x09)
+	AMF3TypeMarkerObject       = uint8(0x0a)
+	AMF3TypeMarkerXML          = uint8(0x0b)
+	AMF3TypeMarkerByteArray    = uint8(0x0c)
+	AMF3TypeMarkerVectorInt    = uint8(0x0d)
+	AMF3TypeMarkerVectorUint   = uint8(0x0e)
+	AMF3TypeMarkerVectorDouble = uint8(0x0f)
+	AMF3TypeMarkerVectorObject = uint8(0x10)
+	AMF3TypeMarkerDictionary   = uint8(0x11)
+)
+
+// U29 能表示的整数范围
+const (
+	amf3IntegerMax = 1<<28 - 1
+	amf3IntegerMin = -1 << 28
+	amf3U29Max     = 1<<29 - 1
+)
+
+type amf3 struct{}
+
+var AMF3 amf3
+
+// 读取任意类型的 amf3 数据，返回值的类型见上文
+func (amf3) ReadValue(b []byte) (interface{}, int, error) {
+	var r amf3Reader
+	return r.readValue(b, 0)
+}
+
+// 根据 val 的类型写入对应的 amf3 数据
+// 支持的类型同 amf0 的 WriteValue，另外支持 []byte, []int32, []uint32, []float64
+func (amf3) WriteValue(writer io.Writer, val interface{}) error {
+	return writeAMF3Value(writer, val, 0)
+}
+
+type amf3Traits struct {
+	className string
+	dynamic   bool
+	sealed    []string
+}
+
+// 一次读取过程中的状态，用于解析引用
+type amf3Reader struct {
+	strs   []string
+	objs   []interface{}
+	traits []amf3Traits
+}
+
+func (r *amf3Reader) readValue(b []byte, depth int) (interface{}, int, error) {
+	if depth > amfMaxDepth {
+		return nil, 0, ErrAMFTooDeep
+	}
+	if len(b) < 1 {
+		return nil, 0, ErrAMFTooShort
+	}
+
+	switch b[0] {
+	case AMF3TypeMarkerUndefined:
+		return Undefined{}, 1, nil
+	case AMF3TypeMarkerNull:
+		return nil, 1, nil
+	case AMF3TypeMarkerFalse:
+		return false, 1, nil
+	case AMF3TypeMarkerTrue:
+		return true, 1, nil
+	case AMF3TypeMarkerInteger:
+		u, l, err := readU29(b[1:])
+		if err != nil {
+			return nil, 0, err
+		}
+		v := int32(u)
+		if u&0x10000000 != 0 {
+			v = int32(u) - (1 << 29)
+		}
+		return float64(v), l + 1, nil
+	case AMF3TypeMarkerDouble:
+		if len(b) < 9 {
+			return nil, 0, ErrAMFTooShort
+		}
+		return bele.BEFloat64(b[1:]), 9, nil
+	case AMF3TypeMarkerString:
+		v, l, err := r.readString(b[1:])
+		if err != nil {
+			return nil, 0, err
+		}
+		return v, l + 1, nil
+	case AMF3TypeMarkerXMLDocument, AMF3TypeMarkerXML, AMF3TypeMarkerByteArray:
+		ref, n, l, err := readU29Ref(b[1:])
+		if err != nil {
+			return nil, 0, err
+		}
+		if ref {
+			v, err := r.objRef(n)
+			return v, l + 1, err
+		}
+		if n > len(b)-1-l {
+			return nil, 0, ErrAMFTooShort
+		}
+		data := b[1+l : 1+l+n]
+		var v interface{}
+		if b[0] == AMF3TypeMarkerByteArray {
+			v = append([]byte{}, data...)
+		} else {
+			v = XMLDocument(data)
+		}
+		r.objs = append(r.objs, v)
+		return v, 1 + l + n, nil
+	case AMF3TypeMarkerDate:
+		ref, n, l, err := readU29Ref(b[1:])
+		if err != nil {
+			return nil, 0, err
+		}
+		if ref {
+			v, err := r.objRef(n)
+			return v, l + 1, err
+		}
+		if len(b)-1-l < 8 {
+			return nil, 0, ErrAMFTooShort
+		}
+		ms := bele.BEFloat64(b[1+l:])
+		if math.IsNaN(ms) || math.Abs(ms) > 8.64e15 {
+			return nil, 0, ErrAMFInvalidType
+		}
+		v := time.Unix(int64(ms)/1000, int64(ms)%1000*int64(time.Millisecond))
+		r.objs = append(r.objs, v)
+		return v, 1 + l + 8, nil
+	case AMF3TypeMarkerArray:
+		return r.readArray(b, depth)
+	case AMF3TypeMarkerObject:
+		return r.readObject(b, depth)
+	case AMF3TypeMarkerVectorInt, AMF3TypeMarkerVectorUint, AMF3TypeMarkerVectorDouble, AMF3TypeMarkerVectorObject:
+		return r.readVector(b, depth)
+	}
+
+	// Dictionary 以及未知类型
+	return nil, 0, ErrAMFInvalidType
+}
+
+func (r *amf3Reader) readString(b []byte) (string, int, error) {
+	ref, n, l, err := readU29Ref(b)
+	if err != nil {
+		return "", 0, err
+	}
+	if ref {
+		if n >= len(r.strs) {
+			return "", 0, ErrAMFReference
+		}
+		return r.strs[n], l, nil
+	}
+	if n > len(b)-l {
+		return "", 0, ErrAMFTooShort
+	}
+	v := string(b[l : l+n])
+	// 空字符串不加入引用表
+	if v != "" {
+		r.strs = append(r.strs, v)
+	}
+	return v, l + n, nil
+}
+
+func (r *amf3Reader) objRef(index int) (interface{}, error) {
+	if index >= len(r.objs) || r.objs[index] == nil {
+		return nil, ErrAMFReference
+	}
+	return r.objs[index], nil
+}
+
+func (r *amf3Reader) readArray(b []byte, depth int) (interface{}, int, error) {
+	ref, count, l, err := readU29Ref(b[1:])
+	if err != nil {
+		return nil, 0, err
+	}
+	index := 1 + l
+	if ref {
+		v, err := r.objRef(count)
+		return v, index, err
+	}
+
+	// 数组在读取完成之前无法被引用，先占位
+	refIndex := len(r.objs)
+	r.objs = append(r.objs, nil)
+
+	// 关联部分，直到空字符串为止
+	var assoc EcmaArray
+	for {
+		k, l, err := r.readString(b[index:])
+		if err != nil {
+			return nil, 0, err
+		}
+		index += l
+		if k == "" {
+			break
+		}
+		v, l, err := r.readValue(b[index:], depth+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		index += l
+		assoc = append(assoc, ObjectPair{Key: k, Value: v})
+	}
+
+	// 稠密部分，每个元素至少1字节，防止恶意的 count 导致申请过大的内存
+	if count > len(b)-index {
+		return nil, 0, ErrAMFTooShort
+	}
+	dense := make([]interface{}, 0, count)
+	for i := 0; i < count; i++ {
+		v, l, err := r.readValue(b[index:], depth+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		index += l
+		dense = append(dense, v)
+	}
+
+	var out interface{} = dense
+	if len(assoc) != 0 {
+		for i := range dense {
+			assoc = append(assoc, ObjectPair{Key: strconv.Itoa(i), Value: dense[i]})
+		}
+		out = assoc
+	}
+	r.objs[refIndex] = out
+	return out, index, nil
+}
+
+func (r *amf3Reader) readObject(b []byte, depth int) (interface{}, int, error) {
+	u, l, err := readU29(b[1:])
+	if err != nil {
+		return nil, 0, err
+	}
+	index := 1 + l
+	if u&0x01 == 0 {
+		v, err := r.objRef(int(u >> 1))
+		return v, index, err
+	}
+
+	var traits amf3Traits
+	if u&0x02 == 0 {
+		// 引用之前的 traits
+		ti := int(u >> 2)
+		if ti >= len(r.traits) {
+			return nil, 0, ErrAMFReference
+		}
+		traits = r.traits[ti]
+	} else {
+		if u&0x04 != 0 {
+			// externalizable，需要知道类的序列化方式，无法解析
+			return nil, 0, ErrAMFInvalidType
+		}
+		traits.dynamic = u&0x08 != 0
+		sealedCount := int(u >> 4)
+		traits.className, l, err = r.readString(b[index:])
+		if err != nil {
+			return nil, 0, err
+		}
+		index += l
+		if sealedCount > len(b)-index {
+			return nil, 0, ErrAMFTooShort
+		}
+		for i := 0; i < sealedCount; i++ {
+			name, l, err := r.readString(b[index:])
+			if err != nil {
+				return nil, 0, err
+			}
+			index += l
+			traits.sealed = append(traits.sealed, name)
+		}
+		r.traits = append(r.traits, traits)
+	}
+
+	obj := make(map[string]interface{})
+	var out interface{} = obj
+	if traits.className != "" {
+		out = TypedObject{ClassName: traits.className, Object: obj}
+	}
+	r.objs = append(r.objs, out)
+
+	for _, name := range traits.sealed {
+		v, l, err := r.readValue(b[index:], depth+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		index += l
+		obj[name] = v
+	}
+	if traits.dynamic {
+		for {
+			k, l, err := r.readString(b[index:])
+			if err != nil {
+				return nil, 0, err
+			}
+			index += l
+			if k == "" {
+				break
+			}
+			v, l, err := r.readValue(b[index:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			index += l
+			obj[k] = v
+		}
+	}
+	return out, index, nil
+}
+
+func (r *amf3Reader) readVector(b []byte, depth int) (interface{}, int, error) {
+	ref, count, l, err := readU29Ref(b[1:])
+	if err != nil {
+		return nil, 0, err
+	}
+	index := 1 + l
+	if ref {
+		v, err := r.objRef(count)
+		return v, index, err
+	}
+	// fixed-vector 标志
+	if len(b)-index < 1 {
+		return nil, 0, ErrAMFTooShort
+	}
+	index++
+
+	var out interface{}
+	switch b[0] {
+	case AMF3TypeMarkerVectorInt, AMF3TypeMarkerVectorUint:
+		if count > (len(b)-index)/4 {
+			return nil, 0, ErrAMFTooShort
+		}
+		if b[0] == AMF3TypeMarkerVectorInt {
+			v := make([]int32, count)
+			for i := range v {
+				v[i] = int32(bele.BEUint32(b[index+i*4:]))
+			}
+			out = v
+		} else {
+			v := make([]uint32, count)
+			for i := range v {
+				v[i] = bele.BEUint32(b[index+i*4:])
+			}
+			out = v
+		}
+		index += count * 4
+		r.objs = append(r.objs, out)
+	case AMF3TypeMarkerVectorDouble:
+		if count > (len(b)-index)/8 {
+			return nil, 0, ErrAMFTooShort
+		}
+		v := make([]float64, count)
+		for i := range v {
+			v[i] = bele.BEFloat64(b[index+i*8:])
+		}
+		index += count * 8
+		out = v
+		r.objs = append(r.objs, out)
+	default:
+		// object-type-name，忽略
+		_, l, err := r.readString(b[index:])
+		if err != nil {
+			return nil, 0, err
+		}
+		index += l
+		if count > len(b)-index {
+			return nil, 0, ErrAMFTooShort
+		}
+		refIndex := len(r.objs)
+		r.objs = append(r.objs, nil)
+		v := make([]interface{}, 0, count)
+		for i := 0; i < count; i++ {
+			item, l, err := r.readValue(b[index:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			index += l
+			v = append(v, item)
+		}
+		out = v
+		r.objs[refIndex] = out
+	}
+	return out, index, nil
+}
+
+func writeAMF3Value(writer io.Writer, val interface{}, depth int) error {
+	if depth > amfMaxDepth {
+		return ErrAMFTooDeep
+	}
+	switch v := val.(type) {
+	case nil:
+		return writeMarker(writer, AMF3TypeMarkerNull)
+	case Undefined:
+		return writeMarker(writer, AMF3TypeMarkerUndefined)
+	case bool:
+		if v {
+			return writeMarker(writer, AMF3TypeMarkerTrue)
+		}
+		return writeMarker(writer, AMF3TypeMarkerFalse)
+	case string:
+		if err := writeMarker(writer, AMF3TypeMarkerString); err != nil {
+			return err
+		}
+		return writeAMF3String(writer, v)
+	case XMLDocument:
+		if err := writeMarker(writer, AMF3TypeMarkerXMLDocument); err != nil {
+			return err
+		}
+		return writeAMF3String(writer, string(v))
+	case []byte:
+		if err := writeMarker(writer, AMF3TypeMarkerByteArray); err != nil {
+			return err
+		}
+		return writeAMF3String(writer, string(v))
+	case float64:
+		return writeAMF3Number(writer, v)
+	case float32:
+		return writeAMF3Number(writer, float64(v))
+	case int:
+		return writeAMF3Number(writer, float64(v))
+	case int8:
+		return writeAMF3Number(writer, float64(v))
+	case int16:
+		return writeAMF3Number(writer, float64(v))
+	case int32:
+		return writeAMF3Number(writer, float64(v))
+	case int64:
+		return writeAMF3Number(writer, float64(v))
+	case uint:
+		return writeAMF3Number(writer, float64(v))
+	case uint8:
+		return writeAMF3Number(writer, float64(v))
+	case uint16:
+		return writeAMF3Number(writer, float64(v))
+	case uint32:
+		return writeAMF3Number(writer, float64(v))
+	case uint64:
+		return writeAMF3Number(writer, float64(v))
+	case time.Time:
+		if err := writeMarker(writer, AMF3TypeMarkerDate); err != nil {
+			return err
+		}
+		if err := writeU29(writer, 1); err != nil {
+			return err
+		}
+		return bele.WriteBE(writer, float64(v.UnixNano()/int64(time.Millisecond)))
+	case []interface{}:
+		return writeAMF3Array(writer, nil, v, depth)
+	case EcmaArray:
+		return writeAMF3Array(writer, v, nil, depth)
+	case []ObjectPair:
+		return writeAMF3Object(writer, "", v, depth)
+	case map[string]interface{}:
+		return writeAMF3Object(writer, "", sortedPairs(v), depth)
+	case TypedObject:
+		return writeAMF3Object(writer, v.ClassName, sortedPairs(v.Object), depth)
+	case []int32:
+		if err := writeAMF3VectorHeader(writer, AMF3TypeMarkerVectorInt, len(v)); err != nil {
+			return err
+		}
+		for i := range v {
+			if err := bele.WriteBE(writer, v[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	case []uint32:
+		if err := writeAMF3VectorHeader(writer, AMF3TypeMarkerVectorUint, len(v)); err != nil {
+			return err
+		}
+		for i := range v {
+			if err := bele.WriteBE(writer, v[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	case []float64:
+		if err := writeAMF3VectorHeader(writer, AMF3TypeMarkerVectorDouble, len(v)); err != nil {
+			return err
+		}
+		for i := range v {
+			if err := bele.WriteBE(writer, v[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return ErrAMFInvalidType
+}
+
+func writeMarker(writer io.Writer, marker uint8) error {
+	_, err := writer.Write([]byte{marker})
+	return err
+}
+
+// 整数并且在 U29 的范围内时使用 Integer，否则使用 Double
+func writeAMF3Number(writer io.Writer, v float64) error {
+	if v == math.Trunc(v) && v >= amf3IntegerMin && v <= amf3IntegerMax {
+		if err := writeMarker(writer, AMF3TypeMarkerInteger); err != nil {
+			return err
+		}
+		return writeU29(writer, uint32(int32(v))&amf3U29Max)
+	}
+	if err := writeMarker(writer, AMF3TypeMarkerDouble); err != nil {
+		return err
+	}
+	return bele.WriteBE(writer, v)
+}
+
+func writeAMF3String(writer io.Writer, v string) error {
+	if len(v) > amf3IntegerMax {
+		return ErrAMFInvalidType
+	}
+	if err := writeU29(writer, uint32(len(v))<<1|1); err != nil {
+		return err
+	}
+	_, err := writer.Write([]byte(v))
+	return err
+}
+
+func writeAMF3Array(writer io.Writer, assoc []ObjectPair, dense []interface{}, depth int) error {
+	if len(dense) > amf3IntegerMax {
+		return ErrAMFInvalidType
+	}
+	if err := writeMarker(writer, AMF3TypeMarkerArray); err != nil {
+		return err
+	}
+	if err := writeU29(writer, uint32(len(dense))<<1|1); err != nil {
+		return err
+	}
+	if err := writeAMF3Pairs(writer, assoc, depth); err != nil {
+		return err
+	}
+	for i := range dense {
+		if err := writeAMF3Value(writer, dense[i], depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 使用内联的 traits，没有 sealed 成员，所有成员都是 dynamic 的
+func writeAMF3Object(writer io.Writer, className string, objs []ObjectPair, depth int) error {
+	if err := writeMarker(writer, AMF3TypeMarkerObject); err != nil {
+		return err
+	}
+	// U29O-traits: sealed count 0 | dynamic 1 | externalizable 0 | traits inline 1 | object inline 1
+	if err := writeU29(writer, 0x0b); err != nil {
+		return err
+	}
+	if err := writeAMF3String(writer, className); err != nil {
+		return err
+	}
+	return writeAMF3Pairs(writer, objs, depth)
+}
+
+// key-value 对，以空字符串结束
+func writeAMF3Pairs(writer io.Writer, objs []ObjectPair, depth int) error {
+	for i := range objs {
+		if objs[i].Key == "" {
+			return ErrAMFInvalidType
+		}
+		if err := writeAMF3String(writer, objs[i].Key); err != nil {
+			return err
+		}
+		if err := writeAMF3Value(writer, objs[i].Value, depth+1); err != nil {
+			return err
+		}
+	}
+	return writeU29(writer, 1)
+}
+
+func writeAMF3VectorHeader(writer io.Writer, marker uint8, count int) error {
+	if count > amf3IntegerMax {
+		return ErrAMFInvalidType
+	}
+	if err := writeMarker(writer, marker); err != nil {
+		return err
+	}
+	if err := writeU29(writer, uint32(count)<<1|1); err != nil {
+		return err
+	}
+	// fixed-vector
+	return writeMarker(writer, 0)
+}
+
+// 读取 U29，返回值为读取出的值，以及消耗的字节大小
+func readU29(b []byte) (uint32, int, error) {
+	var v uint32
+	for i := 0; i < 4; i++ {
+		if i >= len(b) {
+			return 0, 0, ErrAMFTooShort
+		}
+		if i == 3 {
+			// 第4个字节的8位都是有效位
+			return v<<8 | uint32(b[i]), 4, nil
+		}
+		v = v<<7 | uint32(b[i]&0x7f)
+		if b[i]&0x80 == 0 {
+			return v, i + 1, nil
+		}
+	}
+	// should not reach here
+	return 0, 0, ErrAMFInvalidType
+}
+
+// 读取最低位表示是否为引用的 U29
+// 第1个返回值为 true 时表示是引用，第2个返回值为引用的下标
+// 第1个返回值为 false 时，第2个返回值为长度或者个数
+func readU29Ref(b []byte) (bool, int, int, error) {
+	u, l, err := readU29(b)
+	if err != nil {
+		return false, 0, 0, err
+	}
+	return u&0x01 == 0, int(u >> 1), l, nil
+}
+
+func writeU29(writer io.Writer, v uint32) error {
+	v &= amf3U29Max
+	var b []byte
+	switch {
+	case v < 0x80:
+		b = []byte{uint8(v)}
+	case v < 0x4000:
+		b = []byte{uint8(v>>7) | 0x80, uint8(v & 0x7f)}
+	case v < 0x200000:
+		b = []byte{uint8(v>>14) | 0x80, uint8(v>>7)&0x7f | 0x80, uint8(v & 0x7f)}
+	default:
+		b = []byte{uint8(v>>22) | 0x80, uint8(v>>15)&0x7f | 0x80, uint8(v>>8)&0x7f | 0x80, uint8(v)}
+	}
+	_, err := writer.Write(b)
+	return err
+}
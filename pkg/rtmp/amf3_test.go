@@ -0,0 +1,153 @@
+// Copyright 2019, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package rtmp_test
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+
+	. "github.com/q191201771/lal/pkg/rtmp"
+	"github.com/q191201771/naza/pkg/assert"
+)
+
+func TestAmf3_WriteValue_ReadValue(t *testing.T) {
+	date := time.Unix(1577836800, 456*int64(time.Millisecond))
+	cases := []interface{}{
+		Undefined{},
+		nil,
+		true,
+		false,
+		float64(0),
+		float64(127),
+		float64(128),
+		float64(16383),
+		float64(16384),
+		float64(2097151),
+		float64(2097152),
+		float64(1<<28 - 1),
+		float64(-1),
+		float64(-1 << 28),
+		float64(1 << 28),
+		float64(1.5),
+		math.MaxFloat64,
+		"",
+		"abc",
+		XMLDocument("<a/>"),
+		date,
+		[]byte{1, 2, 3},
+		[]interface{}{float64(1), "2", nil},
+		EcmaArray{{Key: "a", Value: "b"}},
+		map[string]interface{}{
+			"app":    "live",
+			"nested": map[string]interface{}{"x": []interface{}{"y"}},
+		},
+		TypedObject{ClassName: "flex.messaging.io.ArrayCollection", Object: map[string]interface{}{"k": float64(1)}},
+		[]int32{-1, 0, 1},
+		[]uint32{0, 0xffffffff},
+		[]float64{1.5, -2},
+	}
+	for _, item := range cases {
+		out := &bytes.Buffer{}
+		err := AMF3.WriteValue(out, item)
+		assert.Equal(t, nil, err)
+		v, l, err := AMF3.ReadValue(out.Bytes())
+		assert.Equal(t, nil, err)
+		assert.Equal(t, out.Len(), l)
+		if tm, ok := v.(time.Time); ok {
+			assert.Equal(t, true, tm.Equal(date))
+			continue
+		}
+		assert.Equal(t, item, v)
+	}
+
+	out := &bytes.Buffer{}
+	err := AMF3.WriteValue(out, struct{}{})
+	assert.Equal(t, ErrAMFInvalidType, err)
+}
+
+func TestAmf3_Reference(t *testing.T) {
+	// 数组 [ "ab", "ab"(字符串引用0), {a:1}, 对象引用1, 相同 traits 的对象 {a:2} ]
+	b := []byte{
+		AMF3TypeMarkerArray, 0x0b, 0x01, // dense count 5, 关联部分为空
+		AMF3TypeMarkerString, 0x05, 'a', 'b',
+		AMF3TypeMarkerString, 0x00,
+		AMF3TypeMarkerObject, 0x13, 0x01, 0x03, 'a', AMF3TypeMarkerInteger, 0x01, // sealed count 1, 匿名类, 成员 a
+		AMF3TypeMarkerObject, 0x02,
+		AMF3TypeMarkerObject, 0x01, AMF3TypeMarkerInteger, 0x02, // traits 引用0
+	}
+	v, l, err := AMF3.ReadValue(b)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, len(b), l)
+	obj := map[string]interface{}{"a": float64(1)}
+	assert.Equal(t, []interface{}{"ab", "ab", obj, obj, map[string]interface{}{"a": float64(2)}}, v)
+
+	// 引用自身未读取完的数组，以及不存在的下标
+	_, _, err = AMF3.ReadValue([]byte{AMF3TypeMarkerArray, 0x03, 0x01, AMF3TypeMarkerArray, 0x00})
+	assert.Equal(t, ErrAMFReference, err)
+	_, _, err = AMF3.ReadValue([]byte{AMF3TypeMarkerString, 0x02})
+	assert.Equal(t, ErrAMFReference, err)
+	_, _, err = AMF3.ReadValue([]byte{AMF3TypeMarkerObject, 0x05})
+	assert.Equal(t, ErrAMFReference, err)
+}
+
+func TestAmf3_Corner(t *testing.T) {
+	// 所有合法数据的截断都应该返回错误，而不是 panic
+	out := &bytes.Buffer{}
+	err := AMF3.WriteValue(out, map[string]interface{}{
+		"a": EcmaArray{{Key: "b", Value: []interface{}{"c", float64(1 << 20), time.Unix(1, 0)}}},
+		"d": TypedObject{ClassName: "e", Object: map[string]interface{}{"f": []byte{1}}},
+		"g": []float64{1},
+	})
+	assert.Equal(t, nil, err)
+	b := out.Bytes()
+	for i := 0; i < len(b); i++ {
+		_, _, err = AMF3.ReadValue(b[:i])
+		assert.IsNotNil(t, err)
+	}
+
+	// externalizable 以及 dictionary
+	_, _, err = AMF3.ReadValue([]byte{AMF3TypeMarkerObject, 0x07, 0x01})
+	assert.Equal(t, ErrAMFInvalidType, err)
+	_, _, err = AMF3.ReadValue([]byte{AMF3TypeMarkerDictionary, 0x01, 0x00})
+	assert.Equal(t, ErrAMFInvalidType, err)
+
+	// 过大的 count
+	_, _, err = AMF3.ReadValue([]byte{AMF3TypeMarkerArray, 0xff, 0xff, 0xff, 0xff, 0x01})
+	assert.Equal(t, ErrAMFTooShort, err)
+	_, _, err = AMF3.ReadValue([]byte{AMF3TypeMarkerVectorDouble, 0xff, 0xff, 0xff, 0xff, 0x00})
+	assert.Equal(t, ErrAMFTooShort, err)
+
+	// 嵌套过深
+	b = nil
+	for i := 0; i < 100; i++ {
+		b = append(b, AMF3TypeMarkerArray, 0x03, 0x01)
+	}
+	b = append(b, AMF3TypeMarkerNull)
+	_, _, err = AMF3.ReadValue(b)
+	assert.Equal(t, ErrAMFTooDeep, err)
+}
+
+func TestAmf0_AvmplusObject(t *testing.T) {
+	// amf0 中通过 avmplus-object-marker 切换到 amf3
+	out := &bytes.Buffer{}
+	_ = AMF0.WriteString(out, "connect")
+	out.WriteByte(AMF0TypeMarkerAvmplusObject)
+	_ = AMF3.WriteValue(out, map[string]interface{}{"app": "live", "objectEncoding": float64(ObjectEncodingAMF3)})
+
+	b := out.Bytes()
+	cmd, l, err := AMF0.ReadString(b)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "connect", cmd)
+	v, l2, err := AMF0.ReadValue(b[l:])
+	assert.Equal(t, nil, err)
+	assert.Equal(t, len(b)-l, l2)
+	assert.Equal(t, map[string]interface{}{"app": "live", "objectEncoding": float64(3)}, v)
+}
@@ -0,0 +1,71 @@
+// Copyright 2019, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package rtmp
+
+import (
+	"io"
+	"sync"
+
+	"github.com/q191201771/lal/pkg/httpflv"
+)
+
+// 供 PushSession 和 ServerSession 使用，将 AVMsg 切割成 chunk 后发送
+// 每个 session 持有一个，使用有状态的 ChunkDivider 压缩 chunk header
+type avMsgWriter struct {
+	chunkSize int // 为0时使用 LocalChunkSize
+
+	mutex   sync.Mutex
+	divider *ChunkDivider
+}
+
+// @param streamID 对端 publish 或者 play 所使用的 message stream id
+func (w *avMsgWriter) write(writer io.Writer, msg AVMsg, streamID int) error {
+	h := msg.Header
+	switch h.MsgTypeID {
+	case TypeidAudio:
+		h.CSID = CSIDAudio
+	case TypeidVideo:
+		h.CSID = CSIDVideo
+	case TypeidDataMessageAMF0, TypeidDataMessageAMF3:
+		h.CSID = CSIDAMF
+	default:
+		return ErrRTMP
+	}
+	h.MsgLen = uint32(len(msg.Payload))
+	h.MsgStreamID = streamID
+
+	// 切割和发送需要保证顺序一致
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.divider == nil {
+		chunkSize := w.chunkSize
+		if chunkSize == 0 {
+			chunkSize = LocalChunkSize
+		}
+		w.divider = NewChunkDivider(chunkSize)
+	}
+	// data message 和信令共用 csid，信令都使用 fmt0 发送，所以这里也不压缩
+	if h.CSID == csidOverStream {
+		w.divider.Reset(h.CSID)
+	}
+	_, err := writer.Write(w.divider.Divide(msg.Payload, &h))
+	return err
+}
+
+func flvTag2AVMsg(tag httpflv.Tag) AVMsg {
+	return AVMsg{
+		Header: Header{
+			MsgLen:       tag.Header.DataSize,
+			MsgTypeID:    tag.Header.Type,
+			Timestamp:    tag.Header.Timestamp,
+			TimestampAbs: tag.Header.Timestamp,
+		},
+		Payload: tag.Payload(),
+	}
+}
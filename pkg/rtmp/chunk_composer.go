@@ -14,14 +14,19 @@ package rtmp
 
 import (
 	"io"
-	"log"
+	"runtime/debug"
 
+	"github.com/q191201771/lal/pkg/bufpool"
 	"github.com/q191201771/naza/pkg/bele"
+	log "github.com/q191201771/naza/pkg/nazalog"
 )
 
+const aggregateSubHeaderSize = 11
+
 type ChunkComposer struct {
 	peerChunkSize uint32
 	csid2stream   map[int]*Stream
+	bufferedBytes int64 // 所有 csid 上用于组装 message 的内存块的大小之和
 }
 
 func NewChunkComposer() *ChunkComposer {
@@ -38,8 +43,22 @@ func (c *ChunkComposer) SetPeerChunkSize(val uint32) {
 type CompleteMessageCB func(stream *Stream) error
 
 // @param cb 回调结束后，内存块会被 ChunkComposer 再次使用
-func (c *ChunkComposer) RunLoop(reader io.Reader, cb CompleteMessageCB) error {
+// Abort message 在内部处理，不回调；Aggregate message 拆分成子 message 后逐个回调
+//
+// 处理 message 时发生 panic（比如对端发送了异常的数据），打印 message 内容后返回 ErrPanic，只影响当前 session
+func (c *ChunkComposer) RunLoop(reader io.Reader, cb CompleteMessageCB) (err error) {
 	bootstrap := make([]byte, 11)
+	var stream *Stream
+	defer func() {
+		if r := recover(); r != nil {
+			if stream != nil {
+				log.Errorf("recover from panic. err=%v, %s\n%s", r, stream.toDebugString(), debug.Stack())
+			} else {
+				log.Errorf("recover from panic. err=%v\n%s", r, debug.Stack())
+			}
+			err = ErrPanic
+		}
+	}()
 
 	for {
 		if _, err := io.ReadAtLeast(reader, bootstrap[:1], 1); err != nil {
@@ -65,7 +84,10 @@ func (c *ChunkComposer) RunLoop(reader io.Reader, cb CompleteMessageCB) error {
 			// noop
 		}
 
-		stream := c.getOrCreateStream(csid)
+		stream, err = c.getOrCreateStream(csid)
+		if err != nil {
+			return err
+		}
 
 		// 5.3.1.2. Chunk Message Header
 		switch fmt {
@@ -80,7 +102,11 @@ func (c *ChunkComposer) RunLoop(reader io.Reader, cb CompleteMessageCB) error {
 			stream.header.MsgTypeID = bootstrap[6]
 			stream.header.MsgStreamID = int(bele.LEUint32(bootstrap[7:]))
 
-			stream.msg.reserve(stream.header.MsgLen)
+			// 新的 message 开始，丢弃之前没有接收完整的 message
+			stream.msg.clear()
+			if err := c.reserve(stream); err != nil {
+				return err
+			}
 		case 1:
 			if _, err := io.ReadAtLeast(reader, bootstrap[:7], 7); err != nil {
 				return err
@@ -91,7 +117,10 @@ func (c *ChunkComposer) RunLoop(reader io.Reader, cb CompleteMessageCB) error {
 			stream.header.MsgLen = bele.BEUint24(bootstrap[3:])
 			stream.header.MsgTypeID = bootstrap[6]
 
-			stream.msg.reserve(stream.header.MsgLen)
+			stream.msg.clear()
+			if err := c.reserve(stream); err != nil {
+				return err
+			}
 		case 2:
 			if _, err := io.ReadAtLeast(reader, bootstrap[:3], 3); err != nil {
 				return err
@@ -125,17 +154,16 @@ func (c *ChunkComposer) RunLoop(reader io.Reader, cb CompleteMessageCB) error {
 				// noop
 			}
 		}
+		// fmt3 作为新 message 的第一个 chunk 时，时间戳增量和前一个 chunk 相同
+		if fmt == 3 && stream.msg.len() == 0 {
+			stream.header.TimestampAbs += stream.header.Timestamp
+		}
 		//stream.header.CSID = csid
 		//log.Debugf("CHEFGREPME tag1 fmt:%d header:%+v csid:%d len:%d ts:%d", fmt, stream.header, csid, stream.header.MsgLen, stream.header.TimestampAbs)
 
-		var neededSize uint32
-		if stream.header.MsgLen <= c.peerChunkSize {
-			neededSize = stream.header.MsgLen
-		} else {
-			neededSize = stream.header.MsgLen - stream.msg.len()
-			if neededSize > c.peerChunkSize {
-				neededSize = c.peerChunkSize
-			}
+		neededSize := stream.header.MsgLen - stream.msg.len()
+		if neededSize > c.peerChunkSize {
+			neededSize = c.peerChunkSize
 		}
 
 		//stream.msg.reserve(neededSize)
@@ -147,27 +175,124 @@ func (c *ChunkComposer) RunLoop(reader io.Reader, cb CompleteMessageCB) error {
 		if stream.msg.len() == stream.header.MsgLen {
 			// 对端设置了chunk size
 			if stream.header.MsgTypeID == typeidSetChunkSize {
-				val := bele.BEUint32(stream.msg.buf)
+				if stream.msg.len() < 4 {
+					return ErrRTMP
+				}
+				// 最高位必须为0，并且不能为0，否则之后无法读取 message
+				val := bele.BEUint32(stream.msg.buf[stream.msg.b:])
+				if val == 0 || val&0x80000000 != 0 {
+					return ErrRTMP
+				}
 				c.SetPeerChunkSize(val)
 			}
 
 			stream.header.CSID = csid
-			if err := cb(stream); err != nil {
+			switch stream.header.MsgTypeID {
+			case typeidAbort:
+				err = c.abort(stream)
+			case typeidAggregateMessage:
+				err = c.splitAggregate(stream, cb)
+			default:
+				err = cb(stream)
+			}
+			if err != nil {
 				return err
 			}
 			stream.msg.clear()
 		}
-		if stream.msg.len() > stream.header.MsgLen {
-			log.Panicf("stream msg len should not greater than len field in header. stream.msg.len=%d, len.in.header=%d", stream.msg.len(), stream.header.MsgLen)
+	}
+}
+
+// 5.4.2. Abort Message
+// 丢弃对应 csid 上还没有接收完整的 message
+func (c *ChunkComposer) abort(stream *Stream) error {
+	if stream.msg.len() < 4 {
+		return ErrRTMP
+	}
+	csid := int(bele.BEUint32(stream.msg.buf[stream.msg.b:]))
+	if target, exist := c.csid2stream[csid]; exist {
+		target.msg.clear()
+	}
+	return nil
+}
+
+// 7.1.6. Aggregate Message
+// payload 由多个子 message 组成，每个子 message 的格式和 flv tag 相同，即 header(11) + payload + back pointer(4)
+// 子 message 的绝对时间戳 = 聚合 message 的绝对时间戳 + (子 message 的时间戳 - 第一个子 message 的时间戳)
+func (c *ChunkComposer) splitAggregate(stream *Stream, cb CompleteMessageCB) error {
+	buf := stream.msg.buf[stream.msg.b:stream.msg.e]
+	var sub Stream
+	var firstTimestamp uint32
+	for i := 0; len(buf) > 0; i++ {
+		if len(buf) < aggregateSubHeaderSize {
+			return ErrRTMP
+		}
+		msgLen := bele.BEUint24(buf[1:])
+		timestamp := bele.BEUint24(buf[4:]) | uint32(buf[7])<<24
+		end := aggregateSubHeaderSize + int(msgLen)
+		if len(buf) < end {
+			return ErrRTMP
+		}
+		if i == 0 {
+			firstTimestamp = timestamp
+		}
+
+		sub.header = Header{
+			CSID:         stream.header.CSID,
+			MsgLen:       msgLen,
+			TimestampAbs: stream.header.TimestampAbs + timestamp - firstTimestamp,
+			MsgTypeID:    buf[0],
+			MsgStreamID:  stream.header.MsgStreamID,
+		}
+		sub.header.Timestamp = sub.header.TimestampAbs
+		// 直接引用聚合 message 的内存块，不拷贝
+		sub.msg = StreamMsg{
+			buf: buf[:end],
+			b:   aggregateSubHeaderSize,
+			e:   uint32(end),
+		}
+		if err := cb(&sub); err != nil {
+			return err
 		}
+
+		// 最后一个子 message 的 back pointer 可能被省略
+		end += 4
+		if end > len(buf) {
+			end = len(buf)
+		}
+		buf = buf[end:]
 	}
+	return nil
 }
 
-func (c *ChunkComposer) getOrCreateStream(csid int) *Stream {
+func (c *ChunkComposer) getOrCreateStream(csid int) (*Stream, error) {
 	stream, exist := c.csid2stream[csid]
 	if !exist {
 		stream = NewStream()
 		c.csid2stream[csid] = stream
+		if err := c.addBufferedBytes(cap(stream.msg.buf)); err != nil {
+			return nil, err
+		}
+	}
+	return stream, nil
+}
+
+// 为 header 中的 message 长度预留内存，检查 bufpool.Limit
+func (c *ChunkComposer) reserve(stream *Stream) error {
+	if max := bufpool.GetLimit().MaxMsgSize; max != 0 && stream.header.MsgLen > max {
+		bufpool.ReportOffence(bufpool.OffenceMsgTooLarge)
+		return ErrMsgTooLarge
+	}
+	prev := cap(stream.msg.buf)
+	stream.msg.reserve(stream.header.MsgLen)
+	return c.addBufferedBytes(cap(stream.msg.buf) - prev)
+}
+
+func (c *ChunkComposer) addBufferedBytes(n int) error {
+	c.bufferedBytes += int64(n)
+	if max := bufpool.GetLimit().MaxSessionBufferedBytes; max != 0 && c.bufferedBytes > max {
+		bufpool.ReportOffence(bufpool.OffenceSessionBufferFull)
+		return bufpool.ErrSessionBufferFull
 	}
-	return stream
+	return nil
 }
@@ -0,0 +1,215 @@
+// Copyright 2019, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package rtmp
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/q191201771/lal/pkg/bufpool"
+	"github.com/q191201771/naza/pkg/assert"
+)
+
+func compose(t *testing.T, b []byte) []AVMsg {
+	var ret []AVMsg
+	c := NewChunkComposer()
+	c.SetPeerChunkSize(uint32(LocalChunkSize))
+	err := c.RunLoop(bytes.NewReader(b), func(stream *Stream) error {
+		msg := stream.toAVMsg()
+		msg.Payload = append([]byte(nil), msg.Payload...)
+		ret = append(ret, msg)
+		return nil
+	})
+	assert.Equal(t, io.EOF, err)
+	return ret
+}
+
+func TestChunkComposer_Aggregate(t *testing.T) {
+	// 子 message：audio 时间戳 100，video 时间戳 140，最后一个省略 back pointer
+	payload := []byte{
+		TypeidAudio, 0, 0, 2, 0, 0, 100, 0, 0, 0, 0, 0xaf, 0x01,
+		0, 0, 0, 13,
+		TypeidVideo, 0, 0, 3, 0, 0, 140, 0, 0, 0, 0, 0x27, 0x01, 0x00,
+	}
+	h := Header{
+		CSID:         csidOverStream,
+		MsgLen:       uint32(len(payload)),
+		MsgTypeID:    typeidAggregateMessage,
+		MsgStreamID:  MSID1,
+		TimestampAbs: 1000,
+	}
+	msgs := compose(t, Message2Chunks(payload, &h))
+	assert.Equal(t, 2, len(msgs))
+	assert.Equal(t, TypeidAudio, msgs[0].Header.MsgTypeID)
+	assert.Equal(t, uint32(1000), msgs[0].Header.TimestampAbs)
+	assert.Equal(t, uint32(2), msgs[0].Header.MsgLen)
+	assert.Equal(t, MSID1, msgs[0].Header.MsgStreamID)
+	assert.Equal(t, []byte{0xaf, 0x01}, msgs[0].Payload)
+	assert.Equal(t, TypeidVideo, msgs[1].Header.MsgTypeID)
+	assert.Equal(t, uint32(1040), msgs[1].Header.TimestampAbs)
+	assert.Equal(t, []byte{0x27, 0x01, 0x00}, msgs[1].Payload)
+
+	// 子 message 长度越界
+	payload[3] = 100
+	c := NewChunkComposer()
+	c.SetPeerChunkSize(uint32(LocalChunkSize))
+	err := c.RunLoop(bytes.NewReader(Message2Chunks(payload, &h)), func(stream *Stream) error {
+		return nil
+	})
+	assert.Equal(t, ErrRTMP, err)
+}
+
+func TestChunkComposer_Abort(t *testing.T) {
+	big := make([]byte, LocalChunkSize+100)
+	h := Header{
+		CSID:         csidOverStream,
+		MsgLen:       uint32(len(big)),
+		MsgTypeID:    TypeidVideo,
+		MsgStreamID:  MSID1,
+		TimestampAbs: 1,
+	}
+	chunks := Message2Chunks(big, &h)
+	// 只发送第一个 chunk
+	b := append([]byte(nil), chunks[:12+LocalChunkSize]...)
+
+	abortHeader := Header{
+		CSID:      csidProtocolControl,
+		MsgLen:    4,
+		MsgTypeID: typeidAbort,
+	}
+	b = append(b, Message2Chunks([]byte{0, 0, 0, csidOverStream}, &abortHeader)...)
+
+	small := []byte{0x17, 0x01, 0x00}
+	h.MsgLen = uint32(len(small))
+	h.TimestampAbs = 2
+	b = append(b, Message2Chunks(small, &h)...)
+
+	msgs := compose(t, b)
+	assert.Equal(t, 1, len(msgs))
+	assert.Equal(t, uint32(2), msgs[0].Header.TimestampAbs)
+	assert.Equal(t, small, msgs[0].Payload)
+}
+
+func TestChunkComposer_Limit(t *testing.T) {
+	defer bufpool.SetLimit(bufpool.GetLimit())
+	bufpool.SetLimit(bufpool.Limit{
+		MaxMsgSize:              1024,
+		MaxSessionBufferedBytes: 64 * 1024,
+	})
+
+	// message 过大，header 中的长度还没有开始接收就返回错误
+	h := Header{
+		CSID:        CSIDVideo,
+		MsgLen:      1025,
+		MsgTypeID:   TypeidVideo,
+		MsgStreamID: MSID1,
+	}
+	before := bufpool.GetOffences().MsgTooLarge
+	chunks := Message2Chunks(make([]byte, 1025), &h)
+	err := NewChunkComposer().RunLoop(bytes.NewReader(chunks[:12]), func(stream *Stream) error {
+		return nil
+	})
+	assert.Equal(t, ErrMsgTooLarge, err)
+	assert.Equal(t, before+1, bufpool.GetOffences().MsgTooLarge)
+
+	// 使用大量的 csid
+	var b []byte
+	for csid := 64; csid < 64+32; csid++ {
+		h = Header{
+			CSID:        csid,
+			MsgLen:      1,
+			MsgTypeID:   TypeidAudio,
+			MsgStreamID: MSID1,
+		}
+		b = append(b, Message2Chunks([]byte{0xaf}, &h)...)
+	}
+	err = NewChunkComposer().RunLoop(bytes.NewReader(b), func(stream *Stream) error {
+		return nil
+	})
+	assert.Equal(t, bufpool.ErrSessionBufferFull, err)
+}
+
+func TestChunkComposer_SetChunkSize(t *testing.T) {
+	big := make([]byte, LocalChunkSize+100)
+	big[len(big)-1] = 0x1
+	h := Header{
+		CSID:         csidOverStream,
+		MsgLen:       uint32(len(big)),
+		MsgTypeID:    TypeidVideo,
+		MsgStreamID:  MSID1,
+		TimestampAbs: 1,
+	}
+	chunks := Message2Chunks(big, &h)
+	first := 12 + LocalChunkSize
+	b := append([]byte(nil), chunks[:first]...)
+
+	// 两个 chunk 之间对端修改了 chunk size，剩余的部分依然按 message 长度读取
+	sh := Header{
+		CSID:      csidProtocolControl,
+		MsgLen:    4,
+		MsgTypeID: typeidSetChunkSize,
+	}
+	b = append(b, Message2Chunks([]byte{0, 0, 0x20, 0}, &sh)...)
+	b = append(b, chunks[first:]...)
+	msgs := compose(t, b)
+	assert.Equal(t, 2, len(msgs))
+	assert.Equal(t, big, msgs[1].Payload)
+
+	// 不合法的 chunk size
+	for _, payload := range [][]byte{{0, 0, 0, 0}, {0x80, 0, 0, 1}, {0, 1}} {
+		sh.MsgLen = uint32(len(payload))
+		err := NewChunkComposer().RunLoop(bytes.NewReader(Message2Chunks(payload, &sh)), func(stream *Stream) error {
+			return nil
+		})
+		assert.Equal(t, ErrRTMP, err)
+	}
+}
+
+func TestChunkComposer_NewMessageHeader(t *testing.T) {
+	big := make([]byte, LocalChunkSize+100)
+	h := Header{
+		CSID:         csidOverStream,
+		MsgLen:       uint32(len(big)),
+		MsgTypeID:    TypeidVideo,
+		MsgStreamID:  MSID1,
+		TimestampAbs: 1,
+	}
+	chunks := Message2Chunks(big, &h)
+	// 只发送第一个 chunk，之后在同一个 csid 上直接开始一个更小的 message
+	b := append([]byte(nil), chunks[:12+LocalChunkSize]...)
+	small := []byte{0x17, 0x01, 0x00}
+	h.MsgLen = uint32(len(small))
+	h.TimestampAbs = 2
+	b = append(b, Message2Chunks(small, &h)...)
+
+	msgs := compose(t, b)
+	assert.Equal(t, 1, len(msgs))
+	assert.Equal(t, small, msgs[0].Payload)
+}
+
+func TestChunkComposer_Panic(t *testing.T) {
+	h := Header{
+		CSID:        CSIDVideo,
+		MsgLen:      1,
+		MsgTypeID:   TypeidVideo,
+		MsgStreamID: MSID1,
+	}
+	b := Message2Chunks([]byte{0x17}, &h)
+	b = append(b, b...)
+	var n int
+	err := NewChunkComposer().RunLoop(bytes.NewReader(b), func(stream *Stream) error {
+		n++
+		var s []byte
+		_ = s[stream.msg.len()]
+		return nil
+	})
+	assert.Equal(t, ErrPanic, err)
+	assert.Equal(t, 1, n)
+}
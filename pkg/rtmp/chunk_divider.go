@@ -13,50 +13,136 @@ package rtmp
 // 将message切割成chunk
 
 import (
+	"github.com/q191201771/lal/pkg/bufpool"
 	"github.com/q191201771/naza/pkg/bele"
+	"github.com/q191201771/naza/pkg/slicebytepool"
 )
 
 type ChunkDivider struct {
 	localChunkSize int
+
+	// 只有 Divide 使用，记录每个 csid 上一个 message 的信息
+	csid2prev map[int]*prevMessage
+}
+
+type prevMessage struct {
+	header Header
+	// chunk header 中时间戳字段的值，fmt0 时为绝对时间戳，fmt1 fmt2 时为相对时间戳，fmt3 时沿用之前的值
+	timestamp uint32
+	// timestamp 是否是相对时间戳，只有为 true 时，新的 message 才可以使用 fmt3
+	isDelta bool
 }
 
 var defaultChunkDivider = ChunkDivider{
 	localChunkSize: LocalChunkSize,
 }
 
+func NewChunkDivider(localChunkSize int) *ChunkDivider {
+	return &ChunkDivider{
+		localChunkSize: localChunkSize,
+		csid2prev:      make(map[int]*prevMessage),
+	}
+}
+
 // @param header 注意，内部使用 TimestampAbs 而非 Timestamp
 func Message2Chunks(message []byte, header *Header) []byte {
 	return defaultChunkDivider.Message2Chunks(message, header)
 }
 
-// TODO chef: 新的 message 的第一个 chunk 始终使用 fmt0 格式，没有参考前一个 message
+// 无状态的切割，新的 message 的第一个 chunk 始终使用 fmt0 格式，没有参考前一个 message
+// 切割的结果可以发送给任意对端，比如 Group 中切割一次，发送给所有拉流 session
 func (d *ChunkDivider) Message2Chunks(message []byte, header *Header) []byte {
-	return message2Chunks(message, header, nil, d.localChunkSize)
+	return message2Chunks(message, header, 0, header.TimestampAbs, d.localChunkSize)
 }
 
-// @param 返回头的大小
-func calcHeader(header *Header, prevHeader *Header, out []byte) int {
-	var index int
+// 和 Message2Chunks 相同，但是内存块从内存池中获取，引用计数为1，不再使用时调用 ReleaseIfNeeded 释放
+// 比如 Group 中切割一次，发送给所有拉流 session，每个 session 发送完成后各自释放
+//
+// @param header 注意，内部使用 TimestampAbs 而非 Timestamp
+func Message2ChunksShared(message []byte, header *Header) *slicebytepool.SharedSliceByte {
+	return defaultChunkDivider.Message2ChunksShared(message, header)
+}
 
-	// 计算fmt和timestamp
-	fmt := uint8(0)
-	var timestamp uint32
-	if prevHeader == nil {
-		timestamp = header.TimestampAbs
-	} else {
-		if header.MsgStreamID == prevHeader.MsgStreamID {
-			fmt++
-			if header.MsgLen == prevHeader.MsgLen && header.MsgTypeID == prevHeader.MsgTypeID {
-				fmt++
-				if header.TimestampAbs == prevHeader.TimestampAbs {
-					fmt++
-				}
-			}
-			timestamp = header.TimestampAbs - prevHeader.TimestampAbs
-		} else {
-			timestamp = header.TimestampAbs
-		}
+func (d *ChunkDivider) Message2ChunksShared(message []byte, header *Header) *slicebytepool.SharedSliceByte {
+	ssb := bufpool.NewShared(maxChunksLen(len(message), d.localChunkSize))
+	n := message2ChunksTo(ssb.Core, message, header, 0, header.TimestampAbs, d.localChunkSize)
+	ssb.Core = ssb.Core[:n]
+	return ssb
+}
+
+// 有状态的切割，参考同一个 csid 上前一个 message，新的 message 的第一个 chunk 使用 fmt1 fmt2 fmt3 压缩
+// 注意，切割的结果必须按顺序发送给同一个对端，并且不能和其他方式生成的 chunk 混用同一个 csid
+//
+// @param header 注意，内部使用 TimestampAbs 而非 Timestamp
+func (d *ChunkDivider) Divide(message []byte, header *Header) []byte {
+	prev := d.csid2prev[header.CSID]
+	fmt, timestamp := chooseFmt(header, prev)
+	out := message2Chunks(message, header, fmt, timestamp, d.localChunkSize)
+
+	if prev == nil {
+		prev = &prevMessage{}
+		d.csid2prev[header.CSID] = prev
 	}
+	prev.header = *header
+	prev.timestamp = timestamp
+	// fmt3 沿用之前的值
+	if fmt != 3 {
+		prev.isDelta = fmt != 0
+	}
+	return out
+}
+
+// 修改 Message2Chunks 切割出的 chunk 中的 message stream id，返回新的内存块，<chunks> 不会被修改
+// 比如 Group 中切割一次的数据，发送给 message stream id 不是 MSID1 的拉流 session
+// 注意，<chunks> 必须只包含一个 message，只有第一个 chunk 是 fmt0，包含 message stream id
+func ModChunksMsgStreamID(chunks []byte, streamID int) []byte {
+	out := make([]byte, len(chunks))
+	copy(out, chunks)
+	if len(out) == 0 || out[0]>>6 != 0 {
+		return out
+	}
+	// basic header 的长度
+	index := 1
+	switch out[0] & 0x3f {
+	case 0:
+		index = 2
+	case 1:
+		index = 3
+	}
+	// timestamp 3 | msgLen 3 | msgTypeID 1
+	index += 7
+	if len(out) >= index+4 {
+		bele.LEPutUint32(out[index:], uint32(streamID))
+	}
+	return out
+}
+
+// 忘记 <csid> 上一个 message 的信息，之后该 csid 上的第一个 message 使用 fmt0
+// 比如该 csid 上插入了其他方式发送的 message 时调用
+func (d *ChunkDivider) Reset(csid int) {
+	delete(d.csid2prev, csid)
+}
+
+// @return fmt 以及 chunk header 中时间戳字段的值
+func chooseFmt(header *Header, prev *prevMessage) (uint8, uint32) {
+	// 时间戳回退时，无法使用相对时间戳
+	if prev == nil || header.MsgStreamID != prev.header.MsgStreamID || header.TimestampAbs < prev.header.TimestampAbs {
+		return 0, header.TimestampAbs
+	}
+	delta := header.TimestampAbs - prev.header.TimestampAbs
+	if header.MsgLen != prev.header.MsgLen || header.MsgTypeID != prev.header.MsgTypeID {
+		return 1, delta
+	}
+	if prev.isDelta && delta == prev.timestamp {
+		return 3, delta
+	}
+	return 2, delta
+}
+
+// @param timestamp chunk header 中时间戳字段的值
+// @return 返回头的大小
+func calcHeader(header *Header, fmt uint8, timestamp uint32, out []byte) int {
+	var index int
 
 	// 设置fmt
 	out[index] = fmt << 6
@@ -81,7 +167,7 @@ func calcHeader(header *Header, prevHeader *Header, out []byte) int {
 
 	// 设置timestamp msgLen msgTypeID msgStreamID
 	if fmt <= 2 {
-		if timestamp > maxTimestampInMessageHeader {
+		if timestamp >= maxTimestampInMessageHeader {
 			bele.BEPutUint24(out[index:], maxTimestampInMessageHeader)
 		} else {
 			bele.BEPutUint24(out[index:], timestamp)
@@ -102,8 +188,8 @@ func calcHeader(header *Header, prevHeader *Header, out []byte) int {
 	}
 
 	// 设置扩展时间戳
-	if timestamp > maxTimestampInMessageHeader {
-		//log.Debugf("CHEFERASEME %+v %+v %d %d", header, prevHeader, timestamp, index)
+	// fmt3 也需要携带，和 ChunkComposer 以及 ffmpeg 的处理保持一致
+	if timestamp >= maxTimestampInMessageHeader {
 		bele.BEPutUint32(out[index:], timestamp)
 		index += 4
 	}
@@ -111,39 +197,49 @@ func calcHeader(header *Header, prevHeader *Header, out []byte) int {
 	return index
 }
 
-func message2Chunks(message []byte, header *Header, prevHeader *Header, chunkSize int) []byte {
-	//if header.CSID < minCSID || header.CSID > maxCSID {
-	//	return nil, ErrRTMP
-	//}
+// @param fmt       第一个 chunk 的 fmt，之后的 chunk 都使用 fmt3
+// @param timestamp chunk header 中时间戳字段的值
+func message2Chunks(message []byte, header *Header, fmt uint8, timestamp uint32, chunkSize int) []byte {
+	out := make([]byte, maxChunksLen(len(message), chunkSize))
+	n := message2ChunksTo(out, message, header, fmt, timestamp, chunkSize)
+	return out[:n]
+}
 
-	// 计算chunk数量，最后一个chunk的大小
-	numOfChunk := len(message) / chunkSize
-	lastChunkSize := chunkSize
-	if len(message)%chunkSize != 0 {
-		numOfChunk++
-		lastChunkSize = len(message) % chunkSize
+// 切割后最多需要的内存大小
+func maxChunksLen(messageLen int, chunkSize int) int {
+	numOfChunk := (messageLen + chunkSize - 1) / chunkSize
+	// 空的 message 也需要一个 chunk 头
+	if numOfChunk == 0 {
+		numOfChunk = 1
 	}
+	return messageLen + maxHeaderSize*numOfChunk
+}
 
-	maxNeededLen := (chunkSize + maxHeaderSize) * numOfChunk
-	out := make([]byte, maxNeededLen)
+// 切割的结果写入 <out>，<out> 的大小至少为 maxChunksLen
+// @return 写入的大小
+func message2ChunksTo(out []byte, message []byte, header *Header, fmt uint8, timestamp uint32, chunkSize int) int {
+	//if header.CSID < minCSID || header.CSID > maxCSID {
+	//	return nil, ErrRTMP
+	//}
 
 	var index int
 
 	// NOTICE 和srs交互时，发现srs要求message中的非第一个chunk不能使用fmt0
 	// 将message切割成chunk放入chunk body中
-	for i := 0; i < numOfChunk; i++ {
-		headLen := calcHeader(header, prevHeader, out[index:])
+	for i := 0; ; i += chunkSize {
+		headLen := calcHeader(header, fmt, timestamp, out[index:])
 		index += headLen
 
-		if i != numOfChunk-1 {
-			copy(out[index:], message[i*chunkSize:i*chunkSize+chunkSize])
-			index += chunkSize
-		} else {
-			copy(out[index:], message[i*chunkSize:i*chunkSize+lastChunkSize])
-			index += lastChunkSize
+		end := i + chunkSize
+		if end > len(message) {
+			end = len(message)
 		}
-		prevHeader = header
+		index += copy(out[index:], message[i:end])
+		if end == len(message) {
+			break
+		}
+		fmt = 3
 	}
 
-	return out[:index]
+	return index
 }
@@ -0,0 +1,149 @@
+// Copyright 2019, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package rtmp
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/q191201771/lal/pkg/httpflv"
+	"github.com/q191201771/naza/pkg/assert"
+)
+
+func TestChunkDivider_Divide(t *testing.T) {
+	type item struct {
+		ts      uint32
+		typeid  uint8
+		len     int
+		wantFmt uint8
+	}
+	items := []item{
+		{0, TypeidVideo, 10, 0},
+		{40, TypeidVideo, 10, 2},   // 长度类型不变，时间戳变化
+		{80, TypeidVideo, 10, 3},   // delta 和上一个相同
+		{120, TypeidVideo, 10, 3},  // 继续沿用
+		{160, TypeidVideo, 20, 1},  // 长度变化
+		{200, TypeidAudio, 20, 1},  // 类型变化
+		{240, TypeidAudio, 300, 1}, // 跨多个 chunk
+		{100, TypeidAudio, 300, 0}, // 时间戳回退
+		{0x1000000, TypeidAudio, 300, 2},
+		{0x1000000 + 0xFFFFFF, TypeidAudio, 300, 2}, // delta 也需要扩展时间戳
+		{0x1000000 + 2*0xFFFFFF, TypeidAudio, 300, 3},
+	}
+
+	d := NewChunkDivider(LocalChunkSize)
+	var all []byte
+	for i, it := range items {
+		payload := bytes.Repeat([]byte{byte(i)}, it.len)
+		h := Header{
+			CSID:         CSIDVideo,
+			MsgLen:       uint32(it.len),
+			MsgTypeID:    it.typeid,
+			MsgStreamID:  MSID1,
+			TimestampAbs: it.ts,
+		}
+		chunks := d.Divide(payload, &h)
+		assert.Equal(t, it.wantFmt, chunks[0]>>6)
+		all = append(all, chunks...)
+	}
+
+	msgs := compose(t, all)
+	assert.Equal(t, len(items), len(msgs))
+	for i, it := range items {
+		assert.Equal(t, it.ts, msgs[i].Header.TimestampAbs)
+		assert.Equal(t, it.typeid, msgs[i].Header.MsgTypeID)
+		assert.Equal(t, bytes.Repeat([]byte{byte(i)}, it.len), msgs[i].Payload)
+	}
+
+	// Reset 之后使用 fmt0
+	d.Reset(CSIDVideo)
+	h := Header{CSID: CSIDVideo, MsgLen: 1, MsgTypeID: TypeidVideo, MsgStreamID: MSID1, TimestampAbs: 0x1000000 + 3*0xFFFFFF}
+	assert.Equal(t, uint8(0), d.Divide([]byte{0}, &h)[0]>>6)
+}
+
+func TestAVMsgWriter(t *testing.T) {
+	var w avMsgWriter
+	var out bytes.Buffer
+
+	newTag := func(typ uint8, timestamp uint32, payload []byte) httpflv.Tag {
+		raw := httpflv.PackHTTPFLVTag(typ, timestamp, payload)
+		return httpflv.Tag{
+			Header: httpflv.TagHeader{Type: typ, DataSize: uint32(len(payload)), Timestamp: timestamp},
+			Raw:    raw,
+		}
+	}
+	tags := []httpflv.Tag{
+		newTag(httpflv.TagTypeMetadata, 0, []byte{1, 2}),
+		newTag(httpflv.TagTypeVideo, 0, []byte{0x17, 0, 0}),
+		newTag(httpflv.TagTypeAudio, 23, []byte{0xaf, 1}),
+		newTag(httpflv.TagTypeVideo, 40, []byte{0x27, 1, 0}),
+	}
+	wantCSID := []int{CSIDAMF, CSIDVideo, CSIDAudio, CSIDVideo}
+	for _, tag := range tags {
+		err := w.write(&out, flvTag2AVMsg(tag), MSID1)
+		assert.Equal(t, nil, err)
+	}
+
+	msgs := compose(t, out.Bytes())
+	assert.Equal(t, len(tags), len(msgs))
+	for i, tag := range tags {
+		assert.Equal(t, wantCSID[i], msgs[i].Header.CSID)
+		assert.Equal(t, tag.Header.Type, msgs[i].Header.MsgTypeID)
+		assert.Equal(t, tag.Header.Timestamp, msgs[i].Header.TimestampAbs)
+		assert.Equal(t, tag.Header.DataSize, msgs[i].Header.MsgLen)
+		assert.Equal(t, MSID1, msgs[i].Header.MsgStreamID)
+		assert.Equal(t, tag.Payload(), msgs[i].Payload)
+	}
+
+	err := w.write(&out, AVMsg{Header: Header{MsgTypeID: typeidCommandMessageAMF0}}, MSID1)
+	assert.Equal(t, ErrRTMP, err)
+}
+
+func TestMessage2ChunksShared(t *testing.T) {
+	h := Header{
+		CSID:         CSIDVideo,
+		MsgTypeID:    TypeidVideo,
+		MsgStreamID:  MSID1,
+		TimestampAbs: 0x1000000,
+	}
+	for _, n := range []int{0, 1, LocalChunkSize, LocalChunkSize*3 + 1} {
+		payload := bytes.Repeat([]byte{0x17}, n)
+		h.MsgLen = uint32(n)
+		ssb := Message2ChunksShared(payload, &h)
+		assert.Equal(t, Message2Chunks(payload, &h), ssb.Core)
+		ssb.ReleaseIfNeeded()
+	}
+}
+
+func benchmarkMessage2Chunks(b *testing.B, shared bool) {
+	payload := make([]byte, 20000)
+	h := Header{
+		CSID:        CSIDVideo,
+		MsgLen:      uint32(len(payload)),
+		MsgTypeID:   TypeidVideo,
+		MsgStreamID: MSID1,
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(payload)))
+	for i := 0; i < b.N; i++ {
+		if shared {
+			Message2ChunksShared(payload, &h).ReleaseIfNeeded()
+		} else {
+			_ = Message2Chunks(payload, &h)
+		}
+	}
+}
+
+func BenchmarkMessage2Chunks(b *testing.B) {
+	benchmarkMessage2Chunks(b, false)
+}
+
+func BenchmarkMessage2ChunksShared(b *testing.B) {
+	benchmarkMessage2Chunks(b, true)
+}
@@ -8,20 +8,44 @@
 
 package rtmp
 
+import (
+	"context"
+	"sync"
+
+	"github.com/q191201771/lal/pkg/reconnect"
+	log "github.com/q191201771/naza/pkg/nazalog"
+)
+
 type PullSession struct {
-	core *ClientSession
+	option PullSessionOption
+
+	mutex       sync.Mutex
+	core        *ClientSession
+	disposed    bool
+	disposeChan chan struct{}
+
+	rebaser reconnect.TimestampRebaser
 }
 
 type PullSessionOption struct {
 	ConnectTimeoutMS int
 	PullTimeoutMS    int
 	ReadAVTimeoutMS  int
+
+	HandshakeMode     HandshakeMode
+	HandshakeFallback bool
+
+	// 默认不重连。开启后，Pull 会在连接失败或断开后自动重连，并且平移新连接上的时间戳，使得回调给上层的时间戳单调递增
+	Reconnect reconnect.Option
 }
 
 var defaultPullSessionOption = PullSessionOption{
-	ConnectTimeoutMS: 0,
-	PullTimeoutMS:    0,
-	ReadAVTimeoutMS:  0,
+	ConnectTimeoutMS:  0,
+	PullTimeoutMS:     0,
+	ReadAVTimeoutMS:   0,
+	HandshakeMode:     HandshakeModeSimple,
+	HandshakeFallback: true,
+	Reconnect:         reconnect.DefaultOption,
 }
 
 type ModPullSessionOption func(option *PullSessionOption)
@@ -32,26 +56,124 @@ func NewPullSession(modOptions ...ModPullSessionOption) *PullSession {
 		fn(&opt)
 	}
 
-	return &PullSession{
-		core: NewClientSession(CSTPullSession, func(option *ClientSessionOption) {
-			option.ConnectTimeoutMS = opt.ConnectTimeoutMS
-			option.DoTimeoutMS = opt.PullTimeoutMS
-			option.ReadAVTimeoutMS = opt.ReadAVTimeoutMS
-		}),
+	s := &PullSession{
+		option:      opt,
+		disposeChan: make(chan struct{}),
 	}
+	s.core = s.newCore()
+	return s
 }
 
 // 阻塞直到连接断开或发生错误
+// 开启重连后，阻塞直到重连次数用完，或者调用了 Dispose
 //
 // @param onReadRTMPAVMsg: 回调结束后，内存块会被 PullSession 重复使用
 func (s *PullSession) Pull(rawURL string, onReadRTMPAVMsg OnReadRTMPAVMsg) error {
-	s.core.onReadRTMPAVMsg = onReadRTMPAVMsg
-	if err := s.core.doWithTimeout(rawURL); err != nil {
-		return err
+	return s.PullContext(context.Background(), rawURL, onReadRTMPAVMsg)
+}
+
+// 和 Pull 相同，并且在建立连接、握手、信令交互、接收数据的过程中，<ctx> 被取消或超时时释放连接，返回 ctx.Err()
+func (s *PullSession) PullContext(ctx context.Context, rawURL string, onReadRTMPAVMsg OnReadRTMPAVMsg) error {
+	onRead := onReadRTMPAVMsg
+	if s.option.Reconnect.Enabled() {
+		onRead = func(msg AVMsg) {
+			msg.Header.TimestampAbs = s.rebaser.Rebase(msg.Header.TimestampAbs)
+			onReadRTMPAVMsg(msg)
+		}
+	}
+
+	waitCtx, cancel := s.withDispose(ctx)
+	defer cancel()
+
+	retrier := reconnect.NewRetrier(s.option.Reconnect)
+	for {
+		core := s.getCore()
+		core.onReadRTMPAVMsg = onRead
+		err := core.doContext(waitCtx, rawURL)
+		if err == nil {
+			retrier.Succeed()
+			err = core.waitLoopContext(waitCtx)
+			if s.isDisposed() {
+				// 拉流过程中调用了 Dispose，正常结束
+				return nil
+			}
+		}
+		if s.isDisposed() {
+			return ErrClientSessionDisposed
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if !retrier.Wait(err, waitCtx.Done()) {
+			return err
+		}
+		log.Warnf("reconnect rtmp pull session. [%s] attempt=%d, err=%+v", core.UniqueKey, retrier.Attempt(), err)
+		if !s.renewCore() {
+			return err
+		}
+		s.rebaser.Reset()
 	}
-	return s.core.WaitLoop()
 }
 
 func (s *PullSession) Dispose() {
+	s.mutex.Lock()
+	if s.disposed {
+		s.mutex.Unlock()
+		return
+	}
+	s.disposed = true
+	close(s.disposeChan)
+	core := s.core
+	s.mutex.Unlock()
+
+	core.Dispose()
+}
+
+// 返回的 ctx 在 <ctx> 结束或者调用 Dispose 时结束，用于打断重连前的等待
+func (s *PullSession) withDispose(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-s.disposeChan:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+func (s *PullSession) newCore() *ClientSession {
+	return NewClientSession(CSTPullSession, func(option *ClientSessionOption) {
+		option.ConnectTimeoutMS = s.option.ConnectTimeoutMS
+		option.DoTimeoutMS = s.option.PullTimeoutMS
+		option.ReadAVTimeoutMS = s.option.ReadAVTimeoutMS
+		option.HandshakeMode = s.option.HandshakeMode
+		option.HandshakeFallback = s.option.HandshakeFallback
+	})
+}
+
+func (s *PullSession) isDisposed() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.disposed
+}
+
+func (s *PullSession) getCore() *ClientSession {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.core
+}
+
+// 释放旧的连接，并创建新的 ClientSession 用于重连
+// @return 已经调用过 Dispose 时返回 false
+func (s *PullSession) renewCore() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.disposed {
+		return false
+	}
 	s.core.Dispose()
+	s.core = s.newCore()
+	return true
 }
@@ -8,20 +8,49 @@
 
 package rtmp
 
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/q191201771/lal/pkg/httpflv"
+	"github.com/q191201771/lal/pkg/reconnect"
+	log "github.com/q191201771/naza/pkg/nazalog"
+)
+
+// 推流还没有建立成功，或者正在重连，此时发送的数据会被丢弃
+var ErrPushSessionNotReady = errors.New("lal.rtmp: push session not ready")
+
 type PushSession struct {
-	core *ClientSession
+	option PushSessionOption
+
+	mutex       sync.Mutex
+	core        *ClientSession
+	ready       bool
+	disposed    bool
+	disposeChan chan struct{}
 }
 
 type PushSessionOption struct {
 	ConnectTimeoutMS int
 	PushTimeoutMS    int
 	WriteAVTimeoutMS int
+
+	HandshakeMode     HandshakeMode
+	HandshakeFallback bool
+
+	// 默认不重连。开启后，Push 失败或者推流断开时自动重连，重连期间 AsyncWrite 返回 ErrPushSessionNotReady
+	// 上层可以在 OnReconnect 回调中重新发送 metadata 以及音视频的 seq header
+	Reconnect reconnect.Option
 }
 
 var defaultPushSessionOption = PushSessionOption{
-	ConnectTimeoutMS: 0,
-	PushTimeoutMS:    0,
-	WriteAVTimeoutMS: 0,
+	ConnectTimeoutMS:  0,
+	PushTimeoutMS:     0,
+	WriteAVTimeoutMS:  0,
+	HandshakeMode:     HandshakeModeSimple,
+	HandshakeFallback: true,
+	Reconnect:         reconnect.DefaultOption,
 }
 
 type ModPushSessionOption func(option *PushSessionOption)
@@ -31,30 +60,189 @@ func NewPushSession(modOptions ...ModPushSessionOption) *PushSession {
 	for _, fn := range modOptions {
 		fn(&opt)
 	}
-	return &PushSession{
-		core: NewClientSession(CSTPushSession, func(option *ClientSessionOption) {
-			option.ConnectTimeoutMS = opt.ConnectTimeoutMS
-			option.DoTimeoutMS = opt.PushTimeoutMS
-			option.WriteAVTimeoutMS = opt.WriteAVTimeoutMS
-		}),
+	s := &PushSession{
+		option:      opt,
+		disposeChan: make(chan struct{}),
 	}
+	s.core = s.newCore()
+	return s
 }
 
 // 阻塞直到收到服务端返回的 rtmp publish 对应结果的信令或发生错误
+// 开启重连后，失败时按照重连策略重试，成功后在后台检测推流断开并重连
 func (s *PushSession) Push(rawURL string) error {
-	return s.core.doWithTimeout(rawURL)
+	return s.PushContext(context.Background(), rawURL)
+}
+
+// 和 Push 相同，并且在建立连接、握手、信令交互（包括失败后的重试）的过程中，<ctx> 被取消或超时时释放连接，返回 ctx.Err()
+// 注意，<ctx> 只作用于本次调用，推流建立成功后的断线重连不受 <ctx> 影响
+func (s *PushSession) PushContext(ctx context.Context, rawURL string) error {
+	retrier := reconnect.NewRetrier(s.option.Reconnect)
+	if err := s.push(ctx, rawURL, retrier); err != nil {
+		return err
+	}
+	if s.option.Reconnect.Enabled() {
+		go s.runReconnectLoop(rawURL, retrier)
+	}
+	return nil
 }
 
 func (s *PushSession) AsyncWrite(msg []byte) error {
-	return s.core.AsyncWrite(msg)
+	core, ok := s.getReadyCore()
+	if !ok {
+		return ErrPushSessionNotReady
+	}
+	return core.AsyncWrite(msg)
+}
+
+// 发送音视频以及 metadata 数据，内部完成 chunk 的切割以及 chunk header 的压缩
+// 注意，不要和 AsyncWrite 混用
+func (s *PushSession) WriteAVMsg(msg AVMsg) error {
+	core, ok := s.getReadyCore()
+	if !ok {
+		return ErrPushSessionNotReady
+	}
+	return core.WriteAVMsg(msg)
+}
+
+func (s *PushSession) WriteFLVTag(tag httpflv.Tag) error {
+	return s.WriteAVMsg(flvTag2AVMsg(tag))
 }
 
 func (s *PushSession) Flush() error {
-	return s.core.Flush()
+	core, ok := s.getReadyCore()
+	if !ok {
+		return ErrPushSessionNotReady
+	}
+	return core.Flush()
 }
 
 func (s *PushSession) Dispose() {
+	s.mutex.Lock()
+	if s.disposed {
+		s.mutex.Unlock()
+		return
+	}
+	s.disposed = true
+	s.ready = false
+	close(s.disposeChan)
+	core := s.core
+	s.mutex.Unlock()
+
+	core.Dispose()
+}
+
+func (s *PushSession) push(ctx context.Context, rawURL string, retrier *reconnect.Retrier) error {
+	waitCtx, cancel := s.withDispose(ctx)
+	defer cancel()
+
+	for {
+		core := s.getCore()
+		err := core.doContext(waitCtx, rawURL)
+		if err == nil {
+			s.mutex.Lock()
+			s.ready = !s.disposed
+			s.mutex.Unlock()
+			retrier.Succeed()
+			return nil
+		}
+		if s.isDisposed() {
+			return ErrClientSessionDisposed
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if !retrier.Wait(err, waitCtx.Done()) {
+			return err
+		}
+		log.Warnf("reconnect rtmp push session. [%s] attempt=%d, err=%+v", core.UniqueKey, retrier.Attempt(), err)
+		if !s.renewCore() {
+			return err
+		}
+	}
+}
+
+func (s *PushSession) runReconnectLoop(rawURL string, retrier *reconnect.Retrier) {
+	// 调用 Dispose 时结束等待
+	ctx, cancel := s.withDispose(context.Background())
+	defer cancel()
+
+	for {
+		core := s.getCore()
+		err := core.waitLoopContext(ctx)
+		s.mutex.Lock()
+		s.ready = false
+		s.mutex.Unlock()
+
+		if s.isDisposed() || !retrier.Wait(err, s.disposeChan) {
+			return
+		}
+		log.Warnf("reconnect rtmp push session. [%s] attempt=%d, err=%+v", core.UniqueKey, retrier.Attempt(), err)
+		if !s.renewCore() {
+			return
+		}
+		if err := s.push(ctx, rawURL, retrier); err != nil {
+			if err != ErrClientSessionDisposed {
+				log.Errorf("reconnect rtmp push session failed. [%s] err=%+v", core.UniqueKey, err)
+			}
+			return
+		}
+	}
+}
+
+// 返回的 ctx 在 <ctx> 结束或者调用 Dispose 时结束，用于打断重连前的等待
+func (s *PushSession) withDispose(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-s.disposeChan:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+func (s *PushSession) newCore() *ClientSession {
+	return NewClientSession(CSTPushSession, func(option *ClientSessionOption) {
+		option.ConnectTimeoutMS = s.option.ConnectTimeoutMS
+		option.DoTimeoutMS = s.option.PushTimeoutMS
+		option.WriteAVTimeoutMS = s.option.WriteAVTimeoutMS
+		option.HandshakeMode = s.option.HandshakeMode
+		option.HandshakeFallback = s.option.HandshakeFallback
+	})
+}
+
+func (s *PushSession) isDisposed() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.disposed
+}
+
+func (s *PushSession) getCore() *ClientSession {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.core
+}
+
+func (s *PushSession) getReadyCore() (*ClientSession, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.core, s.ready
+}
+
+// 释放旧的连接，并创建新的 ClientSession 用于重连
+// @return 已经调用过 Dispose 时返回 false
+func (s *PushSession) renewCore() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.disposed {
+		return false
+	}
 	s.core.Dispose()
+	s.core = s.newCore()
+	return true
 }
 
 // TODO chef: 建议 ClientSession WaitLoop 接口也可以暴露出来
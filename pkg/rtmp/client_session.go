@@ -9,11 +9,14 @@
 package rtmp
 
 import (
+	"context"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"net"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/q191201771/naza/pkg/bele"
@@ -22,7 +25,30 @@ import (
 	"github.com/q191201771/naza/pkg/unique"
 )
 
-var ErrClientSessionTimeout = errors.New("lal.rtmp: client session timeout")
+var (
+	ErrClientSessionTimeout  = errors.New("lal.rtmp: client session timeout")
+	ErrClientSessionDisposed = errors.New("lal.rtmp: client session disposed")
+)
+
+// 服务端回复的错误状态，比如 NetStream.Publish.BadName，NetStream.Play.StreamNotFound，NetConnection.Connect.Rejected
+// Push 和 Pull 返回该类型的错误，调用方可以通过 Code 判断失败原因
+type StatusError struct {
+	Level       string
+	Code        string
+	Description string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("lal.rtmp: %s. level=%s, description=%s", e.Code, e.Level, e.Description)
+}
+
+func newStatusError(infos map[string]interface{}) *StatusError {
+	var e StatusError
+	e.Level, _ = infos["level"].(string)
+	e.Code, _ = infos["code"].(string)
+	e.Description, _ = infos["description"].(string)
+	return &e
+}
 
 // rtmp 客户端类型连接的底层实现
 // package rtmp 的使用者应该优先使用基于 ClientSession 实现的 PushSession 和 PullSession
@@ -41,11 +67,17 @@ type ClientSession struct {
 	appName                string
 	streamName             string
 	streamNameWithRawQuery string
-	hc                     HandshakeClientSimple
-	peerWinAckSize         int
+	hc                     HandshakeClient
 
 	conn         connection.Connection
-	doResultChan chan struct{}
+	fc           *flowControl
+	doResultChan chan error
+	streamID     int // createStream 返回的 message stream id
+	avWriter     avMsgWriter
+
+	// 保护 conn 的赋值，以及 disposed，使得在建立连接的过程中也可以调用 Dispose
+	mutex    sync.Mutex
+	disposed bool
 }
 
 type ClientSessionType int
@@ -61,13 +93,18 @@ type ClientSessionOption struct {
 	DoTimeoutMS      int // 从发起连接（包含了建立连接的时间）到收到publish或play信令结果的超时
 	ReadAVTimeoutMS  int // 读取音视频数据的超时
 	WriteAVTimeoutMS int // 发送音视频数据的超时
+
+	HandshakeMode     HandshakeMode // 握手模式。复杂握手时，如果服务端只支持简单握手，会在当前连接中退化成简单握手
+	HandshakeFallback bool          // 复杂握手失败时（比如服务端直接断开连接），是否重新建立连接并使用简单握手重试
 }
 
 var defaultClientSessOption = ClientSessionOption{
-	ConnectTimeoutMS: 0,
-	DoTimeoutMS:      0,
-	ReadAVTimeoutMS:  0,
-	WriteAVTimeoutMS: 0,
+	ConnectTimeoutMS:  0,
+	DoTimeoutMS:       0,
+	ReadAVTimeoutMS:   0,
+	WriteAVTimeoutMS:  0,
+	HandshakeMode:     HandshakeModeSimple,
+	HandshakeFallback: true,
 }
 
 type ModClientSessionOption func(option *ClientSessionOption)
@@ -88,72 +125,105 @@ func NewClientSession(t ClientSessionType, modOptions ...ModClientSessionOption)
 		fn(&option)
 	}
 
+	var hc HandshakeClient
+	if option.HandshakeMode == HandshakeModeComplex {
+		hc = &HandshakeClientComplex{}
+	} else {
+		hc = &HandshakeClientSimple{}
+	}
+
 	return &ClientSession{
 		UniqueKey:     uk,
 		t:             t,
 		option:        option,
-		doResultChan:  make(chan struct{}, 1),
+		doResultChan:  make(chan error, 1),
+		hc:            hc,
 		packer:        NewMessagePacker(),
 		chunkComposer: NewChunkComposer(),
 	}
 }
 
-// 阻塞直到收到服务端返回的 publish / play 对应结果的信令或者发生错误
-func (s *ClientSession) doWithTimeout(rawURL string) error {
-	if s.option.DoTimeoutMS == 0 {
-		err := <-s.do(rawURL)
-		return err
+// 阻塞直到收到服务端返回的 publish / play 对应结果的信令，或者发生错误，或者 <ctx> 被取消
+// 失败（包括服务端回复 StatusError）、超时或者被取消时，会释放连接
+func (s *ClientSession) doContext(ctx context.Context, rawURL string) error {
+	parent := ctx
+	if s.option.DoTimeoutMS != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(s.option.DoTimeoutMS)*time.Millisecond)
+		defer cancel()
 	}
-	t := time.NewTimer(time.Duration(s.option.DoTimeoutMS) * time.Millisecond)
-	defer t.Stop()
+
+	ch := make(chan error, 1)
+	go func() {
+		ch <- s.do(ctx, rawURL)
+	}()
 	select {
-	// TODO chef: 这种写法执行不到超时
-	case err := <-s.do(rawURL):
+	case err := <-ch:
+		if err != nil {
+			// 比如收到 StatusError 时连接以及 read loop 还在，不重试的话就泄漏了
+			s.Dispose()
+		}
 		return err
-	case <-t.C:
-		return ErrClientSessionTimeout
+	case <-ctx.Done():
+		s.Dispose()
+		// 调用方的 ctx 没有结束，说明是 DoTimeoutMS 超时
+		if parent.Err() == nil {
+			return ErrClientSessionTimeout
+		}
+		return ctx.Err()
 	}
 }
 
-func (s *ClientSession) do(rawURL string) <-chan error {
-	ch := make(chan error, 1)
+func (s *ClientSession) do(ctx context.Context, rawURL string) error {
 	if err := s.parseURL(rawURL); err != nil {
-		ch <- err
-		return ch
+		return err
 	}
-	if err := s.tcpConnect(); err != nil {
-		ch <- err
-		return ch
+	if err := s.tcpConnect(ctx); err != nil {
+		return err
 	}
 
 	if err := s.handshake(); err != nil {
-		ch <- err
-		return ch
+		if s.option.HandshakeMode == HandshakeModeSimple || !s.option.HandshakeFallback {
+			return err
+		}
+		log.Warnf("complex handshake failed, retry with simple handshake. [%s] err=%+v", s.UniqueKey, err)
+		_ = s.conn.Close()
+		if err := s.tcpConnect(ctx); err != nil {
+			return err
+		}
+		s.hc = &HandshakeClientSimple{}
+		if err := s.handshake(); err != nil {
+			return err
+		}
 	}
 
 	log.Infof("<----- SetChunkSize %d. [%s]", LocalChunkSize, s.UniqueKey)
 	if err := s.packer.writeChunkSize(s.conn, LocalChunkSize); err != nil {
-		ch <- err
-		return ch
+		return err
 	}
 
 	log.Infof("<----- connect('%s'). [%s]", s.appName, s.UniqueKey)
 	if err := s.packer.writeConnect(s.conn, s.appName, s.tcURL); err != nil {
-		ch <- err
-		return ch
+		return err
 	}
 
 	go s.runReadLoop()
 
 	select {
-	case <-s.doResultChan:
-		ch <- nil
-		break
+	case err := <-s.doResultChan:
+		return err
 	case err := <-s.conn.Done():
-		ch <- err
-		break
+		// 连接被主动关闭（比如调用了 Dispose，或者 read loop 出错）时 err 为 nil，此时并没有拿到信令结果
+		if err == nil {
+			select {
+			case err = <-s.doResultChan:
+				return err
+			default:
+			}
+			return ErrClientSessionDisposed
+		}
+		return err
 	}
-	return ch
 }
 
 func (s *ClientSession) WaitLoop() error {
@@ -161,22 +231,70 @@ func (s *ClientSession) WaitLoop() error {
 	return err
 }
 
+// 阻塞直到连接断开，或者 <ctx> 被取消。被取消时释放连接，并返回 ctx.Err()
+func (s *ClientSession) waitLoopContext(ctx context.Context) error {
+	select {
+	case err := <-s.conn.Done():
+		return err
+	case <-ctx.Done():
+		s.Dispose()
+		return ctx.Err()
+	}
+}
+
 func (s *ClientSession) AsyncWrite(msg []byte) error {
 	_, err := s.conn.Write(msg)
 	return err
 }
 
+// 按照本端的 chunk size 切割并发送，不需要调用方构造 chunk
+func (s *ClientSession) WriteAVMsg(msg AVMsg) error {
+	return s.avWriter.write(s.conn, msg, s.streamID)
+}
+
 func (s *ClientSession) Flush() error {
 	return s.conn.Flush()
 }
 
+// 握手完成后调用，返回实际使用的握手模式
+func (s *ClientSession) HandshakeMode() HandshakeMode {
+	return s.hc.Mode()
+}
+
 func (s *ClientSession) Dispose() {
 	log.Infof("lifecycle dispose rtmp client session. [%s]", s.UniqueKey)
-	_ = s.conn.Close()
+	s.mutex.Lock()
+	s.disposed = true
+	conn := s.conn
+	s.mutex.Unlock()
+	if conn != nil {
+		_ = conn.Close()
+	}
 }
 
 func (s *ClientSession) runReadLoop() {
-	_ = s.chunkComposer.RunLoop(s.conn, s.doMsg)
+	err := s.chunkComposer.RunLoop(s.fc, func(stream *Stream) error {
+		if err := s.doMsg(stream); err != nil {
+			return err
+		}
+		return s.ackIfNeeded()
+	})
+	// 处理 message 失败时（比如 ErrPanic）连接还没有关闭，关闭后等待的调用方才能拿到结果
+	// 信令交互阶段先通知失败原因，否则 do 只能从 conn.Done() 拿到 nil
+	log.Debugf("read loop done. [%s] err=%v", s.UniqueKey, err)
+	if err != nil {
+		s.notifyDoResultFail(err)
+	}
+	_ = s.conn.Close()
+}
+
+func (s *ClientSession) ackIfNeeded() error {
+	seqNum, ok := s.fc.shouldAck()
+	if !ok {
+		return nil
+	}
+	log.Debugf("<----- Acknowledgement. [%s] sequence number=%d", s.UniqueKey, seqNum)
+	return s.packer.writeAcknowledgement(s.conn, seqNum)
 }
 
 func (s *ClientSession) doMsg(stream *Stream) error {
@@ -189,29 +307,60 @@ func (s *ClientSession) doMsg(stream *Stream) error {
 		return s.doProtocolControlMessage(stream)
 	case typeidCommandMessageAMF0:
 		return s.doCommandMessage(stream)
+	case typeidCommandMessageAMF3:
+		if err := stream.msg.skipAMF3Format(); err != nil {
+			return err
+		}
+		return s.doCommandMessage(stream)
 	case TypeidDataMessageAMF0:
 		return s.doDataMessageAMF0(stream)
+	case TypeidDataMessageAMF3:
+		if err := stream.msg.skipAMF3Format(); err != nil {
+			return err
+		}
+		return s.doDataMessageAMF0(stream)
 	case typeidAck:
 		return s.doAck(stream)
 	case typeidUserControl:
-		log.Warnf("read user control message, ignore. [%s]", s.UniqueKey)
+		return s.doUserControlMessage(stream)
 	case TypeidAudio:
 		fallthrough
 	case TypeidVideo:
 		s.onReadRTMPAVMsg(stream.toAVMsg())
 	default:
-		log.Errorf("read unknown message. [%s] typeid=%d, %s", s.UniqueKey, stream.header.MsgTypeID, stream.toDebugString())
-		panic(0)
+		log.Warnf("read unknown message. [%s] typeid=%d, %s", s.UniqueKey, stream.header.MsgTypeID, stream.toDebugString())
 	}
 	return nil
 }
 
 func (s *ClientSession) doAck(stream *Stream) error {
+	if stream.msg.len() < 4 {
+		return ErrRTMP
+	}
 	seqNum := bele.BEUint32(stream.msg.buf[stream.msg.b:stream.msg.e])
 	log.Infof("-----> Acknowledgement. [%s] ignore. sequence number=%d.", s.UniqueKey, seqNum)
 	return nil
 }
 
+func (s *ClientSession) doUserControlMessage(stream *Stream) error {
+	event, err := parseUserControl(stream.msg.buf[stream.msg.b:stream.msg.e])
+	if err != nil {
+		return err
+	}
+	switch event.eventType {
+	case userControlStreamBegin:
+		log.Infof("-----> StreamBegin. [%s] stream id=%d", s.UniqueKey, event.data)
+	case userControlStreamEOF:
+		log.Infof("-----> StreamEOF. [%s] stream id=%d", s.UniqueKey, event.data)
+	case userControlPingRequest:
+		log.Debugf("-----> PingRequest. [%s] timestamp=%d", s.UniqueKey, event.data)
+		return s.packer.writeUserControl(s.conn, userControlPingResponse, event.data)
+	default:
+		log.Warnf("read user control message, ignore it. [%s] event type=%d", s.UniqueKey, event.eventType)
+	}
+	return nil
+}
+
 func (s *ClientSession) doDataMessageAMF0(stream *Stream) error {
 	val, err := stream.msg.peekStringWithType()
 	if err != nil {
@@ -225,7 +374,7 @@ func (s *ClientSession) doDataMessageAMF0(stream *Stream) error {
 		log.Error(val)
 		log.Error(hex.Dump(stream.msg.buf[stream.msg.b:stream.msg.e]))
 	}
-	s.onReadRTMPAVMsg(stream.toAVMsg())
+	s.onReadRTMPAVMsg(stream.toAMF0DataAVMsg())
 	return nil
 }
 
@@ -245,6 +394,8 @@ func (s *ClientSession) doCommandMessage(stream *Stream) error {
 		log.Warnf("-----> onBWDone. ignore. [%s]", s.UniqueKey)
 	case "_result":
 		return s.doResultMessage(stream, tid)
+	case "_error":
+		return s.doErrorMessage(stream, tid)
 	case "onStatus":
 		return s.doOnStatusMessage(stream, tid)
 	default:
@@ -266,6 +417,11 @@ func (s *ClientSession) doOnStatusMessage(stream *Stream, tid int) error {
 	if !ok {
 		return ErrRTMP
 	}
+	if level, _ := infos["level"].(string); level == "error" {
+		log.Errorf("-----> onStatus('%s'). [%s]", code, s.UniqueKey)
+		s.notifyDoResultFail(newStatusError(infos))
+		return nil
+	}
 	switch s.t {
 	case CSTPushSession:
 		switch code {
@@ -312,6 +468,7 @@ func (s *ClientSession) doResultMessage(stream *Stream, tid int) error {
 			}
 		default:
 			log.Errorf("unknown code. [%s] code=%s", s.UniqueKey, code)
+			s.notifyDoResultFail(newStatusError(infos))
 		}
 	case tidClientCreateStream:
 		err := stream.msg.readNull()
@@ -323,6 +480,7 @@ func (s *ClientSession) doResultMessage(stream *Stream, tid int) error {
 			return err
 		}
 		log.Infof("-----> _result(). [%s]", s.UniqueKey)
+		s.streamID = sid
 		switch s.t {
 		case CSTPullSession:
 			log.Infof("<----- play('%s'). [%s]", s.streamNameWithRawQuery, s.UniqueKey)
@@ -341,18 +499,43 @@ func (s *ClientSession) doResultMessage(stream *Stream, tid int) error {
 	return nil
 }
 
+func (s *ClientSession) doErrorMessage(stream *Stream, tid int) error {
+	// 第一个参数为 null 或者 command object
+	if err := stream.msg.readNull(); err != nil {
+		if _, err = stream.msg.readObjectWithType(); err != nil {
+			return err
+		}
+	}
+	infos, err := stream.msg.readObjectWithType()
+	if err != nil {
+		return err
+	}
+	se := newStatusError(infos)
+	log.Errorf("-----> _error('%s'). [%s] tid=%d, description=%s", se.Code, s.UniqueKey, tid, se.Description)
+	s.notifyDoResultFail(se)
+	return nil
+}
+
 func (s *ClientSession) doProtocolControlMessage(stream *Stream) error {
 	if stream.msg.len() < 4 {
 		return ErrRTMP
 	}
-	val := int(bele.BEUint32(stream.msg.buf))
+	val := bele.BEUint32(stream.msg.buf[stream.msg.b:stream.msg.e])
 
 	switch stream.header.MsgTypeID {
 	case typeidWinAckSize:
-		s.peerWinAckSize = val
-		log.Infof("-----> Window Acknowledgement Size: %d. [%s]", s.peerWinAckSize, s.UniqueKey)
+		log.Infof("-----> Window Acknowledgement Size: %d. [%s]", val, s.UniqueKey)
+		s.fc.onWinAckSize(val)
 	case typeidBandwidth:
-		log.Warnf("-----> Set Peer Bandwidth. ignore. [%s]", s.UniqueKey)
+		if stream.msg.len() < 5 {
+			return ErrRTMP
+		}
+		limitType := stream.msg.buf[stream.msg.b+4]
+		log.Infof("-----> Set Peer Bandwidth %d, limit type %d. [%s]", val, limitType, s.UniqueKey)
+		if winAckSize, ok := s.fc.onPeerBandwidth(val, limitType); ok {
+			log.Infof("<----- Window Acknowledgement Size %d. [%s]", winAckSize, s.UniqueKey)
+			return s.packer.writeWinAckSize(s.conn, int(winAckSize))
+		}
 	case typeidSetChunkSize:
 		// composer内部会自动更新peer chunk size.
 		log.Infof("-----> Set Chunk Size %d. [%s]", val, s.UniqueKey)
@@ -404,14 +587,14 @@ func (s *ClientSession) handshake() error {
 	}
 	log.Infof("-----> Handshake S0+S1+S2. [%s]", s.UniqueKey)
 
-	log.Infof("<----- Handshake C2. [%s]", s.UniqueKey)
+	log.Infof("<----- Handshake C2. [%s] mode=%s", s.UniqueKey, s.hc.Mode())
 	if err := s.hc.WriteC2(s.conn); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (s *ClientSession) tcpConnect() error {
+func (s *ClientSession) tcpConnect(ctx context.Context) error {
 	var err error
 	var addr string
 	if strings.Contains(s.url.Host, ":") {
@@ -421,13 +604,21 @@ func (s *ClientSession) tcpConnect() error {
 	}
 
 	var conn net.Conn
-	if conn, err = net.DialTimeout("tcp", addr, time.Duration(s.option.ConnectTimeoutMS)*time.Millisecond); err != nil {
+	dialer := net.Dialer{Timeout: time.Duration(s.option.ConnectTimeoutMS) * time.Millisecond}
+	if conn, err = dialer.DialContext(ctx, "tcp", addr); err != nil {
 		return err
 	}
 
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.disposed {
+		_ = conn.Close()
+		return ErrClientSessionDisposed
+	}
 	s.conn = connection.New(conn, func(option *connection.Option) {
 		option.ReadBufSize = readBufSize
 	})
+	s.fc = newFlowControl(s.conn)
 	return nil
 }
 
@@ -437,5 +628,13 @@ func (s *ClientSession) notifyDoResultSucc() {
 	s.conn.ModReadTimeoutMS(s.option.ReadAVTimeoutMS)
 	s.conn.ModWriteTimeoutMS(s.option.WriteAVTimeoutMS)
 
-	s.doResultChan <- struct{}{}
+	s.doResultChan <- nil
+}
+
+// 已经通知过结果时（比如推流成功后又收到了错误状态），忽略
+func (s *ClientSession) notifyDoResultFail(err error) {
+	select {
+	case s.doResultChan <- err:
+	default:
+	}
 }
@@ -0,0 +1,124 @@
+// Copyright 2019, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package rtmp_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/q191201771/lal/pkg/rtmp"
+	"github.com/q191201771/naza/pkg/assert"
+)
+
+// 只建立 tcp 连接，不做任何回复的服务端
+func listenSilent(t *testing.T) (net.Listener, string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	return ln, ln.Addr().String()
+}
+
+func TestClientSession_Context(t *testing.T) {
+	ln, addr := listenSilent(t)
+	defer ln.Close()
+
+	// ctx 超时
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	pushSession := rtmp.NewPushSession()
+	err := pushSession.PushContext(ctx, "rtmp://"+addr+"/live/ctx")
+	assert.Equal(t, context.DeadlineExceeded, err)
+	pushSession.Dispose()
+
+	// ctx 被取消
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	pullSession := rtmp.NewPullSession()
+	err = pullSession.PullContext(ctx, "rtmp://"+addr+"/live/ctx", func(msg rtmp.AVMsg) {})
+	assert.Equal(t, context.Canceled, err)
+	pullSession.Dispose()
+
+	// DoTimeoutMS 超时
+	pullSession = rtmp.NewPullSession(func(option *rtmp.PullSessionOption) {
+		option.PullTimeoutMS = 100
+	})
+	err = pullSession.Pull("rtmp://"+addr+"/live/ctx", func(msg rtmp.AVMsg) {})
+	assert.Equal(t, rtmp.ErrClientSessionTimeout, err)
+	pullSession.Dispose()
+}
+
+func TestClientSession_DisposeDuringDo(t *testing.T) {
+	ln, addr := listenSilent(t)
+	defer ln.Close()
+
+	// 握手过程中调用 Dispose，不能返回成功
+	pushSession := rtmp.NewPushSession()
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		pushSession.Dispose()
+	}()
+	err := pushSession.Push("rtmp://" + addr + "/live/dispose")
+	assert.Equal(t, rtmp.ErrClientSessionDisposed, err)
+	assert.Equal(t, rtmp.ErrPushSessionNotReady, pushSession.AsyncWrite([]byte{0}))
+
+	pullSession := rtmp.NewPullSession()
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		pullSession.Dispose()
+	}()
+	err = pullSession.Pull("rtmp://"+addr+"/live/dispose", func(msg rtmp.AVMsg) {})
+	assert.Equal(t, rtmp.ErrClientSessionDisposed, err)
+}
+
+// 握手后回复一个不合法的 user control message
+func TestClientSession_ReadLoopError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var hs rtmp.HandshakeServer
+		if err := hs.ReadC0C1(conn); err != nil {
+			return
+		}
+		if err := hs.WriteS0S1S2(conn); err != nil {
+			return
+		}
+		if err := hs.ReadC2(conn); err != nil {
+			return
+		}
+		// fmt 0, csid 2, timestamp 0, len 1, typeid 4(user control), stream id 0
+		_, _ = conn.Write([]byte{0x02, 0, 0, 0, 0, 0, 1, 4, 0, 0, 0, 0, 0})
+		time.Sleep(time.Second)
+	}()
+
+	pullSession := rtmp.NewPullSession(func(option *rtmp.PullSessionOption) {
+		option.PullTimeoutMS = 5000
+	})
+	err = pullSession.Pull("rtmp://"+ln.Addr().String()+"/live/err", func(msg rtmp.AVMsg) {})
+	assert.Equal(t, rtmp.ErrRTMP, err)
+	pullSession.Dispose()
+}
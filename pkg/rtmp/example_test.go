@@ -78,10 +78,7 @@ type MockPubSessionObserver struct {
 func (pso *MockPubSessionObserver) OnReadRTMPAVMsg(msg rtmp.AVMsg) {
 	bc++
 	// 转发
-	currHeader := logic.Trans.MakeDefaultRTMPHeader(msg.Header)
-	var absChunks []byte
-	absChunks = rtmp.Message2Chunks(msg.Payload, &currHeader)
-	subSession.AsyncWrite(absChunks)
+	_ = subSession.WriteAVMsg(msg)
 }
 
 func TestExample(t *testing.T) {
@@ -129,11 +126,7 @@ func TestExample(t *testing.T) {
 		assert.Equal(t, nil, err)
 		rc++
 		//log.Debugf("send tag. %d", tag.Header.Timestamp)
-		msg := logic.Trans.FLVTag2RTMPMsg(tag)
-		//log.Debugf("send msg. %d %d", msg.Header.Timestamp, msg.Header.TimestampAbs)
-		chunks := rtmp.Message2Chunks(msg.Payload, &msg.Header)
-		//log.Debugf("%s", hex.Dump(chunks[:16]))
-		err = pushSession.AsyncWrite(chunks)
+		err = pushSession.WriteFLVTag(tag)
 		assert.Equal(t, nil, err)
 	}
 
@@ -0,0 +1,93 @@
+// Copyright 2019, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package rtmp
+
+// flow_control.go
+// @pure
+// 5.4.3 Acknowledgement, 5.4.4 Window Acknowledgement Size, 5.4.5 Set Peer Bandwidth
+
+import (
+	"io"
+)
+
+// 包装 session 的读取，统计从对端收到的字节数
+// 只在 session 的读 goroutine 中使用，不需要加锁
+type flowControl struct {
+	r io.Reader
+
+	received   uint32 // 收到的总字节数，溢出后回绕，和 Acknowledgement 中的 sequence number 一致
+	lastAckSeq uint32
+
+	peerWinAckSize  uint32 // 对端通过 Window Acknowledgement Size 设置的窗口，为0时不回复 Acknowledgement
+	localWinAckSize uint32 // 本端最后一次发送给对端的窗口
+
+	peerBandwidth          uint32 // 对端通过 Set Peer Bandwidth 限制的本端发送带宽
+	peerBandwidthLimitType uint8
+}
+
+func newFlowControl(r io.Reader) *flowControl {
+	return &flowControl{
+		r: r,
+	}
+}
+
+func (fc *flowControl) Read(p []byte) (int, error) {
+	n, err := fc.r.Read(p)
+	fc.received += uint32(n)
+	return n, err
+}
+
+func (fc *flowControl) onWinAckSize(val uint32) {
+	fc.peerWinAckSize = val
+}
+
+// 距离上次回复 Acknowledgement 收到的数据达到窗口大小时，返回需要回复的 sequence number
+func (fc *flowControl) shouldAck() (uint32, bool) {
+	if fc.peerWinAckSize == 0 || fc.received-fc.lastAckSeq < fc.peerWinAckSize {
+		return 0, false
+	}
+	fc.lastAckSeq = fc.received
+	return fc.received, true
+}
+
+// 更新对端限制的带宽，如果需要向对端发送新的 Window Acknowledgement Size，返回窗口大小
+//
+// Hard    限制为 val
+// Soft    限制为 val 和当前限制中较小的一个
+// Dynamic 如果当前限制是 Hard 的，作为 Hard 处理，否则忽略
+func (fc *flowControl) onPeerBandwidth(val uint32, limitType uint8) (uint32, bool) {
+	switch limitType {
+	case peerBandwidthLimitTypeHard:
+		fc.peerBandwidth = val
+		fc.peerBandwidthLimitType = limitType
+	case peerBandwidthLimitTypeSoft:
+		if fc.peerBandwidth == 0 || val < fc.peerBandwidth {
+			fc.peerBandwidth = val
+		}
+		fc.peerBandwidthLimitType = limitType
+	case peerBandwidthLimitTypeDynamic:
+		if fc.peerBandwidth == 0 || fc.peerBandwidthLimitType != peerBandwidthLimitTypeHard {
+			return 0, false
+		}
+		fc.peerBandwidth = val
+	default:
+		return 0, false
+	}
+
+	if fc.peerBandwidth == fc.localWinAckSize {
+		return 0, false
+	}
+	fc.localWinAckSize = fc.peerBandwidth
+	return fc.localWinAckSize, true
+}
+
+// 本端主动发送了 Window Acknowledgement Size 时调用
+func (fc *flowControl) setLocalWinAckSize(val uint32) {
+	fc.localWinAckSize = val
+}
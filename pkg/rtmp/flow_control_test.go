@@ -0,0 +1,85 @@
+// Copyright 2019, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package rtmp
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/q191201771/naza/pkg/assert"
+)
+
+func TestFlowControl_Ack(t *testing.T) {
+	fc := newFlowControl(bytes.NewReader(make([]byte, 1000)))
+	buf := make([]byte, 100)
+
+	// 没有收到对端的窗口大小，不回复
+	_, _ = fc.Read(buf)
+	_, ok := fc.shouldAck()
+	assert.Equal(t, false, ok)
+
+	fc.onWinAckSize(250)
+	_, _ = fc.Read(buf)
+	_, ok = fc.shouldAck()
+	assert.Equal(t, false, ok)
+	_, _ = fc.Read(buf)
+	seq, ok := fc.shouldAck()
+	assert.Equal(t, true, ok)
+	assert.Equal(t, uint32(300), seq)
+	_, _ = fc.Read(buf)
+	_, ok = fc.shouldAck()
+	assert.Equal(t, false, ok)
+	_, _ = fc.Read(buf)
+	_, _ = fc.Read(buf)
+	seq, ok = fc.shouldAck()
+	assert.Equal(t, true, ok)
+	assert.Equal(t, uint32(600), seq)
+
+	// sequence number 溢出回绕
+	fc.received = 0xffffffff - 10
+	fc.lastAckSeq = fc.received
+	_, _ = fc.Read(buf)
+	_, _ = fc.Read(buf)
+	_, _ = fc.Read(buf)
+	seq, ok = fc.shouldAck()
+	assert.Equal(t, true, ok)
+	assert.Equal(t, uint32(289), seq)
+}
+
+func TestFlowControl_PeerBandwidth(t *testing.T) {
+	fc := newFlowControl(nil)
+	fc.setLocalWinAckSize(5000000)
+
+	// 之前没有 Hard 限制时忽略 Dynamic
+	_, ok := fc.onPeerBandwidth(1000, peerBandwidthLimitTypeDynamic)
+	assert.Equal(t, false, ok)
+
+	// Soft 取较小值
+	v, ok := fc.onPeerBandwidth(3000, peerBandwidthLimitTypeSoft)
+	assert.Equal(t, true, ok)
+	assert.Equal(t, uint32(3000), v)
+	_, ok = fc.onPeerBandwidth(4000, peerBandwidthLimitTypeSoft)
+	assert.Equal(t, false, ok)
+
+	// Hard 直接生效，之后的 Dynamic 作为 Hard 处理
+	v, ok = fc.onPeerBandwidth(4000, peerBandwidthLimitTypeHard)
+	assert.Equal(t, true, ok)
+	assert.Equal(t, uint32(4000), v)
+	v, ok = fc.onPeerBandwidth(6000, peerBandwidthLimitTypeDynamic)
+	assert.Equal(t, true, ok)
+	assert.Equal(t, uint32(6000), v)
+
+	// 和上次发送的窗口相同时不需要发送
+	_, ok = fc.onPeerBandwidth(6000, peerBandwidthLimitTypeHard)
+	assert.Equal(t, false, ok)
+
+	// 未知的类型
+	_, ok = fc.onPeerBandwidth(1, 3)
+	assert.Equal(t, false, ok)
+}
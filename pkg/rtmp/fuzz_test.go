@@ -0,0 +1,192 @@
+// Copyright 2019, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+//go:build go1.18
+// +build go1.18
+
+package rtmp
+
+// 对端可以控制的输入的 fuzz 测试，比如:
+// go test -run=^$ -fuzz=FuzzChunkComposer -fuzztime=1h ./pkg/rtmp/
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/q191201771/lal/pkg/bufpool"
+)
+
+// 限制 message 的大小，避免 fuzz 时每次都申请大块内存
+var fuzzLimit = bufpool.Limit{
+	MaxMsgSize:              64 * 1024,
+	MaxSessionBufferedBytes: 1024 * 1024,
+}
+
+func FuzzChunkComposer(f *testing.F) {
+	for _, seed := range chunkSeeds() {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		defer bufpool.SetLimit(bufpool.GetLimit())
+		bufpool.SetLimit(fuzzLimit)
+
+		c := NewChunkComposer()
+		err := c.RunLoop(bytes.NewReader(b), func(stream *Stream) error {
+			if stream.msg.len() != stream.header.MsgLen {
+				t.Fatalf("msg len mismatch. header=%+v, len=%d", stream.header, stream.msg.len())
+			}
+			fuzzMsg(stream.toAVMsg())
+			return nil
+		})
+		if err == ErrPanic {
+			t.Fatal(err)
+		}
+	})
+}
+
+// 上层收到 message 后会调用的解析函数
+func fuzzMsg(msg AVMsg) {
+	switch msg.Header.MsgTypeID {
+	case TypeidAudio, TypeidVideo:
+		_ = msg.IsAudioSeqHeader()
+		_ = msg.IsVideoKeySeqHeader()
+		_ = msg.IsVideoKeyNalu()
+		_ = msg.TrackID()
+		msgs, _ := SplitMultitrack(msg)
+		for _, m := range msgs {
+			_ = m.TrackID()
+			_ = m.IsVideoKeySeqHeader()
+		}
+	case TypeidDataMessageAMF0:
+		_, _ = ParseMetadata(msg.Payload)
+	case typeidCommandMessageAMF0, TypeidDataMessageAMF3, typeidCommandMessageAMF3:
+		b := msg.Payload
+		for len(b) > 0 {
+			_, l, err := AMF0.ReadValue(b)
+			if err != nil {
+				break
+			}
+			b = b[l:]
+		}
+	case typeidUserControl:
+		_, _ = parseUserControl(msg.Payload)
+	}
+}
+
+func chunkSeeds() [][]byte {
+	var seeds [][]byte
+	h := Header{
+		CSID:         CSIDVideo,
+		MsgTypeID:    TypeidVideo,
+		MsgStreamID:  MSID1,
+		TimestampAbs: 40,
+	}
+	add := func(payload []byte, h Header) []byte {
+		h.MsgLen = uint32(len(payload))
+		return Message2Chunks(payload, &h)
+	}
+
+	// 默认 chunk size 下的多个 chunk
+	seeds = append(seeds, add(make([]byte, 300), h))
+
+	// set chunk size 之后的音视频数据
+	sh := Header{CSID: csidProtocolControl, MsgTypeID: typeidSetChunkSize}
+	b := add([]byte{0, 0, 0x10, 0}, sh)
+	b = append(b, add([]byte{0x17, 0x0, 0x0, 0x0, 0x0, 0x1, 0x64, 0x0, 0x1f, 0xff, 0xe1, 0x0, 0x4, 0x67, 0x64, 0x0, 0x1f, 0x1, 0x0, 0x1, 0x68}, h)...)
+	ah := h
+	ah.CSID = CSIDAudio
+	ah.MsgTypeID = TypeidAudio
+	b = append(b, add([]byte{0xaf, 0x0, 0x11, 0x90}, ah)...)
+	seeds = append(seeds, b)
+
+	// metadata
+	var buf bytes.Buffer
+	_ = AMF0.WriteString(&buf, onMetaData)
+	_ = AMF0.WriteEcmaArray(&buf, EcmaArray{{Key: MetadataKeyWidth, Value: float64(1280)}, {Key: MetadataKeyEncoder, Value: "lal"}})
+	mh := Header{CSID: CSIDAMF, MsgTypeID: TypeidDataMessageAMF0, MsgStreamID: MSID1}
+	seeds = append(seeds, add(buf.Bytes(), mh))
+
+	// command message
+	buf.Reset()
+	_ = AMF0.WriteString(&buf, "connect")
+	_ = AMF0.WriteNumber(&buf, 1)
+	_ = AMF0.WriteObject(&buf, []ObjectPair{{Key: "app", Value: "live"}, {Key: "objectEncoding", Value: float64(3)}})
+	ch := Header{CSID: csidOverConnection, MsgTypeID: typeidCommandMessageAMF0}
+	seeds = append(seeds, add(buf.Bytes(), ch))
+
+	// abort，aggregate 以及 user control
+	seeds = append(seeds, add([]byte{0, 0, 0, CSIDVideo}, Header{CSID: csidProtocolControl, MsgTypeID: typeidAbort}))
+	seeds = append(seeds, add([]byte{
+		TypeidAudio, 0, 0, 2, 0, 0, 100, 0, 0, 0, 0, 0xaf, 0x01,
+		0, 0, 0, 13,
+	}, Header{CSID: csidOverStream, MsgTypeID: typeidAggregateMessage, MsgStreamID: MSID1}))
+	seeds = append(seeds, add([]byte{0, 3, 0, 0, 0, 1, 0, 0, 0x0b, 0xb8}, Header{CSID: csidProtocolControl, MsgTypeID: typeidUserControl}))
+
+	// 扩展时间戳以及大于 64 的 csid
+	eh := h
+	eh.CSID = 320
+	eh.TimestampAbs = 0x1000000
+	seeds = append(seeds, add([]byte{0x27, 0x1, 0x0, 0x0, 0x0}, eh))
+	return seeds
+}
+
+func FuzzAMF0(f *testing.F) {
+	var buf bytes.Buffer
+	_ = AMF0.WriteValue(&buf, map[string]interface{}{"a": float64(1), "b": "str", "c": []interface{}{true, nil}})
+	f.Add(buf.Bytes())
+	buf.Reset()
+	_ = AMF0.WriteEcmaArray(&buf, EcmaArray{{Key: "duration", Value: float64(0)}, {Key: "stereo", Value: true}})
+	f.Add(buf.Bytes())
+	f.Add([]byte{AMF0TypeMarkerString, 0, 3, 'a', 'b', 'c'})
+	f.Add([]byte{AMF0TypeMarkerLongString, 0, 0, 0, 1, 'a'})
+	f.Add([]byte{AMF0TypeMarkerNumber, 0x40, 0x59, 0, 0, 0, 0, 0, 0})
+	// 引用以及 amf3
+	f.Add([]byte{AMF0TypeMarkerObject, 0, 1, 'a', AMF0TypeMarkerReference, 0, 0, 0, 0, AMF0TypeMarkerObjectEnd})
+	f.Add([]byte{AMF0TypeMarkerAvmplusObject, 0x0a, 0x0b, 0x01, 0x03, 'a', 0x04, 0x01, 0x01})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		if v, l, err := AMF0.ReadValue(b); err == nil {
+			if l > len(b) {
+				t.Fatalf("invalid len. l=%d, len=%d", l, len(b))
+			}
+			// 读取到的值可以重新序列化
+			_ = AMF0.WriteValue(&bytes.Buffer{}, v)
+		}
+		_, _, _ = AMF0.ReadString(b)
+		_, _, _ = AMF0.ReadNumber(b)
+		_, _, _ = AMF0.ReadBoolean(b)
+		_, _ = AMF0.ReadNull(b)
+		_, _, _ = AMF0.ReadObject(b)
+		_, _, _ = AMF0.ReadEcmaArray(b)
+		_, _ = ParseMetadata(b)
+	})
+}
+
+func FuzzHandshakeServer(f *testing.F) {
+	var buf bytes.Buffer
+	_ = (&HandshakeClientSimple{}).WriteC0C1(&buf)
+	f.Add(buf.Bytes())
+	buf.Reset()
+	var hc HandshakeClientComplex
+	_ = hc.WriteC0C1(&buf)
+	f.Add(append(buf.Bytes(), make([]byte, c2Len)...))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		r := bytes.NewReader(b)
+		var hs HandshakeServer
+		if err := hs.ReadC0C1(r); err != nil {
+			return
+		}
+		var out bytes.Buffer
+		if err := hs.WriteS0S1S2(&out); err != nil || out.Len() != s0s1s2Len {
+			t.Fatalf("invalid s0s1s2. err=%v, len=%d", err, out.Len())
+		}
+		_ = hs.ReadC2(r)
+	})
+}
@@ -12,6 +12,7 @@ import (
 	"bytes"
 	"crypto/hmac"
 	"crypto/sha256"
+	"errors"
 	"io"
 	"time"
 
@@ -33,6 +34,7 @@ const (
 const (
 	clientPartKeyLen = 30
 	serverPartKeyLen = 36
+	clientFullKeyLen = 62
 	serverFullKeyLen = 68
 	keyLen           = 32
 )
@@ -67,10 +69,37 @@ var serverKey = []byte{
 
 var random1528Buf []byte
 
+var ErrHandshake = errors.New("lal.rtmp: handshake digest mismatch")
+
+type HandshakeMode int
+
+const (
+	HandshakeModeSimple HandshakeMode = iota
+	HandshakeModeComplex
+)
+
+func (m HandshakeMode) String() string {
+	switch m {
+	case HandshakeModeSimple:
+		return "simple"
+	case HandshakeModeComplex:
+		return "complex"
+	}
+	return "unknown"
+}
+
+// 复杂握手中，c1 s1 由 time(4) + version(4) + key(764) + digest(764) 组成，schema0 和 schema1 的区别在于 key 和 digest 的先后顺序
+// digest 块以 4 字节的 offset 开头，以下为 digest 块相对于 c1 s1 起始位置的偏移
+const (
+	schema0DigestBase = 8 + 764
+	schema1DigestBase = 8
+)
+
 type HandshakeClient interface {
 	WriteC0C1(writer io.Writer) error
 	ReadS0S1S2(reader io.Reader) error
 	WriteC2(writer io.Writer) error
+	Mode() HandshakeMode
 }
 
 var _ HandshakeClient = &HandshakeClientSimple{}
@@ -81,14 +110,18 @@ type HandshakeClientSimple struct {
 	c2   []byte
 }
 
+// 如果服务端回复的 s1 中没有 digest，说明服务端只支持简单握手，此时在当前连接中退化成简单握手
 type HandshakeClientComplex struct {
-	c0c1 []byte
-	c2   []byte
+	c0c1     []byte
+	c1Digest []byte
+	c2       []byte
+	mode     HandshakeMode
 }
 
 type HandshakeServer struct {
-	isSimpleMode bool
-	s0s1s2       []byte
+	mode     HandshakeMode
+	s0s1s2   []byte
+	s1Digest []byte
 }
 
 func (c *HandshakeClientSimple) WriteC0C1(writer io.Writer) error {
@@ -120,6 +153,10 @@ func (c *HandshakeClientSimple) WriteC2(write io.Writer) error {
 	return err
 }
 
+func (c *HandshakeClientSimple) Mode() HandshakeMode {
+	return HandshakeModeSimple
+}
+
 func (c *HandshakeClientComplex) WriteC0C1(writer io.Writer) error {
 	c.c0c1 = make([]byte, c0c1Len)
 	c.c0c1[0] = version
@@ -127,13 +164,12 @@ func (c *HandshakeClientComplex) WriteC0C1(writer io.Writer) error {
 	//
 	copy(c.c0c1[5:], clientVersion)
 	random1528(c.c0c1[9:])
-	// offset
-	c.c0c1[9] = 0
-	c.c0c1[10] = 0
-	c.c0c1[11] = 0
-	c.c0c1[12] = 0
-	// digest
-	makeDigestWithoutCenterPart(c.c0c1[1:], 12, clientKey[:clientPartKeyLen], c.c0c1[13:])
+	// 使用 schema1，offset 置 0，digest 紧跟在 offset 之后
+	c1 := c.c0c1[1:]
+	bele.BEPutUint32(c1[schema1DigestBase:], 0)
+	offs := schema1DigestBase + 4
+	makeDigestWithoutCenterPart(c1, offs, clientKey[:clientPartKeyLen], c1[offs:])
+	c.c1Digest = c1[offs : offs+keyLen]
 	_, err := writer.Write(c.c0c1)
 	return err
 }
@@ -146,9 +182,29 @@ func (c *HandshakeClientComplex) ReadS0S1S2(reader io.Reader) error {
 	//if s0s1s2[0] != version {
 	//	return ErrRTMP
 	//}
-	// TODO chef: 这里复杂模式的 c2 构造没有完全按照规范
-	// nginx rtmp module 作为 server 端时，不会校验 c2 内容
-	c.c2 = append(c.c2, s0s1s2[s0s1Len:]...)
+	s1 := s0s1s2[1:s0s1Len]
+	s2 := s0s1s2[s0s1Len:]
+
+	offs := findDigestWithAnySchema(s1, serverKey[:serverPartKeyLen])
+	if offs == -1 {
+		log.Warn("s1 digest not found. roll back to simple handshake.")
+		c.mode = HandshakeModeSimple
+		// echo s1 as c2
+		c.c2 = append(c.c2, s1...)
+		return nil
+	}
+	c.mode = HandshakeModeComplex
+
+	// 部分服务端不按规范生成 s2 的 digest，这里只打印日志，不作为失败处理
+	if !checkReplyDigest(s2, c.c1Digest, serverKey[:serverFullKeyLen]) {
+		log.Warn("s2 digest mismatch.")
+	}
+
+	// c2 由随机数据加上末尾 32 字节的 digest 组成，digest 的 key 由 s1 的 digest 计算得到
+	c.c2 = make([]byte, c2Len)
+	bele.BEPutUint32(c.c2, uint32(time.Now().UnixNano()))
+	random1528(c.c2[8:])
+	makeReplyDigest(c.c2, s1[offs:offs+keyLen], clientKey[:clientFullKeyLen])
 
 	return nil
 }
@@ -158,6 +214,10 @@ func (c *HandshakeClientComplex) WriteC2(write io.Writer) error {
 	return err
 }
 
+func (c *HandshakeClientComplex) Mode() HandshakeMode {
+	return c.mode
+}
+
 func (s *HandshakeServer) ReadC0C1(reader io.Reader) (err error) {
 	c0c1 := make([]byte, c0c1Len)
 	if _, err = io.ReadAtLeast(reader, c0c1, c0c1Len); err != nil {
@@ -166,15 +226,19 @@ func (s *HandshakeServer) ReadC0C1(reader io.Reader) (err error) {
 
 	s.s0s1s2 = make([]byte, s0s1s2Len)
 
-	s2key := parseChallenge(c0c1)
-	s.isSimpleMode = len(s2key) == 0
+	c1Digest, base := parseChallenge(c0c1)
+	if c1Digest == nil {
+		s.mode = HandshakeModeSimple
+	} else {
+		s.mode = HandshakeModeComplex
+	}
 
 	c1ts := bele.BEUint32(c0c1[1:])
 	now := uint32(time.Now().UnixNano())
 
 	s.s0s1s2[0] = version
 
-	s1 := s.s0s1s2[1:]
+	s1 := s.s0s1s2[1:s0s1Len]
 	s2 := s.s0s1s2[s0s1Len:]
 
 	bele.BEPutUint32(s1, now)
@@ -184,24 +248,23 @@ func (s *HandshakeServer) ReadC0C1(reader io.Reader) (err error) {
 	bele.BEPutUint32(s2[4:], now)
 	random1528(s2[8:])
 
-	if s.isSimpleMode {
+	if s.mode == HandshakeModeSimple {
 		// s1
 		bele.BEPutUint32(s1[4:], 0)
 
 		//copy(s.s0s1s2, c0c1)
 		//copy(s.s0s1s2[s0s1Len:], c0c1)
 	} else {
-		// s1
+		// s1，使用和 c1 相同的 schema
 		copy(s1[4:], serverVersion)
 
-		offs := int(s1[8]) + int(s1[9]) + int(s1[10]) + int(s1[11])
-		offs = (offs % 728) + 12
-		makeDigestWithoutCenterPart(s.s0s1s2[1:s0s1Len], offs, serverKey[:serverPartKeyLen], s.s0s1s2[1+offs:])
+		offs := digestOffset(s1, base)
+		makeDigestWithoutCenterPart(s1, offs, serverKey[:serverPartKeyLen], s1[offs:])
+		s.s1Digest = s1[offs : offs+keyLen]
 
 		// s2
 		// make digest to s2 suffix position
-		replyOffs := s2Len - keyLen
-		makeDigestWithoutCenterPart(s2, replyOffs, s2key, s2[replyOffs:])
+		makeReplyDigest(s2, c1Digest, serverKey[:serverFullKeyLen])
 	}
 
 	return nil
@@ -212,44 +275,74 @@ func (s *HandshakeServer) WriteS0S1S2(write io.Writer) error {
 	return err
 }
 
+// 复杂握手时，c2 末尾的 digest 必须正确，或者 c2 是 s1 或 s2 的回显（部分客户端的实现，比如旧版本的 lal），否则返回 ErrHandshake
 func (s *HandshakeServer) ReadC2(reader io.Reader) error {
 	c2 := make([]byte, c2Len)
 	if _, err := io.ReadAtLeast(reader, c2, c2Len); err != nil {
 		return err
 	}
-	return nil
+	if s.mode == HandshakeModeSimple {
+		return nil
+	}
+	if checkReplyDigest(c2, s.s1Digest, clientKey[:clientFullKeyLen]) {
+		return nil
+	}
+	if bytes.Equal(c2, s.s0s1s2[1:s0s1Len]) {
+		log.Debug("c2 is echo of s1.")
+		return nil
+	}
+	if bytes.Equal(c2, s.s0s1s2[s0s1Len:]) {
+		log.Debug("c2 is echo of s2.")
+		return nil
+	}
+	return ErrHandshake
+}
+
+func (s *HandshakeServer) Mode() HandshakeMode {
+	return s.mode
 }
 
-func parseChallenge(c0c1 []byte) []byte {
+// @return c1 中的 digest 以及所使用 schema 的 digest 块偏移，简单握手时 digest 为 nil
+func parseChallenge(c0c1 []byte) ([]byte, int) {
 	//if c0c1[0] != version {
 	//	return nil, ErrRTMP
 	//}
 	ver := bele.BEUint32(c0c1[5:])
 	if ver == 0 {
 		log.Debug("handshake simple mode.")
-		return nil
+		return nil, 0
 	}
 
-	offs := findDigest(c0c1[1:], 764+8, clientKey[:clientPartKeyLen])
+	c1 := c0c1[1:]
+	base := schema0DigestBase
+	offs := findDigest(c1, base, clientKey[:clientPartKeyLen])
 	if offs == -1 {
-		offs = findDigest(c0c1[1:], 8, clientKey[:clientPartKeyLen])
+		base = schema1DigestBase
+		offs = findDigest(c1, base, clientKey[:clientPartKeyLen])
 	}
 	if offs == -1 {
 		log.Warn("get digest offs failed. roll back to try simple handshake.")
-		return nil
+		return nil, 0
 	}
-	log.Debug("handshake complex mode.")
+	log.Debugf("handshake complex mode. digest base=%d", base)
+
+	return c1[offs : offs+keyLen], base
+}
 
-	// use c0c1 digest to make a new digest
-	digest := makeDigest(c0c1[1+offs:1+offs+keyLen], serverKey[:serverFullKeyLen])
+func findDigestWithAnySchema(b []byte, key []byte) int {
+	if offs := findDigest(b, schema0DigestBase, key); offs != -1 {
+		return offs
+	}
+	return findDigest(b, schema1DigestBase, key)
+}
 
-	return digest
+func digestOffset(b []byte, base int) int {
+	offs := int(b[base]) + int(b[base+1]) + int(b[base+2]) + int(b[base+3])
+	return (offs % 728) + base + 4
 }
 
 func findDigest(c1 []byte, base int, key []byte) int {
-	// calc offs
-	offs := int(c1[base]) + int(c1[base+1]) + int(c1[base+2]) + int(c1[base+3])
-	offs = (offs % 728) + base + 4
+	offs := digestOffset(c1, base)
 	// calc digest
 	digest := make([]byte, keyLen)
 	makeDigestWithoutCenterPart(c1, offs, key, digest)
@@ -260,6 +353,19 @@ func findDigest(c1 []byte, base int, key []byte) int {
 	return -1
 }
 
+// s2 c2 的末尾 32 字节为 digest，key 由对端 c1 s1 中的 digest 计算得到
+func makeReplyDigest(b []byte, peerDigest []byte, key []byte) {
+	replyOffs := len(b) - keyLen
+	makeDigestWithoutCenterPart(b, replyOffs, makeDigest(peerDigest, key), b[replyOffs:])
+}
+
+func checkReplyDigest(b []byte, peerDigest []byte, key []byte) bool {
+	replyOffs := len(b) - keyLen
+	digest := make([]byte, keyLen)
+	makeDigestWithoutCenterPart(b, replyOffs, makeDigest(peerDigest, key), digest)
+	return bytes.Equal(digest, b[replyOffs:])
+}
+
 // <b> could be `c1` or `s1` or `s2`
 func makeDigestWithoutCenterPart(b []byte, offs int, key []byte, out []byte) {
 	mac := hmac.New(sha256.New, key)
@@ -33,6 +33,8 @@ func TestHandshakeSimple(t *testing.T) {
 	assert.Equal(t, nil, err)
 	err = hs.ReadC2(b)
 	assert.Equal(t, nil, err)
+	assert.Equal(t, HandshakeModeSimple, hc.Mode())
+	assert.Equal(t, HandshakeModeSimple, hs.Mode())
 }
 
 func TestHandshakeComplex(t *testing.T) {
@@ -52,6 +54,73 @@ func TestHandshakeComplex(t *testing.T) {
 	assert.Equal(t, nil, err)
 	err = hs.ReadC2(b)
 	assert.Equal(t, nil, err)
+	assert.Equal(t, HandshakeModeComplex, hc.Mode())
+	assert.Equal(t, HandshakeModeComplex, hs.Mode())
+}
+
+func TestHandshakeComplexC2(t *testing.T) {
+	var err error
+	var hc HandshakeClientComplex
+	var hs HandshakeServer
+	b := &bytes.Buffer{}
+	err = hc.WriteC0C1(b)
+	assert.Equal(t, nil, err)
+	err = hs.ReadC0C1(b)
+	assert.Equal(t, nil, err)
+	err = hs.WriteS0S1S2(b)
+	assert.Equal(t, nil, err)
+	s0s1s2 := append([]byte(nil), b.Bytes()...)
+
+	// 回显 s1 作为 c2
+	err = hs.ReadC2(bytes.NewReader(s0s1s2[1:1537]))
+	assert.Equal(t, nil, err)
+
+	// digest 错误的 c2
+	err = hs.ReadC2(bytes.NewReader(make([]byte, 1536)))
+	assert.Equal(t, ErrHandshake, err)
+}
+
+// 旧版本 lal 的复杂握手客户端，以及部分简单的客户端，回显 s2 作为 c2
+func TestHandshakeComplexEchoS2(t *testing.T) {
+	var err error
+	var hc HandshakeClientComplex
+	var hs HandshakeServer
+	b := &bytes.Buffer{}
+	err = hc.WriteC0C1(b)
+	assert.Equal(t, nil, err)
+	err = hs.ReadC0C1(b)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, HandshakeModeComplex, hs.Mode())
+	err = hs.WriteS0S1S2(b)
+	assert.Equal(t, nil, err)
+	s0s1s2 := append([]byte(nil), b.Bytes()...)
+
+	err = hs.ReadC2(bytes.NewReader(s0s1s2[1537:]))
+	assert.Equal(t, nil, err)
+}
+
+// 复杂握手的客户端，服务端回复简单握手时，退化成简单握手
+func TestHandshakeComplexClientSimpleServer(t *testing.T) {
+	var err error
+	var hcs HandshakeClientSimple
+	var hc HandshakeClientComplex
+	var hs HandshakeServer
+	b := &bytes.Buffer{}
+	err = hcs.WriteC0C1(b)
+	assert.Equal(t, nil, err)
+	err = hs.ReadC0C1(b)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, HandshakeModeSimple, hs.Mode())
+	err = hs.WriteS0S1S2(b)
+	assert.Equal(t, nil, err)
+	s0s1s2 := append([]byte(nil), b.Bytes()...)
+
+	err = hc.ReadS0S1S2(b)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, HandshakeModeSimple, hc.Mode())
+	err = hc.WriteC2(b)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, s0s1s2[1:1537], b.Bytes())
 }
 
 func BenchmarkHandshakeSimple(b *testing.B) {
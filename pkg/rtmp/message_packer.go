@@ -37,6 +37,16 @@ func NewMessagePacker() *MessagePacker {
 	}
 }
 
+// 将缓冲中的信令发送出去
+// 注意，connection 开启了异步发送时，Write 不会拷贝传入的内存块，所以不能复用 b 的内存
+func (packer *MessagePacker) flush(writer io.Writer) error {
+	out := make([]byte, packer.b.Len())
+	copy(out, packer.b.Bytes())
+	packer.b.Reset()
+	_, err := writer.Write(out)
+	return err
+}
+
 func (packer *MessagePacker) writeMessageHeader(csid int, bodyLen int, typeID uint8, streamID int) {
 	// 目前这个函数只供发送信令时调用，信令的 csid 都是小于等于 63 的，如果传入的 csid 大于 63，直接 panic
 	if csid > 63 {
@@ -54,8 +64,7 @@ func (packer *MessagePacker) writeMessageHeader(csid int, bodyLen int, typeID ui
 func (packer *MessagePacker) writeProtocolControlMessage(writer io.Writer, typeID uint8, val int) error {
 	packer.writeMessageHeader(csidProtocolControl, 4, typeID, 0)
 	_ = bele.WriteBE(packer.b, uint32(val))
-	_, err := packer.b.WriteTo(writer)
-	return err
+	return packer.flush(writer)
 }
 
 func (packer *MessagePacker) writeChunkSize(writer io.Writer, val int) error {
@@ -66,12 +75,25 @@ func (packer *MessagePacker) writeWinAckSize(writer io.Writer, val int) error {
 	return packer.writeProtocolControlMessage(writer, typeidWinAckSize, val)
 }
 
+func (packer *MessagePacker) writeAcknowledgement(writer io.Writer, seqNum uint32) error {
+	return packer.writeProtocolControlMessage(writer, typeidAck, int(seqNum))
+}
+
 func (packer *MessagePacker) writePeerBandwidth(writer io.Writer, val int, limitType uint8) error {
 	packer.writeMessageHeader(csidProtocolControl, 5, typeidBandwidth, 0)
 	_ = bele.WriteBE(packer.b, uint32(val))
 	_ = packer.b.WriteByte(limitType)
-	_, err := packer.b.WriteTo(writer)
-	return err
+	return packer.flush(writer)
+}
+
+// @param <args> stream id，timestamp，以及 SetBufferLength 中的 buffer length
+func (packer *MessagePacker) writeUserControl(writer io.Writer, eventType uint16, args ...uint32) error {
+	packer.writeMessageHeader(csidProtocolControl, 2+4*len(args), typeidUserControl, 0)
+	_ = bele.WriteBE(packer.b, eventType)
+	for _, arg := range args {
+		_ = bele.WriteBE(packer.b, arg)
+	}
+	return packer.flush(writer)
 }
 
 func (packer *MessagePacker) writeConnect(writer io.Writer, appName, tcURL string) error {
@@ -88,11 +110,10 @@ func (packer *MessagePacker) writeConnect(writer io.Writer, appName, tcURL strin
 	_ = AMF0.WriteObject(packer.b, objs)
 	raw := packer.b.Bytes()
 	bele.BEPutUint24(raw[4:], uint32(len(raw)-12))
-	_, err := packer.b.WriteTo(writer)
-	return err
+	return packer.flush(writer)
 }
 
-func (packer *MessagePacker) writeConnectResult(writer io.Writer, tid int) error {
+func (packer *MessagePacker) writeConnectResult(writer io.Writer, tid int, objectEncoding int) error {
 	packer.writeMessageHeader(csidOverConnection, 190, typeidCommandMessageAMF0, 0)
 	_ = AMF0.WriteString(packer.b, "_result")
 	_ = AMF0.WriteNumber(packer.b, float64(tid))
@@ -105,11 +126,10 @@ func (packer *MessagePacker) writeConnectResult(writer io.Writer, tid int) error
 		{Key: "level", Value: "status"},
 		{Key: "code", Value: "NetConnection.Connect.Success"},
 		{Key: "description", Value: "Connection succeeded."},
-		{Key: "objectEncoding", Value: 0},
+		{Key: "objectEncoding", Value: objectEncoding},
 	}
 	_ = AMF0.WriteObject(packer.b, objs)
-	_, err := packer.b.WriteTo(writer)
-	return err
+	return packer.flush(writer)
 }
 
 func (packer *MessagePacker) writeCreateStream(writer io.Writer) error {
@@ -118,18 +138,16 @@ func (packer *MessagePacker) writeCreateStream(writer io.Writer) error {
 	_ = AMF0.WriteString(packer.b, "createStream")
 	_ = AMF0.WriteNumber(packer.b, float64(tidClientCreateStream))
 	_ = AMF0.WriteNull(packer.b)
-	_, err := packer.b.WriteTo(writer)
-	return err
+	return packer.flush(writer)
 }
 
-func (packer *MessagePacker) writeCreateStreamResult(writer io.Writer, tid int) error {
+func (packer *MessagePacker) writeCreateStreamResult(writer io.Writer, tid int, streamID int) error {
 	packer.writeMessageHeader(csidOverConnection, 29, typeidCommandMessageAMF0, 0)
 	_ = AMF0.WriteString(packer.b, "_result")
 	_ = AMF0.WriteNumber(packer.b, float64(tid))
 	_ = AMF0.WriteNull(packer.b)
-	_ = AMF0.WriteNumber(packer.b, float64(MSID1))
-	_, err := packer.b.WriteTo(writer)
-	return err
+	_ = AMF0.WriteNumber(packer.b, float64(streamID))
+	return packer.flush(writer)
 }
 
 func (packer *MessagePacker) writePlay(writer io.Writer, streamName string, streamID int) error {
@@ -141,8 +159,7 @@ func (packer *MessagePacker) writePlay(writer io.Writer, streamName string, stre
 
 	raw := packer.b.Bytes()
 	bele.BEPutUint24(raw[4:], uint32(len(raw)-12))
-	_, err := packer.b.WriteTo(writer)
-	return err
+	return packer.flush(writer)
 }
 
 func (packer *MessagePacker) writePublish(writer io.Writer, appName string, streamName string, streamID int) error {
@@ -155,8 +172,7 @@ func (packer *MessagePacker) writePublish(writer io.Writer, appName string, stre
 
 	raw := packer.b.Bytes()
 	bele.BEPutUint24(raw[4:], uint32(len(raw)-12))
-	_, err := packer.b.WriteTo(writer)
-	return err
+	return packer.flush(writer)
 }
 
 func (packer *MessagePacker) writeOnStatusPublish(writer io.Writer, streamID int) error {
@@ -170,8 +186,7 @@ func (packer *MessagePacker) writeOnStatusPublish(writer io.Writer, streamID int
 		{Key: "description", Value: "Start publishing"},
 	}
 	_ = AMF0.WriteObject(packer.b, objs)
-	_, err := packer.b.WriteTo(writer)
-	return err
+	return packer.flush(writer)
 }
 
 func (packer *MessagePacker) writeOnStatusPlay(writer io.Writer, streamID int) error {
@@ -185,6 +200,56 @@ func (packer *MessagePacker) writeOnStatusPlay(writer io.Writer, streamID int) e
 		{Key: "description", Value: "Start live"},
 	}
 	_ = AMF0.WriteObject(packer.b, objs)
-	_, err := packer.b.WriteTo(writer)
-	return err
+	return packer.flush(writer)
+}
+
+// 打包并发送任意的 amf0 command message
+// @param <args> 跟在命令名称和 transaction id 后面的参数，类型见 AMF0.WriteValue
+func (packer *MessagePacker) writeCommand(writer io.Writer, csid int, streamID int, name string, tid int, args ...interface{}) error {
+	packer.writeMessageHeader(csid, 0, typeidCommandMessageAMF0, streamID)
+	_ = AMF0.WriteString(packer.b, name)
+	_ = AMF0.WriteNumber(packer.b, float64(tid))
+	for _, arg := range args {
+		if err := AMF0.WriteValue(packer.b, arg); err != nil {
+			packer.b.Reset()
+			return err
+		}
+	}
+
+	raw := packer.b.Bytes()
+	bele.BEPutUint24(raw[4:], uint32(len(raw)-12))
+	return packer.flush(writer)
+}
+
+// _result(tid, null, val)
+func (packer *MessagePacker) writeResult(writer io.Writer, tid int, val interface{}) error {
+	return packer.writeCommand(writer, csidOverConnection, 0, "_result", tid, nil, val)
+}
+
+// _error(tid, null, {level: 'error', code, description})
+func (packer *MessagePacker) writeError(writer io.Writer, tid int, code, description string) error {
+	objs := []ObjectPair{
+		{Key: "level", Value: "error"},
+		{Key: "code", Value: code},
+		{Key: "description", Value: description},
+	}
+	return packer.writeCommand(writer, csidOverConnection, 0, "_error", tid, nil, objs)
+}
+
+func (packer *MessagePacker) writeOnStatus(writer io.Writer, streamID int, level, code, description string) error {
+	objs := []ObjectPair{
+		{Key: "level", Value: level},
+		{Key: "code", Value: code},
+		{Key: "description", Value: description},
+	}
+	return packer.writeCommand(writer, csidOverStream, streamID, "onStatus", 0, nil, objs)
+}
+
+// onFCPublish 以及 onFCUnpublish
+func (packer *MessagePacker) writeOnFCPublish(writer io.Writer, name, code, description string) error {
+	objs := []ObjectPair{
+		{Key: "code", Value: code},
+		{Key: "description", Value: description},
+	}
+	return packer.writeCommand(writer, csidOverConnection, 0, name, 0, nil, objs)
 }
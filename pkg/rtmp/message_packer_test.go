@@ -13,6 +13,7 @@ import (
 	"testing"
 
 	"github.com/q191201771/naza/pkg/assert"
+	"github.com/q191201771/naza/pkg/bele"
 	"github.com/q191201771/naza/pkg/fake"
 )
 
@@ -46,6 +47,16 @@ func TestWrite(t *testing.T) {
 	assert.Equal(t, []byte{2, 0, 0, 0, 0, 0, 4, 5, 0, 0, 0, 0, 0, 0, 0, 1}, buf.Bytes())
 	buf.Reset()
 
+	err = packer.writeAcknowledgement(buf, 1)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []byte{2, 0, 0, 0, 0, 0, 4, 3, 0, 0, 0, 0, 0, 0, 0, 1}, buf.Bytes())
+	buf.Reset()
+
+	err = packer.writeUserControl(buf, userControlStreamBegin, 1)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []byte{2, 0, 0, 0, 0, 0, 6, 4, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}, buf.Bytes())
+	buf.Reset()
+
 	err = packer.writePeerBandwidth(buf, 1, 2)
 	assert.Equal(t, nil, err)
 	assert.Equal(t, []byte{2, 0, 0, 0, 0, 0, 5, 6, 0, 0, 0, 0, 0, 0, 0, 1, 2}, buf.Bytes())
@@ -67,19 +78,26 @@ func TestWrite(t *testing.T) {
 	assert.Equal(t, result, buf.Bytes())
 	buf.Reset()
 
-	err = packer.writeConnectResult(buf, 1)
+	err = packer.writeConnectResult(buf, 1, ObjectEncodingAMF0)
 	assert.Equal(t, nil, err)
 	result = []byte{0x3, 0x0, 0x0, 0x0, 0x0, 0x0, 0xbe, 0x14, 0x0, 0x0, 0x0, 0x0, 0x2, 0x0, 0x7, 0x5f, 0x72, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x0, 0x3f, 0xf0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x6, 0x66, 0x6d, 0x73, 0x56, 0x65, 0x72, 0x2, 0x0, 0xd, 0x46, 0x4d, 0x53, 0x2f, 0x33, 0x2c, 0x30, 0x2c, 0x31, 0x2c, 0x31, 0x32, 0x33, 0x0, 0xc, 0x63, 0x61, 0x70, 0x61, 0x62, 0x69, 0x6c, 0x69, 0x74, 0x69, 0x65, 0x73, 0x0, 0x40, 0x3f, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x9, 0x3, 0x0, 0x5, 0x6c, 0x65, 0x76, 0x65, 0x6c, 0x2, 0x0, 0x6, 0x73, 0x74, 0x61, 0x74, 0x75, 0x73, 0x0, 0x4, 0x63, 0x6f, 0x64, 0x65, 0x2, 0x0, 0x1d, 0x4e, 0x65, 0x74, 0x43, 0x6f, 0x6e, 0x6e, 0x65, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x2e, 0x43, 0x6f, 0x6e, 0x6e, 0x65, 0x63, 0x74, 0x2e, 0x53, 0x75, 0x63, 0x63, 0x65, 0x73, 0x73, 0x0, 0xb, 0x64, 0x65, 0x73, 0x63, 0x72, 0x69, 0x70, 0x74, 0x69, 0x6f, 0x6e, 0x2, 0x0, 0x15, 0x43, 0x6f, 0x6e, 0x6e, 0x65, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x20, 0x73, 0x75, 0x63, 0x63, 0x65, 0x65, 0x64, 0x65, 0x64, 0x2e, 0x0, 0xe, 0x6f, 0x62, 0x6a, 0x65, 0x63, 0x74, 0x45, 0x6e, 0x63, 0x6f, 0x64, 0x69, 0x6e, 0x67, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x9}
 	assert.Equal(t, result, buf.Bytes())
 	buf.Reset()
 
+	// 和 amf0 的区别仅在于 objectEncoding 字段的值
+	err = packer.writeConnectResult(buf, 1, ObjectEncodingAMF3)
+	assert.Equal(t, nil, err)
+	copy(result[len(result)-11:], []byte{0x40, 0x8})
+	assert.Equal(t, result, buf.Bytes())
+	buf.Reset()
+
 	err = packer.writeCreateStream(buf)
 	assert.Equal(t, nil, err)
 	result = []byte{0x3, 0x0, 0x0, 0x0, 0x0, 0x0, 0x19, 0x14, 0x0, 0x0, 0x0, 0x0, 0x2, 0x0, 0xc, 0x63, 0x72, 0x65, 0x61, 0x74, 0x65, 0x53, 0x74, 0x72, 0x65, 0x61, 0x6d, 0x0, 0x40, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x5}
 	assert.Equal(t, result, buf.Bytes())
 	buf.Reset()
 
-	err = packer.writeCreateStreamResult(buf, 1)
+	err = packer.writeCreateStreamResult(buf, 1, MSID1)
 	assert.Equal(t, nil, err)
 	result = []byte{0x3, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1d, 0x14, 0x0, 0x0, 0x0, 0x0, 0x2, 0x0, 0x7, 0x5f, 0x72, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x0, 0x3f, 0xf0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x5, 0x0, 0x3f, 0xf0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}
 	assert.Equal(t, result, buf.Bytes())
@@ -141,11 +159,11 @@ func TestPackCorner(t *testing.T) {
 	assert.IsNotNil(t, err)
 	err = packer.writeConnect(mw, "live", "rtmp://127.0.0.1/live")
 	assert.IsNotNil(t, err)
-	err = packer.writeConnectResult(mw, 1)
+	err = packer.writeConnectResult(mw, 1, ObjectEncodingAMF0)
 	assert.IsNotNil(t, err)
 	err = packer.writeCreateStream(mw)
 	assert.IsNotNil(t, err)
-	err = packer.writeCreateStreamResult(mw, 1)
+	err = packer.writeCreateStreamResult(mw, 1, MSID1)
 	assert.IsNotNil(t, err)
 	err = packer.writePlay(mw, "test", 1)
 	assert.IsNotNil(t, err)
@@ -155,6 +173,47 @@ func TestPackCorner(t *testing.T) {
 	assert.IsNotNil(t, err)
 	err = packer.writeOnStatusPlay(mw, 1)
 	assert.IsNotNil(t, err)
+	err = packer.writeOnStatus(mw, 1, "status", "NetStream.Pause.Notify", "Paused live")
+	assert.IsNotNil(t, err)
+}
+
+func TestWriteCommand(t *testing.T) {
+	buf := &bytes.Buffer{}
+	packer := NewMessagePacker()
+
+	err := packer.writeOnFCPublish(buf, "onFCPublish", "NetStream.Publish.Start", "test")
+	assert.Equal(t, nil, err)
+	b := buf.Bytes()
+	assert.Equal(t, uint8(csidOverConnection), b[0])
+	assert.Equal(t, len(b)-12, int(bele.BEUint24(b[4:])))
+	assert.Equal(t, typeidCommandMessageAMF0, b[7])
+	b = b[12:]
+	name, l, err := AMF0.ReadString(b)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "onFCPublish", name)
+	b = b[l:]
+	tid, l, err := AMF0.ReadNumber(b)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, float64(0), tid)
+	b = b[l:]
+	l, err = AMF0.ReadNull(b)
+	assert.Equal(t, nil, err)
+	obj, _, err := AMF0.ReadObject(b[l:])
+	assert.Equal(t, nil, err)
+	assert.Equal(t, map[string]interface{}{"code": "NetStream.Publish.Start", "description": "test"}, obj)
+
+	buf.Reset()
+	err = packer.writeResult(buf, 3, Undefined{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []byte{0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x15, 0x14, 0x00, 0x00, 0x00, 0x00,
+		0x02, 0x00, 0x07, '_', 'r', 'e', 's', 'u', 'l', 't', 0x00, 0x40, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x05, 0x06}, buf.Bytes())
+
+	// 不支持的参数类型
+	buf.Reset()
+	err = packer.writeCommand(buf, csidOverConnection, 0, "test", 0, struct{}{})
+	assert.Equal(t, ErrAMFInvalidType, err)
+	assert.Equal(t, 0, buf.Len())
+	assert.Equal(t, 0, packer.b.Len())
 }
 
 func BenchmarkMessagePacker(b *testing.B) {
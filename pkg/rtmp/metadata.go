@@ -0,0 +1,172 @@
+// Copyright 2019, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package rtmp
+
+import (
+	"bytes"
+)
+
+// onMetaData 中常用字段的 key
+const (
+	MetadataKeyWidth           = "width"
+	MetadataKeyHeight          = "height"
+	MetadataKeyFrameRate       = "framerate"
+	MetadataKeyVideoCodecID    = "videocodecid"
+	MetadataKeyAudioCodecID    = "audiocodecid"
+	MetadataKeyVideoDataRate   = "videodatarate"
+	MetadataKeyAudioDataRate   = "audiodatarate"
+	MetadataKeyAudioSampleRate = "audiosamplerate"
+	MetadataKeyAudioSampleSize = "audiosamplesize"
+	MetadataKeyStereo          = "stereo"
+	MetadataKeyEncoder         = "encoder"
+)
+
+const (
+	setDataFrame = "@setDataFrame"
+	onMetaData   = "onMetaData"
+)
+
+// onMetaData 的结构化表示
+//
+// 常用字段解析到对应的属性中，所有字段（包括常用字段）按原始顺序保存在 Raw 中。
+// 打包时以 Raw 为基础，用非零值的常用字段覆盖 Raw 中的同名字段。
+// Enhanced RTMP 中 videocodecid 和 audiocodecid 可能是 FourCC 的数值。
+type Metadata struct {
+	Width           int
+	Height          int
+	FrameRate       float64
+	VideoCodecID    int
+	AudioCodecID    int
+	VideoDataRate   float64 // kbps
+	AudioDataRate   float64 // kbps
+	AudioSampleRate float64
+	AudioSampleSize float64
+	Stereo          bool
+	Encoder         string
+
+	Raw EcmaArray
+}
+
+// @param <payload> rtmp data message 的 payload 部分 或者 flv script tag 的 payload 部分，可以以 @setDataFrame 开头
+func ParseMetadata(payload []byte) (*Metadata, error) {
+	name, l, err := AMF0.ReadString(payload)
+	if err != nil {
+		return nil, err
+	}
+	payload = payload[l:]
+	if name == setDataFrame {
+		if name, l, err = AMF0.ReadString(payload); err != nil {
+			return nil, err
+		}
+		payload = payload[l:]
+	}
+	if name != onMetaData {
+		return nil, ErrRTMP
+	}
+
+	// 大部分推流端使用 ecma array，也有部分使用 object
+	v, _, err := AMF0.ReadValue(payload)
+	if err != nil {
+		return nil, err
+	}
+	var raw EcmaArray
+	switch val := v.(type) {
+	case EcmaArray:
+		raw = val
+	case map[string]interface{}:
+		raw = sortedPairs(val)
+	default:
+		return nil, ErrAMFInvalidType
+	}
+
+	m := &Metadata{Raw: raw}
+	for _, pair := range raw {
+		switch pair.Key {
+		case MetadataKeyWidth:
+			m.Width = int(metadataNumber(pair.Value))
+		case MetadataKeyHeight:
+			m.Height = int(metadataNumber(pair.Value))
+		case MetadataKeyFrameRate:
+			m.FrameRate = metadataNumber(pair.Value)
+		case MetadataKeyVideoCodecID:
+			m.VideoCodecID = int(metadataNumber(pair.Value))
+		case MetadataKeyAudioCodecID:
+			m.AudioCodecID = int(metadataNumber(pair.Value))
+		case MetadataKeyVideoDataRate:
+			m.VideoDataRate = metadataNumber(pair.Value)
+		case MetadataKeyAudioDataRate:
+			m.AudioDataRate = metadataNumber(pair.Value)
+		case MetadataKeyAudioSampleRate:
+			m.AudioSampleRate = metadataNumber(pair.Value)
+		case MetadataKeyAudioSampleSize:
+			m.AudioSampleSize = metadataNumber(pair.Value)
+		case MetadataKeyStereo:
+			m.Stereo, _ = pair.Value.(bool)
+		case MetadataKeyEncoder:
+			m.Encoder, _ = pair.Value.(string)
+		}
+	}
+	return m, nil
+}
+
+// 设置 Raw 中的字段，已存在则原位替换，不存在则追加到末尾
+// 注意，常用字段应该直接修改对应的属性，否则打包时会被非零值的属性覆盖
+func (m *Metadata) Set(key string, value interface{}) {
+	for i := range m.Raw {
+		if m.Raw[i].Key == key {
+			m.Raw[i].Value = value
+			return
+		}
+	}
+	m.Raw = append(m.Raw, ObjectPair{Key: key, Value: value})
+}
+
+// 打包成 rtmp data message 的 payload，格式为 onMetaData + ecma array，不包含 @setDataFrame
+func (m *Metadata) Pack() ([]byte, error) {
+	out := &Metadata{Raw: make(EcmaArray, len(m.Raw))}
+	copy(out.Raw, m.Raw)
+
+	setNumber := func(key string, v float64) {
+		if v != 0 {
+			out.Set(key, v)
+		}
+	}
+	setNumber(MetadataKeyWidth, float64(m.Width))
+	setNumber(MetadataKeyHeight, float64(m.Height))
+	setNumber(MetadataKeyFrameRate, m.FrameRate)
+	setNumber(MetadataKeyVideoCodecID, float64(m.VideoCodecID))
+	setNumber(MetadataKeyAudioCodecID, float64(m.AudioCodecID))
+	setNumber(MetadataKeyVideoDataRate, m.VideoDataRate)
+	setNumber(MetadataKeyAudioDataRate, m.AudioDataRate)
+	setNumber(MetadataKeyAudioSampleRate, m.AudioSampleRate)
+	setNumber(MetadataKeyAudioSampleSize, m.AudioSampleSize)
+	if _, ok := m.Raw.Get(MetadataKeyStereo); ok || m.Stereo {
+		out.Set(MetadataKeyStereo, m.Stereo)
+	}
+	if m.Encoder != "" {
+		out.Set(MetadataKeyEncoder, m.Encoder)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := AMF0.WriteString(buf, onMetaData); err != nil {
+		return nil, err
+	}
+	if err := AMF0.WriteEcmaArray(buf, out.Raw); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// 非数值类型的字段返回0
+func metadataNumber(v interface{}) float64 {
+	if f, ok := v.(float64); ok {
+		return f
+	}
+	return 0
+}
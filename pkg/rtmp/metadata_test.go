@@ -0,0 +1,100 @@
+// Copyright 2019, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package rtmp_test
+
+import (
+	"bytes"
+	"testing"
+
+	. "github.com/q191201771/lal/pkg/rtmp"
+	"github.com/q191201771/naza/pkg/assert"
+)
+
+func TestMetadata(t *testing.T) {
+	raw := EcmaArray{
+		{Key: "duration", Value: float64(0)},
+		{Key: "width", Value: float64(640)},
+		{Key: "height", Value: float64(360)},
+		{Key: "framerate", Value: float64(25)},
+		{Key: "videocodecid", Value: float64(7)},
+		{Key: "videodatarate", Value: float64(800)},
+		{Key: "audiocodecid", Value: float64(10)},
+		{Key: "audiosamplerate", Value: float64(44100)},
+		{Key: "stereo", Value: true},
+		{Key: "encoder", Value: "obs-output module"},
+	}
+	out := &bytes.Buffer{}
+	_ = AMF0.WriteString(out, "@setDataFrame")
+	_ = AMF0.WriteString(out, "onMetaData")
+	_ = AMF0.WriteEcmaArray(out, raw)
+
+	m, err := ParseMetadata(out.Bytes())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 640, m.Width)
+	assert.Equal(t, 360, m.Height)
+	assert.Equal(t, float64(25), m.FrameRate)
+	assert.Equal(t, 7, m.VideoCodecID)
+	assert.Equal(t, 10, m.AudioCodecID)
+	assert.Equal(t, float64(800), m.VideoDataRate)
+	assert.Equal(t, float64(44100), m.AudioSampleRate)
+	assert.Equal(t, true, m.Stereo)
+	assert.Equal(t, "obs-output module", m.Encoder)
+	assert.Equal(t, raw, m.Raw)
+
+	// 修改后重新打包，@setDataFrame 被去除，字段顺序不变，新字段追加在末尾
+	m.Width = 1280
+	m.Height = 720
+	m.Set("server", "lal")
+	b, err := m.Pack()
+	assert.Equal(t, nil, err)
+	name, l, err := AMF0.ReadString(b)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "onMetaData", name)
+	arr, _, err := AMF0.ReadEcmaArray(b[l:])
+	assert.Equal(t, nil, err)
+	assert.Equal(t, len(raw)+1, len(arr))
+	assert.Equal(t, ObjectPair{Key: "width", Value: float64(1280)}, arr[1])
+	assert.Equal(t, ObjectPair{Key: "height", Value: float64(720)}, arr[2])
+	assert.Equal(t, ObjectPair{Key: "server", Value: "lal"}, arr[len(arr)-1])
+
+	m2, err := ParseMetadata(b)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1280, m2.Width)
+	assert.Equal(t, "obs-output module", m2.Encoder)
+
+	// 使用 object 的 onMetaData
+	out.Reset()
+	_ = AMF0.WriteString(out, "onMetaData")
+	_ = AMF0.WriteObject(out, []ObjectPair{{Key: "width", Value: float64(320)}})
+	m, err = ParseMetadata(out.Bytes())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 320, m.Width)
+}
+
+func TestMetadata_Corner(t *testing.T) {
+	_, err := ParseMetadata(nil)
+	assert.IsNotNil(t, err)
+
+	out := &bytes.Buffer{}
+	_ = AMF0.WriteString(out, "|RtmpSampleAccess")
+	_ = AMF0.WriteBoolean(out, false)
+	_, err = ParseMetadata(out.Bytes())
+	assert.Equal(t, ErrRTMP, err)
+
+	out.Reset()
+	_ = AMF0.WriteString(out, "onMetaData")
+	_ = AMF0.WriteNumber(out, 1)
+	_, err = ParseMetadata(out.Bytes())
+	assert.Equal(t, ErrAMFInvalidType, err)
+
+	out.Reset()
+	_ = AMF0.WriteString(out, "onMetaData")
+	_, err = ParseMetadata(out.Bytes())
+	assert.Equal(t, ErrAMFTooShort, err)
+}
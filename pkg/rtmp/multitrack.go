@@ -0,0 +1,113 @@
+// Copyright 2019, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package rtmp
+
+// multitrack.go
+// @pure
+// Enhanced RTMP v2 的 multitrack 格式，一个 message 中可以携带多个音频或视频轨道
+//
+// 扩展头之后的结构为:
+// AvMultitrackType 4bit | PacketType 4bit |
+// [FourCC 4字节]（ManyTracksManyCodecs 时每个轨道各自携带）|
+// TrackId 1字节 | [SizeOfTrack 3字节]（OneTrack 时没有）| 轨道数据 | ...
+
+import (
+	"github.com/q191201771/lal/pkg/httpflv"
+	"github.com/q191201771/naza/pkg/bele"
+)
+
+const (
+	AVMultitrackTypeOneTrack             = uint8(0)
+	AVMultitrackTypeManyTracks           = uint8(1)
+	AVMultitrackTypeManyTracksManyCodecs = uint8(2)
+)
+
+// OneTrack 格式的头部大小: 扩展头 1 | AvMultitrackType+PacketType 1 | FourCC 4 | TrackId 1
+const multitrackOneTrackHeaderSize = 7
+
+func (msg AVMsg) IsMultitrack() bool {
+	if len(msg.Payload) < multitrackOneTrackHeaderSize {
+		return false
+	}
+	switch msg.Header.MsgTypeID {
+	case TypeidVideo:
+		return msg.Payload[0]&0x80 != 0 && msg.Payload[0]&0x0f == httpflv.ExVideoPacketTypeMultitrack
+	case TypeidAudio:
+		return msg.Payload[0]>>4 == httpflv.SoundFormatExHeader && msg.Payload[0]&0x0f == httpflv.ExAudioPacketTypeMultitrack
+	}
+	return false
+}
+
+// 获取消息所属的轨道，非 multitrack 格式的数据属于轨道 0
+// 注意，ManyTracks 格式的消息中包含多个轨道，需要先使用 SplitMultitrack 拆分
+func (msg AVMsg) TrackID() uint8 {
+	if msg.IsMultitrack() && msg.Payload[1]>>4 == AVMultitrackTypeOneTrack {
+		return msg.Payload[6]
+	}
+	return 0
+}
+
+// 将 ManyTracks 以及 ManyTracksManyCodecs 格式的消息拆分成多个 OneTrack 格式的消息，其他消息原样返回
+//
+// 注意，拆分出的消息的 Payload 是新申请的内存，原样返回的消息则没有发生拷贝
+func SplitMultitrack(msg AVMsg) ([]AVMsg, error) {
+	if !msg.IsMultitrack() {
+		return []AVMsg{msg}, nil
+	}
+
+	mtType := msg.Payload[1] >> 4
+	packetType := msg.Payload[1] & 0x0f
+
+	var fourCC []byte
+	index := 2
+	switch mtType {
+	case AVMultitrackTypeOneTrack:
+		return []AVMsg{msg}, nil
+	case AVMultitrackTypeManyTracks:
+		fourCC = msg.Payload[2:6]
+		index = 6
+	case AVMultitrackTypeManyTracksManyCodecs:
+		// noop
+	default:
+		return nil, ErrRTMP
+	}
+
+	var out []AVMsg
+	for index != len(msg.Payload) {
+		if mtType == AVMultitrackTypeManyTracksManyCodecs {
+			if len(msg.Payload)-index < 4 {
+				return nil, ErrRTMP
+			}
+			fourCC = msg.Payload[index : index+4]
+			index += 4
+		}
+		if len(msg.Payload)-index < 4 {
+			return nil, ErrRTMP
+		}
+		trackID := msg.Payload[index]
+		size := int(bele.BEUint24(msg.Payload[index+1:]))
+		index += 4
+		if len(msg.Payload)-index < size {
+			return nil, ErrRTMP
+		}
+
+		payload := make([]byte, 0, multitrackOneTrackHeaderSize+size)
+		payload = append(payload, msg.Payload[0], AVMultitrackTypeOneTrack<<4|packetType)
+		payload = append(payload, fourCC...)
+		payload = append(payload, trackID)
+		payload = append(payload, msg.Payload[index:index+size]...)
+		index += size
+
+		track := msg
+		track.Header.MsgLen = uint32(len(payload))
+		track.Payload = payload
+		out = append(out, track)
+	}
+	return out, nil
+}
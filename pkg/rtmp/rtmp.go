@@ -8,10 +8,22 @@
 
 package rtmp
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+
+	"github.com/q191201771/lal/pkg/httpflv"
+	"github.com/q191201771/naza/pkg/bele"
+)
 
 var ErrRTMP = errors.New("lal.rtmp: fxxk")
 
+// message 的长度超过 bufpool.Limit 中的 MaxMsgSize
+var ErrMsgTooLarge = errors.New("lal.rtmp: message too large")
+
+// 处理 message 时发生了 panic，一般是对端发送了异常的数据
+var ErrPanic = errors.New("lal.rtmp: recover from panic")
+
 const (
 	CSIDAMF   = 5
 	CSIDAudio = 6
@@ -29,13 +41,26 @@ const (
 	TypeidAudio           = uint8(8)
 	TypeidVideo           = uint8(9)
 	TypeidDataMessageAMF0 = uint8(18) // meta
+	TypeidDataMessageAMF3 = uint8(15)
 
 	typeidSetChunkSize       = uint8(1)
+	typeidAbort              = uint8(2)
 	typeidAck                = uint8(3)
 	typeidUserControl        = uint8(4)
 	typeidWinAckSize         = uint8(5)
 	typeidBandwidth          = uint8(6)
+	typeidCommandMessageAMF3 = uint8(17)
 	typeidCommandMessageAMF0 = uint8(20)
+	typeidAggregateMessage   = uint8(22) // 由 ChunkComposer 拆分成子 message 后回调给上层
+)
+
+// amf3 的 command message 和 data message，payload 的第一个字节为格式标志，固定为0，后面的数据使用 amf0 编码，
+// 其中的值可以通过 avmplus-object-marker 切换为 amf3 编码
+const amf3MessageFormatSize = 1
+
+const (
+	ObjectEncodingAMF0 = 0
+	ObjectEncodingAMF3 = 3
 )
 
 const (
@@ -58,21 +83,109 @@ const (
 	MSID1 = 1 // publish、play、onStatus 以及 音视频数据
 )
 
+// Enhanced RTMP 的 PacketType，FourCC 以及 SoundFormat 定义在 httpflv 中，rtmp message 和 flv tag 的 body 格式相同
+const (
+	exVideoHeaderSize = 5
+	exAudioHeaderSize = 5
+
+	frameTypeKey = uint8(1)
+)
+
 type AVMsg struct {
 	Header  Header
 	Payload []byte // 不包含 rtmp 头
 }
 
+// 是否是 Enhanced RTMP 格式的视频数据，比如 av1, vp9, hevc
+func (msg AVMsg) IsEnhancedVideo() bool {
+	return msg.Header.MsgTypeID == TypeidVideo && len(msg.Payload) >= exVideoHeaderSize && msg.Payload[0]&0x80 != 0
+}
+
+// 注意，调用方需保证 IsEnhancedVideo 为 true
+func (msg AVMsg) VideoFourCC() uint32 {
+	if msg.IsMultitrack() {
+		return bele.BEUint32(msg.Payload[2:])
+	}
+	return bele.BEUint32(msg.Payload[1:])
+}
+
+// 注意，调用方需保证 IsEnhancedVideo 为 true
+// 如果是 multitrack 格式，返回的是内部实际的 PacketType
+func (msg AVMsg) ExVideoPacketType() uint8 {
+	if msg.IsMultitrack() {
+		return msg.Payload[1] & 0x0f
+	}
+	return msg.Payload[0] & 0x0f
+}
+
+// 是否是 Enhanced RTMP 格式的音频数据，比如 opus, flac, ac3
+func (msg AVMsg) IsEnhancedAudio() bool {
+	return msg.Header.MsgTypeID == TypeidAudio && len(msg.Payload) >= exAudioHeaderSize && msg.SoundFormat() == httpflv.SoundFormatExHeader
+}
+
+// 注意，调用方需保证是音频数据，且 Payload 不为空
+func (msg AVMsg) SoundFormat() uint8 {
+	return msg.Payload[0] >> 4
+}
+
+// 注意，调用方需保证 IsEnhancedAudio 为 true
+func (msg AVMsg) AudioFourCC() uint32 {
+	if msg.IsMultitrack() {
+		return bele.BEUint32(msg.Payload[2:])
+	}
+	return bele.BEUint32(msg.Payload[1:])
+}
+
+// 注意，调用方需保证 IsEnhancedAudio 为 true
+// 如果是 multitrack 格式，返回的是内部实际的 PacketType
+func (msg AVMsg) ExAudioPacketType() uint8 {
+	if msg.IsMultitrack() {
+		return msg.Payload[1] & 0x0f
+	}
+	return msg.Payload[0] & 0x0f
+}
+
+// 音频的 seq header，包含 aac seq header 以及 Enhanced RTMP 的 SequenceStart
+func (msg AVMsg) IsAudioSeqHeader() bool {
+	if msg.IsEnhancedAudio() {
+		return msg.ExAudioPacketType() == httpflv.ExAudioPacketTypeSequenceStart
+	}
+	return msg.IsAACSeqHeader()
+}
+
+// 视频的 seq header，包含 avc seq header 以及 Enhanced RTMP 的 SequenceStart
+func (msg AVMsg) IsVideoKeySeqHeader() bool {
+	if msg.IsEnhancedVideo() {
+		return msg.ExVideoPacketType() == httpflv.ExVideoPacketTypeSequenceStart
+	}
+	return msg.IsAVCKeySeqHeader()
+}
+
+// 视频的关键帧，包含 avc 的关键帧以及 Enhanced RTMP 的关键帧
+func (msg AVMsg) IsVideoKeyNalu() bool {
+	if msg.IsEnhancedVideo() {
+		pt := msg.ExVideoPacketType()
+		return (msg.Payload[0]>>4)&0x07 == frameTypeKey &&
+			(pt == httpflv.ExVideoPacketTypeCodedFrames || pt == httpflv.ExVideoPacketTypeCodedFramesX)
+	}
+	return msg.IsAVCKeyNalu()
+}
+
 func (msg AVMsg) IsAVCKeySeqHeader() bool {
-	return msg.Header.MsgTypeID == TypeidVideo && msg.Payload[0] == 0x17 && msg.Payload[1] == 0x0
+	return msg.Header.MsgTypeID == TypeidVideo && len(msg.Payload) >= 2 && msg.Payload[0] == 0x17 && msg.Payload[1] == 0x0
 }
 
 func (msg AVMsg) IsAVCKeyNalu() bool {
-	return msg.Header.MsgTypeID == TypeidVideo && msg.Payload[0] == 0x17 && msg.Payload[1] == 0x1
+	return msg.Header.MsgTypeID == TypeidVideo && len(msg.Payload) >= 2 && msg.Payload[0] == 0x17 && msg.Payload[1] == 0x1
 }
 
 func (msg AVMsg) IsAACSeqHeader() bool {
-	return msg.Header.MsgTypeID == TypeidAudio && (msg.Payload[0]>>4) == 0x0a && msg.Payload[1] == 0x0
+	return msg.Header.MsgTypeID == TypeidAudio && len(msg.Payload) >= 2 && msg.SoundFormat() == httpflv.SoundFormatAAC && msg.Payload[1] == 0x0
+}
+
+// 序列化成可读字符串，一般用于发生错误时打印日志，payload 只打印前面的部分
+func (msg AVMsg) DebugString() string {
+	return fmt.Sprintf("header=%+v, len=%d, hex=%s", msg.Header, len(msg.Payload), hexDumpHead(msg.Payload))
 }
 
 type AVMsgObserver interface {
@@ -0,0 +1,139 @@
+// Copyright 2019, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package rtmp_test
+
+import (
+	"testing"
+
+	"github.com/q191201771/lal/pkg/httpflv"
+	. "github.com/q191201771/lal/pkg/rtmp"
+	"github.com/q191201771/naza/pkg/assert"
+)
+
+func TestAVMsg_EnhancedVideo(t *testing.T) {
+	var msg AVMsg
+	msg.Header.MsgTypeID = TypeidVideo
+
+	// av1 SequenceStart
+	msg.Payload = []byte{0x90, 'a', 'v', '0', '1', 0x81, 0x0, 0xc, 0x0}
+	assert.Equal(t, true, msg.IsEnhancedVideo())
+	assert.Equal(t, httpflv.FourCCAV1, msg.VideoFourCC())
+	assert.Equal(t, true, msg.IsVideoKeySeqHeader())
+	assert.Equal(t, false, msg.IsVideoKeyNalu())
+
+	// vp9 关键帧
+	msg.Payload = []byte{0x91, 'v', 'p', '0', '9', 0x82, 0x49, 0x83}
+	assert.Equal(t, true, msg.IsEnhancedVideo())
+	assert.Equal(t, httpflv.FourCCVP9, msg.VideoFourCC())
+	assert.Equal(t, false, msg.IsVideoKeySeqHeader())
+	assert.Equal(t, true, msg.IsVideoKeyNalu())
+
+	// av1 非关键帧
+	msg.Payload = []byte{0xa1, 'a', 'v', '0', '1', 0x32, 0x10}
+	assert.Equal(t, false, msg.IsVideoKeySeqHeader())
+	assert.Equal(t, false, msg.IsVideoKeyNalu())
+
+	// av1 SequenceEnd
+	msg.Payload = []byte{0x92, 'a', 'v', '0', '1'}
+	assert.Equal(t, uint8(httpflv.ExVideoPacketTypeSequenceEnd), msg.ExVideoPacketType())
+	assert.Equal(t, false, msg.IsVideoKeyNalu())
+
+	// avc
+	msg.Payload = []byte{0x17, 0x0, 0x0, 0x0, 0x0}
+	assert.Equal(t, false, msg.IsEnhancedVideo())
+	assert.Equal(t, true, msg.IsVideoKeySeqHeader())
+	msg.Payload = []byte{0x17, 0x1, 0x0, 0x0, 0x0}
+	assert.Equal(t, true, msg.IsVideoKeyNalu())
+}
+
+func TestSplitMultitrack(t *testing.T) {
+	var msg AVMsg
+	msg.Header.MsgTypeID = TypeidAudio
+	msg.Header.TimestampAbs = 40
+
+	// opus ManyTracks，两个轨道
+	msg.Payload = []byte{0x95, 0x11, 'O', 'p', 'u', 's', 0x0, 0x0, 0x0, 0x2, 0xa, 0xb, 0x1, 0x0, 0x0, 0x1, 0xc}
+	msg.Header.MsgLen = uint32(len(msg.Payload))
+	assert.Equal(t, true, msg.IsEnhancedAudio())
+	assert.Equal(t, true, msg.IsMultitrack())
+	assert.Equal(t, uint8(httpflv.ExAudioPacketTypeCodedFrames), msg.ExAudioPacketType())
+	msgs, err := SplitMultitrack(msg)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(msgs))
+	assert.Equal(t, []byte{0x95, 0x01, 'O', 'p', 'u', 's', 0x0, 0xa, 0xb}, msgs[0].Payload)
+	assert.Equal(t, []byte{0x95, 0x01, 'O', 'p', 'u', 's', 0x1, 0xc}, msgs[1].Payload)
+	assert.Equal(t, uint8(0), msgs[0].TrackID())
+	assert.Equal(t, uint8(1), msgs[1].TrackID())
+	assert.Equal(t, uint32(8), msgs[1].Header.MsgLen)
+	assert.Equal(t, uint32(40), msgs[1].Header.TimestampAbs)
+
+	// video ManyTracksManyCodecs，SequenceStart
+	msg.Header.MsgTypeID = TypeidVideo
+	msg.Payload = []byte{0x96, 0x20, 'a', 'v', '0', '1', 0x0, 0x0, 0x0, 0x1, 0xa, 'v', 'p', '0', '9', 0x2, 0x0, 0x0, 0x1, 0xb}
+	msgs, err = SplitMultitrack(msg)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(msgs))
+	assert.Equal(t, httpflv.FourCCAV1, msgs[0].VideoFourCC())
+	assert.Equal(t, httpflv.FourCCVP9, msgs[1].VideoFourCC())
+	assert.Equal(t, uint8(2), msgs[1].TrackID())
+	assert.Equal(t, true, msgs[1].IsVideoKeySeqHeader())
+
+	// 长度不合法
+	msg.Payload = []byte{0x96, 0x20, 'a', 'v', '0', '1', 0x0, 0x0, 0x0, 0x5, 0xa}
+	_, err = SplitMultitrack(msg)
+	assert.Equal(t, ErrRTMP, err)
+
+	// 非 multitrack 原样返回
+	msg.Payload = []byte{0x17, 0x1, 0x0, 0x0, 0x0}
+	msgs, err = SplitMultitrack(msg)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(msgs))
+	assert.Equal(t, uint8(0), msgs[0].TrackID())
+}
+
+func TestAVMsg_Audio(t *testing.T) {
+	var msg AVMsg
+	msg.Header.MsgTypeID = TypeidAudio
+
+	msg.Payload = []byte{0xaf, 0x0, 0x11, 0x90}
+	assert.Equal(t, httpflv.SoundFormatAAC, msg.SoundFormat())
+	assert.Equal(t, true, msg.IsAudioSeqHeader())
+
+	msg.Payload = []byte{0x2f, 0xff, 0xfb}
+	assert.Equal(t, httpflv.SoundFormatMP3, msg.SoundFormat())
+	assert.Equal(t, false, msg.IsAudioSeqHeader())
+
+	msg.Payload = []byte{0x72, 0xd5, 0xd5}
+	assert.Equal(t, httpflv.SoundFormatG711A, msg.SoundFormat())
+	assert.Equal(t, false, msg.IsEnhancedAudio())
+	assert.Equal(t, false, msg.IsAudioSeqHeader())
+
+	msg.Payload = []byte{0x90, 'O', 'p', 'u', 's', 'O', 'p', 'u', 's', 'H', 'e', 'a', 'd'}
+	assert.Equal(t, true, msg.IsEnhancedAudio())
+	assert.Equal(t, httpflv.FourCCOpus, msg.AudioFourCC())
+	assert.Equal(t, true, msg.IsAudioSeqHeader())
+}
+
+func TestAVMsg_ShortPayload(t *testing.T) {
+	var msg AVMsg
+	for _, payload := range [][]byte{nil, {0x17}, {0xaf}} {
+		msg.Payload = payload
+		msg.Header.MsgTypeID = TypeidVideo
+		assert.Equal(t, false, msg.IsVideoKeySeqHeader())
+		assert.Equal(t, false, msg.IsVideoKeyNalu())
+		assert.Equal(t, false, msg.IsAVCKeySeqHeader())
+		msg.Header.MsgTypeID = TypeidAudio
+		assert.Equal(t, false, msg.IsAudioSeqHeader())
+		assert.Equal(t, false, msg.IsAACSeqHeader())
+	}
+
+	// 只打印 payload 前面的部分
+	msg.Payload = make([]byte, 4096)
+	assert.Equal(t, true, len(msg.DebugString()) < 2048)
+}
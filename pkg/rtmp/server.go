@@ -9,34 +9,147 @@
 package rtmp
 
 import (
+	"fmt"
 	"net"
 	"sync"
+	"time"
 
 	log "github.com/q191201771/naza/pkg/nazalog"
 )
 
 type ServerObserver interface {
-	NewRTMPPubSessionCB(session *ServerSession) bool // 返回true则允许推流，返回false则强制关闭这个连接
+	NewRTMPPubSessionCB(session *ServerSession) bool // 返回true则允许推流，返回false则回复错误状态后关闭这个连接
 	DelRTMPPubSessionCB(session *ServerSession)
-	NewRTMPSubSessionCB(session *ServerSession) bool // 返回true则允许拉流，返回false则强制关闭这个连接
+	NewRTMPSubSessionCB(session *ServerSession) bool // 返回true则允许拉流，返回false则回复错误状态后关闭这个连接
 	DelRTMPSubSessionCB(session *ServerSession)
 }
 
+// server 上所有 session 使用的配置项，比如接入节点和边缘节点可以使用不同的配置
+type ServerOption struct {
+	ReadBufSize       int // session 读缓冲的大小
+	WriteChanSize     int // session 最多缓存多少个待发送的内存块
+	ReadAVTimeoutMS   int // 推流时读取音视频数据的超时，为0时不设置超时
+	WriteAVTimeoutMS  int // 拉流时发送音视频数据的超时，为0时不设置超时
+	ChunkSize         int // 本端设置的 chunk size
+	WindowAckSize     int // 发送给对端的 Window Acknowledgement Size
+	PeerBandwidth     int // 发送给对端的 Set Peer Bandwidth
+	PingIntervalMS    int // 开始推流或者拉流后，发送 PingRequest 的间隔，为0时不发送
+	PingTimeoutMS     int // 对端回复过 PingResponse 后，超过这个时间没有再回复，则认为对端已经断开，为0时不检查
+	MaxStreamsPerConn int // 一个连接上最多可以创建的 NetStream 数量
+
+	// 各个阶段的超时，超时后关闭连接，见 TimeoutPhase，为0时不设置超时
+	HandshakeTimeoutMS  int // 建立连接后，完成握手的超时
+	CommandTimeoutMS    int // 握手完成后，开始推流或者拉流的超时
+	FirstMediaTimeoutMS int // 开始推流后，收到第一个音视频数据的超时
+
+	// 由 Server 定时检查，精度为 reapIntervalMS，为0时不检查
+	IdleTimeoutMS          int // 连接上没有推流或者拉流的 NetStream 的最长时间，包括握手以及信令交互的阶段
+	MediaInactiveTimeoutMS int // 推流时没有收到音视频数据的最长时间，和 ReadAVTimeoutMS 不同，收到其他数据时依然会超时
+}
+
+var DefaultServerOption = ServerOption{
+	ReadBufSize:       readBufSize,
+	WriteChanSize:     wChanSize,
+	ReadAVTimeoutMS:   10000,
+	WriteAVTimeoutMS:  10000,
+	ChunkSize:         LocalChunkSize,
+	WindowAckSize:     5000000,
+	PeerBandwidth:     5000000,
+	PingIntervalMS:    5000,
+	PingTimeoutMS:     20000,
+	MaxStreamsPerConn: 16,
+
+	HandshakeTimeoutMS:  10000,
+	CommandTimeoutMS:    10000,
+	FirstMediaTimeoutMS: 10000,
+
+	IdleTimeoutMS:          30000,
+	MediaInactiveTimeoutMS: 30000,
+}
+
+type ModServerOption func(option *ServerOption)
+
+const (
+	minChunkSize = 128      // rtmp 协议中默认的 chunk size
+	maxChunkSize = 0xFFFFFF // 不超过 message 的最大长度
+)
+
+// 检查配置项是否合法，比如加载配置文件时调用
+func (option ServerOption) Validate() error {
+	switch {
+	case option.ReadBufSize <= 0:
+		return invalidServerOption("ReadBufSize", option.ReadBufSize)
+	case option.WriteChanSize <= 0:
+		return invalidServerOption("WriteChanSize", option.WriteChanSize)
+	case option.ReadAVTimeoutMS < 0:
+		return invalidServerOption("ReadAVTimeoutMS", option.ReadAVTimeoutMS)
+	case option.WriteAVTimeoutMS < 0:
+		return invalidServerOption("WriteAVTimeoutMS", option.WriteAVTimeoutMS)
+	case option.ChunkSize < minChunkSize || option.ChunkSize > maxChunkSize:
+		return invalidServerOption("ChunkSize", option.ChunkSize)
+	case option.WindowAckSize <= 0:
+		return invalidServerOption("WindowAckSize", option.WindowAckSize)
+	case option.PeerBandwidth <= 0:
+		return invalidServerOption("PeerBandwidth", option.PeerBandwidth)
+	case option.PingIntervalMS < 0:
+		return invalidServerOption("PingIntervalMS", option.PingIntervalMS)
+	case option.PingTimeoutMS < 0:
+		return invalidServerOption("PingTimeoutMS", option.PingTimeoutMS)
+	// 超时时间不大于发送间隔时，对端还没来得及回复就会被断开
+	case option.PingIntervalMS != 0 && option.PingTimeoutMS != 0 && option.PingTimeoutMS <= option.PingIntervalMS:
+		return invalidServerOption("PingTimeoutMS", option.PingTimeoutMS)
+	case option.MaxStreamsPerConn <= 0:
+		return invalidServerOption("MaxStreamsPerConn", option.MaxStreamsPerConn)
+	case option.HandshakeTimeoutMS < 0:
+		return invalidServerOption("HandshakeTimeoutMS", option.HandshakeTimeoutMS)
+	case option.CommandTimeoutMS < 0:
+		return invalidServerOption("CommandTimeoutMS", option.CommandTimeoutMS)
+	case option.FirstMediaTimeoutMS < 0:
+		return invalidServerOption("FirstMediaTimeoutMS", option.FirstMediaTimeoutMS)
+	case option.IdleTimeoutMS < 0:
+		return invalidServerOption("IdleTimeoutMS", option.IdleTimeoutMS)
+	case option.MediaInactiveTimeoutMS < 0:
+		return invalidServerOption("MediaInactiveTimeoutMS", option.MediaInactiveTimeoutMS)
+	}
+	return nil
+}
+
+func invalidServerOption(name string, value int) error {
+	return fmt.Errorf("lal.rtmp: invalid server option. %s=%d", name, value)
+}
+
+// Server 检查空闲连接的间隔
+var reapIntervalMS = 1000
+
 type Server struct {
-	obs  ServerObserver
-	addr string
-	m    sync.Mutex
-	ln   net.Listener
+	obs      ServerObserver
+	addr     string
+	option   ServerOption
+	m        sync.Mutex
+	ln       net.Listener
+	sessions map[*ServerSession]struct{} // 还没有结束的连接，只包含每个连接上的第一个 NetStream
+	exitChan chan struct{}
 }
 
-func NewServer(obs ServerObserver, addr string) *Server {
+func NewServer(obs ServerObserver, addr string, modOptions ...ModServerOption) *Server {
+	option := DefaultServerOption
+	for _, fn := range modOptions {
+		fn(&option)
+	}
 	return &Server{
-		obs:  obs,
-		addr: addr,
+		obs:      obs,
+		addr:     addr,
+		option:   option,
+		sessions: make(map[*ServerSession]struct{}),
+		exitChan: make(chan struct{}),
 	}
 }
 
+// 配置项不合法时直接返回错误，不会开始监听
 func (server *Server) RunLoop() error {
+	if err := server.option.Validate(); err != nil {
+		return err
+	}
 	var err error
 	server.m.Lock()
 	server.ln, err = net.Listen("tcp", server.addr)
@@ -45,6 +158,7 @@ func (server *Server) RunLoop() error {
 		return err
 	}
 	log.Infof("start rtmp server listen. addr=%s", server.addr)
+	go server.runReapLoop()
 	for {
 		conn, err := server.ln.Accept()
 		if err != nil {
@@ -60,6 +174,11 @@ func (server *Server) Dispose() {
 	if server.ln == nil {
 		return
 	}
+	select {
+	case <-server.exitChan:
+	default:
+		close(server.exitChan)
+	}
 	if err := server.ln.Close(); err != nil {
 		log.Error(err)
 	}
@@ -67,32 +186,76 @@ func (server *Server) Dispose() {
 
 func (server *Server) handleTCPConnect(conn net.Conn) {
 	log.Infof("accept a rtmp connection. remoteAddr=%v", conn.RemoteAddr())
-	session := NewServerSession(server, conn)
+	session := NewServerSession(server, conn, func(option *ServerOption) {
+		*option = server.option
+	})
+	server.m.Lock()
+	server.sessions[session] = struct{}{}
+	server.m.Unlock()
 	err := session.RunLoop()
+	server.m.Lock()
+	delete(server.sessions, session)
+	server.m.Unlock()
 	log.Infof("rtmp loop done. [%s] err=%v", session.UniqueKey, err)
-	switch session.t {
-	case ServerSessionTypeUnknown:
-	// noop
-	case ServerSessionTypePub:
-		server.obs.DelRTMPPubSessionCB(session)
-	case ServerSessionTypeSub:
-		server.obs.DelRTMPSubSessionCB(session)
+	// 连接上的所有 NetStream
+	for _, st := range session.streams {
+		switch st.t {
+		case ServerSessionTypeUnknown:
+		// noop
+		case ServerSessionTypePub:
+			server.obs.DelRTMPPubSessionCB(st)
+		case ServerSessionTypeSub:
+			server.obs.DelRTMPSubSessionCB(st)
+		}
+	}
+}
+
+// 定时关闭空闲的连接，以及不再发送音视频数据的推流连接
+func (server *Server) runReapLoop() {
+	if server.option.IdleTimeoutMS == 0 && server.option.MediaInactiveTimeoutMS == 0 {
+		return
+	}
+	t := time.NewTicker(time.Duration(reapIntervalMS) * time.Millisecond)
+	defer t.Stop()
+	for {
+		select {
+		case <-server.exitChan:
+			return
+		case now := <-t.C:
+			nowMS := now.UnixNano() / 1e6
+			server.m.Lock()
+			for session := range server.sessions {
+				session.reapIfNeeded(nowMS)
+			}
+			server.m.Unlock()
+		}
 	}
 }
 
 // ServerSessionObserver
-func (server *Server) NewRTMPPubSessionCB(session *ServerSession) {
+func (server *Server) NewRTMPPubSessionCB(session *ServerSession) bool {
 	if !server.obs.NewRTMPPubSessionCB(session) {
-		log.Warnf("dispose PubSession since pub exist.")
-		session.Dispose()
-		return
+		log.Warnf("reject PubSession since pub exist. [%s]", session.UniqueKey)
+		return false
 	}
+	return true
 }
 
 // ServerSessionObserver
-func (server *Server) NewRTMPSubSessionCB(session *ServerSession) {
+func (server *Server) NewRTMPSubSessionCB(session *ServerSession) bool {
 	if !server.obs.NewRTMPSubSessionCB(session) {
-		session.Dispose()
-		return
+		log.Warnf("reject SubSession. [%s]", session.UniqueKey)
+		return false
 	}
+	return true
+}
+
+// ServerSessionObserver
+func (server *Server) DelRTMPPubSessionCB(session *ServerSession) {
+	server.obs.DelRTMPPubSessionCB(session)
+}
+
+// ServerSessionObserver
+func (server *Server) DelRTMPSubSessionCB(session *ServerSession) {
+	server.obs.DelRTMPSubSessionCB(session)
 }
@@ -9,20 +9,37 @@
 package rtmp
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"net"
+	"runtime/debug"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/q191201771/lal/pkg/bufpool"
+	"github.com/q191201771/lal/pkg/httpflv"
 	"github.com/q191201771/naza/pkg/bele"
 	"github.com/q191201771/naza/pkg/connection"
+	"github.com/q191201771/naza/pkg/nazaatomic"
 	log "github.com/q191201771/naza/pkg/nazalog"
+	"github.com/q191201771/naza/pkg/slicebytepool"
 	"github.com/q191201771/naza/pkg/unique"
 )
 
-// TODO chef: 没有进化成Pub Sub时的超时释放
+// 推流或者拉流被上层拒绝，已经向客户端回复了错误状态
+var ErrServerSessionRejected = errors.New("lal.rtmp: rejected by server")
 
 type ServerSessionObserver interface {
-	NewRTMPPubSessionCB(session *ServerSession) // 上层代码应该在这个事件回调中注册音视频数据的监听
-	NewRTMPSubSessionCB(session *ServerSession)
+	// 返回 false 时，session 向客户端回复错误状态后关闭连接
+	NewRTMPPubSessionCB(session *ServerSession) bool // 上层代码应该在这个事件回调中注册音视频数据的监听
+	NewRTMPSubSessionCB(session *ServerSession) bool
+
+	// 收到 deleteStream，closeStream，FCUnpublish 信令时，不等待连接断开，提前结束推流或者拉流
+	DelRTMPPubSessionCB(session *ServerSession)
+	DelRTMPSubSessionCB(session *ServerSession)
 }
 
 var _ ServerSessionObserver = &Server{}
@@ -43,76 +60,273 @@ const (
 	ServerSessionTypeSub
 )
 
+// 一个 ServerSession 对应连接上的一个 NetStream（由 createStream 创建，使用独立的 message stream id）
+// NewServerSession 返回的是连接上的第一个 NetStream，之后再次 createStream 时创建新的 ServerSession，
+// 它们共享同一个连接，并且分别通过 ServerSessionObserver 回调给上层
 type ServerSession struct {
+	*serverConn
+
 	AppName                string
 	StreamName             string
 	StreamNameWithRawQuery string
+	RawQuery               string // 流名称中 `?` 后面的部分，不包含 `?`
 	UniqueKey              string
 
-	obs           ServerSessionObserver
-	t             ServerSessionType
-	hs            HandshakeServer
-	chunkComposer *ChunkComposer
-	packer        *MessagePacker
-
-	conn connection.Connection
+	obs            ServerSessionObserver
+	t              ServerSessionType
+	streamID       int
+	bufferLengthMS nazaatomic.Uint32 // 对端通过 SetBufferLength 设置的缓冲时长
 
 	// only for PubSession
-	avObs PubSessionObserver
+	avObs       PubSessionObserver
+	unpublished bool // 已经通过信令结束推流，忽略之后收到的音视频数据
 
 	// only for SubSession
-	IsFresh     bool
-	WaitKeyNalu bool
+	IsFresh       bool
+	WaitKeyNalu   bool
+	playStarted   nazaatomic.Bool
+	paused        nazaatomic.Bool
+	audioDisabled nazaatomic.Bool
+	videoDisabled nazaatomic.Bool
 }
 
-func NewServerSession(obs ServerSessionObserver, conn net.Conn) *ServerSession {
+// 连接级别的状态，同一个连接上的所有 NetStream 共享
+// 除了原子类型的字段之外，都只在读 goroutine 中访问
+type serverConn struct {
+	hs            HandshakeServer
+	chunkComposer *ChunkComposer
+	packer        *MessagePacker
+
+	conn     connection.Connection
+	rawConn  net.Conn
+	aw       atomic.Value // *bufpool.Writer，ModConnProps 之后不为 nil，之后发送的数据都经过它，保证顺序
+	fc       *flowControl
+	avMutex  sync.Mutex  // 保护 avWriter，上层可能在不同的 goroutine 中向同一个连接上的 NetStream 发送
+	avWriter avMsgWriter // 所有 NetStream 共用，因为 chunk header 的压缩是按 csid 进行的
+	option   ServerOption
+
+	// 握手，信令交互，以及等待第一个音视频数据的超时，连接上第一个 NetStream 开始推流或者拉流后不再计时
+	phaseTimer phaseTimer
+	// 以下字段由读 goroutine 更新，Server 定时检查，见 reapIfNeeded
+	idleSinceMS  nazaatomic.Int64 // 连接上没有推流或者拉流的 NetStream 的开始时间，unix 毫秒，为0表示有
+	pubStreamNum nazaatomic.Int32 // 连接上推流的 NetStream 的数量
+	lastMediaMS  nazaatomic.Int64 // 最后一次收到音视频数据的时间，unix 毫秒
+
+	startTime           time.Time
+	exitChan            chan struct{}
+	pingStarted         bool
+	readTimeoutModified bool
+	lastPingRespMS      nazaatomic.Int64 // 最后一次收到 PingResponse 的时间，unix 毫秒，为0表示对端从未回复
+	rttMS               nazaatomic.Int64
+
+	// key 为 message stream id
+	// 连接上的第一个 NetStream 在 createStream 之前就已经存在，使用 MSID1，兼容不发送 createStream 的客户端
+	streams      map[int]*ServerSession
+	nextStreamID int
+}
+
+func NewServerSession(obs ServerSessionObserver, conn net.Conn, modOptions ...ModServerOption) *ServerSession {
 	uk := unique.GenUniqueKey("RTMPPUBSUB")
 	log.Infof("lifecycle new rtmp server session. [%s]", uk)
-	return &ServerSession{
-		conn: connection.New(conn, func(option *connection.Option) {
-			option.ReadBufSize = readBufSize
-		}),
-		UniqueKey:     uk,
-		obs:           obs,
-		t:             ServerSessionTypeUnknown,
+	option := DefaultServerOption
+	for _, fn := range modOptions {
+		fn(&option)
+	}
+	c := connection.New(conn, func(connOption *connection.Option) {
+		connOption.ReadBufSize = option.ReadBufSize
+	})
+	sc := &serverConn{
+		conn:          c,
+		rawConn:       conn,
+		fc:            newFlowControl(c),
+		avWriter:      avMsgWriter{chunkSize: option.ChunkSize},
+		option:        option,
+		startTime:     time.Now(),
+		exitChan:      make(chan struct{}),
 		chunkComposer: NewChunkComposer(),
 		packer:        NewMessagePacker(),
-		IsFresh:       true,
-		WaitKeyNalu:   true,
+		streams:       make(map[int]*ServerSession),
+		nextStreamID:  MSID1,
+	}
+	sc.idleSinceMS.Store(sc.startTime.UnixNano() / 1e6)
+	s := newServerSessionStream(sc, obs, uk, MSID1)
+	sc.streams[MSID1] = s
+	return s
+}
+
+func newServerSessionStream(sc *serverConn, obs ServerSessionObserver, uk string, streamID int) *ServerSession {
+	return &ServerSession{
+		serverConn:  sc,
+		UniqueKey:   uk,
+		obs:         obs,
+		t:           ServerSessionTypeUnknown,
+		streamID:    streamID,
+		IsFresh:     true,
+		WaitKeyNalu: true,
 	}
 }
 
 func (s *ServerSession) RunLoop() (err error) {
+	defer func() {
+		// 只断开发生异常的 session，不影响整个进程
+		if r := recover(); r != nil {
+			log.Errorf("recover from panic. [%s] err=%v\n%s", s.UniqueKey, r, debug.Stack())
+			err = ErrPanic
+		}
+		// 因为超时被关闭连接时，返回真正的原因，而不是读取失败
+		s.phaseTimer.stop()
+		if phase := s.phaseTimer.expiredPhase(); phase != 0 {
+			err = ErrServerSessionTimeout
+		}
+		// 处理 message 失败时连接还没有关闭
+		_ = s.conn.Close()
+		if aw := s.asyncWriter(); aw != nil {
+			// 因为发送的数据超过限制而被关闭连接时，返回真正的原因，而不是读取失败
+			if werr := aw.Err(); bufpool.IsLimitError(werr) {
+				err = werr
+			}
+			aw.Close()
+		}
+		if err == ErrMsgTooLarge || bufpool.IsLimitError(err) {
+			log.Warnf("disconnect since exceed limit. [%s] err=%v", s.UniqueKey, err)
+		}
+		close(s.exitChan)
+	}()
+
+	s.startPhase(TimeoutPhaseHandshake, s.option.HandshakeTimeoutMS)
 	if err = s.handshake(); err != nil {
 		return err
 	}
 
+	s.startPhase(TimeoutPhaseCommand, s.option.CommandTimeoutMS)
 	return s.runReadLoop()
 }
 
+func (s *ServerSession) startPhase(phase TimeoutPhase, timeoutMS int) {
+	s.phaseTimer.start(phase, timeoutMS, func() {
+		log.Warnf("%s timeout, dispose session. [%s] timeout=%dms", phase, s.UniqueKey, timeoutMS)
+		_ = s.conn.Close()
+	})
+}
+
+// 注意，<msg> 在发送完成之前不会被拷贝，调用方不应该再修改
+// 注意，<msg> 中的 chunk 需要按照 ServerOption.ChunkSize 切割，见 NewChunkDivider
 func (s *ServerSession) AsyncWrite(msg []byte) error {
-	_, err := s.conn.Write(msg)
+	_, err := s.writer().Write(msg)
 	return err
 }
 
+// 和 AsyncWrite 相同，<ssb> 被引用直到发送完成，调用方依然需要释放自己持有的引用
+func (s *ServerSession) AsyncWriteShared(ssb *slicebytepool.SharedSliceByte) error {
+	aw := s.asyncWriter()
+	if aw == nil {
+		// 还没有开启异步发送，同步发送完成后返回
+		_, err := s.conn.Write(ssb.Core)
+		return err
+	}
+	return aw.WriteShared(ssb)
+}
+
+// 发送音视频以及 metadata 数据，内部完成 chunk 的切割以及 chunk header 的压缩
+// 注意，不要和 AsyncWrite 混用
+func (s *ServerSession) WriteAVMsg(msg AVMsg) error {
+	s.avMutex.Lock()
+	defer s.avMutex.Unlock()
+	return s.avWriter.write(s.writer(), msg, s.streamID)
+}
+
+func (s *ServerSession) WriteFLVTag(tag httpflv.Tag) error {
+	return s.WriteAVMsg(flvTag2AVMsg(tag))
+}
+
 func (s *ServerSession) Flush() error {
+	if aw := s.asyncWriter(); aw != nil {
+		return aw.Flush()
+	}
 	return s.conn.Flush()
 }
 
+// 该 NetStream 的 message stream id
+// 注意，使用 AsyncWrite 发送 Message2Chunks 切割的数据时，chunk 中的 message stream id 需要和它保持一致，见 ModChunksMsgStreamID
+func (s *ServerSession) StreamID() int {
+	return s.streamID
+}
+
+// 最近一次 PingRequest 和 PingResponse 之间的时长，对端没有回复过时为0
+func (s *ServerSession) RTT() time.Duration {
+	return time.Duration(s.rttMS.Load()) * time.Millisecond
+}
+
+// 拉流端通过 SetBufferLength 设置的缓冲时长，单位毫秒，没有设置时为0
+func (s *ServerSession) BufferLengthMS() uint32 {
+	return s.bufferLengthMS.Load()
+}
+
+// 推流结束时，由上层对所有的拉流 session 调用
+func (s *ServerSession) WriteStreamEOF() error {
+	log.Infof("<----- StreamEOF. [%s]", s.UniqueKey)
+	return NewMessagePacker().writeUserControl(s.writer(), userControlStreamEOF, uint32(s.streamID))
+}
+
+// 新的推流开始时，由上层对已经存在的拉流 session 调用
+func (s *ServerSession) WriteStreamBegin() error {
+	log.Infof("<----- StreamBegin. [%s]", s.UniqueKey)
+	return NewMessagePacker().writeUserControl(s.writer(), userControlStreamBegin, uint32(s.streamID))
+}
+
+// 握手完成后调用，返回实际使用的握手模式
+func (s *ServerSession) HandshakeMode() HandshakeMode {
+	return s.hs.Mode()
+}
+
+// 是否已经回复了 NetStream.Play.Start，在此之前上层不应该发送任何数据
+func (s *ServerSession) IsPlayStarted() bool {
+	return s.playStarted.Load()
+}
+
+// 拉流端是否需要该类型的数据，由 pause，receiveAudio，receiveVideo 信令控制
+func (s *ServerSession) IsReceiving(msgTypeID uint8) bool {
+	if s.paused.Load() {
+		return msgTypeID != TypeidAudio && msgTypeID != TypeidVideo
+	}
+	switch msgTypeID {
+	case TypeidAudio:
+		return !s.audioDisabled.Load()
+	case TypeidVideo:
+		return !s.videoDisabled.Load()
+	}
+	return true
+}
+
+// 关闭连接，同一个连接上的所有 NetStream 都会结束
 func (s *ServerSession) Dispose() {
 	log.Infof("lifecycle dispose rtmp server session. [%s]", s.UniqueKey)
 	_ = s.conn.Close()
 }
 
 func (s *ServerSession) runReadLoop() error {
-	return s.chunkComposer.RunLoop(s.conn, s.doMsg)
+	return s.chunkComposer.RunLoop(s.fc, func(stream *Stream) error {
+		if err := s.doMsg(stream); err != nil {
+			return err
+		}
+		return s.ackIfNeeded()
+	})
+}
+
+func (s *ServerSession) ackIfNeeded() error {
+	seqNum, ok := s.fc.shouldAck()
+	if !ok {
+		return nil
+	}
+	log.Debugf("<----- Acknowledgement. [%s] sequence number=%d", s.UniqueKey, seqNum)
+	return s.packer.writeAcknowledgement(s.writer(), seqNum)
 }
 
 func (s *ServerSession) handshake() error {
 	if err := s.hs.ReadC0C1(s.conn); err != nil {
 		return err
 	}
-	log.Infof("-----> Handshake C0+C1. [%s]", s.UniqueKey)
+	log.Infof("-----> Handshake C0+C1. [%s] mode=%s", s.UniqueKey, s.hs.Mode())
 
 	log.Infof("<----- Handshake S0+S1+S2. [%s]", s.UniqueKey)
 	if err := s.hs.WriteS0S1S2(s.conn); err != nil {
@@ -134,18 +348,42 @@ func (s *ServerSession) doMsg(stream *Stream) error {
 		// 因为底层的 chunk composer 已经处理过了，这里就不用处理
 	case typeidCommandMessageAMF0:
 		return s.doCommandMessage(stream)
+	case typeidCommandMessageAMF3:
+		if err := stream.msg.skipAMF3Format(); err != nil {
+			return err
+		}
+		return s.doCommandMessage(stream)
 	case TypeidDataMessageAMF0:
-		return s.doDataMessageAMF0(stream)
+		return s.streamOf(stream.header.MsgStreamID).doDataMessageAMF0(stream)
+	case TypeidDataMessageAMF3:
+		if err := stream.msg.skipAMF3Format(); err != nil {
+			return err
+		}
+		return s.streamOf(stream.header.MsgStreamID).doDataMessageAMF0(stream)
 	case typeidAck:
 		return s.doACK(stream)
+	case typeidWinAckSize:
+		fallthrough
+	case typeidBandwidth:
+		return s.doFlowControlMessage(stream)
+	case typeidUserControl:
+		return s.doUserControlMessage(stream)
 	case TypeidAudio:
 		fallthrough
 	case TypeidVideo:
-		if s.t != ServerSessionTypePub {
-			log.Errorf("read audio/video message but server session not pub type. [%s]", s.UniqueKey)
+		st := s.streamOf(stream.header.MsgStreamID)
+		if st.t != ServerSessionTypePub {
+			if st.unpublished {
+				return nil
+			}
+			log.Errorf("read audio/video message but server session not pub type. [%s]", st.UniqueKey)
 			return ErrRTMP
 		}
-		s.avObs.OnReadRTMPAVMsg(stream.toAVMsg())
+		if s.phaseTimer.phase == TimeoutPhaseFirstMedia {
+			s.phaseTimer.stop()
+		}
+		s.lastMediaMS.Store(time.Now().UnixNano() / 1e6)
+		st.avObs.OnReadRTMPAVMsg(stream.toAVMsg())
 	default:
 		log.Warnf("read unknown message. [%s] typeid=%d, %s", s.UniqueKey, stream.header.MsgTypeID, stream.toDebugString())
 
@@ -154,11 +392,98 @@ func (s *ServerSession) doMsg(stream *Stream) error {
 }
 
 func (s *ServerSession) doACK(stream *Stream) error {
+	if stream.msg.len() < 4 {
+		return ErrRTMP
+	}
 	seqNum := bele.BEUint32(stream.msg.buf[stream.msg.b:stream.msg.e])
 	log.Infof("-----> Acknowledgement. [%s] ignore. sequence number=%d.", s.UniqueKey, seqNum)
 	return nil
 }
 
+func (s *ServerSession) doUserControlMessage(stream *Stream) error {
+	event, err := parseUserControl(stream.msg.buf[stream.msg.b:stream.msg.e])
+	if err != nil {
+		return err
+	}
+	switch event.eventType {
+	case userControlSetBufferLength:
+		st := s.streamOf(int(event.data))
+		log.Infof("-----> SetBufferLength. [%s] stream id=%d, buffer length=%dms", st.UniqueKey, event.data, event.bufferLength)
+		st.bufferLengthMS.Store(event.bufferLength)
+	case userControlPingRequest:
+		log.Debugf("-----> PingRequest. [%s] timestamp=%d", s.UniqueKey, event.data)
+		return s.packer.writeUserControl(s.writer(), userControlPingResponse, event.data)
+	case userControlPingResponse:
+		// 时间戳为相对 session 创建时的毫秒数，回绕后差值依然正确
+		now := time.Now()
+		rtt := uint32(now.Sub(s.startTime)/time.Millisecond) - event.data
+		s.rttMS.Store(int64(rtt))
+		s.lastPingRespMS.Store(now.UnixNano() / 1e6)
+		log.Debugf("-----> PingResponse. [%s] rtt=%dms", s.UniqueKey, rtt)
+	default:
+		log.Warnf("read user control message, ignore it. [%s] event type=%d", s.UniqueKey, event.eventType)
+	}
+	return nil
+}
+
+// 定时发送 PingRequest，用于检测对端是否存活，以及测量 rtt
+// 只检查回复过 PingResponse 的对端，因为部分客户端不会回复
+func (s *ServerSession) runPingLoop() {
+	t := time.NewTicker(time.Duration(s.option.PingIntervalMS) * time.Millisecond)
+	defer t.Stop()
+	// 和读 goroutine 分开，使用单独的 packer
+	packer := NewMessagePacker()
+	for {
+		select {
+		case <-s.exitChan:
+			return
+		case now := <-t.C:
+			last := s.lastPingRespMS.Load()
+			if last != 0 && s.option.PingTimeoutMS != 0 && now.UnixNano()/1e6-last > int64(s.option.PingTimeoutMS) {
+				log.Warnf("ping timeout, dispose session. [%s] last ping response=%dms ago", s.UniqueKey, now.UnixNano()/1e6-last)
+				s.Dispose()
+				return
+			}
+			ts := uint32(now.Sub(s.startTime) / time.Millisecond)
+			if err := packer.writeUserControl(s.writer(), userControlPingRequest, ts); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *ServerSession) startPingLoop() {
+	if s.pingStarted || s.option.PingIntervalMS == 0 {
+		return
+	}
+	s.pingStarted = true
+	go s.runPingLoop()
+}
+
+func (s *ServerSession) doFlowControlMessage(stream *Stream) error {
+	if stream.msg.len() < 4 {
+		return ErrRTMP
+	}
+	val := bele.BEUint32(stream.msg.buf[stream.msg.b:stream.msg.e])
+
+	switch stream.header.MsgTypeID {
+	case typeidWinAckSize:
+		log.Infof("-----> Window Acknowledgement Size %d. [%s]", val, s.UniqueKey)
+		s.fc.onWinAckSize(val)
+	case typeidBandwidth:
+		if stream.msg.len() < 5 {
+			return ErrRTMP
+		}
+		limitType := stream.msg.buf[stream.msg.b+4]
+		log.Infof("-----> Set Peer Bandwidth %d, limit type %d. [%s]", val, limitType, s.UniqueKey)
+		if winAckSize, ok := s.fc.onPeerBandwidth(val, limitType); ok {
+			log.Infof("<----- Window Acknowledgement Size %d. [%s]", winAckSize, s.UniqueKey)
+			return s.packer.writeWinAckSize(s.writer(), int(winAckSize))
+		}
+	}
+	return nil
+}
+
 func (s *ServerSession) doDataMessageAMF0(stream *Stream) error {
 	if s.t != ServerSessionTypePub {
 		log.Errorf("read audio/video message but server session not pub type. [%s]", s.UniqueKey)
@@ -193,7 +518,7 @@ func (s *ServerSession) doDataMessageAMF0(stream *Stream) error {
 		return nil
 	}
 
-	s.avObs.OnReadRTMPAVMsg(stream.toAVMsg())
+	s.avObs.OnReadRTMPAVMsg(stream.toAMF0DataAVMsg())
 	return nil
 }
 
@@ -207,23 +532,39 @@ func (s *ServerSession) doCommandMessage(stream *Stream) error {
 		return err
 	}
 
+	// 作用于 NetStream 的信令，根据 message stream id 找到对应的 NetStream
+	st := s.streamOf(stream.header.MsgStreamID)
+
 	switch cmd {
 	case "connect":
 		return s.doConnect(tid, stream)
 	case "createStream":
 		return s.doCreateStream(tid, stream)
 	case "publish":
-		return s.doPublish(tid, stream)
+		return st.doPublish(tid, stream)
 	case "play":
-		return s.doPlay(tid, stream)
+		return st.doPlay(tid, stream)
 	case "releaseStream":
-		fallthrough
+		return s.doReleaseStream(tid, stream)
 	case "FCPublish":
-		fallthrough
+		return s.doFCPublish(tid, stream)
 	case "FCUnpublish":
-		fallthrough
+		return s.doFCUnpublish(tid, stream)
 	case "getStreamLength":
-		log.Warnf("read command message, ignore it. [%s] cmd=%s, %s", s.UniqueKey, cmd, stream.toDebugString())
+		return s.doGetStreamLength(tid, stream)
+	case "deleteStream":
+		return s.doDeleteStream(tid, stream)
+	case "closeStream":
+		log.Infof("-----> closeStream(). [%s]", st.UniqueKey)
+		st.closeStream()
+	case "pause":
+		return st.doPause(tid, stream)
+	case "seek":
+		return st.doSeek(tid, stream)
+	case "receiveAudio":
+		fallthrough
+	case "receiveVideo":
+		return st.doReceiveAV(cmd, stream)
 	default:
 		log.Errorf("read unknown command message. [%s] cmd=%s, %s", s.UniqueKey, cmd, stream.toDebugString())
 	}
@@ -238,27 +579,36 @@ func (s *ServerSession) doConnect(tid int, stream *Stream) error {
 	var ok bool
 	s.AppName, ok = val["app"].(string)
 	if !ok {
-		return ErrRTMP
+		log.Errorf("-----> connect without app field. [%s]", s.UniqueKey)
+		log.Infof("<---- _error('NetConnection.Connect.Rejected'). [%s]", s.UniqueKey)
+		_ = s.packer.writeError(s.writer(), tid, "NetConnection.Connect.Rejected", "Missing app field in connect.")
+		return ErrServerSessionRejected
+	}
+	// 客户端使用 amf3 时，回复中也需要告诉客户端使用 amf3，之后客户端可能会发送 amf3 的 command message
+	objectEncoding := ObjectEncodingAMF0
+	if oe, ok := val["objectEncoding"].(float64); ok && int(oe) == ObjectEncodingAMF3 {
+		objectEncoding = ObjectEncodingAMF3
 	}
-	log.Infof("-----> connect('%s'). [%s]", s.AppName, s.UniqueKey)
+	log.Infof("-----> connect('%s'). [%s] objectEncoding=%d", s.AppName, s.UniqueKey, objectEncoding)
 
-	log.Infof("<----- Window Acknowledgement Size %d. [%s]", windowAcknowledgementSize, s.UniqueKey)
-	if err := s.packer.writeWinAckSize(s.conn, windowAcknowledgementSize); err != nil {
+	log.Infof("<----- Window Acknowledgement Size %d. [%s]", s.option.WindowAckSize, s.UniqueKey)
+	if err := s.packer.writeWinAckSize(s.writer(), s.option.WindowAckSize); err != nil {
 		return err
 	}
+	s.fc.setLocalWinAckSize(uint32(s.option.WindowAckSize))
 
 	log.Infof("<----- Set Peer Bandwidth. [%s]", s.UniqueKey)
-	if err := s.packer.writePeerBandwidth(s.conn, peerBandwidth, peerBandwidthLimitTypeDynamic); err != nil {
+	if err := s.packer.writePeerBandwidth(s.writer(), s.option.PeerBandwidth, peerBandwidthLimitTypeDynamic); err != nil {
 		return err
 	}
 
-	log.Infof("<----- SetChunkSize %d. [%s]", LocalChunkSize, s.UniqueKey)
-	if err := s.packer.writeChunkSize(s.conn, LocalChunkSize); err != nil {
+	log.Infof("<----- SetChunkSize %d. [%s]", s.option.ChunkSize, s.UniqueKey)
+	if err := s.packer.writeChunkSize(s.writer(), s.option.ChunkSize); err != nil {
 		return err
 	}
 
 	log.Infof("<---- _result('NetConnection.Connect.Success'). [%s]", s.UniqueKey)
-	if err := s.packer.writeConnectResult(s.conn, tid); err != nil {
+	if err := s.packer.writeConnectResult(s.writer(), tid, objectEncoding); err != nil {
 		return err
 	}
 	return nil
@@ -266,8 +616,25 @@ func (s *ServerSession) doConnect(tid int, stream *Stream) error {
 
 func (s *ServerSession) doCreateStream(tid int, stream *Stream) error {
 	log.Infof("-----> createStream(). [%s]", s.UniqueKey)
-	log.Infof("<---- _result(). [%s]", s.UniqueKey)
-	if err := s.packer.writeCreateStreamResult(s.conn, tid); err != nil {
+
+	// 第一个 NetStream 在连接建立时就已经存在，只有新增时才检查数量
+	streamID := s.nextStreamID
+	if _, ok := s.streams[streamID]; !ok {
+		if len(s.streams) >= s.option.MaxStreamsPerConn {
+			log.Warnf("too many streams in one connection. [%s] num=%d", s.UniqueKey, len(s.streams))
+			log.Infof("<---- _error('NetStream.Create.Failed'). [%s]", s.UniqueKey)
+			return s.packer.writeError(s.writer(), tid, "NetStream.Create.Failed", "Too many streams.")
+		}
+		uk := fmt.Sprintf("%s-%d", s.UniqueKey, streamID)
+		log.Infof("lifecycle new rtmp server session stream. [%s]", uk)
+		st := newServerSessionStream(s.serverConn, s.obs, uk, streamID)
+		st.AppName = s.AppName
+		s.streams[streamID] = st
+	}
+	s.nextStreamID++
+
+	log.Infof("<---- _result(%d). [%s]", streamID, s.UniqueKey)
+	if err := s.packer.writeCreateStreamResult(s.writer(), tid, streamID); err != nil {
 		return err
 	}
 	return nil
@@ -281,8 +648,11 @@ func (s *ServerSession) doPublish(tid int, stream *Stream) (err error) {
 	if err != nil {
 		return err
 	}
-	ss := strings.Split(s.StreamNameWithRawQuery, "?")
+	ss := strings.SplitN(s.StreamNameWithRawQuery, "?", 2)
 	s.StreamName = ss[0]
+	if len(ss) == 2 {
+		s.RawQuery = ss[1]
+	}
 
 	pubType, err := stream.msg.readStringWithType()
 	if err != nil {
@@ -291,17 +661,35 @@ func (s *ServerSession) doPublish(tid int, stream *Stream) (err error) {
 	log.Debugf("[%s] pubType=%s", s.UniqueKey, pubType)
 	log.Infof("-----> publish('%s') [%s]", s.StreamName, s.UniqueKey)
 
+	s.t = ServerSessionTypePub
+	s.unpublished = false
+	if !s.obs.NewRTMPPubSessionCB(s) {
+		s.t = ServerSessionTypeUnknown
+		log.Infof("<---- onStatus('NetStream.Publish.BadName'). [%s]", s.UniqueKey)
+		_ = s.packer.writeOnStatus(s.writer(), s.streamID, "error", "NetStream.Publish.BadName",
+			fmt.Sprintf("Stream %s is already publishing.", s.StreamName))
+		return ErrServerSessionRejected
+	}
+
+	log.Infof("<----- StreamBegin. [%s]", s.UniqueKey)
+	if err := s.packer.writeUserControl(s.writer(), userControlStreamBegin, uint32(s.streamID)); err != nil {
+		return err
+	}
+
 	log.Infof("<---- onStatus('NetStream.Publish.Start'). [%s]", s.UniqueKey)
-	if err := s.packer.writeOnStatusPublish(s.conn, MSID1); err != nil {
+	if err := s.packer.writeOnStatusPublish(s.writer(), s.streamID); err != nil {
 		return err
 	}
 
 	// 回复完信令后修改 connection 的属性
 	s.ModConnProps()
-
-	s.t = ServerSessionTypePub
-	s.obs.NewRTMPPubSessionCB(s)
-
+	s.startPingLoop()
+	if s.phaseTimer.phase == TimeoutPhaseCommand {
+		s.startPhase(TimeoutPhaseFirstMedia, s.option.FirstMediaTimeoutMS)
+	}
+	// 从开始推流时计算没有收到音视频数据的时长
+	s.lastMediaMS.Store(time.Now().UnixNano() / 1e6)
+	s.updateActivity()
 	return nil
 }
 
@@ -313,35 +701,270 @@ func (s *ServerSession) doPlay(tid int, stream *Stream) (err error) {
 	if err != nil {
 		return err
 	}
-	ss := strings.Split(s.StreamNameWithRawQuery, "?")
+	ss := strings.SplitN(s.StreamNameWithRawQuery, "?", 2)
 	s.StreamName = ss[0]
+	if len(ss) == 2 {
+		s.RawQuery = ss[1]
+	}
 
 	log.Infof("-----> play('%s'). [%s]", s.StreamName, s.UniqueKey)
 	// TODO chef: start duration reset
 
+	// 同一个连接上 closeStream 后可能再次 play
+	s.IsFresh = true
+	s.WaitKeyNalu = true
+	s.playStarted.Store(false)
+	s.paused.Store(false)
+
+	s.t = ServerSessionTypeSub
+	if !s.obs.NewRTMPSubSessionCB(s) {
+		s.t = ServerSessionTypeUnknown
+		log.Infof("<---- onStatus('NetStream.Play.StreamNotFound'). [%s]", s.UniqueKey)
+		_ = s.packer.writeOnStatus(s.writer(), s.streamID, "error", "NetStream.Play.StreamNotFound",
+			fmt.Sprintf("Stream %s not found.", s.StreamName))
+		return ErrServerSessionRejected
+	}
+
+	log.Infof("<----- StreamBegin. [%s]", s.UniqueKey)
+	if err := s.packer.writeUserControl(s.writer(), userControlStreamBegin, uint32(s.streamID)); err != nil {
+		return err
+	}
+
 	log.Infof("<----onStatus('NetStream.Play.Start'). [%s]", s.UniqueKey)
-	if err := s.packer.writeOnStatusPlay(s.conn, MSID1); err != nil {
+	if err := s.packer.writeOnStatusPlay(s.writer(), s.streamID); err != nil {
 		return err
 	}
 
 	// 回复完信令后修改 connection 的属性
 	s.ModConnProps()
+	s.startPingLoop()
+	if s.phaseTimer.phase == TimeoutPhaseCommand {
+		s.phaseTimer.stop()
+	}
+	s.updateActivity()
+	s.playStarted.Store(true)
+	return nil
+}
 
-	s.t = ServerSessionTypeSub
-	s.obs.NewRTMPSubSessionCB(s)
+func (s *ServerSession) doReleaseStream(tid int, stream *Stream) error {
+	streamName, _ := s.readStreamName(stream)
+	log.Infof("-----> releaseStream('%s'). [%s]", streamName, s.UniqueKey)
+	log.Infof("<---- _result(). [%s]", s.UniqueKey)
+	return s.packer.writeResult(s.writer(), tid, Undefined{})
+}
 
+func (s *ServerSession) doFCPublish(tid int, stream *Stream) error {
+	streamName, _ := s.readStreamName(stream)
+	log.Infof("-----> FCPublish('%s'). [%s]", streamName, s.UniqueKey)
+	log.Infof("<---- onFCPublish('NetStream.Publish.Start'). [%s]", s.UniqueKey)
+	return s.packer.writeOnFCPublish(s.writer(), "onFCPublish", "NetStream.Publish.Start", streamName)
+}
+
+func (s *ServerSession) doFCUnpublish(tid int, stream *Stream) error {
+	streamName, _ := s.readStreamName(stream)
+	log.Infof("-----> FCUnpublish('%s'). [%s]", streamName, s.UniqueKey)
+	log.Infof("<---- onFCUnpublish('NetStream.Unpublish.Success'). [%s]", s.UniqueKey)
+	if err := s.packer.writeOnFCPublish(s.writer(), "onFCUnpublish", "NetStream.Unpublish.Success", streamName); err != nil {
+		return err
+	}
+	// FCUnpublish 一般在 message stream 0 上发送，根据流名称找到对应的推流，找不到时只回复不处理
+	for _, st := range s.streams {
+		if st.t == ServerSessionTypePub && st.StreamName == streamName {
+			st.closeStream()
+			return nil
+		}
+	}
+	log.Warnf("read FCUnpublish but no pub stream named '%s', ignore it. [%s]", streamName, s.UniqueKey)
 	return nil
 }
 
+func (s *ServerSession) doGetStreamLength(tid int, stream *Stream) error {
+	streamName, _ := s.readStreamName(stream)
+	log.Infof("-----> getStreamLength('%s'). [%s]", streamName, s.UniqueKey)
+	// 直播流的长度为0
+	log.Infof("<---- _result(0). [%s]", s.UniqueKey)
+	return s.packer.writeResult(s.writer(), tid, 0)
+}
+
+func (s *ServerSession) doDeleteStream(tid int, stream *Stream) error {
+	var streamID int
+	if err := stream.msg.readNull(); err == nil {
+		streamID, _ = stream.msg.readNumberWithType()
+	}
+	log.Infof("-----> deleteStream(%d). [%s]", streamID, s.UniqueKey)
+	// 不能使用 streamOf，否则未知的 stream id 会结束连接上的第一个 NetStream
+	st, ok := s.streams[streamID]
+	if !ok {
+		log.Warnf("read deleteStream but stream id not exist, ignore it. [%s] streamID=%d", s.UniqueKey, streamID)
+		return nil
+	}
+	st.closeStream()
+	// 第一个 NetStream 保留，兼容 deleteStream 之后不再 createStream 就直接 publish 或 play 的客户端
+	if st.streamID != MSID1 {
+		delete(s.streams, st.streamID)
+	}
+	return nil
+}
+
+func (s *ServerSession) doPause(tid int, stream *Stream) error {
+	if err := stream.msg.readNull(); err != nil {
+		return err
+	}
+	pause, err := stream.msg.readBooleanWithType()
+	if err != nil {
+		return err
+	}
+	log.Infof("-----> pause(%t). [%s]", pause, s.UniqueKey)
+	if s.t != ServerSessionTypeSub {
+		log.Warnf("read pause but server session not sub type, ignore it. [%s]", s.UniqueKey)
+		return nil
+	}
+
+	// 直播流恢复播放时从当前位置继续，上层需要等待下一个关键帧
+	s.paused.Store(pause)
+	if pause {
+		log.Infof("<---- onStatus('NetStream.Pause.Notify'). [%s]", s.UniqueKey)
+		return s.packer.writeOnStatus(s.writer(), s.streamID, "status", "NetStream.Pause.Notify", "Paused live")
+	}
+	log.Infof("<---- onStatus('NetStream.Unpause.Notify'). [%s]", s.UniqueKey)
+	return s.packer.writeOnStatus(s.writer(), s.streamID, "status", "NetStream.Unpause.Notify", "Unpaused live")
+}
+
+func (s *ServerSession) doSeek(tid int, stream *Stream) error {
+	var ms int
+	if err := stream.msg.readNull(); err == nil {
+		ms, _ = stream.msg.readNumberWithType()
+	}
+	log.Infof("-----> seek(%d). [%s]", ms, s.UniqueKey)
+	if s.t != ServerSessionTypeSub {
+		log.Warnf("read seek but server session not sub type, ignore it. [%s]", s.UniqueKey)
+		return nil
+	}
+	// 直播流不支持 seek，始终从当前位置继续播放
+	log.Infof("<---- onStatus('NetStream.Seek.Notify'). [%s]", s.UniqueKey)
+	return s.packer.writeOnStatus(s.writer(), s.streamID, "status", "NetStream.Seek.Notify", "Seeking live")
+}
+
+// receiveAudio 以及 receiveVideo
+func (s *ServerSession) doReceiveAV(cmd string, stream *Stream) error {
+	if err := stream.msg.readNull(); err != nil {
+		return err
+	}
+	flag, err := stream.msg.readBooleanWithType()
+	if err != nil {
+		return err
+	}
+	log.Infof("-----> %s(%t). [%s]", cmd, flag, s.UniqueKey)
+	if cmd == "receiveAudio" {
+		s.audioDisabled.Store(!flag)
+	} else {
+		s.videoDisabled.Store(!flag)
+	}
+	return nil
+}
+
+// 读取 releaseStream，FCPublish 等信令中的流名称
+func (s *ServerSession) readStreamName(stream *Stream) (string, error) {
+	if err := stream.msg.readNull(); err != nil {
+		return "", err
+	}
+	return stream.msg.readStringWithType()
+}
+
+// 结束推流或者拉流，连接保持不变
+func (s *ServerSession) closeStream() {
+	switch s.t {
+	case ServerSessionTypePub:
+		s.t = ServerSessionTypeUnknown
+		s.unpublished = true
+		s.obs.DelRTMPPubSessionCB(s)
+	case ServerSessionTypeSub:
+		s.t = ServerSessionTypeUnknown
+		s.obs.DelRTMPSubSessionCB(s)
+	}
+	s.updateActivity()
+}
+
+// 推流或者拉流开始以及结束时，在读 goroutine 中调用
+func (sc *serverConn) updateActivity() {
+	var activeNum, pubNum int32
+	for _, st := range sc.streams {
+		switch st.t {
+		case ServerSessionTypePub:
+			pubNum++
+			activeNum++
+		case ServerSessionTypeSub:
+			activeNum++
+		}
+	}
+	sc.pubStreamNum.Store(pubNum)
+	if activeNum != 0 {
+		sc.idleSinceMS.Store(0)
+	} else if sc.idleSinceMS.Load() == 0 {
+		sc.idleSinceMS.Store(time.Now().UnixNano() / 1e6)
+	}
+}
+
+// 由 Server 定时调用，关闭长时间空闲的连接，以及长时间没有收到音视频数据的推流连接
+// 只检查连接级别的状态，同一个连接上有多个推流时，任意一个推流收到音视频数据都会重新计时
+func (s *ServerSession) reapIfNeeded(nowMS int64) {
+	var (
+		phase     TimeoutPhase
+		timeoutMS int
+	)
+	if since := s.idleSinceMS.Load(); since != 0 && s.option.IdleTimeoutMS != 0 && nowMS-since > int64(s.option.IdleTimeoutMS) {
+		phase, timeoutMS = TimeoutPhaseIdle, s.option.IdleTimeoutMS
+	} else if s.pubStreamNum.Load() != 0 && s.option.MediaInactiveTimeoutMS != 0 && nowMS-s.lastMediaMS.Load() > int64(s.option.MediaInactiveTimeoutMS) {
+		phase, timeoutMS = TimeoutPhaseMediaInactive, s.option.MediaInactiveTimeoutMS
+	} else {
+		return
+	}
+	if s.phaseTimer.expire(phase) {
+		log.Warnf("%s timeout, dispose session. [%s] timeout=%dms", phase, s.UniqueKey, timeoutMS)
+		_ = s.conn.Close()
+	}
+}
+
+// 根据 message stream id 找到对应的 NetStream，找不到时使用连接上的第一个 NetStream
+func (s *ServerSession) streamOf(streamID int) *ServerSession {
+	if st, ok := s.streams[streamID]; ok {
+		return st
+	}
+	return s.streams[MSID1]
+}
+
 func (s *ServerSession) ModConnProps() {
-	s.conn.ModWriteChanSize(wChanSize)
-	// TODO chef: naza.connection 这种方式会导致最后一点数据发送不出去，我们应该使用更好的方式
-	//s.conn.ModWriteBufSize(writeBufSize)
+	// 同一个连接上可能有多个 NetStream，或者 closeStream 后再次 publish 或 play，connection 的属性只能修改一次
+	aw := s.asyncWriter()
+	if aw == nil {
+		aw = bufpool.NewWriter(s.rawConn, func(option *bufpool.WriterOption) {
+			option.MaxPendingNum = s.option.WriteChanSize
+		})
+		s.aw.Store(aw)
+	}
 
 	switch s.t {
 	case ServerSessionTypePub:
-		s.conn.ModReadTimeoutMS(serverSessionReadAVTimeoutMS)
+		if !s.readTimeoutModified {
+			s.readTimeoutModified = true
+			s.conn.ModReadTimeoutMS(s.option.ReadAVTimeoutMS)
+		}
 	case ServerSessionTypeSub:
-		s.conn.ModWriteTimeoutMS(serverSessionWriteAVTimeoutMS)
+		aw.ModWriteTimeoutMS(s.option.WriteAVTimeoutMS)
+	}
+}
+
+// ModConnProps 之前同步发送，之后异步发送
+// aw 只在读 goroutine 中设置，但是上层可能在任意 goroutine 中发送，比如在 NewRTMPSubSessionCB 回调中，所以原子读写
+func (sc *serverConn) writer() io.Writer {
+	if aw := sc.asyncWriter(); aw != nil {
+		return aw
 	}
+	return sc.conn
+}
+
+// 还没有开启异步发送时返回 nil
+func (sc *serverConn) asyncWriter() *bufpool.Writer {
+	aw, _ := sc.aw.Load().(*bufpool.Writer)
+	return aw
 }
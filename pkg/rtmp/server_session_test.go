@@ -0,0 +1,645 @@
+// Copyright 2019, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package rtmp
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/q191201771/naza/pkg/assert"
+	"github.com/q191201771/naza/pkg/bele"
+)
+
+type multiStreamObserver struct {
+	mutex sync.Mutex
+	pubs  map[string]*ServerSession
+	msgs  map[string][]AVMsg
+	dels  []string
+}
+
+type multiStreamAVObserver struct {
+	name string
+	obs  *multiStreamObserver
+}
+
+func (o *multiStreamAVObserver) OnReadRTMPAVMsg(msg AVMsg) {
+	o.obs.mutex.Lock()
+	defer o.obs.mutex.Unlock()
+	msg.Payload = append([]byte(nil), msg.Payload...)
+	o.obs.msgs[o.name] = append(o.obs.msgs[o.name], msg)
+}
+
+func (so *multiStreamObserver) NewRTMPPubSessionCB(session *ServerSession) bool {
+	so.mutex.Lock()
+	defer so.mutex.Unlock()
+	so.pubs[session.StreamName] = session
+	session.SetPubSessionObserver(&multiStreamAVObserver{name: session.StreamName, obs: so})
+	return true
+}
+func (so *multiStreamObserver) NewRTMPSubSessionCB(session *ServerSession) bool {
+	return false
+}
+func (so *multiStreamObserver) DelRTMPPubSessionCB(session *ServerSession) {
+	so.mutex.Lock()
+	defer so.mutex.Unlock()
+	so.dels = append(so.dels, session.StreamName)
+}
+func (so *multiStreamObserver) DelRTMPSubSessionCB(session *ServerSession) {
+}
+
+func TestServerSession_MultiStream(t *testing.T) {
+	so := &multiStreamObserver{
+		pubs: make(map[string]*ServerSession),
+		msgs: make(map[string][]AVMsg),
+	}
+	cc, sc := net.Pipe()
+	s := NewServerSession(so, sc)
+	doneChan := make(chan error, 1)
+	go func() {
+		doneChan <- s.RunLoop()
+	}()
+
+	var hc HandshakeClientSimple
+	assert.Equal(t, nil, hc.WriteC0C1(cc))
+	assert.Equal(t, nil, hc.ReadS0S1S2(cc))
+	assert.Equal(t, nil, hc.WriteC2(cc))
+
+	// 读取服务端回复的 createStream 结果，以及 onStatus 所在的 message stream id
+	var (
+		mutex       sync.Mutex
+		streamIDs   []int
+		onStatusIDs []int
+	)
+	go func() {
+		c := NewChunkComposer()
+		_ = c.RunLoop(cc, func(stream *Stream) error {
+			switch stream.header.MsgTypeID {
+			case typeidSetChunkSize:
+				c.SetPeerChunkSize(bele.BEUint32(stream.msg.buf[stream.msg.b:stream.msg.e]))
+			case typeidCommandMessageAMF0:
+				cmd, _ := stream.msg.readStringWithType()
+				tid, _ := stream.msg.readNumberWithType()
+				mutex.Lock()
+				defer mutex.Unlock()
+				switch {
+				case cmd == "_result" && tid == tidClientCreateStream:
+					_ = stream.msg.readNull()
+					sid, _ := stream.msg.readNumberWithType()
+					streamIDs = append(streamIDs, sid)
+				case cmd == "onStatus":
+					onStatusIDs = append(onStatusIDs, stream.header.MsgStreamID)
+				}
+			}
+			return nil
+		})
+	}()
+
+	packer := NewMessagePacker()
+	assert.Equal(t, nil, packer.writeChunkSize(cc, LocalChunkSize))
+	assert.Equal(t, nil, packer.writeConnect(cc, "live", "rtmp://127.0.0.1/live"))
+	assert.Equal(t, nil, packer.writeCreateStream(cc))
+	assert.Equal(t, nil, packer.writeCreateStream(cc))
+	assert.Equal(t, nil, packer.writePublish(cc, "live", "a", 1))
+	assert.Equal(t, nil, packer.writePublish(cc, "live", "b", 2))
+
+	for i, sid := range []int{1, 2, 2} {
+		h := Header{
+			CSID:         CSIDAudio,
+			MsgLen:       2,
+			MsgTypeID:    TypeidAudio,
+			MsgStreamID:  sid,
+			TimestampAbs: uint32(i * 10),
+		}
+		_, err := cc.Write(Message2Chunks([]byte{0xaf, byte(i)}, &h))
+		assert.Equal(t, nil, err)
+	}
+
+	// 结束其中一个 NetStream，另外一个不受影响
+	assert.Equal(t, nil, packer.writeCommand(cc, csidOverConnection, 0, "deleteStream", 0, nil, 2))
+	time.Sleep(100 * time.Millisecond)
+
+	so.mutex.Lock()
+	assert.Equal(t, 2, len(so.pubs))
+	assert.Equal(t, MSID1, so.pubs["a"].StreamID())
+	assert.Equal(t, 2, so.pubs["b"].StreamID())
+	assert.Equal(t, "live", so.pubs["b"].AppName)
+	assert.Equal(t, 1, len(so.msgs["a"]))
+	assert.Equal(t, 2, len(so.msgs["b"]))
+	assert.Equal(t, []byte{0xaf, 2}, so.msgs["b"][1].Payload)
+	assert.Equal(t, []string{"b"}, so.dels)
+	so.mutex.Unlock()
+
+	mutex.Lock()
+	assert.Equal(t, []int{1, 2}, streamIDs)
+	assert.Equal(t, []int{1, 2}, onStatusIDs)
+	mutex.Unlock()
+
+	_ = cc.Close()
+	<-doneChan
+	assert.Equal(t, 1, len(s.streams))
+}
+
+// 未知的 stream id 以及不存在的推流名称，不影响连接上的其他 NetStream
+func TestServerSession_DeleteUnknownStream(t *testing.T) {
+	so := &multiStreamObserver{
+		pubs: make(map[string]*ServerSession),
+		msgs: make(map[string][]AVMsg),
+	}
+	cc, sc := net.Pipe()
+	s := NewServerSession(so, sc)
+	doneChan := make(chan error, 1)
+	go func() {
+		doneChan <- s.RunLoop()
+	}()
+
+	var hc HandshakeClientSimple
+	assert.Equal(t, nil, hc.WriteC0C1(cc))
+	assert.Equal(t, nil, hc.ReadS0S1S2(cc))
+	assert.Equal(t, nil, hc.WriteC2(cc))
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, cc)
+	}()
+
+	writeAudio := func() {
+		h := Header{CSID: CSIDAudio, MsgLen: 2, MsgTypeID: TypeidAudio, MsgStreamID: MSID1}
+		_, err := cc.Write(Message2Chunks([]byte{0xaf, 0x1}, &h))
+		assert.Equal(t, nil, err)
+	}
+
+	packer := NewMessagePacker()
+	assert.Equal(t, nil, packer.writeChunkSize(cc, LocalChunkSize))
+	assert.Equal(t, nil, packer.writeConnect(cc, "live", "rtmp://127.0.0.1/live"))
+	assert.Equal(t, nil, packer.writePublish(cc, "live", "a", MSID1))
+	writeAudio()
+
+	assert.Equal(t, nil, packer.writeCommand(cc, csidOverConnection, 0, "deleteStream", 0, nil, 5))
+	assert.Equal(t, nil, packer.writeCommand(cc, csidOverConnection, 0, "deleteStream", 0, nil))
+	assert.Equal(t, nil, packer.writeCommand(cc, csidOverConnection, 0, "deleteStream", 0))
+	assert.Equal(t, nil, packer.writeCommand(cc, csidOverConnection, 0, "FCUnpublish", 0, nil, "b"))
+	writeAudio()
+	time.Sleep(100 * time.Millisecond)
+
+	so.mutex.Lock()
+	assert.Equal(t, 0, len(so.dels))
+	assert.Equal(t, 2, len(so.msgs["a"]))
+	so.mutex.Unlock()
+
+	// 名称匹配时结束推流
+	assert.Equal(t, nil, packer.writeCommand(cc, csidOverConnection, 0, "FCUnpublish", 0, nil, "a"))
+	time.Sleep(100 * time.Millisecond)
+	so.mutex.Lock()
+	assert.Equal(t, []string{"a"}, so.dels)
+	so.mutex.Unlock()
+
+	_ = cc.Close()
+	<-doneChan
+}
+
+func TestServerSession_Option(t *testing.T) {
+	cc, sc := net.Pipe()
+	s := NewServerSession(&multiStreamObserver{}, sc, func(option *ServerOption) {
+		option.ChunkSize = 256
+		option.WindowAckSize = 1000
+	})
+	doneChan := make(chan error, 1)
+	go func() {
+		doneChan <- s.RunLoop()
+	}()
+
+	var hc HandshakeClientSimple
+	assert.Equal(t, nil, hc.WriteC0C1(cc))
+	assert.Equal(t, nil, hc.ReadS0S1S2(cc))
+	assert.Equal(t, nil, hc.WriteC2(cc))
+	go func() {
+		packer := NewMessagePacker()
+		_ = packer.writeChunkSize(cc, LocalChunkSize)
+		_ = packer.writeConnect(cc, "live", "rtmp://127.0.0.1/live")
+	}()
+
+	// 读取服务端回复的协议控制消息，直到 connect 的结果
+	vals := make(map[uint8]uint32)
+	c := NewChunkComposer()
+	_ = c.RunLoop(cc, func(stream *Stream) error {
+		switch stream.header.MsgTypeID {
+		case typeidSetChunkSize, typeidWinAckSize:
+			vals[stream.header.MsgTypeID] = bele.BEUint32(stream.msg.buf[stream.msg.b:stream.msg.e])
+			if stream.header.MsgTypeID == typeidSetChunkSize {
+				c.SetPeerChunkSize(vals[typeidSetChunkSize])
+			}
+		case typeidCommandMessageAMF0:
+			return ErrRTMP
+		}
+		return nil
+	})
+	assert.Equal(t, uint32(256), vals[typeidSetChunkSize])
+	assert.Equal(t, uint32(1000), vals[typeidWinAckSize])
+
+	_ = cc.Close()
+	<-doneChan
+}
+
+func TestServerSession_Timeout(t *testing.T) {
+	run := func(steps func(cc net.Conn)) error {
+		cc, sc := net.Pipe()
+		s := NewServerSession(&multiStreamObserver{pubs: make(map[string]*ServerSession), msgs: make(map[string][]AVMsg)}, sc, func(option *ServerOption) {
+			option.HandshakeTimeoutMS = 100
+			option.CommandTimeoutMS = 100
+			option.FirstMediaTimeoutMS = 100
+		})
+		doneChan := make(chan error, 1)
+		go func() {
+			doneChan <- s.RunLoop()
+		}()
+		steps(cc)
+		select {
+		case err := <-doneChan:
+			return err
+		case <-time.After(300 * time.Millisecond):
+		}
+		_ = cc.Close()
+		<-doneChan
+		return nil
+	}
+	handshake := func(cc net.Conn) {
+		var hc HandshakeClientSimple
+		assert.Equal(t, nil, hc.WriteC0C1(cc))
+		assert.Equal(t, nil, hc.ReadS0S1S2(cc))
+		assert.Equal(t, nil, hc.WriteC2(cc))
+	}
+	// 服务端的回复在另一个 goroutine 中读取
+	publish := func(cc net.Conn) {
+		handshake(cc)
+		go func() {
+			_, _ = io.Copy(ioutil.Discard, cc)
+		}()
+		packer := NewMessagePacker()
+		assert.Equal(t, nil, packer.writeChunkSize(cc, LocalChunkSize))
+		assert.Equal(t, nil, packer.writeConnect(cc, "live", "rtmp://127.0.0.1/live"))
+		assert.Equal(t, nil, packer.writePublish(cc, "live", "timeout", MSID1))
+	}
+
+	before := GetTimeouts()
+	assert.Equal(t, ErrServerSessionTimeout, run(func(cc net.Conn) {}))
+	assert.Equal(t, before.Handshake+1, GetTimeouts().Handshake)
+
+	assert.Equal(t, ErrServerSessionTimeout, run(handshake))
+	assert.Equal(t, before.Command+1, GetTimeouts().Command)
+
+	assert.Equal(t, ErrServerSessionTimeout, run(publish))
+	assert.Equal(t, before.FirstMedia+1, GetTimeouts().FirstMedia)
+
+	// 收到音视频数据后不再计时
+	assert.Equal(t, nil, run(func(cc net.Conn) {
+		publish(cc)
+		h := Header{CSID: CSIDAudio, MsgLen: 2, MsgTypeID: TypeidAudio, MsgStreamID: MSID1}
+		_, err := cc.Write(Message2Chunks([]byte{0xaf, 0x1}, &h))
+		assert.Equal(t, nil, err)
+	}))
+	assert.Equal(t, before.FirstMedia+1, GetTimeouts().FirstMedia)
+}
+
+func TestServerSession_Reap(t *testing.T) {
+	run := func(steps func(cc net.Conn, s *ServerSession)) error {
+		cc, sc := net.Pipe()
+		s := NewServerSession(&multiStreamObserver{pubs: make(map[string]*ServerSession), msgs: make(map[string][]AVMsg)}, sc, func(option *ServerOption) {
+			option.IdleTimeoutMS = 100
+			option.MediaInactiveTimeoutMS = 100
+		})
+		doneChan := make(chan error, 1)
+		go func() {
+			doneChan <- s.RunLoop()
+		}()
+		var hc HandshakeClientSimple
+		assert.Equal(t, nil, hc.WriteC0C1(cc))
+		assert.Equal(t, nil, hc.ReadS0S1S2(cc))
+		assert.Equal(t, nil, hc.WriteC2(cc))
+		go func() {
+			_, _ = io.Copy(ioutil.Discard, cc)
+		}()
+		packer := NewMessagePacker()
+		assert.Equal(t, nil, packer.writeChunkSize(cc, LocalChunkSize))
+		assert.Equal(t, nil, packer.writeConnect(cc, "live", "rtmp://127.0.0.1/live"))
+		assert.Equal(t, nil, packer.writePublish(cc, "live", "reap", MSID1))
+		time.Sleep(50 * time.Millisecond)
+
+		// 刚开始推流，没有超时
+		s.reapIfNeeded(time.Now().UnixNano() / 1e6)
+		steps(cc, s)
+		s.reapIfNeeded(time.Now().UnixNano()/1e6 + 200)
+		select {
+		case err := <-doneChan:
+			return err
+		case <-time.After(200 * time.Millisecond):
+		}
+		_ = cc.Close()
+		<-doneChan
+		return nil
+	}
+
+	// 推流的连接上只有其他数据，没有音视频数据
+	before := GetTimeouts()
+	assert.Equal(t, ErrServerSessionTimeout, run(func(cc net.Conn, s *ServerSession) {
+		assert.Equal(t, nil, NewMessagePacker().writeAcknowledgement(cc, 1))
+	}))
+	assert.Equal(t, before.MediaInactive+1, GetTimeouts().MediaInactive)
+
+	// 停止推流后不断开连接
+	assert.Equal(t, ErrServerSessionTimeout, run(func(cc net.Conn, s *ServerSession) {
+		assert.Equal(t, nil, NewMessagePacker().writeCommand(cc, csidOverConnection, 0, "deleteStream", 0, nil, MSID1))
+		time.Sleep(50 * time.Millisecond)
+	}))
+	assert.Equal(t, before.Idle+1, GetTimeouts().Idle)
+
+	// 收到音视频数据后重新计时
+	assert.Equal(t, nil, run(func(cc net.Conn, s *ServerSession) {
+		h := Header{CSID: CSIDAudio, MsgLen: 2, MsgTypeID: TypeidAudio, MsgStreamID: MSID1}
+		_, err := cc.Write(Message2Chunks([]byte{0xaf, 0x1}, &h))
+		assert.Equal(t, nil, err)
+		time.Sleep(50 * time.Millisecond)
+		// 下面检查时的时间往后推了 200 毫秒，这里模拟那时刚收到音视频数据
+		s.lastMediaMS.Add(200)
+	}))
+	assert.Equal(t, before.MediaInactive+1, GetTimeouts().MediaInactive)
+}
+
+// Server 定时检查所有连接
+func TestServer_Reap(t *testing.T) {
+	defer func(n int) { reapIntervalMS = n }(reapIntervalMS)
+	reapIntervalMS = 50
+
+	addr := ":19356"
+	s := NewServer(&multiStreamObserver{}, addr, func(option *ServerOption) {
+		option.HandshakeTimeoutMS = 0
+		option.CommandTimeoutMS = 0
+		option.IdleTimeoutMS = 100
+	})
+	go s.RunLoop()
+	defer s.Dispose()
+	time.Sleep(100 * time.Millisecond)
+
+	before := GetTimeouts()
+	conn, err := net.Dial("tcp", "127.0.0.1"+addr)
+	assert.Equal(t, nil, err)
+	var hc HandshakeClientSimple
+	assert.Equal(t, nil, hc.WriteC0C1(conn))
+	assert.Equal(t, nil, hc.ReadS0S1S2(conn))
+	assert.Equal(t, nil, hc.WriteC2(conn))
+
+	// 握手完成后不再发送任何数据，被服务端断开
+	assert.Equal(t, nil, conn.SetReadDeadline(time.Now().Add(3*time.Second)))
+	_, err = io.Copy(ioutil.Discard, conn)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, before.Idle+1, GetTimeouts().Idle)
+	_ = conn.Close()
+}
+
+func TestModChunksMsgStreamID(t *testing.T) {
+	h := Header{
+		CSID:         CSIDVideo,
+		MsgLen:       uint32(LocalChunkSize + 1),
+		MsgTypeID:    TypeidVideo,
+		MsgStreamID:  MSID1,
+		TimestampAbs: 0x1000000,
+	}
+	payload := make([]byte, LocalChunkSize+1)
+	chunks := Message2Chunks(payload, &h)
+	out := ModChunksMsgStreamID(chunks, 3)
+	msgs := compose(t, out)
+	assert.Equal(t, 1, len(msgs))
+	assert.Equal(t, 3, msgs[0].Header.MsgStreamID)
+	assert.Equal(t, uint32(0x1000000), msgs[0].Header.TimestampAbs)
+	assert.Equal(t, payload, msgs[0].Payload)
+	// 原始数据没有被修改
+	assert.Equal(t, MSID1, compose(t, chunks)[0].Header.MsgStreamID)
+}
+
+// 记录推流和拉流的开始以及结束，接受拉流
+type commandObserver struct {
+	multiStreamObserver
+	subs   map[string]*ServerSession
+	events []string
+}
+
+func newCommandObserver() *commandObserver {
+	return &commandObserver{
+		multiStreamObserver: multiStreamObserver{
+			pubs: make(map[string]*ServerSession),
+			msgs: make(map[string][]AVMsg),
+		},
+		subs: make(map[string]*ServerSession),
+	}
+}
+
+func (so *commandObserver) NewRTMPPubSessionCB(session *ServerSession) bool {
+	so.multiStreamObserver.NewRTMPPubSessionCB(session)
+	so.addEvent("newpub " + session.StreamName)
+	return true
+}
+func (so *commandObserver) NewRTMPSubSessionCB(session *ServerSession) bool {
+	so.mutex.Lock()
+	so.subs[session.StreamName] = session
+	so.mutex.Unlock()
+	so.addEvent("newsub " + session.StreamName)
+	return true
+}
+func (so *commandObserver) DelRTMPPubSessionCB(session *ServerSession) {
+	so.addEvent("delpub " + session.StreamName)
+}
+func (so *commandObserver) DelRTMPSubSessionCB(session *ServerSession) {
+	so.addEvent("delsub " + session.StreamName)
+}
+
+func (so *commandObserver) addEvent(e string) {
+	so.mutex.Lock()
+	defer so.mutex.Unlock()
+	so.events = append(so.events, e)
+}
+
+func (so *commandObserver) getEvents() []string {
+	so.mutex.Lock()
+	defer so.mutex.Unlock()
+	return append([]string(nil), so.events...)
+}
+
+// 完成握手以及 connect，记录服务端回复的 onStatus 中的 code
+type testClient struct {
+	cc     net.Conn
+	packer *MessagePacker
+
+	mutex sync.Mutex
+	codes []string
+}
+
+func startTestClient(t *testing.T, obs ServerSessionObserver, modOptions ...ModServerOption) (*testClient, chan error) {
+	cc, sc := net.Pipe()
+	s := NewServerSession(obs, sc, modOptions...)
+	doneChan := make(chan error, 1)
+	go func() {
+		doneChan <- s.RunLoop()
+	}()
+
+	var hc HandshakeClientSimple
+	assert.Equal(t, nil, hc.WriteC0C1(cc))
+	assert.Equal(t, nil, hc.ReadS0S1S2(cc))
+	assert.Equal(t, nil, hc.WriteC2(cc))
+
+	c := &testClient{cc: cc, packer: NewMessagePacker()}
+	go func() {
+		composer := NewChunkComposer()
+		_ = composer.RunLoop(cc, func(stream *Stream) error {
+			switch stream.header.MsgTypeID {
+			case typeidSetChunkSize:
+				composer.SetPeerChunkSize(bele.BEUint32(stream.msg.buf[stream.msg.b:stream.msg.e]))
+			case typeidCommandMessageAMF0:
+				if cmd, _ := stream.msg.readStringWithType(); cmd != "onStatus" && cmd != "_error" {
+					return nil
+				}
+				_, _ = stream.msg.readNumberWithType()
+				_ = stream.msg.readNull()
+				obj, _ := stream.msg.readObjectWithType()
+				code, _ := obj["code"].(string)
+				c.mutex.Lock()
+				c.codes = append(c.codes, code)
+				c.mutex.Unlock()
+			}
+			return nil
+		})
+	}()
+	assert.Equal(t, nil, c.packer.writeChunkSize(cc, LocalChunkSize))
+	assert.Equal(t, nil, c.packer.writeConnect(cc, "live", "rtmp://127.0.0.1/live"))
+	return c, doneChan
+}
+
+func (c *testClient) writeCommand(t *testing.T, streamID int, name string, args ...interface{}) {
+	assert.Equal(t, nil, c.packer.writeCommand(c.cc, csidOverStream, streamID, name, 0, append([]interface{}{nil}, args...)...))
+}
+
+func (c *testClient) writeAudio(t *testing.T, streamID int) {
+	h := Header{CSID: CSIDAudio, MsgLen: 2, MsgTypeID: TypeidAudio, MsgStreamID: streamID}
+	_, err := c.cc.Write(Message2Chunks([]byte{0xaf, 0x1}, &h))
+	assert.Equal(t, nil, err)
+}
+
+func (c *testClient) getCodes() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]string(nil), c.codes...)
+}
+
+func (c *testClient) close(doneChan chan error) {
+	_ = c.cc.Close()
+	<-doneChan
+}
+
+// deleteStream，FCUnpublish，closeStream 结束推流，之后收到的音视频数据被忽略，连接保持不变
+func TestServerSession_Unpublish(t *testing.T) {
+	cases := []struct {
+		name     string
+		streamID int
+		args     []interface{}
+	}{
+		{"deleteStream", 0, []interface{}{MSID1}},
+		{"FCUnpublish", 0, []interface{}{"a"}},
+		{"closeStream", MSID1, nil},
+	}
+	for _, tc := range cases {
+		so := newCommandObserver()
+		c, doneChan := startTestClient(t, so)
+		assert.Equal(t, nil, c.packer.writePublish(c.cc, "live", "a", MSID1))
+		c.writeAudio(t, MSID1)
+		c.writeCommand(t, tc.streamID, tc.name, tc.args...)
+		c.writeAudio(t, MSID1)
+		time.Sleep(50 * time.Millisecond)
+
+		assert.Equal(t, []string{"newpub a", "delpub a"}, so.getEvents(), tc.name)
+		so.mutex.Lock()
+		assert.Equal(t, 1, len(so.msgs["a"]), tc.name)
+		so.mutex.Unlock()
+
+		// 同一个连接上可以再次推流
+		assert.Equal(t, nil, c.packer.writePublish(c.cc, "live", "b", MSID1))
+		time.Sleep(50 * time.Millisecond)
+		assert.Equal(t, []string{"newpub a", "delpub a", "newpub b"}, so.getEvents(), tc.name)
+		c.close(doneChan)
+	}
+}
+
+// pause，receiveAudio，receiveVideo 控制拉流端接收哪些数据，closeStream 以及 deleteStream 结束拉流
+func TestServerSession_PlayControl(t *testing.T) {
+	so := newCommandObserver()
+	c, doneChan := startTestClient(t, so)
+	assert.Equal(t, nil, c.packer.writePlay(c.cc, "a", MSID1))
+	time.Sleep(50 * time.Millisecond)
+
+	so.mutex.Lock()
+	sub := so.subs["a"]
+	so.mutex.Unlock()
+	assert.Equal(t, true, sub.IsPlayStarted())
+	assert.Equal(t, true, sub.IsReceiving(TypeidAudio))
+	assert.Equal(t, true, sub.IsReceiving(TypeidVideo))
+
+	c.writeCommand(t, MSID1, "receiveAudio", false)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, false, sub.IsReceiving(TypeidAudio))
+	assert.Equal(t, true, sub.IsReceiving(TypeidVideo))
+
+	c.writeCommand(t, MSID1, "receiveVideo", false)
+	c.writeCommand(t, MSID1, "receiveAudio", true)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, true, sub.IsReceiving(TypeidAudio))
+	assert.Equal(t, false, sub.IsReceiving(TypeidVideo))
+	c.writeCommand(t, MSID1, "receiveVideo", true)
+
+	// 暂停时只接收 metadata 等其他数据
+	c.writeCommand(t, MSID1, "pause", true, 0)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, false, sub.IsReceiving(TypeidAudio))
+	assert.Equal(t, false, sub.IsReceiving(TypeidVideo))
+	assert.Equal(t, true, sub.IsReceiving(TypeidDataMessageAMF0))
+	c.writeCommand(t, MSID1, "pause", false, 0)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, true, sub.IsReceiving(TypeidAudio))
+	assert.Equal(t, true, sub.IsReceiving(TypeidVideo))
+	assert.Equal(t, []string{"NetStream.Play.Start", "NetStream.Pause.Notify", "NetStream.Unpause.Notify"}, c.getCodes())
+
+	c.writeCommand(t, MSID1, "closeStream")
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, []string{"newsub a", "delsub a"}, so.getEvents())
+
+	// 在另一个 NetStream 上拉流，deleteStream 结束。第一次 createStream 返回 MSID1
+	assert.Equal(t, nil, c.packer.writeCreateStream(c.cc))
+	assert.Equal(t, nil, c.packer.writeCreateStream(c.cc))
+	assert.Equal(t, nil, c.packer.writePlay(c.cc, "b", 2))
+	time.Sleep(50 * time.Millisecond)
+	c.writeCommand(t, 0, "deleteStream", 2)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, []string{"newsub a", "delsub a", "newsub b", "delsub b"}, so.getEvents())
+	c.close(doneChan)
+}
+
+func TestServerSession_MaxStreamsPerConn(t *testing.T) {
+	so := newCommandObserver()
+	c, doneChan := startTestClient(t, so, func(option *ServerOption) {
+		option.MaxStreamsPerConn = 1
+	})
+	// 第一次 createStream 返回预先创建的 MSID1，不受限制
+	assert.Equal(t, nil, c.packer.writeCreateStream(c.cc))
+	assert.Equal(t, nil, c.packer.writePlay(c.cc, "a", MSID1))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, []string{"NetStream.Play.Start"}, c.getCodes())
+
+	assert.Equal(t, nil, c.packer.writeCreateStream(c.cc))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, []string{"NetStream.Play.Start", "NetStream.Create.Failed"}, c.getCodes())
+	c.close(doneChan)
+}
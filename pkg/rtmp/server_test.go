@@ -0,0 +1,151 @@
+// Copyright 2019, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package rtmp_test
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/q191201771/lal/pkg/rtmp"
+	"github.com/q191201771/naza/pkg/assert"
+)
+
+type rejectServerObserver struct {
+	pubCount int32
+	subCount int32
+	subChan  chan int32 // 不为 nil 时，每次收到 play 都通知当前的次数
+}
+
+func (so *rejectServerObserver) NewRTMPPubSessionCB(session *rtmp.ServerSession) bool {
+	atomic.AddInt32(&so.pubCount, 1)
+	return false
+}
+func (so *rejectServerObserver) NewRTMPSubSessionCB(session *rtmp.ServerSession) bool {
+	n := atomic.AddInt32(&so.subCount, 1)
+	if so.subChan != nil {
+		select {
+		case so.subChan <- n:
+		default:
+		}
+	}
+	return false
+}
+func (so *rejectServerObserver) DelRTMPPubSessionCB(session *rtmp.ServerSession) {
+}
+func (so *rejectServerObserver) DelRTMPSubSessionCB(session *rtmp.ServerSession) {
+}
+
+func TestServer_Reject(t *testing.T) {
+	addr := ":19353"
+	s := rtmp.NewServer(&rejectServerObserver{}, addr)
+	go s.RunLoop()
+	defer s.Dispose()
+	time.Sleep(100 * time.Millisecond)
+
+	pushSession := rtmp.NewPushSession(func(option *rtmp.PushSessionOption) {
+		option.PushTimeoutMS = 5000
+	})
+	err := pushSession.Push("rtmp://127.0.0.1" + addr + "/live/reject")
+	se, ok := err.(*rtmp.StatusError)
+	assert.Equal(t, true, ok)
+	assert.Equal(t, "error", se.Level)
+	assert.Equal(t, "NetStream.Publish.BadName", se.Code)
+	pushSession.Dispose()
+
+	pullSession := rtmp.NewPullSession(func(option *rtmp.PullSessionOption) {
+		option.PullTimeoutMS = 5000
+	})
+	err = pullSession.Pull("rtmp://127.0.0.1"+addr+"/live/reject", func(msg rtmp.AVMsg) {})
+	se, ok = err.(*rtmp.StatusError)
+	assert.Equal(t, true, ok)
+	assert.Equal(t, "NetStream.Play.StreamNotFound", se.Code)
+	pullSession.Dispose()
+}
+
+func TestServer_Reconnect(t *testing.T) {
+	addr := ":19354"
+	so := rejectServerObserver{subChan: make(chan int32, 8)}
+	s := rtmp.NewServer(&so, addr)
+	go s.RunLoop()
+	defer s.Dispose()
+	time.Sleep(100 * time.Millisecond)
+
+	// 重试次数用完后返回最后一次的错误
+	pushSession := rtmp.NewPushSession(func(option *rtmp.PushSessionOption) {
+		option.PushTimeoutMS = 5000
+		option.Reconnect.MaxRetries = 2
+		option.Reconnect.MinBackoffMS = 10
+	})
+	err := pushSession.Push("rtmp://127.0.0.1" + addr + "/live/reconnect")
+	se, ok := err.(*rtmp.StatusError)
+	assert.Equal(t, true, ok)
+	assert.Equal(t, "NetStream.Publish.BadName", se.Code)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&so.pubCount))
+	pushSession.Dispose()
+	assert.Equal(t, rtmp.ErrPushSessionNotReady, pushSession.AsyncWrite([]byte{0}))
+
+	// 无限重连时，Dispose 后 Pull 返回
+	pullSession := rtmp.NewPullSession(func(option *rtmp.PullSessionOption) {
+		option.PullTimeoutMS = 5000
+		option.Reconnect.MaxRetries = -1
+		option.Reconnect.MinBackoffMS = 10
+		option.Reconnect.MaxBackoffMS = 10
+	})
+	pullDone := make(chan error, 1)
+	go func() {
+		pullDone <- pullSession.Pull("rtmp://127.0.0.1"+addr+"/live/reconnect", func(msg rtmp.AVMsg) {})
+	}()
+	// 等到发生过重连之后再 Dispose
+	timeout := time.After(10 * time.Second)
+	for n := int32(0); n < 2; {
+		select {
+		case n = <-so.subChan:
+		case <-timeout:
+			t.Fatal("wait reconnect timeout")
+		}
+	}
+	pullSession.Dispose()
+	select {
+	case err = <-pullDone:
+		assert.IsNotNil(t, err)
+	case <-timeout:
+		t.Fatal("wait pull return timeout")
+	}
+}
+
+func TestServerOption_Validate(t *testing.T) {
+	assert.Equal(t, nil, rtmp.DefaultServerOption.Validate())
+
+	cases := []func(option *rtmp.ServerOption){
+		func(option *rtmp.ServerOption) { option.ChunkSize = 127 },
+		func(option *rtmp.ServerOption) { option.ChunkSize = 0x1000000 },
+		func(option *rtmp.ServerOption) { option.WriteChanSize = 0 },
+		func(option *rtmp.ServerOption) { option.ReadAVTimeoutMS = -1 },
+		func(option *rtmp.ServerOption) { option.PingTimeoutMS = option.PingIntervalMS },
+		func(option *rtmp.ServerOption) { option.MaxStreamsPerConn = 0 },
+	}
+	for _, fn := range cases {
+		option := rtmp.DefaultServerOption
+		fn(&option)
+		assert.IsNotNil(t, option.Validate())
+	}
+
+	// 不发送 PingRequest 时不检查 PingTimeoutMS
+	option := rtmp.DefaultServerOption
+	option.PingIntervalMS = 0
+	option.PingTimeoutMS = 0
+	assert.Equal(t, nil, option.Validate())
+
+	// 配置项不合法时不会开始监听
+	s := rtmp.NewServer(&rejectServerObserver{}, ":19355", func(option *rtmp.ServerOption) {
+		option.ChunkSize = 0
+	})
+	assert.IsNotNil(t, s.RunLoop())
+}
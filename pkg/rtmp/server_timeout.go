@@ -0,0 +1,134 @@
+// Copyright 2019, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package rtmp
+
+import (
+	"errors"
+	"time"
+
+	"github.com/q191201771/naza/pkg/nazaatomic"
+)
+
+// server session 各个阶段的超时，防止建立连接后不完成握手或者信令交互的对端一直占用连接和 goroutine
+// 以及由 Server 定时检查的空闲连接和不再发送音视频数据的推流连接
+// 超时后关闭连接，并按阶段计数
+
+var ErrServerSessionTimeout = errors.New("lal.rtmp: server session phase timeout")
+
+type TimeoutPhase int32
+
+const (
+	TimeoutPhaseHandshake     TimeoutPhase = iota + 1 // 建立连接后，完成握手之前
+	TimeoutPhaseCommand                               // 握手完成后，开始推流或者拉流之前
+	TimeoutPhaseFirstMedia                            // 开始推流后，收到第一个音视频数据之前
+	TimeoutPhaseIdle                                  // 连接上没有推流或者拉流的 NetStream，比如 closeStream 之后
+	TimeoutPhaseMediaInactive                         // 推流过程中，没有收到音视频数据，但是连接上还有其他数据
+)
+
+func (phase TimeoutPhase) String() string {
+	switch phase {
+	case TimeoutPhaseHandshake:
+		return "handshake"
+	case TimeoutPhaseCommand:
+		return "command"
+	case TimeoutPhaseFirstMedia:
+		return "first media"
+	case TimeoutPhaseIdle:
+		return "idle"
+	case TimeoutPhaseMediaInactive:
+		return "media inactive"
+	}
+	return "unknown"
+}
+
+// 因为各个阶段超时而被关闭的连接的数量
+type Timeouts struct {
+	Handshake     uint64
+	Command       uint64
+	FirstMedia    uint64
+	Idle          uint64
+	MediaInactive uint64
+}
+
+var timeouts struct {
+	handshake     nazaatomic.Uint64
+	command       nazaatomic.Uint64
+	firstMedia    nazaatomic.Uint64
+	idle          nazaatomic.Uint64
+	mediaInactive nazaatomic.Uint64
+}
+
+func GetTimeouts() Timeouts {
+	return Timeouts{
+		Handshake:     timeouts.handshake.Load(),
+		Command:       timeouts.command.Load(),
+		FirstMedia:    timeouts.firstMedia.Load(),
+		Idle:          timeouts.idle.Load(),
+		MediaInactive: timeouts.mediaInactive.Load(),
+	}
+}
+
+func reportTimeout(phase TimeoutPhase) {
+	switch phase {
+	case TimeoutPhaseHandshake:
+		timeouts.handshake.Increment()
+	case TimeoutPhaseCommand:
+		timeouts.command.Increment()
+	case TimeoutPhaseFirstMedia:
+		timeouts.firstMedia.Increment()
+	case TimeoutPhaseIdle:
+		timeouts.idle.Increment()
+	case TimeoutPhaseMediaInactive:
+		timeouts.mediaInactive.Increment()
+	}
+}
+
+// 同一时间只对一个阶段计时，start 和 stop 只在读 goroutine 中调用，expire 可以在任意 goroutine 中调用
+type phaseTimer struct {
+	phase   TimeoutPhase // 正在计时的阶段，为0时表示没有计时
+	timer   *time.Timer
+	expired nazaatomic.Int32 // 超时的阶段，为0时表示没有超时
+}
+
+// 停止之前阶段的计时，开始 <phase> 的计时，超时后调用 <onTimeout>
+// <timeoutMS> 为0时不计时
+func (pt *phaseTimer) start(phase TimeoutPhase, timeoutMS int, onTimeout func()) {
+	pt.stop()
+	pt.phase = phase
+	if timeoutMS == 0 {
+		return
+	}
+	pt.timer = time.AfterFunc(time.Duration(timeoutMS)*time.Millisecond, func() {
+		if pt.expire(phase) {
+			onTimeout()
+		}
+	})
+}
+
+// 标记 <phase> 超时并计数，已经有阶段超时时返回 false
+func (pt *phaseTimer) expire(phase TimeoutPhase) bool {
+	if !pt.expired.CompareAndSwap(0, int32(phase)) {
+		return false
+	}
+	reportTimeout(phase)
+	return true
+}
+
+func (pt *phaseTimer) stop() {
+	pt.phase = 0
+	if pt.timer != nil {
+		pt.timer.Stop()
+		pt.timer = nil
+	}
+}
+
+// 超时的阶段，没有超时时返回0
+func (pt *phaseTimer) expiredPhase() TimeoutPhase {
+	return TimeoutPhase(pt.expired.Load())
+}
@@ -12,11 +12,15 @@ import (
 	"encoding/hex"
 	"fmt"
 
+	"github.com/q191201771/lal/pkg/bufpool"
 	log "github.com/q191201771/naza/pkg/nazalog"
 )
 
 const initMsgLen = 4096
 
+// 打印日志时，二进制数据最多打印的字节数
+const maxDebugDumpSize = 256
+
 type Header struct {
 	CSID        int
 	MsgLen      uint32
@@ -41,7 +45,7 @@ type Stream struct {
 func NewStream() *Stream {
 	return &Stream{
 		msg: StreamMsg{
-			buf: make([]byte, initMsgLen),
+			buf: bufpool.Get(initMsgLen),
 		},
 	}
 }
@@ -49,8 +53,15 @@ func NewStream() *Stream {
 // 序列化成可读字符串，一般用于发生错误时打印日志
 func (stream *Stream) toDebugString() string {
 	// 注意，这里打印的二进制数据的其实位置是从 0 开始，而不是 msg.b 位置
-	return fmt.Sprintf("header=%+v, b=%d, hex=%s",
-		stream.header, stream.msg.b, hex.Dump(stream.msg.buf[:stream.msg.e]))
+	return fmt.Sprintf("header=%+v, b=%d, e=%d, hex=%s",
+		stream.header, stream.msg.b, stream.msg.e, hexDumpHead(stream.msg.buf[:stream.msg.e]))
+}
+
+func hexDumpHead(b []byte) string {
+	if len(b) > maxDebugDumpSize {
+		return hex.Dump(b[:maxDebugDumpSize]) + "..."
+	}
+	return hex.Dump(b)
 }
 
 func (stream *Stream) toAVMsg() AVMsg {
@@ -60,19 +71,27 @@ func (stream *Stream) toAVMsg() AVMsg {
 	}
 }
 
+// amf3 的 data message 跳过格式标志后，和 amf0 的 data message 格式相同，统一转换成 amf0 类型，便于上层处理
+func (stream *Stream) toAMF0DataAVMsg() AVMsg {
+	msg := stream.toAVMsg()
+	msg.Header.MsgTypeID = TypeidDataMessageAMF0
+	msg.Header.MsgLen = uint32(len(msg.Payload))
+	return msg
+}
+
+// 保证还可以写入 <n> 字节
+// 新的内存块从内存池中获取，旧的内存块归还到内存池
 func (msg *StreamMsg) reserve(n uint32) {
-	bufCap := uint32(cap(msg.buf))
-	nn := bufCap - msg.e
-	if nn > n {
+	need := msg.e + n
+	if need <= uint32(cap(msg.buf)) {
 		return
 	}
-	for nn < n {
-		nn <<= 1
-	}
-	nb := make([]byte, bufCap+nn)
-	copy(nb, msg.buf[msg.b:msg.e])
+	nb := bufpool.Get(int(need))
+	nb = nb[:cap(nb)]
+	copy(nb, msg.buf[:msg.e])
+	bufpool.Put(msg.buf)
 	msg.buf = nb
-	log.Debugf("reserve. need:%d left:%d %d %d", n, nn, len(msg.buf), cap(msg.buf))
+	log.Debugf("reserve. need:%d %d %d", n, len(msg.buf), cap(msg.buf))
 }
 
 func (msg *StreamMsg) len() uint32 {
@@ -96,12 +115,30 @@ func (msg *StreamMsg) clear() {
 //	return msg.buf[msg.b: msg.e]
 //}
 
+// 跳过 amf3 command message 以及 data message 开头的格式标志
+func (msg *StreamMsg) skipAMF3Format() error {
+	if msg.len() < amf3MessageFormatSize {
+		return ErrAMFTooShort
+	}
+	msg.consumed(amf3MessageFormatSize)
+	return nil
+}
+
+// 以下 read 类型的方法，兼容 amf0 中通过 avmplus-object-marker 切换到 amf3 编码的值
+
 func (msg *StreamMsg) peekStringWithType() (string, error) {
+	if msg.isAMF3Switched() {
+		v, _, err := AMF0.ReadValue(msg.buf[msg.b:msg.e])
+		return amf3SwitchedString(v, err)
+	}
 	str, _, err := AMF0.ReadString(msg.buf[msg.b:msg.e])
 	return str, err
 }
 
 func (msg *StreamMsg) readStringWithType() (string, error) {
+	if msg.isAMF3Switched() {
+		return amf3SwitchedString(msg.readSwitchedValue())
+	}
 	str, l, err := AMF0.ReadString(msg.buf[msg.b:msg.e])
 	if err == nil {
 		msg.consumed(uint32(l))
@@ -110,6 +147,17 @@ func (msg *StreamMsg) readStringWithType() (string, error) {
 }
 
 func (msg *StreamMsg) readNumberWithType() (int, error) {
+	if msg.isAMF3Switched() {
+		v, err := msg.readSwitchedValue()
+		if err != nil {
+			return 0, err
+		}
+		val, ok := v.(float64)
+		if !ok {
+			return 0, ErrAMFInvalidType
+		}
+		return int(val), nil
+	}
 	val, l, err := AMF0.ReadNumber(msg.buf[msg.b:msg.e])
 	if err == nil {
 		msg.consumed(uint32(l))
@@ -117,7 +165,39 @@ func (msg *StreamMsg) readNumberWithType() (int, error) {
 	return int(val), err
 }
 
+func (msg *StreamMsg) readBooleanWithType() (bool, error) {
+	if msg.isAMF3Switched() {
+		v, err := msg.readSwitchedValue()
+		if err != nil {
+			return false, err
+		}
+		val, ok := v.(bool)
+		if !ok {
+			return false, ErrAMFInvalidType
+		}
+		return val, nil
+	}
+	val, l, err := AMF0.ReadBoolean(msg.buf[msg.b:msg.e])
+	if err == nil {
+		msg.consumed(uint32(l))
+	}
+	return val, err
+}
+
 func (msg *StreamMsg) readObjectWithType() (map[string]interface{}, error) {
+	if msg.isAMF3Switched() {
+		v, err := msg.readSwitchedValue()
+		if err != nil {
+			return nil, err
+		}
+		switch obj := v.(type) {
+		case map[string]interface{}:
+			return obj, nil
+		case TypedObject:
+			return obj.Object, nil
+		}
+		return nil, ErrAMFInvalidType
+	}
 	obj, l, err := AMF0.ReadObject(msg.buf[msg.b:msg.e])
 	if err == nil {
 		msg.consumed(uint32(l))
@@ -126,9 +206,42 @@ func (msg *StreamMsg) readObjectWithType() (map[string]interface{}, error) {
 }
 
 func (msg *StreamMsg) readNull() error {
+	if msg.isAMF3Switched() {
+		v, err := msg.readSwitchedValue()
+		if err != nil {
+			return err
+		}
+		if v != nil {
+			return ErrAMFInvalidType
+		}
+		return nil
+	}
 	l, err := AMF0.ReadNull(msg.buf[msg.b:msg.e])
 	if err == nil {
 		msg.consumed(uint32(l))
 	}
 	return err
 }
+
+func (msg *StreamMsg) isAMF3Switched() bool {
+	return msg.len() > 0 && msg.buf[msg.b] == AMF0TypeMarkerAvmplusObject
+}
+
+func (msg *StreamMsg) readSwitchedValue() (interface{}, error) {
+	v, l, err := AMF0.ReadValue(msg.buf[msg.b:msg.e])
+	if err == nil {
+		msg.consumed(uint32(l))
+	}
+	return v, err
+}
+
+func amf3SwitchedString(v interface{}, err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+	str, ok := v.(string)
+	if !ok {
+		return "", ErrAMFInvalidType
+	}
+	return str, nil
+}
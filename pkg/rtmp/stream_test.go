@@ -0,0 +1,67 @@
+// Copyright 2019, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package rtmp
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/q191201771/naza/pkg/assert"
+)
+
+func TestStreamMsg_AMF3Command(t *testing.T) {
+	// amf3 command message: 格式标志 | play | tid | null | stream name，其中后两个值切换为 amf3 编码
+	buf := &bytes.Buffer{}
+	buf.WriteByte(0)
+	_ = AMF0.WriteString(buf, "play")
+	_ = AMF0.WriteNumber(buf, 4)
+	buf.WriteByte(AMF0TypeMarkerAvmplusObject)
+	_ = AMF3.WriteValue(buf, nil)
+	buf.WriteByte(AMF0TypeMarkerAvmplusObject)
+	_ = AMF3.WriteValue(buf, "test110?token=1")
+
+	stream := NewStream()
+	stream.header.MsgTypeID = typeidCommandMessageAMF3
+	stream.msg.reserve(uint32(buf.Len()))
+	copy(stream.msg.buf, buf.Bytes())
+	stream.msg.produced(uint32(buf.Len()))
+
+	assert.Equal(t, nil, stream.msg.skipAMF3Format())
+	cmd, err := stream.msg.readStringWithType()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "play", cmd)
+	tid, err := stream.msg.readNumberWithType()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 4, tid)
+	assert.Equal(t, nil, stream.msg.readNull())
+	name, err := stream.msg.peekStringWithType()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "test110?token=1", name)
+	name, err = stream.msg.readStringWithType()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "test110?token=1", name)
+	assert.Equal(t, uint32(0), stream.msg.len())
+
+	_, err = stream.msg.readStringWithType()
+	assert.Equal(t, ErrAMFTooShort, err)
+	assert.Equal(t, ErrAMFTooShort, stream.msg.skipAMF3Format())
+}
+
+func TestStream_toAMF0DataAVMsg(t *testing.T) {
+	stream := NewStream()
+	stream.header.MsgTypeID = TypeidDataMessageAMF3
+	stream.header.MsgLen = 4
+	copy(stream.msg.buf, []byte{0, AMF0TypeMarkerNull, AMF0TypeMarkerNull, AMF0TypeMarkerNull})
+	stream.msg.produced(4)
+	assert.Equal(t, nil, stream.msg.skipAMF3Format())
+	msg := stream.toAMF0DataAVMsg()
+	assert.Equal(t, TypeidDataMessageAMF0, msg.Header.MsgTypeID)
+	assert.Equal(t, uint32(3), msg.Header.MsgLen)
+	assert.Equal(t, 3, len(msg.Payload))
+}
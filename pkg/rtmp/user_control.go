@@ -0,0 +1,50 @@
+// Copyright 2019, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package rtmp
+
+// user_control.go
+// @pure
+// 7.1.7 User Control Message Events
+
+import (
+	"github.com/q191201771/naza/pkg/bele"
+)
+
+// 直播场景下不会发送 StreamDry 以及 StreamIsRecorded，收到时忽略
+const (
+	userControlStreamBegin     = uint16(0)
+	userControlStreamEOF       = uint16(1)
+	userControlSetBufferLength = uint16(3)
+	userControlPingRequest     = uint16(6)
+	userControlPingResponse    = uint16(7)
+)
+
+type userControlEvent struct {
+	eventType uint16
+	// StreamBegin，StreamEOF，StreamDry，SetBufferLength，StreamIsRecorded 中为 stream id
+	// PingRequest，PingResponse 中为 timestamp
+	data uint32
+	// 只有 SetBufferLength 有，单位毫秒
+	bufferLength uint32
+}
+
+func parseUserControl(b []byte) (event userControlEvent, err error) {
+	if len(b) < 6 {
+		return event, ErrRTMP
+	}
+	event.eventType = bele.BEUint16(b)
+	event.data = bele.BEUint32(b[2:])
+	if event.eventType == userControlSetBufferLength {
+		if len(b) < 10 {
+			return event, ErrRTMP
+		}
+		event.bufferLength = bele.BEUint32(b[6:])
+	}
+	return event, nil
+}
@@ -0,0 +1,38 @@
+// Copyright 2019, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package rtmp
+
+import (
+	"testing"
+
+	"github.com/q191201771/naza/pkg/assert"
+)
+
+func TestParseUserControl(t *testing.T) {
+	event, err := parseUserControl([]byte{0, 0, 0, 0, 0, 1})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, userControlStreamBegin, event.eventType)
+	assert.Equal(t, uint32(1), event.data)
+
+	event, err = parseUserControl([]byte{0, 3, 0, 0, 0, 1, 0, 0, 0x0b, 0xb8})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, userControlSetBufferLength, event.eventType)
+	assert.Equal(t, uint32(1), event.data)
+	assert.Equal(t, uint32(3000), event.bufferLength)
+
+	event, err = parseUserControl([]byte{0, 6, 0, 0, 0x12, 0x34})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, userControlPingRequest, event.eventType)
+	assert.Equal(t, uint32(0x1234), event.data)
+
+	_, err = parseUserControl([]byte{0, 0, 0})
+	assert.Equal(t, ErrRTMP, err)
+	_, err = parseUserControl([]byte{0, 3, 0, 0, 0, 1})
+	assert.Equal(t, ErrRTMP, err)
+}
@@ -0,0 +1,234 @@
+// Copyright 2019, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package timestamp
+
+// normalizer.go
+// @pure
+// 修复推流端不规范的时间戳，比如回退，从很大的值开始，32位回绕，以及音视频之间的偏差越来越大
+// 输入输出都是毫秒级别的 rtmp / flv 时间戳，不依赖 rtmp 以及 httpflv 包，所以 Group、flv 文件录制、转推等都可以使用
+
+// 和 rtmp message type id 以及 flv tag type 的取值相同
+const (
+	TypeAudio = uint8(8)
+	TypeVideo = uint8(9)
+)
+
+type Option struct {
+	// 是否将第一个时间戳平移为0，音视频使用同一个起点，所以不会改变音视频之间的相对关系
+	RebaseToZero bool
+
+	// 同一个轨道上相邻的两个时间戳的差值超过这个值（向前或者向后）时，认为发生了跳变，
+	// 跳变后的时间戳紧接着跳变前的时间戳继续，间隔使用跳变前的间隔。为0时不检查
+	JumpThresholdMS uint32
+
+	// 音频和视频的时间戳相差超过这个值时，将落后的轨道对齐到领先的轨道。为0时不检查
+	MaxAVDriftMS uint32
+
+	// 每次修正时间戳时回调，可以为 nil
+	OnCorrection func(c Correction)
+}
+
+var DefaultOption = Option{
+	RebaseToZero:    false,
+	JumpThresholdMS: 5000,
+	MaxAVDriftMS:    0,
+}
+
+type CorrectionKind int
+
+const (
+	CorrectionBackward CorrectionKind = iota + 1 // 时间戳小幅度回退，使用上一个时间戳
+	CorrectionJump                               // 时间戳大幅度跳变
+	CorrectionWrap                               // 32位时间戳回绕，输出的时间戳保持连续
+	CorrectionDrift                              // 音视频偏差过大，落后的轨道被对齐
+)
+
+func (k CorrectionKind) String() string {
+	switch k {
+	case CorrectionBackward:
+		return "backward"
+	case CorrectionJump:
+		return "jump"
+	case CorrectionWrap:
+		return "wrap"
+	case CorrectionDrift:
+		return "drift"
+	}
+	return "unknown"
+}
+
+type Correction struct {
+	Kind      CorrectionKind
+	MsgTypeID uint8
+	In        uint32 // 修正前的时间戳
+	Out       uint32 // 修正后的时间戳
+}
+
+type Stats struct {
+	Total    uint64 // 处理的音视频时间戳的数量
+	Backward uint64
+	Jump     uint64
+	Wrap     uint64
+	Drift    uint64
+}
+
+type track struct {
+	started   bool
+	lastIn    uint32
+	lastOut   uint32
+	lastDelta uint32
+}
+
+// 注意，非协程安全，由调用方保证
+type Normalizer struct {
+	option Option
+
+	started bool
+	origin  uint32 // 第一个时间戳，RebaseToZero 时作为起点
+	audio   track
+	video   track
+	stats   Stats
+}
+
+type ModOption func(option *Option)
+
+func NewNormalizer(modOptions ...ModOption) *Normalizer {
+	option := DefaultOption
+	for _, fn := range modOptions {
+		fn(&option)
+	}
+	return &Normalizer{
+		option: option,
+	}
+}
+
+// 重新开始，比如推流端重新推流，或者新的录制文件
+// 统计数据不会被清空
+func (n *Normalizer) Reset() {
+	n.started = false
+	n.audio = track{}
+	n.video = track{}
+}
+
+func (n *Normalizer) Stats() Stats {
+	return n.stats
+}
+
+// @param msgTypeID 音频、视频以外的类型（比如 metadata）不参与修正，返回当前音视频中最大的时间戳
+// @return 修正后的时间戳
+func (n *Normalizer) Normalize(msgTypeID uint8, timestamp uint32) uint32 {
+	var t, other *track
+	switch msgTypeID {
+	case TypeAudio:
+		t, other = &n.audio, &n.video
+	case TypeVideo:
+		t, other = &n.video, &n.audio
+	default:
+		return n.maxOut()
+	}
+	n.stats.Total++
+
+	if !n.started {
+		n.started = true
+		n.origin = timestamp
+	}
+
+	var out uint32
+	if !t.started {
+		out = n.first(msgTypeID, timestamp, other)
+		t.started = true
+	} else {
+		out = n.next(msgTypeID, timestamp, t)
+	}
+
+	// 只对齐落后的轨道，保证每个轨道都是单调递增的
+	if n.option.MaxAVDriftMS != 0 && other.started && diff(out, other.lastOut) > int64(n.option.MaxAVDriftMS) {
+		n.correct(CorrectionDrift, msgTypeID, timestamp, other.lastOut)
+		out = other.lastOut
+	}
+
+	t.lastIn = timestamp
+	t.lastOut = out
+	return out
+}
+
+// 轨道上的第一个时间戳
+func (n *Normalizer) first(msgTypeID uint8, timestamp uint32, other *track) uint32 {
+	if !n.option.RebaseToZero {
+		return timestamp
+	}
+	d := diff(n.origin, timestamp)
+	if d < 0 {
+		n.correct(CorrectionBackward, msgTypeID, timestamp, 0)
+		return 0
+	}
+	// 和另一个轨道的起点相差太大，直接对齐到另一个轨道
+	if n.option.JumpThresholdMS != 0 && d > int64(n.option.JumpThresholdMS) && other.started {
+		n.correct(CorrectionJump, msgTypeID, timestamp, other.lastOut)
+		return other.lastOut
+	}
+	return uint32(d)
+}
+
+func (n *Normalizer) next(msgTypeID uint8, timestamp uint32, t *track) uint32 {
+	d := diff(t.lastIn, timestamp)
+	threshold := int64(n.option.JumpThresholdMS)
+
+	switch {
+	case threshold != 0 && (d > threshold || d < -threshold):
+		out := t.lastOut + t.lastDelta
+		n.correct(CorrectionJump, msgTypeID, timestamp, out)
+		return out
+	case d < 0:
+		n.correct(CorrectionBackward, msgTypeID, timestamp, t.lastOut)
+		t.lastDelta = 0
+		return t.lastOut
+	}
+
+	out := t.lastOut + uint32(d)
+	// 按32位有符号数计算差值，回绕后依然是连续的
+	if timestamp < t.lastIn {
+		n.correct(CorrectionWrap, msgTypeID, timestamp, out)
+	}
+	t.lastDelta = uint32(d)
+	return out
+}
+
+func (n *Normalizer) maxOut() uint32 {
+	if diff(n.audio.lastOut, n.video.lastOut) > 0 {
+		return n.video.lastOut
+	}
+	return n.audio.lastOut
+}
+
+func (n *Normalizer) correct(kind CorrectionKind, msgTypeID uint8, in uint32, out uint32) {
+	switch kind {
+	case CorrectionBackward:
+		n.stats.Backward++
+	case CorrectionJump:
+		n.stats.Jump++
+	case CorrectionWrap:
+		n.stats.Wrap++
+	case CorrectionDrift:
+		n.stats.Drift++
+	}
+	if n.option.OnCorrection != nil {
+		n.option.OnCorrection(Correction{
+			Kind:      kind,
+			MsgTypeID: msgTypeID,
+			In:        in,
+			Out:       out,
+		})
+	}
+}
+
+// 返回 b - a，按32位回绕处理
+func diff(a, b uint32) int64 {
+	return int64(int32(b - a))
+}
@@ -0,0 +1,107 @@
+// Copyright 2019, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package timestamp_test
+
+import (
+	"testing"
+
+	"github.com/q191201771/lal/pkg/timestamp"
+	"github.com/q191201771/naza/pkg/assert"
+)
+
+type item struct {
+	t   uint8
+	in  uint32
+	out uint32
+}
+
+func check(t *testing.T, n *timestamp.Normalizer, items []item) {
+	for _, it := range items {
+		assert.Equal(t, it.out, n.Normalize(it.t, it.in))
+	}
+}
+
+func TestNormalizer_Rebase(t *testing.T) {
+	n := timestamp.NewNormalizer(func(option *timestamp.Option) {
+		option.RebaseToZero = true
+	})
+	check(t, n, []item{
+		{timestamp.TypeVideo, 100000, 0},
+		{timestamp.TypeAudio, 100010, 10},
+		{timestamp.TypeVideo, 100040, 40},
+		{18, 0, 40}, // metadata
+		{timestamp.TypeAudio, 100033, 33},
+	})
+	assert.Equal(t, uint64(4), n.Stats().Total)
+
+	// Reset 后重新从0开始
+	n.Reset()
+	check(t, n, []item{
+		{timestamp.TypeAudio, 5000, 0},
+		{timestamp.TypeVideo, 4990, 0},
+	})
+	assert.Equal(t, uint64(1), n.Stats().Backward)
+}
+
+func TestNormalizer_BackwardAndJump(t *testing.T) {
+	var corrections []timestamp.Correction
+	n := timestamp.NewNormalizer(func(option *timestamp.Option) {
+		option.JumpThresholdMS = 1000
+		option.OnCorrection = func(c timestamp.Correction) {
+			corrections = append(corrections, c)
+		}
+	})
+	check(t, n, []item{
+		{timestamp.TypeVideo, 0, 0},
+		{timestamp.TypeVideo, 40, 40},
+		{timestamp.TypeVideo, 30, 40},      // 小幅度回退
+		{timestamp.TypeVideo, 70, 80},      // 从回退的位置继续
+		{timestamp.TypeVideo, 500000, 120}, // 跳变，沿用上一次的间隔
+		{timestamp.TypeVideo, 500040, 160},
+		{timestamp.TypeVideo, 80, 200}, // 向后跳变
+		{timestamp.TypeVideo, 120, 240},
+	})
+	stats := n.Stats()
+	assert.Equal(t, uint64(1), stats.Backward)
+	assert.Equal(t, uint64(2), stats.Jump)
+	assert.Equal(t, 3, len(corrections))
+	assert.Equal(t, timestamp.CorrectionBackward, corrections[0].Kind)
+	assert.Equal(t, timestamp.TypeVideo, corrections[0].MsgTypeID)
+	assert.Equal(t, uint32(30), corrections[0].In)
+	assert.Equal(t, uint32(40), corrections[0].Out)
+	assert.Equal(t, "jump", corrections[1].Kind.String())
+}
+
+func TestNormalizer_Wrap(t *testing.T) {
+	n := timestamp.NewNormalizer()
+	check(t, n, []item{
+		{timestamp.TypeAudio, 0xFFFFFFF0, 0xFFFFFFF0},
+		{timestamp.TypeAudio, 0xFFFFFFFF, 0xFFFFFFFF},
+		{timestamp.TypeAudio, 0x10, 0x10},
+		{timestamp.TypeAudio, 0x20, 0x20},
+	})
+	assert.Equal(t, uint64(1), n.Stats().Wrap)
+	assert.Equal(t, uint64(0), n.Stats().Jump)
+}
+
+func TestNormalizer_Drift(t *testing.T) {
+	n := timestamp.NewNormalizer(func(option *timestamp.Option) {
+		option.JumpThresholdMS = 0
+		option.MaxAVDriftMS = 500
+	})
+	check(t, n, []item{
+		{timestamp.TypeVideo, 0, 0},
+		{timestamp.TypeAudio, 0, 0},
+		{timestamp.TypeVideo, 2000, 2000},
+		{timestamp.TypeAudio, 23, 2000}, // 落后太多，对齐到视频
+		{timestamp.TypeAudio, 46, 2023},
+		{timestamp.TypeVideo, 2040, 2040},
+	})
+	assert.Equal(t, uint64(1), n.Stats().Drift)
+}